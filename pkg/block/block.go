@@ -2,6 +2,7 @@ package block
 
 import (
 	"Chain/pkg/pro"
+	"Chain/pkg/utils"
 	"crypto/sha256"
 	"fmt"
 	"google.golang.org/protobuf/proto"
@@ -16,7 +17,7 @@ import (
 // Timestamp is when the Block was successfully mined.
 type Header struct {
 	Version          uint32
-	PreviousHash     string
+	PreviousHash     BlockHash
 	MerkleRoot       string
 	DifficultyTarget string
 	Nonce            uint32
@@ -33,7 +34,7 @@ type Block struct {
 func EncodeHeader(header *Header) *pro.Header {
 	return &pro.Header{
 		Version:          header.Version,
-		PreviousHash:     header.PreviousHash,
+		PreviousHash:     string(header.PreviousHash),
 		MerkleRoot:       header.MerkleRoot,
 		DifficultyTarget: header.DifficultyTarget,
 		Nonce:            header.Nonce,
@@ -45,7 +46,7 @@ func EncodeHeader(header *Header) *pro.Header {
 func DecodeHeader(pheader *pro.Header) *Header {
 	return &Header{
 		Version:          pheader.GetVersion(),
-		PreviousHash:     pheader.GetPreviousHash(),
+		PreviousHash:     BlockHash(pheader.GetPreviousHash()),
 		MerkleRoot:       pheader.GetMerkleRoot(),
 		DifficultyTarget: pheader.GetDifficultyTarget(),
 		Nonce:            pheader.GetNonce(),
@@ -78,13 +79,13 @@ func DecodeBlock(pb *pro.Block) *Block {
 }
 
 // Hash returns the hash of the block (which is done via the header)
-func (block *Block) Hash() string {
+func (block *Block) Hash() BlockHash {
 	h := sha256.New()
 	pb := EncodeHeader(block.Header)
 	bytes, err := proto.Marshal(pb)
 	if err != nil {
-		fmt.Errorf("[block.Hash()] Unable to marshal block")
+		utils.Debug.Printf("[block.Hash()] Unable to marshal block")
 	}
 	h.Write(bytes)
-	return fmt.Sprintf("%x", h.Sum(nil))
+	return BlockHash(fmt.Sprintf("%x", h.Sum(nil)))
 }
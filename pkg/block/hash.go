@@ -0,0 +1,10 @@
+package block
+
+// BlockHash is the hex-encoded hash of a Block's Header, as returned by
+// Block.Hash. It is a distinct type from TxHash so that one cannot be
+// passed where the other is expected without an explicit conversion.
+type BlockHash string
+
+// TxHash is the hex-encoded hash of a Transaction, as returned by
+// HashTransaction.
+type TxHash string
@@ -0,0 +1,34 @@
+package block
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHashTypesAreDistinct(t *testing.T) {
+	blockHash := reflect.TypeOf(BlockHash(""))
+	txHash := reflect.TypeOf(TxHash(""))
+	str := reflect.TypeOf("")
+	// neither hash can be passed where the other, or a bare string, is
+	// expected without a conversion
+	for _, pair := range [][2]reflect.Type{{blockHash, txHash}, {txHash, blockHash}, {blockHash, str}, {txHash, str}} {
+		if pair[0].AssignableTo(pair[1]) {
+			t.Errorf("%v is assignable to %v", pair[0], pair[1])
+		}
+		if !pair[0].ConvertibleTo(pair[1]) {
+			t.Errorf("%v is not convertible to %v", pair[0], pair[1])
+		}
+	}
+	tx := &Transaction{Outputs: []*TransactionOutput{{Amount: 5, LockingScript: "alice"}}}
+	b := &Block{Header: &Header{}, Transactions: []*Transaction{tx}}
+	if reflect.TypeOf(tx.Hash()) != txHash {
+		t.Errorf("Transaction.Hash returns %v, want %v", reflect.TypeOf(tx.Hash()), txHash)
+	}
+	if reflect.TypeOf(b.Hash()) != blockHash {
+		t.Errorf("Block.Hash returns %v, want %v", reflect.TypeOf(b.Hash()), blockHash)
+	}
+	// an explicit conversion keeps the hex digest
+	if string(BlockHash(tx.Hash())) != string(tx.Hash()) {
+		t.Errorf("converting %v to a BlockHash changed it", tx.Hash())
+	}
+}
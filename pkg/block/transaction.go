@@ -2,6 +2,7 @@ package block
 
 import (
 	"Chain/pkg/pro"
+	"Chain/pkg/utils"
 	"crypto/sha256"
 	"fmt"
 	"google.golang.org/protobuf/proto"
@@ -14,7 +15,7 @@ import (
 // OutputIndex is the index of the parent TransactionOutput's Transaction.
 // Signature verifies that the payer can spend the referenced TransactionOutput.
 type TransactionInput struct {
-	ReferenceTransactionHash string // the hash of the parent TransactionOutput's Transaction
+	ReferenceTransactionHash TxHash // the hash of the parent TransactionOutput's Transaction
 	OutputIndex              uint32 // the index of the parent TransactionOutput's Transaction
 	UnlockingScript          string // Signature, verifies that the payer can spend the referenced TransactionOutput
 }
@@ -45,7 +46,7 @@ type Transaction struct {
 // given a TransactionInput.
 func EncodeTransactionInput(txi *TransactionInput) *pro.TransactionInput {
 	return &pro.TransactionInput{
-		ReferenceTransactionHash: txi.ReferenceTransactionHash,
+		ReferenceTransactionHash: string(txi.ReferenceTransactionHash),
 		OutputIndex:              txi.OutputIndex,
 		UnlockingScript:          txi.UnlockingScript,
 	}
@@ -55,7 +56,7 @@ func EncodeTransactionInput(txi *TransactionInput) *pro.TransactionInput {
 // a pro.TransactionInput.
 func DecodeTransactionInput(ptxi *pro.TransactionInput) *TransactionInput {
 	return &TransactionInput{
-		ReferenceTransactionHash: ptxi.GetReferenceTransactionHash(),
+		ReferenceTransactionHash: TxHash(ptxi.GetReferenceTransactionHash()),
 		OutputIndex:              ptxi.GetOutputIndex(),
 		UnlockingScript:          ptxi.GetUnlockingScript(),
 	}
@@ -115,14 +116,22 @@ func DecodeTransaction(ptx *pro.Transaction) *Transaction {
 	}
 }
 
-// Hash returns the hash of the transaction
-func (tx *Transaction) Hash() string {
+// Hash returns the hash of the transaction. It is HashTransaction(tx).
+func (tx *Transaction) Hash() TxHash {
+	return HashTransaction(tx)
+}
+
+// HashTransaction returns the canonical hash of a Transaction, the
+// hex-encoded SHA-256 digest of its deterministic protobuf encoding.
+// Every package that keys data on a Transaction, such as CoinRecords in
+// the CoinDatabase, must use this hash.
+func HashTransaction(tx *Transaction) TxHash {
 	h := sha256.New()
 	pt := EncodeTransaction(tx)
-	bytes, err := proto.Marshal(pt)
+	bytes, err := proto.MarshalOptions{Deterministic: true}.Marshal(pt)
 	if err != nil {
-		fmt.Errorf("[tx.Hash()] Unable to marshal transaction")
+		utils.Debug.Printf("[block.HashTransaction] Unable to marshal transaction")
 	}
 	h.Write(bytes)
-	return fmt.Sprintf("%x", h.Sum(nil))
+	return TxHash(fmt.Sprintf("%x", h.Sum(nil)))
 }
@@ -0,0 +1,42 @@
+package block
+
+import (
+	"Chain/pkg/pro"
+	"google.golang.org/protobuf/proto"
+	"testing"
+)
+
+func TestHashTransactionIsCanonical(t *testing.T) {
+	tx := &Transaction{
+		Version:  1,
+		Inputs:   []*TransactionInput{{ReferenceTransactionHash: "parent", OutputIndex: 2, UnlockingScript: "sig"}},
+		Outputs:  []*TransactionOutput{{Amount: 5, LockingScript: "alice"}, {Amount: 7, LockingScript: "bob"}},
+		LockTime: 3,
+	}
+	want := HashTransaction(tx)
+	if got := tx.Hash(); got != want {
+		t.Errorf("Transaction.Hash returned %v, want %v", got, want)
+	}
+	// a Transaction read back from a serialized Block, as when Blocks are
+	// read from Disk and their Transactions hashed for the Merkle root,
+	// hashes the same as the one the CoinDatabase keyed its Coins on
+	b := &Block{Header: &Header{}, Transactions: []*Transaction{tx}}
+	bytes, err := proto.Marshal(EncodeBlock(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pb := &pro.Block{}
+	if err := proto.Unmarshal(bytes, pb); err != nil {
+		t.Fatal(err)
+	}
+	decoded := DecodeBlock(pb).Transactions[0]
+	if got := HashTransaction(decoded); got != want {
+		t.Errorf("decoded transaction has hash %v, want %v", got, want)
+	}
+	// repeated hashing is stable
+	for i := 0; i < 10; i++ {
+		if got := HashTransaction(tx); got != want {
+			t.Fatalf("hash %v of the same transaction is %v, want %v", i, got, want)
+		}
+	}
+}
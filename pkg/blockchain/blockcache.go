@@ -0,0 +1,91 @@
+package blockchain
+
+import (
+	"Chain/pkg/block"
+	"container/list"
+	"sync"
+)
+
+// blockCache is a least-recently-used cache of decoded Blocks, keyed by
+// hash, so that repeated reads of the same Blocks do not go to Disk.
+// hits and misses count lookups that did and did not find a Block.
+type blockCache struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List                        // most recently used at the front
+	entries  map[block.BlockHash]*list.Element // values are *blockCacheEntry
+
+	hits   uint64
+	misses uint64
+}
+
+// blockCacheEntry is a Block in a blockCache.
+type blockCacheEntry struct {
+	hash  block.BlockHash
+	block *block.Block
+}
+
+// newBlockCache returns an empty blockCache holding up to capacity Blocks.
+func newBlockCache(capacity int) *blockCache {
+	return &blockCache{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[block.BlockHash]*list.Element),
+	}
+}
+
+// get returns the cached Block for a hash, if there is one.
+func (c *blockCache) get(hash block.BlockHash) (*block.Block, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[hash]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.order.MoveToFront(elem)
+	return elem.Value.(*blockCacheEntry).block, true
+}
+
+// add caches a Block, evicting the least recently used Block if the
+// cache is full.
+func (c *blockCache) add(hash block.BlockHash, b *block.Block) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[hash]; ok {
+		elem.Value.(*blockCacheEntry).block = b
+		c.order.MoveToFront(elem)
+		return
+	}
+	if c.order.Len() >= c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*blockCacheEntry).hash)
+	}
+	c.entries[hash] = c.order.PushFront(&blockCacheEntry{hash, b})
+}
+
+// stats returns the number of cache hits and misses.
+func (c *blockCache) stats() (hits uint64, misses uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses
+}
+
+// BlockCacheStats returns how many Block reads were served from the
+// block cache and how many went to Disk. Both are 0 if the cache is
+// disabled.
+func (bc *BlockChain) BlockCacheStats() (hits uint64, misses uint64) {
+	if bc.blockCache == nil {
+		return 0, 0
+	}
+	return bc.blockCache.stats()
+}
+
+// cacheBlock adds a Block to the block cache, if it is enabled.
+func (bc *BlockChain) cacheBlock(hash block.BlockHash, b *block.Block) {
+	if bc.blockCache != nil {
+		bc.blockCache.add(hash, b)
+	}
+}
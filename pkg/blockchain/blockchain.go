@@ -7,7 +7,11 @@ import (
 	"Chain/pkg/blockchain/blockinfodatabase"
 	"Chain/pkg/blockchain/chainwriter"
 	"Chain/pkg/blockchain/coindatabase"
+	"Chain/pkg/blockchain/kvstore"
 	"Chain/pkg/utils"
+	"errors"
+	"fmt"
+	"time"
 )
 
 // BlockChain is the main type of this project.
@@ -18,41 +22,136 @@ import (
 // active chain. These "unsafe" blocks may be reverted during a
 // fork.
 // maxHashes is the number of unsafe hashes that the chain keeps track of.
+// maxUndoDepth is the number of Blocks below the tip whose UndoBlocks
+// are kept on Disk.
+// undoPrunedHeight is the height below which no BlockRecord points into
+// an undo file.
+// maxReorgDepth is the most Blocks that switching to a fork may undo.
 // BlockInfoDB is a pointer to a block info database
 // ChainWriter is a pointer to a chain writer.
 // CoinDB is a pointer to a coin database.
+// wal is a write-ahead log that keeps the databases consistent across
+// a crash.
+// blockCache caches recently stored and read Blocks by hash.
+// OnBlockStored is an optional callback invoked after a Block is stored
+// and connected to the active chain.
+// OnBlockUndone is an optional callback invoked after a Block is
+// disconnected from the active chain during a fork.
 type BlockChain struct {
-	Length       uint32       // the length of the active chain
-	LastBlock    *block.Block // the last block of the active chain
-	LastHash     string       // the hash of the last block of the active chain
-	UnsafeHashes []string     // the hashes of the "unsafe" blocks on the active chain. These "unsafe" blocks may be reverted during a fork. See https://edstem.org/us/courses/36337/discussion/2551008 for more details.
-	maxHashes    int          // the number of unsafe hashes that the chain keeps track of
+	Length           uint32            // the length of the active chain
+	LastBlock        *block.Block      // the last block of the active chain
+	LastHash         block.BlockHash   // the hash of the last block of the active chain
+	UnsafeHashes     []block.BlockHash // the hashes of the "unsafe" blocks on the active chain. These "unsafe" blocks may be reverted during a fork. See https://edstem.org/us/courses/36337/discussion/2551008 for more details.
+	maxHashes        int               // the number of unsafe hashes that the chain keeps track of
+	maxUndoDepth     uint32            // the number of Blocks below the tip whose UndoBlocks are kept, 0 to keep all
+	undoPrunedHeight uint32            // the height below which no BlockRecord points into an undo file
+	maxReorgDepth    uint32            // the most Blocks a fork may undo, 0 for no limit beyond the unsafe hashes
+	disableUndo      bool              // whether UndoBlocks are kept off Disk and forks are refused
+	txIndex          bool              // whether the Transactions of the active chain are indexed by hash
+	totalMinted      uint64            // the total amount of the outputs of the active chain
+	totalSpent       uint64            // the total amount of the Coins spent by the active chain
 
 	BlockInfoDB *blockinfodatabase.BlockInfoDatabase // pointer to a block info database
 	ChainWriter *chainwriter.ChainWriter             // pointer to a chain writer
 	CoinDB      *coindatabase.CoinDatabase           // pointer to a coin database
+	wal         *writeAheadLog                       // write-ahead log for applying Blocks
+	blockCache  *blockCache                          // recently read Blocks, nil if disabled
+
+	OnBlockStored func(hash block.BlockHash, height uint32) // called after a Block is connected to the active chain
+	OnBlockUndone func(hash block.BlockHash)                // called after a Block is disconnected from the active chain
 }
 
-// New returns a blockchain given a Config.
-func New(config *Config) *BlockChain {
+// maxUnsafeHashes is the number of unsafe hashes a BlockChain keeps.
+const maxUnsafeHashes = 6
+
+// New returns a blockchain given a Config. It returns an error if the
+// Config's MaxUndoDepth is too shallow to undo a fork, or if the
+// ChainWriter cannot be created or a database cannot be opened, closing
+// whatever was already opened.
+func New(config *Config) (*BlockChain, error) {
+	if config.MaxUndoDepth > 0 && config.MaxUndoDepth < maxUnsafeHashes {
+		return nil, fmt.Errorf("[blockchain.New] MaxUndoDepth {%v} is less than the {%v} unsafe hashes that a fork may undo", config.MaxUndoDepth, maxUnsafeHashes)
+	}
+	cwConfig := chainwriter.DefaultConfig()
+	cwConfig.DisableUndo = config.DisableUndo
+	cw, err := chainwriter.New(cwConfig)
+	if err != nil {
+		return nil, err
+	}
+	wal, err := openWriteAheadLog(config.WALPath, config.RecoverFromLock)
+	if err != nil {
+		cw.Close() // ignore error; open error takes precedence
+		return nil, err
+	}
+	blockInfoDBConfig := blockinfodatabase.DefaultConfig()
+	blockInfoDBConfig.RecoverFromLock = config.RecoverFromLock
+	blockInfoDB, err := blockinfodatabase.New(blockInfoDBConfig)
+	if err != nil {
+		wal.close() // ignore error; open error takes precedence
+		cw.Close()  // ignore error; open error takes precedence
+		return nil, err
+	}
+	coinDBConfig := coindatabase.DefaultConfig()
+	coinDBConfig.Subsidy = config.Subsidy
+	coinDBConfig.DisableUndo = config.DisableUndo
+	coinDBConfig.RecoverFromLock = config.RecoverFromLock
+	coinDB, err := coindatabase.New(coinDBConfig)
+	if err != nil {
+		blockInfoDB.Close() // ignore error; open error takes precedence
+		wal.close()         // ignore error; open error takes precedence
+		cw.Close()          // ignore error; open error takes precedence
+		return nil, err
+	}
 	genBlock := GenesisBlock(config)
 	hash := genBlock.Hash()
 	bc := &BlockChain{
-		Length:       1,
-		LastBlock:    genBlock,
-		LastHash:     hash,
-		UnsafeHashes: []string{},
-		maxHashes:    6,
-		BlockInfoDB:  blockinfodatabase.New(blockinfodatabase.DefaultConfig()),
-		ChainWriter:  chainwriter.New(chainwriter.DefaultConfig()),
-		CoinDB:       coindatabase.New(coindatabase.DefaultConfig()),
+		Length:        1,
+		LastBlock:     genBlock,
+		LastHash:      hash,
+		UnsafeHashes:  []block.BlockHash{hash},
+		maxHashes:     maxUnsafeHashes,
+		maxUndoDepth:  config.MaxUndoDepth,
+		maxReorgDepth: config.MaxReorgDepth,
+		disableUndo:   config.DisableUndo,
+		txIndex:       config.TransactionIndex,
+		BlockInfoDB:   blockInfoDB,
+		ChainWriter:   cw,
+		CoinDB:        coinDB,
+		wal:           wal,
+	}
+	if config.BlockCacheSize > 0 {
+		bc.blockCache = newBlockCache(config.BlockCacheSize)
+	}
+	// roll back a Block left half-applied by a crash
+	if err := bc.recover(); err != nil {
+		bc.Close() // ignore error; recover error takes precedence
+		return nil, err
 	}
 	// have to store the genesis block
-	bc.CoinDB.StoreBlock(genBlock.Transactions)
+	bc.CoinDB.StoreBlock(genBlock.Transactions, 1)
 	ub := &chainwriter.UndoBlock{}
-	br := bc.ChainWriter.StoreBlock(genBlock, ub, 1)
+	bc.addSupply(genBlock, ub)
+	br, err := bc.ChainWriter.StoreBlock(genBlock, ub, 1)
+	if err != nil {
+		bc.Close() // ignore error; StoreBlock error takes precedence
+		return nil, err
+	}
 	bc.BlockInfoDB.StoreBlockRecord(hash, br)
-	return bc
+	bc.indexTransactions(genBlock, hash)
+	return bc, nil
+}
+
+// Close closes the write-ahead log, CoinDatabase, BlockInfoDatabase,
+// and ChainWriter, in that order. Every store is closed even if closing
+// an earlier one fails, and the first error is returned.
+func (bc *BlockChain) Close() error {
+	var firstErr error
+	for _, closeStore := range []func() error{bc.wal.close, bc.CoinDB.Close, bc.BlockInfoDB.Close, bc.ChainWriter.Close} {
+		if err := closeStore(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("[blockchain.Close] %w", err)
+		}
+	}
+	return firstErr
 }
 
 // GenesisBlock creates the genesis Block, using the Config's
@@ -89,35 +188,456 @@ func GenesisBlock(config *Config) *block.Block {
 //	(4) Handles a fork, if necessary.
 //	(5) Updates the BlockChain's fields.
 func (bc *BlockChain) HandleBlock(b *block.Block) {
-	// TODO: Handle fork and unsafe hashes
-	ok := bc.CoinDB.ValidateBlock(b.Transactions)
-	if ok {
-		bc.CoinDB.StoreBlock(b.Transactions)
-		undoBlock := bc.makeUndoBlock(b.Transactions)
-		blockRecord := bc.ChainWriter.StoreBlock(b, undoBlock, bc.Length+1)
-		blockHash := b.Hash()
-		bc.BlockInfoDB.StoreBlockRecord(blockHash, blockRecord)
-		bc.Length += 1
-		bc.LastBlock = b
-		bc.LastHash = blockHash
-	} else {
-		utils.Debug.Printf("Block {%v} is invalid!", b.Hash())
-	}
-}
-
-// makeUndoBlock returns an UndoBlock given a slice of Transactions.
-func (bc *BlockChain) makeUndoBlock(txs []*block.Transaction) *chainwriter.UndoBlock {
-	var transactionHashes []string
+	bc.HandleBlockFrom(b, "")
+}
+
+// provenance is when a Block was received and the peer it came from,
+// recorded in its BlockRecord.
+type provenance struct {
+	receivedAt int64
+	sourcePeer string
+}
+
+// apply sets a BlockRecord's provenance fields.
+func (p provenance) apply(br *blockinfodatabase.BlockRecord) {
+	br.ReceivedAt = p.receivedAt
+	br.SourcePeer = p.sourcePeer
+}
+
+// HandleBlockFrom handles a new Block received from a peer, like
+// HandleBlock, recording the peer and the time of receipt in the
+// Block's BlockRecord. Errors are logged; use ProcessBlockFrom to
+// receive them instead.
+func (bc *BlockChain) HandleBlockFrom(b *block.Block, sourcePeer string) {
+	if err := bc.ProcessBlockFrom(b, sourcePeer); err != nil {
+		utils.Debug.Printf("%v", err)
+	}
+}
+
+// ProcessBlockFrom is HandleBlockFrom, except that it returns an error
+// if the Block is invalid, cannot be stored, or extends a fork that the
+// BlockChain refuses or fails to switch to, such as an error wrapping
+// ErrReorgTooDeep.
+func (bc *BlockChain) ProcessBlockFrom(b *block.Block, sourcePeer string) error {
+	prov := provenance{receivedAt: time.Now().UnixNano(), sourcePeer: sourcePeer}
+	blockHash := b.Hash()
+	if !bc.appendsToActiveChain(b) {
+		return bc.handleSideBlock(b, blockHash, prov)
+	}
+	if !bc.CoinDB.ValidateBlock(b.Transactions, bc.Length+1) {
+		return fmt.Errorf("[ProcessBlockFrom] block {%v} is invalid", blockHash)
+	}
+	height := bc.Length + 1
+	if err := bc.connectBlock(b, blockHash, height, prov); err != nil {
+		return fmt.Errorf("[ProcessBlockFrom] failed to store block {%v}: %w", blockHash, err)
+	}
+	bc.setTip(b, blockHash, height)
+	bc.UnsafeHashes = append(bc.UnsafeHashes, blockHash)
+	if len(bc.UnsafeHashes) > bc.maxHashes {
+		bc.UnsafeHashes = bc.UnsafeHashes[len(bc.UnsafeHashes)-bc.maxHashes:]
+	}
+	bc.pruneUndo()
+	if bc.OnBlockStored != nil {
+		bc.OnBlockStored(blockHash, height)
+	}
+	return nil
+}
+
+// connectBlock stores a Block's Coins in the CoinDatabase, writes the
+// Block and its UndoBlock to Disk, and stores the resulting BlockRecord.
+// The UndoBlock must be made before the Coins are spent. It returns an
+// error wrapping ErrHeightMismatch, before changing anything, if height
+// does not follow the height of the Block's parent.
+func (bc *BlockChain) connectBlock(b *block.Block, blockHash block.BlockHash, height uint32, prov provenance) error {
+	if err := bc.checkHeight(b, blockHash, height); err != nil {
+		return err
+	}
+	// a Block undone by an earlier fork keeps its BlockRecord
+	_, err := bc.BlockInfoDB.GetBlockRecord(blockHash)
+	if err != nil && !errors.Is(err, kvstore.ErrNotFound) {
+		return err
+	}
+	recordExisted := err == nil
+	undoBlock, err := bc.makeUndoBlock(b.Transactions)
+	if err != nil {
+		return err
+	}
+	if err := bc.wal.begin(blockHash, height, b, undoBlock, recordExisted); err != nil {
+		return err
+	}
+	bc.CoinDB.StoreBlock(b.Transactions, height)
+	// with undo disabled, the ChainWriter does not write the UndoBlock,
+	// but the write-ahead log still needs it to recover from a crash
+	blockRecord, err := bc.ChainWriter.StoreBlock(b, undoBlock, height)
+	if err != nil {
+		return bc.abortBlock(b, undoBlock, err)
+	}
+	prov.apply(blockRecord)
+	bc.BlockInfoDB.StoreBlockRecord(blockHash, blockRecord)
+	bc.indexTransactions(b, blockHash)
+	if err := bc.wal.commit(); err != nil {
+		return err
+	}
+	bc.addSupply(b, undoBlock)
+	bc.cacheBlock(blockHash, b)
+	return nil
+}
+
+// connectForkedBlock stores a forked Block's Coins in the CoinDatabase.
+// The forked Block is already on Disk, so only its UndoBlock is written,
+// and its BlockRecord is updated to point at it. Like connectBlock, it
+// returns an error wrapping ErrHeightMismatch if height is wrong.
+func (bc *BlockChain) connectForkedBlock(b *block.Block, blockHash block.BlockHash, height uint32) error {
+	if err := bc.checkHeight(b, blockHash, height); err != nil {
+		return err
+	}
+	br, err := bc.BlockInfoDB.GetBlockRecord(blockHash)
+	if err != nil {
+		return err
+	}
+	undoBlock, err := bc.makeUndoBlock(b.Transactions)
+	if err != nil {
+		return err
+	}
+	if err := bc.wal.begin(blockHash, height, b, undoBlock, true); err != nil {
+		return err
+	}
+	bc.CoinDB.StoreBlock(b.Transactions, height)
+	ufi, err := bc.ChainWriter.StoreUndoBlock(undoBlock, height)
+	if err != nil {
+		return bc.abortBlock(b, undoBlock, err)
+	}
+	br.UndoFile = ufi.FileName
+	br.UndoFileNumber = ufi.FileNumber
+	br.UndoStartOffset = ufi.StartOffset
+	br.UndoEndOffset = ufi.EndOffset
+	br.HasUndo = undoBlock.Amounts != nil
+	bc.BlockInfoDB.StoreBlockRecord(blockHash, br)
+	bc.indexTransactions(b, blockHash)
+	if err := bc.wal.commit(); err != nil {
+		return err
+	}
+	bc.addSupply(b, undoBlock)
+	return nil
+}
+
+// ErrHeightMismatch is returned when a Block is to be stored at a height
+// other than one above its parent's, which would leave the height index
+// inconsistent.
+var ErrHeightMismatch = errors.New("height does not follow parent")
+
+// checkHeight returns an error wrapping ErrHeightMismatch unless height
+// is one above the height of the Block's parent, or 1 if the Block is a
+// genesis Block.
+func (bc *BlockChain) checkHeight(b *block.Block, blockHash block.BlockHash, height uint32) error {
+	want := uint32(1)
+	if b.Header.PreviousHash != "" {
+		parent, err := bc.BlockInfoDB.GetBlockRecord(b.Header.PreviousHash)
+		if err != nil {
+			return fmt.Errorf("[checkHeight] cannot get parent {%v} of block {%v}: %w", b.Header.PreviousHash, blockHash, err)
+		}
+		want = parent.Height + 1
+	}
+	if height != want {
+		return fmt.Errorf("[checkHeight] block {%v} given height {%v}, expected {%v}: %w", blockHash, height, want, ErrHeightMismatch)
+	}
+	return nil
+}
+
+// abortBlock undoes the Coins of a Block whose write to Disk failed
+// and clears the write-ahead log, returning the write's error.
+func (bc *BlockChain) abortBlock(b *block.Block, undoBlock *chainwriter.UndoBlock, err error) error {
+	if undoErr := bc.CoinDB.UndoCoins([]*block.Block{b}, []*chainwriter.UndoBlock{undoBlock}); undoErr != nil {
+		return fmt.Errorf("%w (and failed to undo coins: %v)", err, undoErr)
+	}
+	if commitErr := bc.wal.commit(); commitErr != nil {
+		return fmt.Errorf("%w (and failed to clear write-ahead log: %v)", err, commitErr)
+	}
+	return err
+}
+
+// Supply returns the total amount of the outputs created by the active
+// chain and the total amount of the Coins it spent. The amount in
+// unspent Coins is minted - spent.
+func (bc *BlockChain) Supply() (minted, spent uint64) {
+	return bc.totalMinted, bc.totalSpent
+}
+
+// addSupply adds a connected Block's outputs and spent Coins to the
+// BlockChain's totals.
+func (bc *BlockChain) addSupply(b *block.Block, undoBlock *chainwriter.UndoBlock) {
+	minted, spent := blockSupply(b, undoBlock)
+	bc.totalMinted += minted
+	bc.totalSpent += spent
+}
+
+// blockSupply returns the total amount of a Block's outputs and of the
+// Coins it spends, given its UndoBlock. Coins created and spent within
+// the Block are not in its UndoBlock, so their amounts are taken from
+// the Block itself.
+func blockSupply(b *block.Block, undoBlock *chainwriter.UndoBlock) (minted, spent uint64) {
+	for _, amount := range undoBlock.Amounts {
+		spent += uint64(amount)
+	}
+	created := make(map[coindatabase.CoinLocator]uint32)
+	for _, tx := range b.Transactions {
+		for _, txi := range tx.Inputs {
+			cl := coindatabase.CoinLocator{ReferenceTransactionHash: txi.ReferenceTransactionHash, OutputIndex: txi.OutputIndex}
+			if amount, ok := created[cl]; ok {
+				spent += uint64(amount)
+			}
+		}
+		txHash := tx.Hash()
+		for i, txo := range tx.Outputs {
+			minted += uint64(txo.Amount)
+			created[coindatabase.CoinLocator{ReferenceTransactionHash: txHash, OutputIndex: uint32(i)}] = txo.Amount
+		}
+	}
+	return minted, spent
+}
+
+// setTip updates the BlockChain's fields to point at a new last Block.
+func (bc *BlockChain) setTip(b *block.Block, blockHash block.BlockHash, height uint32) {
+	bc.Length = height
+	bc.LastBlock = b
+	bc.LastHash = blockHash
+}
+
+// handleSideBlock handles a Block that does not append to the active
+// chain. The Block is written to Disk so that it can be used later, and
+// if its branch is now longer than the active chain, the BlockChain
+// switches to that branch. It returns an error if the Block cannot be
+// stored, or if switching to its branch is refused or fails; the Block
+// stays on Disk either way.
+func (bc *BlockChain) handleSideBlock(b *block.Block, blockHash block.BlockHash, prov provenance) error {
+	parent, err := bc.BlockInfoDB.GetBlockRecord(b.Header.PreviousHash)
+	if err != nil {
+		return fmt.Errorf("[handleSideBlock] block {%v} has no known parent: %w", blockHash, err)
+	}
+	height := parent.Height + 1
+	blockRecord, err := bc.ChainWriter.StoreBlock(b, &chainwriter.UndoBlock{}, height)
+	if err != nil {
+		return fmt.Errorf("[handleSideBlock] failed to store block {%v}: %w", blockHash, err)
+	}
+	prov.apply(blockRecord)
+	bc.BlockInfoDB.StoreBlockRecord(blockHash, blockRecord)
+	bc.cacheBlock(blockHash, b)
+	if height > bc.Length {
+		if err := bc.handleFork(b, blockHash, height); err != nil {
+			return fmt.Errorf("[handleSideBlock] failed to switch to fork ending in {%v}: %w", blockHash, err)
+		}
+	}
+	return nil
+}
+
+// ErrReorgTooDeep is returned when switching to a fork would undo more
+// Blocks than the BlockChain allows.
+var ErrReorgTooDeep = errors.New("reorg too deep")
+
+// ErrUndoDisabled is returned when switching to a fork on a BlockChain
+// that does not keep UndoBlocks. It is the ChainWriter's and the
+// CoinDatabase's error too.
+var ErrUndoDisabled = chainwriter.ErrUndoDisabled
+
+// ErrUndoPruned is returned when reading the UndoBlock of a Block that
+// spends Coins but whose UndoBlock is not on Disk, because it was
+// pruned or never written.
+var ErrUndoPruned = errors.New("undo block pruned")
+
+// handleFork switches the active chain to the branch ending in the
+// given Block. It:
+//
+//	(1) finds the forked Blocks back to the common ancestor.
+//	(2) undoes the active Blocks above the common ancestor.
+//	(3) validates and connects the forked Blocks in order.
+//
+// If the fork would undo more than maxReorgDepth Blocks, handleFork
+// returns an error wrapping ErrReorgTooDeep before changing anything. If
+// the BlockChain does not keep UndoBlocks, it returns ErrUndoDisabled.
+// If a forked Block is invalid or cannot be stored, the forked Blocks
+// connected so far are undone and the undone Blocks are connected
+// again, so the active chain is left as it was. The hooks are only
+// called once the switch has succeeded.
+func (bc *BlockChain) handleFork(b *block.Block, blockHash block.BlockHash, height uint32) error {
+	if bc.disableUndo {
+		return fmt.Errorf("[handleFork] cannot switch to block {%v}: %w", blockHash, ErrUndoDisabled)
+	}
+	forkedBlocks, err := bc.getForkedBlocks(blockHash)
+	if err != nil {
+		return fmt.Errorf("[handleFork] failed to get forked blocks: %w", err)
+	}
+	ancestorHash := forkedBlocks[len(forkedBlocks)-1].Hash()
+	ancestorIndex := indexOfHash(bc.UnsafeHashes, ancestorHash)
+	if ancestorIndex < 0 {
+		return fmt.Errorf("[handleFork] %w: common ancestor {%v} is not an unsafe block", ErrReorgTooDeep, ancestorHash)
+	}
+	forkedBlocks = reverseBlocks(forkedBlocks[:len(forkedBlocks)-1])
+
+	numUndone := len(bc.UnsafeHashes) - 1 - ancestorIndex
+	if bc.maxReorgDepth > 0 && uint32(numUndone) > bc.maxReorgDepth {
+		return fmt.Errorf("[handleFork] %w: would undo {%v} blocks, at most {%v} allowed", ErrReorgTooDeep, numUndone, bc.maxReorgDepth)
+	}
+	blocks, undoBlocks, err := bc.getBlocksAndUndoBlocks(numUndone)
+	if err != nil {
+		return fmt.Errorf("[handleFork] failed to get blocks to undo: %w", err)
+	}
+	unsafeHashes := append([]block.BlockHash{}, bc.UnsafeHashes...)
+	ancestorHeight := bc.Length - uint32(numUndone)
+	if err := bc.disconnectBlocks(blocks, undoBlocks); err != nil {
+		return fmt.Errorf("[handleFork] %w", err)
+	}
+	bc.UnsafeHashes = bc.UnsafeHashes[:ancestorIndex+1]
+
+	connected, err := bc.connectBranch(forkedBlocks, ancestorHeight+1)
+	if err != nil {
+		if restoreErr := bc.restoreBranch(connected, blocks, ancestorHeight+1); restoreErr != nil {
+			return fmt.Errorf("[handleFork] %w (and failed to restore the active chain: %v)", err, restoreErr)
+		}
+		bc.UnsafeHashes = unsafeHashes
+		return fmt.Errorf("[handleFork] %w", err)
+	}
+	if len(bc.UnsafeHashes) > bc.maxHashes {
+		bc.UnsafeHashes = bc.UnsafeHashes[len(bc.UnsafeHashes)-bc.maxHashes:]
+	}
+	bc.pruneUndo()
+	if bc.OnBlockUndone != nil {
+		for _, ub := range blocks {
+			bc.OnBlockUndone(ub.Hash())
+		}
+	}
+	if bc.OnBlockStored != nil {
+		for i, fb := range forkedBlocks {
+			bc.OnBlockStored(fb.Hash(), ancestorHeight+uint32(i)+1)
+		}
+	}
+	return nil
+}
+
+// disconnectBlocks undoes the Coins of Blocks at the end of the active
+// chain, given last Block first as by getBlocksAndUndoBlocks, and takes
+// them out of the supply totals and the transaction index.
+func (bc *BlockChain) disconnectBlocks(blocks []*block.Block, undoBlocks []*chainwriter.UndoBlock) error {
+	if err := bc.CoinDB.UndoCoins(blocks, undoBlocks); err != nil {
+		return err
+	}
+	for i := range blocks {
+		minted, spent := blockSupply(blocks[i], undoBlocks[i])
+		bc.totalMinted -= minted
+		bc.totalSpent -= spent
+		bc.unindexTransactions(blocks[i], blocks[i].Hash())
+	}
+	return nil
+}
+
+// connectBranch validates and connects stored Blocks in order, the first
+// at height, moving the tip to each in turn. It returns how many Blocks
+// were connected, and an error if a Block is invalid or cannot be
+// connected; that Block is left unconnected.
+func (bc *BlockChain) connectBranch(blocks []*block.Block, height uint32) (int, error) {
+	for i, b := range blocks {
+		bHash := b.Hash()
+		bHeight := height + uint32(i)
+		if !bc.CoinDB.ValidateBlock(b.Transactions, bHeight) {
+			return i, fmt.Errorf("block {%v} is invalid", bHash)
+		}
+		if err := bc.connectForkedBlock(b, bHash, bHeight); err != nil {
+			return i, fmt.Errorf("failed to store block {%v}: %w", bHash, err)
+		}
+		bc.setTip(b, bHash, bHeight)
+		bc.UnsafeHashes = append(bc.UnsafeHashes, bHash)
+	}
+	return len(blocks), nil
+}
+
+// restoreBranch undoes the last n Blocks connected by a failed switch to
+// a fork and connects the undone Blocks, given last Block first, again
+// from height.
+func (bc *BlockChain) restoreBranch(n int, undone []*block.Block, height uint32) error {
+	blocks, undoBlocks, err := bc.getBlocksAndUndoBlocks(n)
+	if err != nil {
+		return err
+	}
+	if err := bc.disconnectBlocks(blocks, undoBlocks); err != nil {
+		return err
+	}
+	restored := make([]*block.Block, len(undone))
+	for i, b := range undone {
+		restored[len(undone)-1-i] = b
+	}
+	_, err = bc.connectBranch(restored, height)
+	return err
+}
+
+// pruneUndo deletes the undo files that only hold UndoBlocks of Blocks
+// buried more than maxUndoDepth Blocks below the tip, and clears the
+// undo file information of the active chain's BlockRecords that pointed
+// into them.
+func (bc *BlockChain) pruneUndo() {
+	if bc.maxUndoDepth == 0 || bc.Length <= bc.maxUndoDepth {
+		return
+	}
+	cutoff := bc.Length - bc.maxUndoDepth
+	pruned, err := bc.ChainWriter.PruneUndoBelow(cutoff)
+	if err != nil {
+		utils.Debug.Printf("Failed to prune undo files: %v", err)
+		return
+	}
+	if len(pruned) == 0 {
+		return
+	}
+	prunedFiles := make(map[uint32]bool, len(pruned))
+	for _, fileNumber := range pruned {
+		prunedFiles[fileNumber] = true
+	}
+	// records below undoPrunedHeight no longer point into any undo file
+	lowestLive := cutoff
+	nextHash := bc.LastHash
+	for height := bc.Length; height >= bc.undoPrunedHeight && height > 0; height-- {
+		br, err := bc.BlockInfoDB.GetBlockRecord(nextHash)
+		if err != nil {
+			utils.Debug.Printf("Failed to clear pruned undo files: %v", err)
+			return
+		}
+		if height < cutoff && br.HasUndo {
+			if prunedFiles[br.UndoFileNumber] {
+				br.UndoFile = ""
+				br.UndoFileNumber = 0
+				br.UndoStartOffset = 0
+				br.UndoEndOffset = 0
+				br.HasUndo = false
+				bc.BlockInfoDB.StoreBlockRecord(nextHash, br)
+			} else {
+				lowestLive = height
+			}
+		}
+		nextHash = br.Header.PreviousHash
+	}
+	bc.undoPrunedHeight = lowestLive
+}
+
+// makeUndoBlock returns an UndoBlock given a slice of Transactions. It
+// returns an error if a spent Coin cannot be read from the CoinDatabase.
+func (bc *BlockChain) makeUndoBlock(txs []*block.Transaction) (*chainwriter.UndoBlock, error) {
+	var transactionHashes []block.TxHash
 	var outputIndexes []uint32
 	var amounts []uint32
 	var lockingScripts []string
+	// Coins created and spent within the Block are erased by undoing
+	// the Block, so they need no undo information
+	created := make(map[block.TxHash]bool, len(txs))
 	for _, tx := range txs {
 		for _, txi := range tx.Inputs {
+			if created[txi.ReferenceTransactionHash] {
+				continue
+			}
 			cl := coindatabase.CoinLocator{
 				ReferenceTransactionHash: txi.ReferenceTransactionHash,
 				OutputIndex:              txi.OutputIndex,
 			}
-			coin := bc.CoinDB.GetCoin(cl)
+			coin, err := bc.CoinDB.GetCoin(cl)
+			if err != nil {
+				return nil, fmt.Errorf("[makeUndoBlock] %w", err)
+			}
 			// if the coin is nil it means this isn't even a possible fork
 			if coin == nil {
 				return &chainwriter.UndoBlock{
@@ -125,40 +645,90 @@ func (bc *BlockChain) makeUndoBlock(txs []*block.Transaction) *chainwriter.UndoB
 					OutputIndexes:          nil,
 					Amounts:                nil,
 					LockingScripts:         nil,
-				}
+				}, nil
 			}
 			transactionHashes = append(transactionHashes, txi.ReferenceTransactionHash)
 			outputIndexes = append(outputIndexes, txi.OutputIndex)
 			amounts = append(amounts, coin.TransactionOutput.Amount)
 			lockingScripts = append(lockingScripts, coin.TransactionOutput.LockingScript)
 		}
+		created[tx.Hash()] = true
 	}
 	return &chainwriter.UndoBlock{
 		TransactionInputHashes: transactionHashes,
 		OutputIndexes:          outputIndexes,
 		Amounts:                amounts,
 		LockingScripts:         lockingScripts,
+	}, nil
+}
+
+// spendsEarlierCoins returns whether any of the Transactions spends a
+// Coin not created by the Transactions themselves, which is what
+// makeUndoBlock keeps undo information for.
+func spendsEarlierCoins(txs []*block.Transaction) bool {
+	created := make(map[block.TxHash]bool, len(txs))
+	for _, tx := range txs {
+		for _, txi := range tx.Inputs {
+			if !created[txi.ReferenceTransactionHash] {
+				return true
+			}
+		}
+		created[tx.Hash()] = true
 	}
+	return false
 }
 
 // getBlock uses the ChainWriter to retrieve a Block from Disk
 // given that Block's hash
-func (bc *BlockChain) getBlock(blockHash string) *block.Block {
-	br := bc.BlockInfoDB.GetBlockRecord(blockHash)
+func (bc *BlockChain) getBlock(blockHash block.BlockHash) (*block.Block, error) {
+	if bc.blockCache != nil {
+		if b, ok := bc.blockCache.get(blockHash); ok {
+			return b, nil
+		}
+	}
+	br, err := bc.BlockInfoDB.GetBlockRecord(blockHash)
+	if err != nil {
+		return nil, err
+	}
+	return bc.readBlock(blockHash, br)
+}
+
+// readBlock reads the Block described by a BlockRecord from Disk and
+// adds it to the block cache.
+func (bc *BlockChain) readBlock(blockHash block.BlockHash, br *blockinfodatabase.BlockRecord) (*block.Block, error) {
 	fi := &chainwriter.FileInfo{
 		FileName:    br.BlockFile,
+		FileNumber:  br.BlockFileNumber,
 		StartOffset: br.BlockStartOffset,
 		EndOffset:   br.BlockEndOffset,
 	}
-	return bc.ChainWriter.ReadBlock(fi)
+	b, err := bc.ChainWriter.ReadBlock(fi)
+	if err != nil {
+		return nil, err
+	}
+	bc.cacheBlock(blockHash, b)
+	return b, nil
 }
 
 // getUndoBlock uses the ChainWriter to retrieve an UndoBlock
-// from Disk given the corresponding Block's hash
-func (bc *BlockChain) getUndoBlock(blockHash string) *chainwriter.UndoBlock {
-	br := bc.BlockInfoDB.GetBlockRecord(blockHash)
+// from Disk given the corresponding Block and its hash. It returns an
+// error wrapping ErrUndoPruned if the Block spends Coins but has no
+// UndoBlock on Disk.
+func (bc *BlockChain) getUndoBlock(b *block.Block, blockHash block.BlockHash) (*chainwriter.UndoBlock, error) {
+	br, err := bc.BlockInfoDB.GetBlockRecord(blockHash)
+	if err != nil {
+		return nil, err
+	}
+	// a Block that spends no earlier Coins has no UndoBlock on Disk
+	if !br.HasUndo {
+		if spendsEarlierCoins(b.Transactions) {
+			return nil, fmt.Errorf("[getUndoBlock] block {%v}: %w", blockHash, ErrUndoPruned)
+		}
+		return &chainwriter.UndoBlock{}, nil
+	}
 	fi := &chainwriter.FileInfo{
 		FileName:    br.UndoFile,
+		FileNumber:  br.UndoFileNumber,
 		StartOffset: br.UndoStartOffset,
 		EndOffset:   br.UndoEndOffset,
 	}
@@ -178,14 +748,17 @@ func (bc *BlockChain) GetBlocks(start, end uint32) []*block.Block {
 	nextHash := bc.LastBlock.Hash()
 
 	for currentHeight >= start {
-		br := bc.BlockInfoDB.GetBlockRecord(nextHash)
-		fi := &chainwriter.FileInfo{
-			FileName:    br.BlockFile,
-			StartOffset: br.BlockStartOffset,
-			EndOffset:   br.BlockEndOffset,
+		br, err := bc.BlockInfoDB.GetBlockRecord(nextHash)
+		if err != nil {
+			utils.Debug.Printf("cannot get chain block at height %v: %v", currentHeight, err)
+			break
 		}
 		if currentHeight <= end {
-			nextBlock := bc.ChainWriter.ReadBlock(fi)
+			nextBlock, err := bc.getBlock(nextHash)
+			if err != nil {
+				utils.Debug.Printf("cannot get chain block at height %v: %v", currentHeight, err)
+				break
+			}
 			blocks = append(blocks, nextBlock)
 		}
 		nextHash = br.Header.PreviousHash
@@ -197,17 +770,21 @@ func (bc *BlockChain) GetBlocks(start, end uint32) []*block.Block {
 // GetHashes retrieves a slice of hashes from the main chain given a
 // starting and ending height, inclusive. Given a BlockChain of length
 // 50, GetHashes(10, 20) returns the hashes of Blocks 10 through 20.
-func (bc *BlockChain) GetHashes(start, end uint32) []string {
+func (bc *BlockChain) GetHashes(start, end uint32) []block.BlockHash {
 	if start >= end || end <= 0 || start <= 0 || end > bc.Length {
 		utils.Debug.Printf("cannot get chain blocks with values start: %v end: %v", start, end)
 	}
 
-	var hashes []string
+	var hashes []block.BlockHash
 	currentHeight := bc.Length
 	nextHash := bc.LastBlock.Hash()
 
 	for currentHeight >= start {
-		br := bc.BlockInfoDB.GetBlockRecord(nextHash)
+		br, err := bc.BlockInfoDB.GetBlockRecord(nextHash)
+		if err != nil {
+			utils.Debug.Printf("cannot get chain hash at height %v: %v", currentHeight, err)
+			break
+		}
 		if currentHeight <= end {
 			hashes = append(hashes, nextHash)
 		}
@@ -217,6 +794,264 @@ func (bc *BlockChain) GetHashes(start, end uint32) []string {
 	return reverseHashes(hashes)
 }
 
+// RecentRecords returns the BlockRecords of up to n Blocks at the end of
+// the active chain, starting with the last Block and following parent
+// hashes back towards the genesis Block. Fewer than n BlockRecords are
+// returned if the active chain is shorter than n.
+func (bc *BlockChain) RecentRecords(n int) ([]*blockinfodatabase.BlockRecord, error) {
+	var records []*blockinfodatabase.BlockRecord
+	nextHash := bc.LastHash
+	for height := bc.Length; height > 0 && len(records) < n; height-- {
+		br, err := bc.BlockInfoDB.GetBlockRecord(nextHash)
+		if err != nil {
+			return nil, fmt.Errorf("[RecentRecords] cannot get block record at height {%v}: %w", height, err)
+		}
+		records = append(records, br)
+		nextHash = br.Header.PreviousHash
+	}
+	return records, nil
+}
+
+// IterateDescending calls fn with each Block of the active chain and its
+// height, starting at height from and walking down towards the genesis
+// Block. A from of 0 starts at the last Block. Iteration stops when fn
+// returns false or after the genesis Block. Blocks are read one at a
+// time, so the chain is never held in memory at once.
+func (bc *BlockChain) IterateDescending(from uint32, fn func(*block.Block, uint32) bool) error {
+	if from == 0 {
+		from = bc.Length
+	}
+	if from > bc.Length {
+		return fmt.Errorf("[IterateDescending] height {%v} is above the last block at height {%v}", from, bc.Length)
+	}
+	nextHash := bc.LastHash
+	for height := bc.Length; height > 0; height-- {
+		br, err := bc.BlockInfoDB.GetBlockRecord(nextHash)
+		if err != nil {
+			return fmt.Errorf("[IterateDescending] cannot get block record at height {%v}: %w", height, err)
+		}
+		if height <= from {
+			b, err := bc.readBlock(nextHash, br)
+			if err != nil {
+				return fmt.Errorf("[IterateDescending] cannot read block at height {%v}: %w", height, err)
+			}
+			if !fn(b, height) {
+				return nil
+			}
+		}
+		nextHash = br.Header.PreviousHash
+	}
+	return nil
+}
+
+// ErrHeightOutOfRange is returned by GetBlockByHeight for a height with
+// no Block on the active chain.
+var ErrHeightOutOfRange = errors.New("height out of range")
+
+// GetBlockByHeight returns the Block at a height on the active chain,
+// from 1 for the genesis Block up to the BlockChain's Length. The hash
+// is looked up in the height index, and if several Blocks share the
+// height, the one the last Block descends from is read. It returns an
+// error wrapping ErrHeightOutOfRange if there is no such height, and an
+// error if the Block cannot be found or read.
+func (bc *BlockChain) GetBlockByHeight(height uint32) (*block.Block, error) {
+	if height < 1 || height > bc.Length {
+		return nil, fmt.Errorf("[GetBlockByHeight] height {%v} not in [1, %v]: %w", height, bc.Length, ErrHeightOutOfRange)
+	}
+	hashes, err := bc.BlockInfoDB.GetHashesAtHeight(height)
+	if err != nil {
+		return nil, fmt.Errorf("[GetBlockByHeight] %w", err)
+	}
+	for _, hash := range hashes {
+		// a lone hash at a height within the active chain must be on it
+		if len(hashes) > 1 {
+			ancestor, err := bc.CommonAncestor(hash, bc.LastHash)
+			if err != nil {
+				return nil, fmt.Errorf("[GetBlockByHeight] %w", err)
+			}
+			if ancestor != hash {
+				continue
+			}
+		}
+		b, err := bc.getBlock(hash)
+		if err != nil {
+			return nil, fmt.Errorf("[GetBlockByHeight] cannot read block {%v} at height {%v}: %w", hash, height, err)
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("[GetBlockByHeight] no block at height {%v} in the height index is on the active chain", height)
+}
+
+// VerifyChainLinks walks the active chain from the last Block back to
+// the genesis Block, checking that every Block's parent has a
+// BlockRecord, that each BlockRecord is stored under the hash of its
+// Header, and that heights decrease by one down to the genesis Block at
+// height 1. It returns an error describing the first broken link.
+func (bc *BlockChain) VerifyChainLinks() error {
+	nextHash := bc.LastHash
+	for height := bc.Length; ; height-- {
+		br, err := bc.BlockInfoDB.GetBlockRecord(nextHash)
+		if err != nil {
+			return fmt.Errorf("[VerifyChainLinks] missing block record {%v} at height {%v}: %w", nextHash, height, err)
+		}
+		if br.Height != height {
+			return fmt.Errorf("[VerifyChainLinks] block {%v} has height {%v}, expected {%v}", nextHash, br.Height, height)
+		}
+		if headerHash := (&block.Block{Header: br.Header}).Hash(); headerHash != nextHash {
+			return fmt.Errorf("[VerifyChainLinks] block record {%v} at height {%v} holds the header of block {%v}", nextHash, height, headerHash)
+		}
+		if height == 1 {
+			if br.Header.PreviousHash != "" {
+				return fmt.Errorf("[VerifyChainLinks] genesis block {%v} has parent {%v}", nextHash, br.Header.PreviousHash)
+			}
+			return nil
+		}
+		nextHash = br.Header.PreviousHash
+	}
+}
+
+// ErrNoParent is returned by ParentBlock for the genesis Block, which
+// has no parent.
+var ErrNoParent = errors.New("genesis block has no parent")
+
+// ParentBlock returns the parent of the Block with a given hash, reading
+// the parent hash from the Block's BlockRecord. It returns ErrNoParent
+// if the Block is the genesis Block, and an error if either Block is
+// unknown.
+func (bc *BlockChain) ParentBlock(hash block.BlockHash) (*block.Block, error) {
+	br, err := bc.BlockInfoDB.GetBlockRecord(hash)
+	if err != nil {
+		return nil, fmt.Errorf("[ParentBlock] cannot get block record {%v}: %w", hash, err)
+	}
+	if br.Header.PreviousHash == "" {
+		return nil, fmt.Errorf("[ParentBlock] block {%v}: %w", hash, ErrNoParent)
+	}
+	parent, err := bc.getBlock(br.Header.PreviousHash)
+	if err != nil {
+		return nil, fmt.Errorf("[ParentBlock] cannot read parent {%v} of block {%v}: %w", br.Header.PreviousHash, hash, err)
+	}
+	return parent, nil
+}
+
+// ErrNoCommonAncestor is returned by CommonAncestor when two Blocks do
+// not descend from the same Block.
+var ErrNoCommonAncestor = errors.New("no common ancestor")
+
+// CommonAncestor returns the hash of the highest Block that both Blocks
+// descend from, or are; for a Block on a fork and the tip, this is the
+// fork point. It follows parent hashes through the BlockRecords, first
+// moving the higher Block down to the height of the lower one, then
+// stepping both back together until they meet. It returns an error if
+// either Block or one of their ancestors has no BlockRecord, or one
+// wrapping ErrNoCommonAncestor if the chains are disjoint: a walk that
+// reaches a genesis Block before the chains meet has run out of Blocks.
+func (bc *BlockChain) CommonAncestor(hashA, hashB block.BlockHash) (block.BlockHash, error) {
+	brA, err := bc.BlockInfoDB.GetBlockRecord(hashA)
+	if err != nil {
+		return "", fmt.Errorf("[CommonAncestor] cannot get block record {%v}: %w", hashA, err)
+	}
+	brB, err := bc.BlockInfoDB.GetBlockRecord(hashB)
+	if err != nil {
+		return "", fmt.Errorf("[CommonAncestor] cannot get block record {%v}: %w", hashB, err)
+	}
+	for brA.Height > brB.Height {
+		if hashA, brA, err = bc.parentRecord(brA); err != nil {
+			return "", fmt.Errorf("[CommonAncestor] %w", err)
+		}
+	}
+	for brB.Height > brA.Height {
+		if hashB, brB, err = bc.parentRecord(brB); err != nil {
+			return "", fmt.Errorf("[CommonAncestor] %w", err)
+		}
+	}
+	for hashA != hashB {
+		if hashA, brA, err = bc.parentRecord(brA); err != nil {
+			return "", fmt.Errorf("[CommonAncestor] %w", err)
+		}
+		if hashB, brB, err = bc.parentRecord(brB); err != nil {
+			return "", fmt.Errorf("[CommonAncestor] %w", err)
+		}
+	}
+	return hashA, nil
+}
+
+// parentRecord returns the hash and BlockRecord of the parent of the
+// Block with a BlockRecord. It returns ErrNoCommonAncestor if the Block
+// is a genesis Block.
+func (bc *BlockChain) parentRecord(br *blockinfodatabase.BlockRecord) (block.BlockHash, *blockinfodatabase.BlockRecord, error) {
+	hash := br.Header.PreviousHash
+	if hash == "" {
+		return "", nil, ErrNoCommonAncestor
+	}
+	parent, err := bc.BlockInfoDB.GetBlockRecord(hash)
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot get block record {%v}: %w", hash, err)
+	}
+	return hash, parent, nil
+}
+
+// RegenerateUndoBlock rebuilds the UndoBlock of the stored Block with a
+// given hash from the Transactions of its ancestors, for when its undo
+// file is lost or pruned. The ancestors are read from Disk, walking back
+// from the Block's parent until every Transaction the Block spends from
+// is found, so it may read back as far as the genesis Block. It returns
+// an error if the Block or a needed ancestor cannot be read, or if a
+// spent Coin is not found among its ancestors.
+func (bc *BlockChain) RegenerateUndoBlock(hash block.BlockHash) (*chainwriter.UndoBlock, error) {
+	b, err := bc.getBlock(hash)
+	if err != nil {
+		return nil, fmt.Errorf("[RegenerateUndoBlock] cannot read block {%v}: %w", hash, err)
+	}
+	// Coins created and spent within the Block need no undo
+	// information, as in makeUndoBlock
+	created := make(map[block.TxHash]bool, len(b.Transactions))
+	needed := make(map[block.TxHash]*block.Transaction)
+	for _, tx := range b.Transactions {
+		for _, txi := range tx.Inputs {
+			if !created[txi.ReferenceTransactionHash] {
+				needed[txi.ReferenceTransactionHash] = nil
+			}
+		}
+		created[tx.Hash()] = true
+	}
+	if len(needed) == 0 {
+		return &chainwriter.UndoBlock{}, nil
+	}
+	remaining := len(needed)
+	for nextHash := b.Header.PreviousHash; remaining > 0 && nextHash != ""; {
+		ancestor, err := bc.getBlock(nextHash)
+		if err != nil {
+			return nil, fmt.Errorf("[RegenerateUndoBlock] cannot read ancestor {%v} of block {%v}: %w", nextHash, hash, err)
+		}
+		for _, tx := range ancestor.Transactions {
+			txHash := tx.Hash()
+			if parent, ok := needed[txHash]; ok && parent == nil {
+				needed[txHash] = tx
+				remaining--
+			}
+		}
+		nextHash = ancestor.Header.PreviousHash
+	}
+	ub := &chainwriter.UndoBlock{}
+	for _, tx := range b.Transactions {
+		for _, txi := range tx.Inputs {
+			parent, ok := needed[txi.ReferenceTransactionHash]
+			if !ok {
+				continue
+			}
+			if parent == nil || int(txi.OutputIndex) >= len(parent.Outputs) {
+				return nil, fmt.Errorf("[RegenerateUndoBlock] block {%v} spends coin {%v:%v}, which none of its ancestors created", hash, txi.ReferenceTransactionHash, txi.OutputIndex)
+			}
+			txo := parent.Outputs[txi.OutputIndex]
+			ub.TransactionInputHashes = append(ub.TransactionInputHashes, txi.ReferenceTransactionHash)
+			ub.OutputIndexes = append(ub.OutputIndexes, txi.OutputIndex)
+			ub.Amounts = append(ub.Amounts, txo.Amount)
+			ub.LockingScripts = append(ub.LockingScripts, txo.LockingScript)
+		}
+	}
+	return ub, nil
+}
+
 // appendsToActiveChain returns whether a Block appends to the
 // BlockChain's active chain or not.
 func (bc *BlockChain) appendsToActiveChain(b *block.Block) bool {
@@ -226,40 +1061,59 @@ func (bc *BlockChain) appendsToActiveChain(b *block.Block) bool {
 // getForkedBlocks returns a slice of Blocks given a starting hash.
 // It returns a maximum of maxHashes Blocks, where maxHashes is the
 // BlockChain's maximum number of unsafe hashes.
-func (bc *BlockChain) getForkedBlocks(startHash string) []*block.Block {
-	unsafeHashes := make(map[string]bool)
+func (bc *BlockChain) getForkedBlocks(startHash block.BlockHash) ([]*block.Block, error) {
+	unsafeHashes := make(map[block.BlockHash]bool)
 	for _, h := range bc.UnsafeHashes {
 		unsafeHashes[h] = true
 	}
 	var forkedBlocks []*block.Block
 	nextHash := startHash
-	for i := 0; i < len(bc.UnsafeHashes); i++ {
-		forkedBlock := bc.getBlock(nextHash)
+	for i := 0; i <= len(bc.UnsafeHashes); i++ {
+		forkedBlock, err := bc.getBlock(nextHash)
+		if err != nil {
+			return nil, err
+		}
 		forkedBlocks = append(forkedBlocks, forkedBlock)
 		if _, ok := unsafeHashes[nextHash]; ok {
-			return forkedBlocks
+			return forkedBlocks, nil
 		}
 		nextHash = forkedBlock.Header.PreviousHash
 	}
-	return forkedBlocks
+	return forkedBlocks, nil
 }
 
 // getBlocksAndUndoBlocks returns a slice of n Blocks with a
 // corresponding slice of n UndoBlocks. They are returned in reverse order:
 // given block heights of 1, 2, and 3, this function will return the blocks
 // as [3, 2, 1] (to make undoing easier)
-func (bc *BlockChain) getBlocksAndUndoBlocks(n int) ([]*block.Block, []*chainwriter.UndoBlock) {
+func (bc *BlockChain) getBlocksAndUndoBlocks(n int) ([]*block.Block, []*chainwriter.UndoBlock, error) {
 	var blocks []*block.Block
 	var undoBlocks []*chainwriter.UndoBlock
 	nextHash := bc.LastHash
 	for i := 0; i < n; i++ {
-		b := bc.getBlock(nextHash)
-		ub := bc.getUndoBlock(nextHash)
+		b, err := bc.getBlock(nextHash)
+		if err != nil {
+			return nil, nil, err
+		}
+		ub, err := bc.getUndoBlock(b, nextHash)
+		if err != nil {
+			return nil, nil, err
+		}
 		blocks = append(blocks, b)
 		undoBlocks = append(undoBlocks, ub)
 		nextHash = b.Header.PreviousHash
 	}
-	return blocks, undoBlocks
+	return blocks, undoBlocks, nil
+}
+
+// indexOfHash returns the index of hash h in slice s, -1 if it does not exist.
+func indexOfHash(s []block.BlockHash, h block.BlockHash) int {
+	for i, a := range s {
+		if a == h {
+			return i
+		}
+	}
+	return -1
 }
 
 // reverseBlocks returns a reversed slice of Blocks.
@@ -271,7 +1125,7 @@ func reverseBlocks(s []*block.Block) []*block.Block {
 }
 
 // reverseHashes returns a reversed slice of hashes.
-func reverseHashes(s []string) []string {
+func reverseHashes(s []block.BlockHash) []block.BlockHash {
 	for i, j := 0, len(s)-1; i < j; i, j = i+1, j-1 {
 		s[i], s[j] = s[j], s[i]
 	}
@@ -0,0 +1,811 @@
+package blockchain
+
+import (
+	"Chain/pkg/block"
+	"Chain/pkg/blockchain/chainwriter"
+	"Chain/pkg/blockchain/coindatabase"
+	"Chain/pkg/blockchain/kvstore"
+	"Chain/test"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// inTempDir runs the rest of the test in a temporary directory, since
+// New opens its stores at paths relative to the working directory.
+func inTempDir(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+// extend handles n Blocks, each spending the outputs of the one before,
+// on top of b, and returns them.
+func extend(t *testing.T, bc *BlockChain, b *block.Block, n int) []*block.Block {
+	t.Helper()
+	var blocks []*block.Block
+	for i := 0; i < n; i++ {
+		b = test.MakeBlockFromPrev(b)
+		bc.HandleBlock(b)
+		if bc.LastHash != b.Hash() {
+			t.Fatalf("block {%v} did not extend the active chain", i)
+		}
+		blocks = append(blocks, b)
+	}
+	return blocks
+}
+
+// newTestChain returns a BlockChain given a Config, closed when the
+// test finishes.
+func newTestChain(t *testing.T, config *Config) *BlockChain {
+	t.Helper()
+	bc, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := bc.Close(); err != nil {
+			t.Error(err)
+		}
+	})
+	return bc
+}
+
+func TestCloseReleasesStores(t *testing.T) {
+	inTempDir(t)
+	bc, err := New(DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// every levelDB is unlocked, so the same stores open again
+	newTestChain(t, DefaultConfig())
+}
+
+func TestNewClosesStoresOnError(t *testing.T) {
+	inTempDir(t)
+	// holding the coin database's lock makes New fail after opening
+	// the other stores
+	held, err := kvstore.OpenLevelDB("coindata", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(DefaultConfig()); err == nil {
+		t.Fatal("New succeeded with the coin database locked")
+	}
+	if err := held.Close(); err != nil {
+		t.Fatal(err)
+	}
+	newTestChain(t, DefaultConfig())
+}
+
+func TestNewRejectsShallowUndoDepth(t *testing.T) {
+	inTempDir(t)
+	config := DefaultConfig()
+	config.MaxUndoDepth = maxUnsafeHashes - 1
+	if _, err := New(config); err == nil {
+		t.Fatal("New accepted a MaxUndoDepth shallower than the unsafe hashes")
+	}
+	if _, err := os.Stat("coindata"); !os.IsNotExist(err) {
+		t.Errorf("New opened stores before rejecting the Config: %v", err)
+	}
+}
+
+func TestGetUndoBlockReportsPrunedUndo(t *testing.T) {
+	inTempDir(t)
+	config := DefaultConfig()
+	config.InitialSubsidy = 1000
+	config.MaxUndoDepth = maxUnsafeHashes
+	bc := newTestChain(t, config)
+	// reopen the ChainWriter with undo files small enough to be pruned
+	if err := bc.ChainWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	cwConfig := chainwriter.DefaultConfig()
+	cwConfig.MaxUndoFileSize = 64
+	cw, err := chainwriter.New(cwConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc.ChainWriter = cw
+	blocks := extend(t, bc, bc.LastBlock, 2*maxUnsafeHashes)
+	buried := blocks[0]
+	if _, err := bc.getUndoBlock(buried, buried.Hash()); !errors.Is(err, ErrUndoPruned) {
+		t.Errorf("reading a pruned undo block returned %v, want ErrUndoPruned", err)
+	}
+	recent := blocks[len(blocks)-1]
+	ub, err := bc.getUndoBlock(recent, recent.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ub.Amounts) != len(recent.Transactions) {
+		t.Errorf("read undo block with {%v} amounts, want {%v}", len(ub.Amounts), len(recent.Transactions))
+	}
+}
+
+func TestProcessBlockFromRejectsDeepReorg(t *testing.T) {
+	inTempDir(t)
+	config := DefaultConfig()
+	config.InitialSubsidy = 1000
+	config.MaxReorgDepth = 1
+	bc := newTestChain(t, config)
+	genesis := bc.LastBlock
+	extend(t, bc, genesis, 2)
+	length, lastHash := bc.Length, bc.LastHash
+	minted, spent := bc.Supply()
+	// a fork from the genesis Block would undo both Blocks above it
+	b := genesis
+	var err error
+	for i := 0; i < 3; i++ {
+		b = test.MakeBlockFromPrev(b)
+		b.Header.Nonce = 1
+		err = bc.ProcessBlockFrom(b, "peer")
+	}
+	if !errors.Is(err, ErrReorgTooDeep) {
+		t.Errorf("switching to a fork two blocks deep returned %v, want ErrReorgTooDeep", err)
+	}
+	if bc.Length != length || bc.LastHash != lastHash {
+		t.Errorf("refused reorg moved the tip to {%v} at height {%v}", bc.LastHash, bc.Length)
+	}
+	if gotMinted, gotSpent := bc.Supply(); gotMinted != minted || gotSpent != spent {
+		t.Errorf("refused reorg changed the supply to {%v} minted, {%v} spent", gotMinted, gotSpent)
+	}
+}
+
+func TestSubsidyIsCheckedByBlockChain(t *testing.T) {
+	inTempDir(t)
+	config := DefaultConfig()
+	config.InitialSubsidy = 1000
+	config.Subsidy = func(height uint32) uint32 { return 10 }
+	bc := newTestChain(t, config)
+	genesis := bc.LastBlock
+	// spending the genesis output leaves a fee of 100
+	spendTx := &block.Transaction{
+		Inputs:  []*block.TransactionInput{{ReferenceTransactionHash: genesis.Transactions[0].Hash(), OutputIndex: 0}},
+		Outputs: []*block.TransactionOutput{{Amount: 900}},
+	}
+	withCoinbase := func(claim uint32) *block.Block {
+		b := test.MakeBlockFromPrev(genesis)
+		b.Transactions = []*block.Transaction{{Outputs: []*block.TransactionOutput{{Amount: claim}}}, spendTx}
+		return b
+	}
+	if err := bc.ProcessBlockFrom(withCoinbase(111), ""); err == nil {
+		t.Error("stored a block whose coinbase over-claims the subsidy")
+	}
+	b := withCoinbase(110)
+	if err := bc.ProcessBlockFrom(b, ""); err != nil {
+		t.Fatal(err)
+	}
+	if bc.LastHash != b.Hash() {
+		t.Errorf("block claiming exactly the subsidy plus fees did not extend the active chain")
+	}
+}
+
+func TestDisableUndo(t *testing.T) {
+	inTempDir(t)
+	config := DefaultConfig()
+	config.InitialSubsidy = 1000
+	config.DisableUndo = true
+	bc := newTestChain(t, config)
+	genesis := bc.LastBlock
+	extend(t, bc, genesis, 2)
+	numbers, err := bc.ChainWriter.UndoFileNumbers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(numbers) != 0 {
+		t.Errorf("undo files %v were created with undo disabled", numbers)
+	}
+	b := genesis
+	for i := 0; i < 3; i++ {
+		b = test.MakeBlockFromPrev(b)
+		b.Header.Nonce = 1
+		err = bc.ProcessBlockFrom(b, "")
+	}
+	if !errors.Is(err, ErrUndoDisabled) {
+		t.Errorf("switching to a fork returned %v, want ErrUndoDisabled", err)
+	}
+}
+
+func TestCommonAncestor(t *testing.T) {
+	inTempDir(t)
+	config := DefaultConfig()
+	config.InitialSubsidy = 1000
+	bc := newTestChain(t, config)
+	active := extend(t, bc, bc.LastBlock, 3)
+	forkPoint := active[0]
+	// a shorter fork from the first Block is stored but not switched to
+	fork := forkPoint
+	for i := 0; i < 2; i++ {
+		fork = test.MakeBlockFromPrev(fork)
+		fork.Header.Nonce = 1
+		if err := bc.ProcessBlockFrom(fork, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tip := active[len(active)-1]
+	for _, pair := range [][2]*block.Block{{tip, fork}, {fork, tip}, {tip, forkPoint}} {
+		ancestor, err := bc.CommonAncestor(pair[0].Hash(), pair[1].Hash())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ancestor != forkPoint.Hash() {
+			t.Errorf("got common ancestor {%v}, want the fork point {%v}", ancestor, forkPoint.Hash())
+		}
+	}
+	// a second genesis Block starts a disjoint chain
+	other := test.MockedBlockRecord()
+	other.Header.PreviousHash = ""
+	other.Height = 1
+	bc.BlockInfoDB.StoreBlockRecord("other", other)
+	if _, err := bc.CommonAncestor(tip.Hash(), "other"); !errors.Is(err, ErrNoCommonAncestor) {
+		t.Errorf("disjoint chains returned %v, want ErrNoCommonAncestor", err)
+	}
+}
+
+func TestRegenerateUndoBlock(t *testing.T) {
+	inTempDir(t)
+	config := DefaultConfig()
+	config.InitialSubsidy = 1000
+	bc := newTestChain(t, config)
+	blocks := extend(t, bc, bc.LastBlock, 3)
+	b := blocks[len(blocks)-1]
+	original, err := bc.getUndoBlock(b, b.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(original.Amounts) == 0 {
+		t.Fatal("block spends no earlier coins, so there is nothing to regenerate")
+	}
+	br, err := bc.BlockInfoDB.GetBlockRecord(b.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(br.UndoFile); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bc.getUndoBlock(b, b.Hash()); err == nil {
+		t.Fatal("read an undo block from a deleted undo file")
+	}
+	ub, err := bc.RegenerateUndoBlock(b.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ub, original) {
+		t.Errorf("regenerated undo block %+v, want %+v", ub, original)
+	}
+}
+
+func TestGetBlockByHeight(t *testing.T) {
+	inTempDir(t)
+	config := DefaultConfig()
+	config.InitialSubsidy = 1000
+	bc := newTestChain(t, config)
+	genesis := bc.LastBlock
+	blocks := append([]*block.Block{genesis}, extend(t, bc, genesis, 3)...)
+	// a side Block shares height 2 with the active chain
+	side := test.MakeBlockFromPrev(genesis)
+	side.Header.Nonce = 1
+	if err := bc.ProcessBlockFrom(side, "peer"); err != nil {
+		t.Fatal(err)
+	}
+	if hashes, err := bc.BlockInfoDB.GetHashesAtHeight(2); err != nil || len(hashes) != 2 {
+		t.Fatalf("got hashes %v and error %v at height 2, want the active and side blocks", hashes, err)
+	}
+	for i, want := range blocks {
+		b, err := bc.GetBlockByHeight(uint32(i + 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.Hash() != want.Hash() {
+			t.Errorf("got block {%v} at height {%v}, want {%v}", b.Hash(), i+1, want.Hash())
+		}
+	}
+	for _, height := range []uint32{0, uint32(len(blocks) + 1)} {
+		if b, err := bc.GetBlockByHeight(height); !errors.Is(err, ErrHeightOutOfRange) {
+			t.Errorf("got block %v and error %v at height {%v}, want ErrHeightOutOfRange", b, err, height)
+		}
+	}
+}
+
+func TestFindTransaction(t *testing.T) {
+	inTempDir(t)
+	config := DefaultConfig()
+	config.InitialSubsidy = 1000
+	config.TransactionIndex = true
+	bc := newTestChain(t, config)
+	genesis := bc.LastBlock
+	b := extend(t, bc, genesis, 1)[0]
+	tx := b.Transactions[0]
+	found, blockHash, err := bc.FindTransaction(tx.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Hash() != tx.Hash() || blockHash != b.Hash() {
+		t.Errorf("found transaction {%v} in block {%v}, want {%v} in {%v}", found.Hash(), blockHash, tx.Hash(), b.Hash())
+	}
+	// a longer fork with different Transactions undoes b
+	fork := test.MakeBlockFromPrev(genesis)
+	fork.Header.Nonce = 1
+	for _, forkTx := range fork.Transactions {
+		forkTx.LockTime = 1
+	}
+	for i := 0; i < 2; i++ {
+		if err := bc.ProcessBlockFrom(fork, "peer"); err != nil {
+			t.Fatal(err)
+		}
+		fork = test.MakeBlockFromPrev(fork)
+	}
+	if bc.Length != 3 || bc.LastHash == b.Hash() {
+		t.Fatalf("fork did not become the active chain")
+	}
+	if found, _, err := bc.FindTransaction(tx.Hash()); !errors.Is(err, ErrTransactionNotFound) {
+		t.Errorf("found transaction %v of an undone block, with error %v", found, err)
+	}
+}
+
+func TestHooks(t *testing.T) {
+	inTempDir(t)
+	config := DefaultConfig()
+	config.InitialSubsidy = 1000
+	bc := newTestChain(t, config)
+	var events []string
+	bc.OnBlockStored = func(hash block.BlockHash, height uint32) {
+		// the hook runs once the Block is on the active chain
+		if b, err := bc.GetBlockByHeight(height); err != nil || b.Hash() != hash {
+			t.Errorf("stored hook for {%v} ran before it was at height {%v} of the active chain", hash, height)
+		}
+		events = append(events, fmt.Sprintf("stored %v %v", hash, height))
+	}
+	bc.OnBlockUndone = func(hash block.BlockHash) {
+		events = append(events, fmt.Sprintf("undone %v", hash))
+	}
+	genesis := bc.LastBlock
+	active := extend(t, bc, genesis, 2)
+	want := []string{
+		fmt.Sprintf("stored %v 2", active[0].Hash()),
+		fmt.Sprintf("stored %v 3", active[1].Hash()),
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Fatalf("got events %v storing two blocks, want %v", events, want)
+	}
+
+	// a fork of three Blocks undoes both, last first, once it is longer
+	events = nil
+	var fork []*block.Block
+	b := genesis
+	for i := 0; i < 3; i++ {
+		b = test.MakeBlockFromPrev(b)
+		b.Header.Nonce = 1
+		if err := bc.ProcessBlockFrom(b, "peer"); err != nil {
+			t.Fatal(err)
+		}
+		fork = append(fork, b)
+	}
+	want = []string{
+		fmt.Sprintf("undone %v", active[1].Hash()),
+		fmt.Sprintf("undone %v", active[0].Hash()),
+		fmt.Sprintf("stored %v 2", fork[0].Hash()),
+		fmt.Sprintf("stored %v 3", fork[1].Hash()),
+		fmt.Sprintf("stored %v 4", fork[2].Hash()),
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("got events %v during the reorg, want %v", events, want)
+	}
+}
+
+func TestBlockCache(t *testing.T) {
+	inTempDir(t)
+	config := DefaultConfig()
+	config.InitialSubsidy = 1000
+	config.BlockCacheSize = 2
+	bc := newTestChain(t, config)
+	blocks := extend(t, bc, bc.LastBlock, 4)
+	hits, misses := bc.BlockCacheStats()
+	// the cache holds the last two Blocks stored, so this one is read
+	// from Disk
+	if b, err := bc.GetBlockByHeight(2); err != nil || b.Hash() != blocks[0].Hash() {
+		t.Fatalf("got block %v and error %v at height 2, want %v", b, err, blocks[0].Hash())
+	}
+	if h, m := bc.BlockCacheStats(); h != hits || m != misses+1 {
+		t.Errorf("first read went from %v hits and %v misses to %v and %v, want one more miss", hits, misses, h, m)
+	}
+	// with the block files gone, only the cache can serve a read
+	files, err := filepath.Glob(filepath.Join(bc.ChainWriter.DataDirectory, "block_*"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("found block files %v (error %v)", files, err)
+	}
+	for _, file := range files {
+		if err := os.Remove(file); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if b, err := bc.GetBlockByHeight(2); err != nil || b.Hash() != blocks[0].Hash() {
+		t.Fatalf("got block %v and error %v from the cache at height 2, want %v", b, err, blocks[0].Hash())
+	}
+	if h, m := bc.BlockCacheStats(); h != hits+1 || m != misses+1 {
+		t.Errorf("second read went from %v hits and %v misses to %v and %v, want one more hit", hits, misses+1, h, m)
+	}
+	if _, err := bc.GetBlockByHeight(1); err == nil {
+		t.Error("read an uncached block with its file removed")
+	}
+}
+
+func TestRecentRecords(t *testing.T) {
+	inTempDir(t)
+	config := DefaultConfig()
+	config.InitialSubsidy = 1000
+	bc := newTestChain(t, config)
+	genesis := bc.LastBlock
+	blocks := append([]*block.Block{genesis}, extend(t, bc, genesis, 3)...)
+	// asking for more records than the chain holds stops at the genesis
+	// Block
+	for _, n := range []int{0, 2, len(blocks), len(blocks) + 5} {
+		records, err := bc.RecentRecords(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := n
+		if want > len(blocks) {
+			want = len(blocks)
+		}
+		if len(records) != want {
+			t.Fatalf("got %v records when asking for %v, want %v", len(records), n, want)
+		}
+		// records run from the last Block back towards the genesis Block
+		for i, br := range records {
+			b := blocks[len(blocks)-1-i]
+			if hash := (&block.Block{Header: br.Header}).Hash(); hash != b.Hash() {
+				t.Errorf("record %v of %v is for block {%v}, want {%v}", i, n, hash, b.Hash())
+			}
+		}
+	}
+}
+
+func TestExportImportBlocks(t *testing.T) {
+	inTempDir(t)
+	config := DefaultConfig()
+	config.InitialSubsidy = 1000
+	bc := newTestChain(t, config)
+	genesis := bc.LastBlock
+	active := extend(t, bc, genesis, 4)
+	// a side Block is not on the active chain, so it is not exported
+	side := test.MakeBlockFromPrev(genesis)
+	side.Header.Nonce = 1
+	bc.HandleBlock(side)
+	path := filepath.Join(t.TempDir(), "chain.bin")
+	if err := bc.ExportBlocks(path); err != nil {
+		t.Fatal(err)
+	}
+	// the import goes into fresh databases in another directory
+	inTempDir(t)
+	imported := newTestChain(t, config)
+	if err := imported.ImportBlocks(path); err != nil {
+		t.Fatal(err)
+	}
+	if imported.Length != bc.Length || imported.LastHash != bc.LastHash {
+		t.Fatalf("imported chain ends at height %v with {%v}, want height %v with {%v}", imported.Length, imported.LastHash, bc.Length, bc.LastHash)
+	}
+	for i, b := range active {
+		got, err := imported.GetBlockByHeight(uint32(i + 2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Hash() != b.Hash() {
+			t.Errorf("imported block at height %v is {%v}, want {%v}", i+2, got.Hash(), b.Hash())
+		}
+	}
+	if _, err := imported.BlockInfoDB.GetBlockRecord(side.Hash()); err == nil {
+		t.Error("imported a block that was not on the active chain")
+	}
+	want, err := bc.CoinDB.UTXOSetHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := imported.CoinDB.UTXOSetHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("imported chain has a different UTXO set")
+	}
+}
+
+func TestVerifyChainLinks(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		corrupt func(t *testing.T, bc *BlockChain, blocks []*block.Block)
+		want    string
+	}{
+		{"intact", func(*testing.T, *BlockChain, []*block.Block) {}, ""},
+		{"missing parent", func(t *testing.T, bc *BlockChain, blocks []*block.Block) {
+			if err := bc.BlockInfoDB.RemoveBlockRecord(blocks[1].Hash()); err != nil {
+				t.Fatal(err)
+			}
+		}, "missing block record"},
+		{"wrong height", func(t *testing.T, bc *BlockChain, blocks []*block.Block) {
+			br, err := bc.BlockInfoDB.GetBlockRecord(blocks[1].Hash())
+			if err != nil {
+				t.Fatal(err)
+			}
+			broken := *br
+			broken.Height = 7
+			bc.BlockInfoDB.StoreBlockRecord(blocks[1].Hash(), &broken)
+		}, "has height"},
+		{"parent relinked", func(t *testing.T, bc *BlockChain, blocks []*block.Block) {
+			br, err := bc.BlockInfoDB.GetBlockRecord(blocks[2].Hash())
+			if err != nil {
+				t.Fatal(err)
+			}
+			broken, header := *br, *br.Header
+			header.PreviousHash = blocks[0].Hash()
+			broken.Header = &header
+			bc.BlockInfoDB.StoreBlockRecord(blocks[2].Hash(), &broken)
+		}, "holds the header"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inTempDir(t)
+			config := DefaultConfig()
+			config.InitialSubsidy = 1000
+			bc := newTestChain(t, config)
+			blocks := extend(t, bc, bc.LastBlock, 4)
+			tc.corrupt(t, bc, blocks)
+			err := bc.VerifyChainLinks()
+			switch {
+			case tc.want == "" && err != nil:
+				t.Errorf("intact chain failed verification: %v", err)
+			case tc.want != "" && (err == nil || !strings.Contains(err.Error(), tc.want)):
+				t.Errorf("got error %v, want one containing {%v}", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestParentBlock(t *testing.T) {
+	inTempDir(t)
+	config := DefaultConfig()
+	config.InitialSubsidy = 1000
+	bc := newTestChain(t, config)
+	genesis := bc.LastBlock
+	blocks := append([]*block.Block{genesis}, extend(t, bc, genesis, 3)...)
+	// walking back from the last Block reaches each parent in turn
+	for i := len(blocks) - 1; i >= 1; i-- {
+		parent, err := bc.ParentBlock(blocks[i].Hash())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parent.Hash() != blocks[i-1].Hash() {
+			t.Errorf("parent of block at height %v is {%v}, want {%v}", i+1, parent.Hash(), blocks[i-1].Hash())
+		}
+	}
+	// a side Block's parent is found the same way
+	side := test.MakeBlockFromPrev(blocks[1])
+	side.Header.Nonce = 1
+	bc.HandleBlock(side)
+	if parent, err := bc.ParentBlock(side.Hash()); err != nil || parent.Hash() != blocks[1].Hash() {
+		t.Errorf("got parent %v and error %v for a side block, want {%v}", parent, err, blocks[1].Hash())
+	}
+	if _, err := bc.ParentBlock(genesis.Hash()); !errors.Is(err, ErrNoParent) {
+		t.Errorf("got error %v for the genesis block's parent, want %v", err, ErrNoParent)
+	}
+	if _, err := bc.ParentBlock(test.MakeBlockFromPrev(blocks[3]).Hash()); err == nil || errors.Is(err, ErrNoParent) {
+		t.Errorf("got error %v for an unknown block's parent", err)
+	}
+}
+
+func TestSupplyAcrossReorg(t *testing.T) {
+	inTempDir(t)
+	config := DefaultConfig()
+	config.InitialSubsidy = 1000
+	bc := newTestChain(t, config)
+	genesis := bc.LastBlock
+	outputs := func(b *block.Block) uint64 {
+		var total uint64
+		for _, tx := range b.Transactions {
+			for _, txo := range tx.Outputs {
+				total += uint64(txo.Amount)
+			}
+		}
+		return total
+	}
+	// each Block spends every output of the Block before it, so the
+	// unspent amount is the last Block's outputs
+	check := func(chain []*block.Block) {
+		t.Helper()
+		var wantMinted, wantSpent uint64
+		for i, b := range chain {
+			wantMinted += outputs(b)
+			if i > 0 {
+				wantSpent += outputs(chain[i-1])
+			}
+		}
+		minted, spent := bc.Supply()
+		if minted != wantMinted || spent != wantSpent {
+			t.Errorf("supply is {%v} minted, {%v} spent, want {%v}, {%v}", minted, spent, wantMinted, wantSpent)
+		}
+		if unspent := outputs(chain[len(chain)-1]); minted-spent != unspent {
+			t.Errorf("supply leaves {%v} unspent, want {%v}", minted-spent, unspent)
+		}
+	}
+	active := append([]*block.Block{genesis}, extend(t, bc, genesis, 2)...)
+	check(active)
+	// a longer fork from the genesis Block undoes both active Blocks
+	fork := []*block.Block{genesis}
+	for i := 0; i < 3; i++ {
+		b := test.MakeBlockFromPrev(fork[i])
+		b.Header.Nonce = 1
+		bc.HandleBlock(b)
+		fork = append(fork, b)
+	}
+	if bc.LastHash != fork[3].Hash() {
+		t.Fatal("the longer fork did not become the active chain")
+	}
+	check(fork)
+}
+
+func TestBlockProvenance(t *testing.T) {
+	inTempDir(t)
+	config := DefaultConfig()
+	config.InitialSubsidy = 1000
+	bc := newTestChain(t, config)
+	genesis := bc.LastBlock
+	start := time.Now().UnixNano()
+	active := test.MakeBlockFromPrev(genesis)
+	bc.HandleBlockFrom(active, "peer-1")
+	// a side Block records its provenance too
+	side := test.MakeBlockFromPrev(genesis)
+	side.Header.Nonce = 1
+	bc.HandleBlockFrom(side, "peer-2")
+	end := time.Now().UnixNano()
+	for _, tc := range []struct {
+		b    *block.Block
+		peer string
+	}{{active, "peer-1"}, {side, "peer-2"}} {
+		br, err := bc.BlockInfoDB.GetBlockRecord(tc.b.Hash())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if br.SourcePeer != tc.peer {
+			t.Errorf("block {%v} has source peer %q, want %q", tc.b.Hash(), br.SourcePeer, tc.peer)
+		}
+		if br.ReceivedAt < start || br.ReceivedAt > end {
+			t.Errorf("block {%v} was received at %v, want between %v and %v", tc.b.Hash(), br.ReceivedAt, start, end)
+		}
+	}
+}
+
+func TestIterateDescending(t *testing.T) {
+	inTempDir(t)
+	config := DefaultConfig()
+	config.InitialSubsidy = 1000
+	bc := newTestChain(t, config)
+	genesis := bc.LastBlock
+	blocks := append([]*block.Block{genesis}, extend(t, bc, genesis, 4)...)
+	// collect returns the heights visited from a height, stopping after
+	// limit Blocks if limit is non-zero
+	collect := func(from uint32, limit int) []uint32 {
+		t.Helper()
+		var heights []uint32
+		err := bc.IterateDescending(from, func(b *block.Block, height uint32) bool {
+			if b.Hash() != blocks[height-1].Hash() {
+				t.Errorf("block at height %v is {%v}, want {%v}", height, b.Hash(), blocks[height-1].Hash())
+			}
+			heights = append(heights, height)
+			return limit == 0 || len(heights) < limit
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return heights
+	}
+	for _, tc := range []struct {
+		from  uint32
+		limit int
+		want  []uint32
+	}{
+		{0, 0, []uint32{5, 4, 3, 2, 1}},
+		{3, 0, []uint32{3, 2, 1}},
+		{0, 2, []uint32{5, 4}},
+		{4, 1, []uint32{4}},
+	} {
+		if got := collect(tc.from, tc.limit); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("iterating from %v with limit %v visited %v, want %v", tc.from, tc.limit, got, tc.want)
+		}
+	}
+	if err := bc.IterateDescending(6, func(*block.Block, uint32) bool { return true }); err == nil {
+		t.Error("iterated from above the last block")
+	}
+}
+
+func TestUndoBlockAtOffsetZero(t *testing.T) {
+	inTempDir(t)
+	config := DefaultConfig()
+	config.InitialSubsidy = 1000
+	bc := newTestChain(t, config)
+	genesis := bc.LastBlock
+	b := extend(t, bc, genesis, 1)[0]
+	// the genesis Block spends nothing, so the first UndoBlock written is
+	// this Block's, at the start of the first undo file
+	br, err := bc.BlockInfoDB.GetBlockRecord(b.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !br.HasUndo || br.UndoFileNumber != 0 || br.UndoStartOffset != 0 {
+		t.Fatalf("block has undo %v in file %v at offset %v, want an undo block in file 0 at offset 0", br.HasUndo, br.UndoFileNumber, br.UndoStartOffset)
+	}
+	ub, err := bc.getUndoBlock(b, b.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ub.Amounts) != 1 || ub.Amounts[0] != genesis.Transactions[0].Outputs[0].Amount {
+		t.Errorf("read undo block with amounts %v, want the genesis output's", ub.Amounts)
+	}
+	// while the genesis Block has none
+	br, err = bc.BlockInfoDB.GetBlockRecord(genesis.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if br.HasUndo {
+		t.Error("genesis block has an undo block")
+	}
+	if ub, err := bc.getUndoBlock(genesis, genesis.Hash()); err != nil || len(ub.Amounts) != 0 {
+		t.Errorf("got undo block %v and error %v for the genesis block, want an empty one", ub, err)
+	}
+}
+
+func TestConnectBlockChecksHeight(t *testing.T) {
+	inTempDir(t)
+	config := DefaultConfig()
+	config.InitialSubsidy = 1000
+	bc := newTestChain(t, config)
+	genesis := bc.LastBlock
+	// a genesis Block is at height 1
+	if err := bc.checkHeight(genesis, genesis.Hash(), 1); err != nil {
+		t.Errorf("genesis block at height 1 returned %v", err)
+	}
+	if err := bc.checkHeight(genesis, genesis.Hash(), 0); !errors.Is(err, ErrHeightMismatch) {
+		t.Errorf("genesis block at height 0 returned %v, want ErrHeightMismatch", err)
+	}
+	b := test.MakeBlockFromPrev(genesis)
+	for _, height := range []uint32{1, 3} {
+		if err := bc.connectBlock(b, b.Hash(), height, provenance{}); !errors.Is(err, ErrHeightMismatch) {
+			t.Errorf("connecting a block at height %v returned %v, want ErrHeightMismatch", height, err)
+		}
+	}
+	// nothing is stored for a Block given the wrong height
+	if _, err := bc.BlockInfoDB.GetBlockRecord(b.Hash()); err == nil {
+		t.Error("block given the wrong height has a block record")
+	}
+	coin, err := bc.CoinDB.GetCoin(coindatabase.CoinLocator{ReferenceTransactionHash: b.Transactions[0].Hash(), OutputIndex: 0})
+	if err != nil || coin != nil {
+		t.Errorf("got coin %v and error %v for a block given the wrong height, want none", coin, err)
+	}
+	if err := bc.connectBlock(b, b.Hash(), 2, provenance{}); err != nil {
+		t.Fatalf("connecting a block at height 2 returned %v", err)
+	}
+	br, err := bc.BlockInfoDB.GetBlockRecord(b.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if br.Height != 2 {
+		t.Errorf("block record has height %v, want 2", br.Height)
+	}
+}
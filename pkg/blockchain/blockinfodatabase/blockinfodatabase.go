@@ -3,63 +3,329 @@
 // Key - hash(Block), Value - BlockRecord (serialized with protocol buffer)
 // In addition, each BlockRecord contains storage information for an UndoBlock,
 // which provides additional information to revert a Block, should a fork occur.
+// A height index, keyed by "height:<height>", lists the hashes of the Blocks at each height.
+// An optional transaction index, keyed by "tx:<hash>", maps Transaction hashes to the Blocks containing them.
 package blockinfodatabase
 
 import (
+	"Chain/pkg/block"
+	"Chain/pkg/blockchain/kvstore"
 	"Chain/pkg/pro"
 	"Chain/pkg/utils"
+	"errors"
+	"fmt"
 	"google.golang.org/protobuf/proto"
-
-	"github.com/syndtr/goleveldb/leveldb"
 )
 
-// BlockInfoDatabase is a wrapper for a levelDB
+// BlockInfoDatabase is a wrapper for a KVStore, a levelDB by default.
+// cache holds recently used BlockRecords, evicted in insertion order
+// once it holds cacheCapacity of them.
 type BlockInfoDatabase struct {
-	db *leveldb.DB
+	db kvstore.KVStore
+
+	cache         map[block.BlockHash]*BlockRecord
+	cacheOrder    []block.BlockHash
+	cacheCapacity int
 }
 
-// New returns a BlockInfoDatabase given a Config
-func New(config *Config) *BlockInfoDatabase {
-	db, err := leveldb.OpenFile(config.DatabasePath, nil)
+// New returns a BlockInfoDatabase given a Config, storing BlockRecords in a
+// levelDB at the Config's DatabasePath. It returns an error if the
+// levelDB cannot be opened, wrapping kvstore.ErrLocked if another
+// process has it open.
+func New(config *Config) (*BlockInfoDatabase, error) {
+	db, err := kvstore.OpenLevelDB(config.DatabasePath, config.RecoverFromLock)
 	if err != nil {
-		utils.Debug.Printf("Unable to initialize BlockInfoDatabase with path {%v}", config.DatabasePath)
+		return nil, fmt.Errorf("[blockinfodatabase.New] %w", err)
+	}
+	if len(config.KeyPrefix) > 0 {
+		return newWithStore(kvstore.NewPrefixed(db, config.KeyPrefix, true), config), nil
+	}
+	return newWithStore(db, config), nil
+}
+
+// NewWithStore returns a BlockInfoDatabase given a Config, storing
+// BlockRecords in a KVStore. The Config's DatabasePath is ignored.
+// If the Config has a KeyPrefix, the KVStore is assumed to be shared,
+// and is left open by Close.
+func NewWithStore(db kvstore.KVStore, config *Config) *BlockInfoDatabase {
+	if len(config.KeyPrefix) > 0 {
+		db = kvstore.NewPrefixed(db, config.KeyPrefix, false)
+	}
+	return newWithStore(db, config)
+}
+
+// newWithStore returns a BlockInfoDatabase given a Config, storing
+// BlockRecords in a KVStore that any KeyPrefix has already been
+// applied to.
+func newWithStore(db kvstore.KVStore, config *Config) *BlockInfoDatabase {
+	return &BlockInfoDatabase{
+		db:            db,
+		cache:         make(map[block.BlockHash]*BlockRecord),
+		cacheCapacity: config.CacheCapacity,
+	}
+}
+
+// Close closes the db. A KVStore shared through a KeyPrefix is left
+// open.
+func (blockInfoDB *BlockInfoDatabase) Close() error {
+	return blockInfoDB.db.Close()
+}
+
+// cacheBlockRecord adds a BlockRecord to the cache, evicting the oldest
+// cached BlockRecord if the cache is full.
+func (blockInfoDB *BlockInfoDatabase) cacheBlockRecord(hash block.BlockHash, br *BlockRecord) {
+	if blockInfoDB.cacheCapacity <= 0 {
+		return
+	}
+	if _, ok := blockInfoDB.cache[hash]; !ok {
+		if len(blockInfoDB.cacheOrder) >= blockInfoDB.cacheCapacity {
+			delete(blockInfoDB.cache, blockInfoDB.cacheOrder[0])
+			blockInfoDB.cacheOrder = blockInfoDB.cacheOrder[1:]
+		}
+		blockInfoDB.cacheOrder = append(blockInfoDB.cacheOrder, hash)
+	}
+	cached := *br
+	blockInfoDB.cache[hash] = &cached
+}
+
+// uncacheBlockRecord removes a BlockRecord from the cache, if it is there.
+func (blockInfoDB *BlockInfoDatabase) uncacheBlockRecord(hash block.BlockHash) {
+	if _, ok := blockInfoDB.cache[hash]; !ok {
+		return
+	}
+	delete(blockInfoDB.cache, hash)
+	for i, h := range blockInfoDB.cacheOrder {
+		if h == hash {
+			blockInfoDB.cacheOrder = append(blockInfoDB.cacheOrder[:i], blockInfoDB.cacheOrder[i+1:]...)
+			break
+		}
 	}
-	return &BlockInfoDatabase{db: db}
 }
 
-// StoreBlockRecord stores a block record in the block info database.
+// StoreBlockRecord stores a block record in the block info database,
+// overwriting any BlockRecord already stored for the hash.
 //
 //  1. encode the BlockRecord as a protobuf
 //  2. convert the protobuf to the correct format and type (byte[]) so that it can be inserted into the database
-//  3. put the block record into the database
-func (blockInfoDB *BlockInfoDatabase) StoreBlockRecord(hash string, blockRecord *BlockRecord) {
+//  3. put the block record into the database, along with its hash in
+//     the height index
+func (blockInfoDB *BlockInfoDatabase) StoreBlockRecord(hash block.BlockHash, blockRecord *BlockRecord) {
+	if err := blockInfoDB.storeBlockRecord(hash, blockRecord); err != nil {
+		utils.Debug.Println("Failed to store block record to block info database: ", err)
+	}
+}
+
+// ErrRecordExists is returned by StoreBlockRecordIfAbsent when a
+// BlockRecord is already stored for a hash.
+var ErrRecordExists = errors.New("block record already exists")
+
+// StoreBlockRecordIfAbsent stores a BlockRecord like StoreBlockRecord,
+// unless a BlockRecord is already stored for the hash, in which case it
+// returns an error wrapping ErrRecordExists and leaves the stored
+// BlockRecord unchanged. Since Block hashes are unique, this catches a
+// Block being processed twice. It also returns an error if the
+// BlockRecord cannot be stored.
+func (blockInfoDB *BlockInfoDatabase) StoreBlockRecordIfAbsent(hash block.BlockHash, blockRecord *BlockRecord) error {
+	exists, err := blockInfoDB.db.Has([]byte(hash))
+	if err != nil {
+		return fmt.Errorf("[StoreBlockRecordIfAbsent] failed to check for block record {%v}: %w", hash, err)
+	}
+	if exists {
+		return fmt.Errorf("[StoreBlockRecordIfAbsent] block {%v}: %w", hash, ErrRecordExists)
+	}
+	if err := blockInfoDB.storeBlockRecord(hash, blockRecord); err != nil {
+		return fmt.Errorf("[StoreBlockRecordIfAbsent] %w", err)
+	}
+	return nil
+}
+
+// storeBlockRecord writes a BlockRecord and its entry in the height
+// index to the db in a single batch.
+func (blockInfoDB *BlockInfoDatabase) storeBlockRecord(hash block.BlockHash, blockRecord *BlockRecord) error {
 	encodedBlock := EncodeBlockRecord(blockRecord)
 	// https://protobuf.dev/getting-started/gotutorial/#writing-a-message
 	serialized, err := proto.Marshal(encodedBlock)
 	if err != nil {
-		utils.Debug.Println("Failed to serialize block record: ", err)
+		return fmt.Errorf("failed to serialize block record {%v}: %w", hash, err)
 	}
-	if err := blockInfoDB.db.Put([]byte(hash), serialized, nil); err != nil {
-		utils.Debug.Println("Failed to store block record to block info database: ", err)
+	batch := new(kvstore.Batch)
+	batch.Put([]byte(hash), appendChecksum(serialized))
+	hashes, err := blockInfoDB.hashesAtHeight(blockRecord.Height)
+	if err != nil {
+		return fmt.Errorf("failed to read height index: %w", err)
+	}
+	if !containsHash(hashes, hash) {
+		if err := putHashesAtHeight(batch, blockRecord.Height, append(hashes, hash)); err != nil {
+			return fmt.Errorf("failed to update height index: %w", err)
+		}
+	}
+	if err := blockInfoDB.db.Write(batch); err != nil {
+		blockInfoDB.uncacheBlockRecord(hash)
+		return fmt.Errorf("failed to write block record {%v}: %w", hash, err)
+	}
+	if _, ok := blockInfoDB.cache[hash]; ok {
+		blockInfoDB.cacheBlockRecord(hash, blockRecord)
+	}
+	return nil
+}
+
+// RemoveBlockRecord removes the BlockRecord for a block hash, if there
+// is one.
+func (blockInfoDB *BlockInfoDatabase) RemoveBlockRecord(hash block.BlockHash) error {
+	batch := new(kvstore.Batch)
+	batch.Delete([]byte(hash))
+	br, err := blockInfoDB.getBlockRecord(hash)
+	if err == nil {
+		hashes, err := blockInfoDB.hashesAtHeight(br.Height)
+		if err != nil {
+			return fmt.Errorf("[RemoveBlockRecord] %w", err)
+		}
+		var remaining []block.BlockHash
+		for _, h := range hashes {
+			if h != hash {
+				remaining = append(remaining, h)
+			}
+		}
+		if err := putHashesAtHeight(batch, br.Height, remaining); err != nil {
+			return fmt.Errorf("[RemoveBlockRecord] %w", err)
+		}
+	}
+	if err := blockInfoDB.db.Write(batch); err != nil {
+		return fmt.Errorf("[RemoveBlockRecord] failed to remove block record {%v}: %w", hash, err)
 	}
+	blockInfoDB.uncacheBlockRecord(hash)
+	return nil
+}
+
+// Reset deletes every BlockRecord and the height index, leaving the
+// db open and ready for reuse.
+func (blockInfoDB *BlockInfoDatabase) Reset() error {
+	batch := new(kvstore.Batch)
+	iter := blockInfoDB.db.NewIterator()
+	for iter.Next() {
+		batch.Delete(append([]byte{}, iter.Key()...))
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return fmt.Errorf("[Reset] failed to iterate db: %w", err)
+	}
+	if err := blockInfoDB.db.Write(batch); err != nil {
+		return fmt.Errorf("[Reset] failed to delete block records: %w", err)
+	}
+	blockInfoDB.cache = make(map[block.BlockHash]*BlockRecord)
+	blockInfoDB.cacheOrder = nil
+	return nil
 }
 
 // GetBlockRecord returns a BlockRecord from the BlockInfoDatabase given
-// the relevant block's hash.
+// the relevant block's hash. It returns an error wrapping
+// kvstore.ErrNotFound if there is no such BlockRecord, or an error
+// wrapping ErrChecksumMismatch or a *pro.UnmarshalError if the stored
+// BlockRecord is corrupt.
 //
 //  1. retrieve the block record from the database
 //  2. Convert the byte[] returned by the database to a protobuf
 //  3. convert the protobuf back into a BlockRecord
-func (blockInfoDB *BlockInfoDatabase) GetBlockRecord(hash string) *BlockRecord {
-	data, err := blockInfoDB.db.Get([]byte(hash), nil)
+func (blockInfoDB *BlockInfoDatabase) GetBlockRecord(hash block.BlockHash) (*BlockRecord, error) {
+	br, _, err := blockInfoDB.getCachedBlockRecord(hash)
+	if err != nil {
+		return nil, fmt.Errorf("[GetBlockRecord] %w", err)
+	}
+	return br, nil
+}
+
+// GetBlockRecordCached is GetBlockRecord, additionally reporting whether
+// the BlockRecord was found in the cache rather than read from the db.
+func (blockInfoDB *BlockInfoDatabase) GetBlockRecordCached(hash block.BlockHash) (*BlockRecord, bool, error) {
+	br, hit, err := blockInfoDB.getCachedBlockRecord(hash)
+	if err != nil {
+		return nil, false, fmt.Errorf("[GetBlockRecordCached] %w", err)
+	}
+	return br, hit, nil
+}
+
+// getCachedBlockRecord returns a copy of a BlockRecord from the cache if
+// it is there, or from the db otherwise, caching it. The bool reports
+// whether the BlockRecord was found in the cache.
+func (blockInfoDB *BlockInfoDatabase) getCachedBlockRecord(hash block.BlockHash) (*BlockRecord, bool, error) {
+	if cached, ok := blockInfoDB.cache[hash]; ok {
+		br := *cached
+		return &br, true, nil
+	}
+	br, err := blockInfoDB.getBlockRecord(hash)
+	if err != nil {
+		return nil, false, err
+	}
+	blockInfoDB.cacheBlockRecord(hash, br)
+	return br, false, nil
+}
+
+// GetBlockRecords returns the BlockRecords for a slice of block hashes,
+// keyed by hash. Hashes that are not in the BlockInfoDatabase are
+// omitted from the result.
+func (blockInfoDB *BlockInfoDatabase) GetBlockRecords(hashes []block.BlockHash) (map[block.BlockHash]*BlockRecord, error) {
+	records := make(map[block.BlockHash]*BlockRecord, len(hashes))
+	for _, hash := range hashes {
+		if _, ok := records[hash]; ok {
+			continue
+		}
+		br, err := blockInfoDB.getBlockRecord(hash)
+		if errors.Is(err, kvstore.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("[GetBlockRecords] %w", err)
+		}
+		records[hash] = br
+	}
+	return records, nil
+}
+
+// GetHeader returns the Header of a Block given its hash. The Header is
+// read from the Block's BlockRecord, so the Block itself is not read
+// from Disk.
+func (blockInfoDB *BlockInfoDatabase) GetHeader(hash block.BlockHash) (*block.Header, error) {
+	br, err := blockInfoDB.getBlockRecord(hash)
+	if err != nil {
+		return nil, fmt.Errorf("[GetHeader] %w", err)
+	}
+	return br.Header, nil
+}
+
+// containsHash returns whether a slice of hashes contains a hash.
+func containsHash(hashes []block.BlockHash, hash block.BlockHash) bool {
+	for _, h := range hashes {
+		if h == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// getBlockRecord returns a BlockRecord from the db given the relevant
+// block's hash. It returns kvstore.ErrNotFound if there is no such
+// BlockRecord, or an error wrapping ErrChecksumMismatch if the stored
+// BlockRecord does not match its checksum.
+func (blockInfoDB *BlockInfoDatabase) getBlockRecord(hash block.BlockHash) (*BlockRecord, error) {
+	data, err := blockInfoDB.db.Get([]byte(hash))
+	if errors.Is(err, kvstore.ErrNotFound) {
+		return nil, err
+	}
 	if err != nil {
-		utils.Debug.Println("Failed to retrieve the block record from database: ", err)
+		return nil, fmt.Errorf("failed to retrieve block record {%v}: %w", hash, err)
+	}
+	data, err = verifyChecksum(hash, data)
+	if err != nil {
+		return nil, err
 	}
 	// https://protobuf.dev/getting-started/gotutorial/#reading-a-message
-	deserializedBlock := &pro.BlockRecord{}
-	if err := proto.Unmarshal(data, deserializedBlock); err != nil {
-		utils.Debug.Println("Failed to deserialize block record: ", err)
+	pbr := &pro.BlockRecord{}
+	if err := pro.Unmarshal(string(hash), data, pbr); err != nil {
+		return nil, err
+	}
+	br, err := DecodeBlockRecord(pbr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode block record {%v}: %w", hash, err)
 	}
-	decodedBlock := DecodeBlockRecord(deserializedBlock)
-	return decodedBlock
+	return br, nil
 }
@@ -0,0 +1,349 @@
+package blockinfodatabase
+
+import (
+	"Chain/pkg/block"
+	"Chain/pkg/blockchain/kvstore"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"google.golang.org/protobuf/proto"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newTestDB returns a BlockInfoDatabase backed by an in-memory KVStore,
+// without a cache, so that every read goes to the KVStore.
+func newTestDB() (*BlockInfoDatabase, kvstore.KVStore) {
+	db := kvstore.NewMemoryStore()
+	config := DefaultConfig()
+	config.CacheCapacity = 0
+	return NewWithStore(db, config), db
+}
+
+// testRecord returns a BlockRecord for a Block at height.
+func testRecord(height uint32) *BlockRecord {
+	return &BlockRecord{
+		Header:               &block.Header{PreviousHash: "parent", Nonce: height},
+		Height:               height,
+		NumberOfTransactions: 2,
+		BlockFile:            "block_0.txt",
+		BlockStartOffset:     100,
+		BlockEndOffset:       200,
+		UndoFile:             "undo_0.txt",
+		UndoStartOffset:      10,
+		UndoEndOffset:        20,
+		HasUndo:              true,
+	}
+}
+
+func TestGetBlockRecordDetectsCorruption(t *testing.T) {
+	blockInfoDB, db := newTestDB()
+	blockInfoDB.StoreBlockRecord("hash", testRecord(3))
+	br, err := blockInfoDB.GetBlockRecord("hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if br.Height != 3 || br.BlockEndOffset != 200 {
+		t.Errorf("got block record %v, want height 3 and block end offset 200", br)
+	}
+	data, err := db.Get([]byte("hash"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range data {
+		corrupt := append([]byte{}, data...)
+		corrupt[i] ^= 0x01
+		if err := db.Put([]byte("hash"), corrupt); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := blockInfoDB.GetBlockRecord("hash"); !errors.Is(err, ErrChecksumMismatch) {
+			t.Fatalf("flipping byte {%v} returned %v, want ErrChecksumMismatch", i, err)
+		}
+	}
+}
+
+func TestExportCSV(t *testing.T) {
+	blockInfoDB, _ := newTestDB()
+	blockInfoDB.StoreBlockRecord("b", testRecord(2))
+	blockInfoDB.StoreBlockRecord("a", testRecord(1))
+	noUndo := testRecord(2)
+	noUndo.UndoFile, noUndo.UndoStartOffset, noUndo.UndoEndOffset, noUndo.HasUndo = "", 0, 0, false
+	blockInfoDB.StoreBlockRecord("c", noUndo)
+	var buf bytes.Buffer
+	if err := blockInfoDB.ExportCSV(&buf); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// one row per record, in height order, without the height index
+	want := [][]string{
+		{"1", "a", "block_0.txt", "100", "200", "undo_0.txt", "10", "20"},
+		{"2", "b", "block_0.txt", "100", "200", "undo_0.txt", "10", "20"},
+		{"2", "c", "block_0.txt", "100", "200", "", "", ""},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("exported %v, want %v", rows, want)
+	}
+}
+
+func TestStoreBlockRecordIfAbsent(t *testing.T) {
+	blockInfoDB, _ := newTestDB()
+	if err := blockInfoDB.StoreBlockRecordIfAbsent("hash", testRecord(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := blockInfoDB.StoreBlockRecordIfAbsent("hash", testRecord(2)); !errors.Is(err, ErrRecordExists) {
+		t.Errorf("storing a record twice returned %v, want ErrRecordExists", err)
+	}
+	br, err := blockInfoDB.GetBlockRecord("hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if br.Height != 1 {
+		t.Errorf("refused store changed the record's height to {%v}", br.Height)
+	}
+	// the unguarded store still overwrites
+	blockInfoDB.StoreBlockRecord("hash", testRecord(2))
+	if br, err := blockInfoDB.GetBlockRecord("hash"); err != nil || br.Height != 2 {
+		t.Errorf("got record %v and error %v after overwriting, want height 2", br, err)
+	}
+}
+
+func TestGetBlockRecordRejectsUnknownVersion(t *testing.T) {
+	blockInfoDB, db := newTestDB()
+	pbr := EncodeBlockRecord(testRecord(3))
+	pbr.Version = BlockRecordVersion + 1
+	if br, err := DecodeBlockRecord(pbr); err == nil || !strings.Contains(err.Error(), "version") {
+		t.Errorf("decoded record %v of an unknown version with error %v, want a version error", br, err)
+	}
+	data, err := proto.Marshal(pbr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("hash"), appendChecksum(data)); err != nil {
+		t.Fatal(err)
+	}
+	if br, err := blockInfoDB.GetBlockRecord("hash"); err == nil || !strings.Contains(err.Error(), "version") {
+		t.Errorf("read record %v of an unknown version with error %v, want a version error", br, err)
+	}
+}
+
+func TestGetBlockRecords(t *testing.T) {
+	for _, capacity := range []int{0, 10} {
+		config := DefaultConfig()
+		config.CacheCapacity = capacity
+		blockInfoDB := NewWithStore(kvstore.NewMemoryStore(), config)
+		blockInfoDB.StoreBlockRecord("first", testRecord(1))
+		blockInfoDB.StoreBlockRecord("second", testRecord(2))
+		records, err := blockInfoDB.GetBlockRecords([]block.BlockHash{"first", "missing", "second", "first", "also missing"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		first, second := records["first"], records["second"]
+		if len(records) != 2 || first == nil || first.Height != 1 || second == nil || second.Height != 2 {
+			t.Errorf("with cache capacity %v, got records %v, want first at height 1 and second at height 2", capacity, records)
+		}
+		if records, err := blockInfoDB.GetBlockRecords([]block.BlockHash{"missing"}); err != nil || len(records) != 0 {
+			t.Errorf("with cache capacity %v, got records %v and error %v for missing hashes, want none", capacity, records, err)
+		}
+	}
+}
+
+func TestGetHeader(t *testing.T) {
+	blockInfoDB, _ := newTestDB()
+	br := testRecord(4)
+	br.Header = &block.Header{Version: 1, PreviousHash: "parent", MerkleRoot: "root", DifficultyTarget: "target", Nonce: 4, Timestamp: 1234}
+	blockInfoDB.StoreBlockRecord("hash", br)
+	header, err := blockInfoDB.GetHeader("hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(header, br.Header) {
+		t.Errorf("got header %v, want %v", header, br.Header)
+	}
+	if header, err := blockInfoDB.GetHeader("missing"); !errors.Is(err, kvstore.ErrNotFound) {
+		t.Errorf("got header %v and error %v for a missing block, want ErrNotFound", header, err)
+	}
+}
+
+func TestReset(t *testing.T) {
+	// with a cache, so that Reset must empty it too
+	blockInfoDB := NewWithStore(kvstore.NewMemoryStore(), DefaultConfig())
+	blockInfoDB.StoreBlockRecord("hash", testRecord(1))
+	if _, err := blockInfoDB.GetBlockRecord("hash"); err != nil {
+		t.Fatal(err)
+	}
+	if err := blockInfoDB.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if br, err := blockInfoDB.GetBlockRecord("hash"); !errors.Is(err, kvstore.ErrNotFound) {
+		t.Errorf("got block record %v and error %v after Reset, want ErrNotFound", br, err)
+	}
+	iter := blockInfoDB.db.NewIterator()
+	for iter.Next() {
+		t.Errorf("db holds key %q after Reset", iter.Key())
+	}
+	iter.Release()
+	blockInfoDB.StoreBlockRecord("hash", testRecord(2))
+	if br, err := blockInfoDB.GetBlockRecord("hash"); err != nil || br.Height != 2 {
+		t.Errorf("got block record %v and error %v stored after Reset, want height 2", br, err)
+	}
+}
+
+func TestGetBlockRecordCached(t *testing.T) {
+	config := DefaultConfig()
+	config.CacheCapacity = 1
+	blockInfoDB := NewWithStore(kvstore.NewMemoryStore(), config)
+	blockInfoDB.StoreBlockRecord("first", testRecord(1))
+	blockInfoDB.StoreBlockRecord("second", testRecord(2))
+	for _, want := range []struct {
+		hash   block.BlockHash
+		height uint32
+		cached bool
+	}{
+		{"first", 1, false},
+		{"first", 1, true},
+		// the cache holds one record, so reading another evicts the first
+		{"second", 2, false},
+		{"second", 2, true},
+		{"first", 1, false},
+	} {
+		br, cached, err := blockInfoDB.GetBlockRecordCached(want.hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cached != want.cached || br.Height != want.height {
+			t.Errorf("got block record at height %v, cached %v for %v, want height %v, cached %v", br.Height, cached, want.hash, want.height, want.cached)
+		}
+	}
+	// without a cache, no read is a hit
+	uncached, _ := newTestDB()
+	uncached.StoreBlockRecord("first", testRecord(1))
+	for i := 0; i < 2; i++ {
+		if _, cached, err := uncached.GetBlockRecordCached("first"); err != nil || cached {
+			t.Errorf("got cached %v and error %v without a cache", cached, err)
+		}
+	}
+}
+
+func TestBlockRecordOffsetsPastFourGiB(t *testing.T) {
+	blockInfoDB, _ := newTestDB()
+	br := testRecord(1)
+	br.BlockStartOffset, br.BlockEndOffset = 5<<30, 5<<30+100
+	br.UndoStartOffset, br.UndoEndOffset = 1<<40, 1<<40+10
+	blockInfoDB.StoreBlockRecord("hash", br)
+	got, err := blockInfoDB.GetBlockRecord("hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.BlockStartOffset != br.BlockStartOffset || got.BlockEndOffset != br.BlockEndOffset || got.UndoStartOffset != br.UndoStartOffset || got.UndoEndOffset != br.UndoEndOffset {
+		t.Errorf("got offsets [%v:%v] and [%v:%v], want [%v:%v] and [%v:%v]", got.BlockStartOffset, got.BlockEndOffset, got.UndoStartOffset, got.UndoEndOffset,
+			br.BlockStartOffset, br.BlockEndOffset, br.UndoStartOffset, br.UndoEndOffset)
+	}
+}
+
+func TestGetHashesAtHeight(t *testing.T) {
+	blockInfoDB, _ := newTestDB()
+	blockInfoDB.StoreBlockRecord("main", testRecord(3))
+	blockInfoDB.StoreBlockRecord("fork", testRecord(3))
+	blockInfoDB.StoreBlockRecord("next", testRecord(4))
+	// storing a record again does not list it twice
+	blockInfoDB.StoreBlockRecord("main", testRecord(3))
+	for _, want := range []struct {
+		height uint32
+		hashes []block.BlockHash
+	}{
+		{3, []block.BlockHash{"main", "fork"}},
+		{4, []block.BlockHash{"next"}},
+		{5, nil},
+	} {
+		hashes, err := blockInfoDB.GetHashesAtHeight(want.height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hashes) != len(want.hashes) || (len(hashes) > 0 && !reflect.DeepEqual(hashes, want.hashes)) {
+			t.Errorf("got hashes %v at height %v, want %v", hashes, want.height, want.hashes)
+		}
+	}
+	if err := blockInfoDB.RemoveBlockRecord("fork"); err != nil {
+		t.Fatal(err)
+	}
+	if hashes, err := blockInfoDB.GetHashesAtHeight(3); err != nil || !reflect.DeepEqual(hashes, []block.BlockHash{"main"}) {
+		t.Errorf("got hashes %v and error %v after removing a fork, want [main]", hashes, err)
+	}
+}
+
+func TestBlockRecordString(t *testing.T) {
+	br := testRecord(7)
+	var dump map[string]interface{}
+	if err := json.Unmarshal([]byte(br.String()), &dump); err != nil {
+		t.Fatalf("dump %v is not JSON: %v", br, err)
+	}
+	for field, want := range map[string]interface{}{
+		"Height":           7.0,
+		"BlockFile":        "block_0.txt",
+		"BlockStartOffset": 100.0,
+		"BlockEndOffset":   200.0,
+		"UndoFile":         "undo_0.txt",
+		"UndoStartOffset":  10.0,
+		"UndoEndOffset":    20.0,
+	} {
+		if got, ok := dump[field]; !ok || got != want {
+			t.Errorf("dump has %v %v, want %v", field, got, want)
+		}
+	}
+	// the Header is rendered field by field rather than as a protobuf
+	header, ok := dump["Header"].(map[string]interface{})
+	if !ok || header["PreviousHash"] != "parent" || header["Nonce"] != 7.0 {
+		t.Errorf("dump has header %v, want previous hash parent and nonce 7", dump["Header"])
+	}
+}
+
+func TestProvenanceRoundTrip(t *testing.T) {
+	blockInfoDB, _ := newTestDB()
+	br := testRecord(4)
+	br.ReceivedAt = 1_700_000_000_123_456_789
+	br.SourcePeer = "10.0.0.7:8333"
+	blockInfoDB.StoreBlockRecord("hash", br)
+	got, err := blockInfoDB.GetBlockRecord("hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ReceivedAt != br.ReceivedAt || got.SourcePeer != br.SourcePeer {
+		t.Errorf("read back received at %v from %q, want %v from %q", got.ReceivedAt, got.SourcePeer, br.ReceivedAt, br.SourcePeer)
+	}
+	// both fields are optional
+	blockInfoDB.StoreBlockRecord("bare", testRecord(5))
+	if got, err := blockInfoDB.GetBlockRecord("bare"); err != nil || got.ReceivedAt != 0 || got.SourcePeer != "" {
+		t.Errorf("got record %v and error %v without provenance, want empty fields", got, err)
+	}
+}
+
+func TestHasUndoRoundTrip(t *testing.T) {
+	blockInfoDB, _ := newTestDB()
+	// an UndoBlock at the start of file 0 has all-zero undo offsets
+	atZero := testRecord(1)
+	atZero.UndoFileNumber, atZero.UndoStartOffset = 0, 0
+	noUndo := testRecord(2)
+	noUndo.UndoFile, noUndo.UndoStartOffset, noUndo.UndoEndOffset, noUndo.HasUndo = "", 0, 0, false
+	for hash, want := range map[block.BlockHash]*BlockRecord{"zero": atZero, "none": noUndo} {
+		blockInfoDB.StoreBlockRecord(hash, want)
+		got, err := blockInfoDB.GetBlockRecord(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.HasUndo != want.HasUndo {
+			t.Errorf("record {%v} read back with undo %v, want %v", hash, got.HasUndo, want.HasUndo)
+		}
+	}
+	// records written before HasUndo was kept have an undo block if they
+	// have an undo file
+	old := EncodeBlockRecord(atZero)
+	old.HasUndo = false
+	if br, err := DecodeBlockRecord(old); err != nil || !br.HasUndo {
+		t.Errorf("got record %v and error %v for an old record with an undo file, want an undo block", br, err)
+	}
+}
@@ -3,35 +3,65 @@ package blockinfodatabase
 import (
 	"Chain/pkg/block"
 	"Chain/pkg/pro"
+	"encoding/json"
+	"fmt"
 )
 
+// BlockRecordVersion is the version of the BlockRecord format written
+// to the db. Records of any other version cannot be decoded.
+const BlockRecordVersion uint32 = 0
+
 // BlockRecord contains information about where a Block
 // and its UndoBlock are stored on Disk.
 // Header is the Block's Header.
 // Height is the height of the Block.
 // NumberOfTransactions is the number of Transactions in the Block.
 // BlockFile is the name of the file where the Block is stored.
+// BlockFileNumber is the number of the BlockFile.
 // BlockStartOffset is the starting offset of the Block within the
 // BlockFile.
 // BlockEndOffset is the ending offset of the Block within
 // the BlockFile.
 // UndoFile is the name of the file where the UndoBlock is stored.
+// UndoFileNumber is the number of the UndoFile.
 // UndoStartOffset is the starting offset of the UndoBlock within
 // the UndoFile.
 // UndoEndOffset is the ending offset of the UndoBlock within the
 // UndoFile.
+// HasUndo is whether the Block has an UndoBlock on Disk. The Undo fields
+// are only meaningful if it is set, since a Block without inputs has no
+// UndoBlock, and a pruned UndoBlock is gone.
+// ReceivedAt is when the Block was received, in nanoseconds since the
+// Unix epoch, and SourcePeer is the peer it came from, if known. They
+// record the Block's provenance and do not affect consensus.
 type BlockRecord struct {
 	Header               *block.Header
 	Height               uint32
 	NumberOfTransactions uint32
 
 	BlockFile        string // the name of the file where the Block is stored
-	BlockStartOffset uint32 // the starting offset of the Block within the BlockFile
-	BlockEndOffset   uint32 // the ending offset of the Block within the BlockFile
+	BlockFileNumber  uint32 // the number of the BlockFile
+	BlockStartOffset uint64 // the starting offset of the Block within the BlockFile
+	BlockEndOffset   uint64 // the ending offset of the Block within the BlockFile
 
 	UndoFile        string // the name of the file where the UndoBlock is stored
-	UndoStartOffset uint32 // the starting offset of the UndoBlock within the UndoFile
-	UndoEndOffset   uint32 // the ending offset of the UndoBlock within the UndoFile
+	UndoFileNumber  uint32 // the number of the UndoFile
+	UndoStartOffset uint64 // the starting offset of the UndoBlock within the UndoFile
+	UndoEndOffset   uint64 // the ending offset of the UndoBlock within the UndoFile
+	HasUndo         bool   // whether the Block has an UndoBlock on Disk
+
+	ReceivedAt int64  // when the Block was received, in Unix nanoseconds
+	SourcePeer string // the peer the Block came from, empty if unknown
+}
+
+// String returns the BlockRecord as JSON, with its Header's fields and
+// every offset, so that it can be logged directly.
+func (br *BlockRecord) String() string {
+	data, err := json.Marshal(br)
+	if err != nil {
+		return fmt.Sprintf("{\"error\": %q}", err.Error())
+	}
+	return string(data)
 }
 
 // EncodeBlockRecord returns a pro.BlockRecord given a BlockRecord.
@@ -41,25 +71,42 @@ func EncodeBlockRecord(br *BlockRecord) *pro.BlockRecord {
 		Height:               br.Height,
 		NumberOfTransactions: br.NumberOfTransactions,
 		BlockFile:            br.BlockFile,
+		BlockFileNumber:      br.BlockFileNumber,
 		BlockStartOffset:     br.BlockStartOffset,
 		BlockEndOffset:       br.BlockEndOffset,
 		UndoFile:             br.UndoFile,
+		UndoFileNumber:       br.UndoFileNumber,
 		UndoStartOffset:      br.UndoStartOffset,
 		UndoEndOffset:        br.UndoEndOffset,
+		Version:              BlockRecordVersion,
+		ReceivedAt:           br.ReceivedAt,
+		SourcePeer:           br.SourcePeer,
+		HasUndo:              br.HasUndo,
 	}
 }
 
-// DecodeBlockRecord returns a BlockRecord given a pro.BlockRecord.
-func DecodeBlockRecord(pbr *pro.BlockRecord) *BlockRecord {
+// DecodeBlockRecord returns a BlockRecord given a pro.BlockRecord. It
+// returns an error if the pro.BlockRecord's version is unknown.
+func DecodeBlockRecord(pbr *pro.BlockRecord) (*BlockRecord, error) {
+	if pbr.GetVersion() != BlockRecordVersion {
+		return nil, fmt.Errorf("[DecodeBlockRecord] unknown block record version {%v}, expected {%v}", pbr.GetVersion(), BlockRecordVersion)
+	}
 	return &BlockRecord{
 		Header:               block.DecodeHeader(pbr.GetHeader()),
 		Height:               pbr.GetHeight(),
 		NumberOfTransactions: pbr.GetNumberOfTransactions(),
 		BlockFile:            pbr.GetBlockFile(),
+		BlockFileNumber:      pbr.GetBlockFileNumber(),
 		BlockStartOffset:     pbr.GetBlockStartOffset(),
 		BlockEndOffset:       pbr.GetBlockEndOffset(),
 		UndoFile:             pbr.GetUndoFile(),
+		UndoFileNumber:       pbr.GetUndoFileNumber(),
 		UndoStartOffset:      pbr.GetUndoStartOffset(),
 		UndoEndOffset:        pbr.GetUndoEndOffset(),
-	}
+		ReceivedAt:           pbr.GetReceivedAt(),
+		SourcePeer:           pbr.GetSourcePeer(),
+		// records written before HasUndo was kept have an UndoFile only
+		// if they have an UndoBlock
+		HasUndo: pbr.GetHasUndo() || pbr.GetUndoFile() != "",
+	}, nil
 }
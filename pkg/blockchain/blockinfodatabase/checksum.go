@@ -0,0 +1,41 @@
+package blockinfodatabase
+
+import (
+	"Chain/pkg/block"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// ErrChecksumMismatch is returned when a stored BlockRecord does not
+// match its checksum, meaning the stored value is corrupt.
+var ErrChecksumMismatch = errors.New("block record checksum mismatch")
+
+// checksumSize is the size of the CRC-32 appended to each stored
+// BlockRecord.
+const checksumSize = 4
+
+// appendChecksum returns a serialized BlockRecord followed by its
+// big-endian CRC-32.
+func appendChecksum(data []byte) []byte {
+	sealed := make([]byte, len(data)+checksumSize)
+	copy(sealed, data)
+	binary.BigEndian.PutUint32(sealed[len(data):], crc32.ChecksumIEEE(data))
+	return sealed
+}
+
+// verifyChecksum checks the CRC-32 at the end of a stored BlockRecord,
+// returning the serialized BlockRecord without it. It returns an error
+// wrapping ErrChecksumMismatch if the checksum does not match.
+func verifyChecksum(hash block.BlockHash, data []byte) ([]byte, error) {
+	if len(data) < checksumSize {
+		return nil, fmt.Errorf("%w: block record {%v} is too short", ErrChecksumMismatch, hash)
+	}
+	body := data[:len(data)-checksumSize]
+	stored := binary.BigEndian.Uint32(data[len(data)-checksumSize:])
+	if computed := crc32.ChecksumIEEE(body); computed != stored {
+		return nil, fmt.Errorf("%w: block record {%v} has checksum {%08x}, expected {%08x}", ErrChecksumMismatch, hash, computed, stored)
+	}
+	return body, nil
+}
@@ -1,12 +1,24 @@
 package blockinfodatabase
 
 // Config is the BlockInfoDatabase's configuration options.
+// CacheCapacity is the number of BlockRecords kept in memory, 0 to
+// disable the cache.
+// KeyPrefix, if set, is prepended to every key, so that the
+// BlockInfoDatabase can share a KVStore with other databases.
+// RecoverFromLock makes New rebuild the manifest of a levelDB left
+// corrupt by a crash, instead of returning an error. Despite the name,
+// it cannot open a locked levelDB: only a running process holds the
+// lock, and New returns an error wrapping kvstore.ErrLocked.
 type Config struct {
-	DatabasePath string
+	DatabasePath  string
+	CacheCapacity int
+	KeyPrefix     []byte
+
+	RecoverFromLock bool
 }
 
 // DefaultConfig returns the default configuration for the
 // BlockInfoDatabase.
 func DefaultConfig() *Config {
-	return &Config{DatabasePath: "blockinfodata"}
+	return &Config{DatabasePath: "blockinfodata", CacheCapacity: 100}
 }
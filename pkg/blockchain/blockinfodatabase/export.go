@@ -0,0 +1,80 @@
+package blockinfodatabase
+
+import (
+	"Chain/pkg/block"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// ExportCSV writes every BlockRecord to w as CSV, one row per Block,
+// sorted by height and then hash, for offline analysis. Each row is:
+// height, hash, block file, block start offset, block end offset, undo
+// file, undo start offset, undo end offset. The undo columns are empty
+// for Blocks without an UndoBlock on Disk.
+func (blockInfoDB *BlockInfoDatabase) ExportCSV(w io.Writer) error {
+	var hashes []block.BlockHash
+	iter := blockInfoDB.db.NewIterator()
+	for iter.Next() {
+		// skip the height and transaction indexes
+		if bytes.HasPrefix(iter.Key(), []byte(heightKeyPrefix)) || bytes.HasPrefix(iter.Key(), []byte(txKeyPrefix)) {
+			continue
+		}
+		hashes = append(hashes, block.BlockHash(iter.Key()))
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return fmt.Errorf("[ExportCSV] failed to iterate db: %w", err)
+	}
+	records := make([]*BlockRecord, len(hashes))
+	for i, hash := range hashes {
+		br, err := blockInfoDB.getBlockRecord(hash)
+		if err != nil {
+			return fmt.Errorf("[ExportCSV] %w", err)
+		}
+		records[i] = br
+	}
+	order := make([]int, len(hashes))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		a, b := records[order[i]], records[order[j]]
+		if a.Height != b.Height {
+			return a.Height < b.Height
+		}
+		return hashes[order[i]] < hashes[order[j]]
+	})
+	cw := csv.NewWriter(w)
+	for _, i := range order {
+		if err := cw.Write(csvRow(hashes[i], records[i])); err != nil {
+			return fmt.Errorf("[ExportCSV] failed to write record {%v}: %w", hashes[i], err)
+		}
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return fmt.Errorf("[ExportCSV] failed to write records: %w", err)
+	}
+	return nil
+}
+
+// csvRow returns the CSV row ExportCSV writes for a BlockRecord.
+func csvRow(hash block.BlockHash, br *BlockRecord) []string {
+	row := []string{
+		strconv.FormatUint(uint64(br.Height), 10),
+		string(hash),
+		br.BlockFile,
+		strconv.FormatUint(br.BlockStartOffset, 10),
+		strconv.FormatUint(br.BlockEndOffset, 10),
+		"", "", "",
+	}
+	if br.HasUndo {
+		row[5] = br.UndoFile
+		row[6] = strconv.FormatUint(br.UndoStartOffset, 10)
+		row[7] = strconv.FormatUint(br.UndoEndOffset, 10)
+	}
+	return row
+}
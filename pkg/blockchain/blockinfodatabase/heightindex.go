@@ -0,0 +1,70 @@
+package blockinfodatabase
+
+import (
+	"Chain/pkg/block"
+	"Chain/pkg/blockchain/kvstore"
+	"Chain/pkg/pro"
+	"errors"
+	"fmt"
+	"google.golang.org/protobuf/proto"
+)
+
+// heightKeyPrefix starts the db key of every entry in the height index.
+const heightKeyPrefix = "height:"
+
+// heightKey returns the db key of the hashes of the Blocks at a height.
+// Block hashes are hex strings, so they never collide with it.
+func heightKey(height uint32) []byte {
+	return []byte(fmt.Sprintf("%v%v", heightKeyPrefix, height))
+}
+
+// GetHashesAtHeight returns the hashes of every Block with a BlockRecord
+// at a height, in the order they were stored. During a fork there may be
+// several; which of them is on the active chain is up to the BlockChain.
+func (blockInfoDB *BlockInfoDatabase) GetHashesAtHeight(height uint32) ([]block.BlockHash, error) {
+	hashes, err := blockInfoDB.hashesAtHeight(height)
+	if err != nil {
+		return nil, fmt.Errorf("[GetHashesAtHeight] %w", err)
+	}
+	return hashes, nil
+}
+
+// hashesAtHeight returns the hashes stored in the height index for a
+// height, or nil if there are none.
+func (blockInfoDB *BlockInfoDatabase) hashesAtHeight(height uint32) ([]block.BlockHash, error) {
+	data, err := blockInfoDB.db.Get(heightKey(height))
+	if errors.Is(err, kvstore.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve hashes at height {%v}: %w", height, err)
+	}
+	index := &pro.HeightIndex{}
+	if err := pro.Unmarshal(string(heightKey(height)), data, index); err != nil {
+		return nil, err
+	}
+	hashes := make([]block.BlockHash, len(index.GetHashes()))
+	for i, hash := range index.GetHashes() {
+		hashes[i] = block.BlockHash(hash)
+	}
+	return hashes, nil
+}
+
+// putHashesAtHeight adds a Put of the hashes at a height to a Batch, or
+// a Delete if there are none.
+func putHashesAtHeight(batch *kvstore.Batch, height uint32, hashes []block.BlockHash) error {
+	if len(hashes) == 0 {
+		batch.Delete(heightKey(height))
+		return nil
+	}
+	index := &pro.HeightIndex{Hashes: make([]string, len(hashes))}
+	for i, hash := range hashes {
+		index.Hashes[i] = string(hash)
+	}
+	data, err := proto.Marshal(index)
+	if err != nil {
+		return fmt.Errorf("failed to serialize hashes at height {%v}: %w", height, err)
+	}
+	batch.Put(heightKey(height), data)
+	return nil
+}
@@ -0,0 +1,68 @@
+package blockinfodatabase
+
+import (
+	"Chain/pkg/block"
+	"Chain/pkg/blockchain/kvstore"
+	"errors"
+	"fmt"
+)
+
+// txKeyPrefix starts the db key of every entry in the transaction index,
+// which maps the hash of each indexed Transaction to the hash of the
+// Block containing it.
+const txKeyPrefix = "tx:"
+
+// txKey returns the db key of a Transaction's entry in the transaction
+// index. Block hashes are hex strings, so they never collide with it.
+func txKey(txHash block.TxHash) []byte {
+	return []byte(txKeyPrefix + string(txHash))
+}
+
+// IndexTransactions adds every Transaction of a Block to the transaction
+// index, replacing any entries for the same Transactions, in a single
+// batch.
+func (blockInfoDB *BlockInfoDatabase) IndexTransactions(blockHash block.BlockHash, transactions []*block.Transaction) error {
+	batch := new(kvstore.Batch)
+	for _, tx := range transactions {
+		batch.Put(txKey(tx.Hash()), []byte(blockHash))
+	}
+	if err := blockInfoDB.db.Write(batch); err != nil {
+		return fmt.Errorf("[IndexTransactions] failed to index transactions of block {%v}: %w", blockHash, err)
+	}
+	return nil
+}
+
+// UnindexTransactions removes the Transactions of a Block from the
+// transaction index, in a single batch. Entries that point at another
+// Block, because the Transaction was since indexed there, are kept.
+func (blockInfoDB *BlockInfoDatabase) UnindexTransactions(blockHash block.BlockHash, transactions []*block.Transaction) error {
+	batch := new(kvstore.Batch)
+	for _, tx := range transactions {
+		key := txKey(tx.Hash())
+		data, err := blockInfoDB.db.Get(key)
+		if errors.Is(err, kvstore.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("[UnindexTransactions] failed to read index entry of transaction {%v}: %w", tx.Hash(), err)
+		}
+		if block.BlockHash(data) == blockHash {
+			batch.Delete(key)
+		}
+	}
+	if err := blockInfoDB.db.Write(batch); err != nil {
+		return fmt.Errorf("[UnindexTransactions] failed to unindex transactions of block {%v}: %w", blockHash, err)
+	}
+	return nil
+}
+
+// GetTransactionBlock returns the hash of the Block containing a
+// Transaction, according to the transaction index. It returns an error
+// wrapping kvstore.ErrNotFound if the Transaction is not indexed.
+func (blockInfoDB *BlockInfoDatabase) GetTransactionBlock(txHash block.TxHash) (block.BlockHash, error) {
+	data, err := blockInfoDB.db.Get(txKey(txHash))
+	if err != nil {
+		return "", fmt.Errorf("[GetTransactionBlock] transaction {%v}: %w", txHash, err)
+	}
+	return block.BlockHash(data), nil
+}
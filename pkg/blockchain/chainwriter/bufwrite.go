@@ -0,0 +1,128 @@
+package chainwriter
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+)
+
+// bufferedFile keeps a block or undo file open for appending, holding
+// writes in memory until they are flushed, so that writing many small
+// Blocks does not open and close the file each time.
+type bufferedFile struct {
+	fileName string
+	file     *os.File
+	writer   *bufio.Writer
+}
+
+// openBufferedFile opens a file for buffered appending. As with
+// writeToDisk, the file's size must equal offset.
+func openBufferedFile(fileName string, offset uint64) (*bufferedFile, error) {
+	file, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open file {%v}: %w", fileName, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close() // ignore error; Stat error takes precedence
+		return nil, fmt.Errorf("unable to stat file {%v}: %w", fileName, err)
+	}
+	if info.Size() != int64(offset) {
+		file.Close() // ignore error; size mismatch takes precedence
+		return nil, fmt.Errorf("file {%v} has size {%v} but expected offset {%v}", fileName, info.Size(), offset)
+	}
+	return &bufferedFile{fileName: fileName, file: file, writer: bufio.NewWriter(file)}, nil
+}
+
+// flush writes any buffered data to the file.
+func (bf *bufferedFile) flush() error {
+	if err := bf.writer.Flush(); err != nil {
+		return fmt.Errorf("failed to flush file {%v}: %w", bf.fileName, err)
+	}
+	return nil
+}
+
+// close flushes and closes the file.
+func (bf *bufferedFile) close() error {
+	if err := bf.flush(); err != nil {
+		bf.file.Close() // ignore error; Flush error takes precedence
+		return err
+	}
+	if err := bf.file.Close(); err != nil {
+		return fmt.Errorf("failed to close file {%v}: %w", bf.fileName, err)
+	}
+	return nil
+}
+
+// writeBuffered appends data to a file through *bf, first closing *bf
+// and opening the file if *bf is for a different file, as happens when
+// the ChainWriter moves on to a new file.
+func writeBuffered(bf **bufferedFile, fileName string, offset uint64, data []byte) error {
+	if *bf != nil && (*bf).fileName != fileName {
+		err := (*bf).close()
+		*bf = nil
+		if err != nil {
+			return err
+		}
+	}
+	if *bf == nil {
+		opened, err := openBufferedFile(fileName, offset)
+		if err != nil {
+			return err
+		}
+		*bf = opened
+	}
+	if _, err := (*bf).writer.Write(data); err != nil {
+		return fmt.Errorf("failed to write to file {%v}: %w", fileName, err)
+	}
+	return nil
+}
+
+// write appends data to a block or undo file, through bf if writes are
+// buffered, or directly to Disk otherwise.
+func (cw *ChainWriter) write(bf **bufferedFile, fileName string, offset uint64, data []byte) error {
+	if !cw.buffered {
+		return writeToDisk(fileName, offset, data)
+	}
+	return writeBuffered(bf, fileName, offset, data)
+}
+
+// Flush writes any buffered Blocks and UndoBlocks to Disk. It does
+// nothing if writes are not buffered.
+func (cw *ChainWriter) Flush() error {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	if err := cw.flushBuffers(); err != nil {
+		return fmt.Errorf("[Flush] %w", err)
+	}
+	return nil
+}
+
+// flushBuffers writes any buffered data in the open block and undo
+// files to Disk.
+func (cw *ChainWriter) flushBuffers() error {
+	for _, bf := range []*bufferedFile{cw.blockFile, cw.undoFile} {
+		if bf == nil {
+			continue
+		}
+		if err := bf.flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// closeBuffers flushes and closes the open block and undo files.
+func (cw *ChainWriter) closeBuffers() error {
+	for _, bf := range []**bufferedFile{&cw.blockFile, &cw.undoFile} {
+		if *bf == nil {
+			continue
+		}
+		err := (*bf).close()
+		*bf = nil
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
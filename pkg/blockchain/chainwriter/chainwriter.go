@@ -5,10 +5,14 @@ import (
 	"Chain/pkg/block"
 	"Chain/pkg/blockchain/blockinfodatabase"
 	"Chain/pkg/pro"
-	"Chain/pkg/utils"
+	"errors"
 	"fmt"
-	"log"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 
 	"google.golang.org/protobuf/proto"
 )
@@ -30,56 +34,271 @@ type ChainWriter struct {
 	// block information
 	BlockFileName          string
 	CurrentBlockFileNumber uint32
-	CurrentBlockOffset     uint32
-	MaxBlockFileSize       uint32
+	CurrentBlockOffset     uint64
+	MaxBlockFileSize       uint64
+	blockAlignment         uint64 // the multiple of bytes each Block is padded to, 0 if unpadded
 
 	// undo block information
 	UndoFileName          string
 	CurrentUndoFileNumber uint32
-	CurrentUndoOffset     uint32
-	MaxUndoFileSize       uint32
+	CurrentUndoOffset     uint64
+	MaxUndoFileSize       uint64
+	undoFileHeights       map[uint32]uint32 // the highest Block height with an UndoBlock in each undo file
+	disableUndo           bool              // whether UndoBlocks are not written at all
+
+	// memory-mapped files for reading, nil if reads are not memory-mapped
+	mapped *mappedFiles
+
+	// whether writes are buffered, and the block and undo files open for
+	// buffered writes
+	buffered  bool
+	blockFile *bufferedFile
+	undoFile  *bufferedFile
+
+	// mu guards the file positions and DataDirectory, so that a
+	// relocation never overlaps a write
+	mu sync.Mutex
 }
 
-// New returns a ChainWriter given a Config.
-func New(config *Config) *ChainWriter {
+// ErrUndoDisabled is returned when an UndoBlock is to be written or
+// applied with undo disabled.
+var ErrUndoDisabled = errors.New("undo disabled")
+
+// New returns a ChainWriter given a Config. If the data directory
+// already holds block and undo files, the ChainWriter appends to the
+// highest-numbered of each, after the data already in it. It returns an
+// error if the Config is invalid or the data directory cannot be created
+// or read.
+func New(config *Config) (*ChainWriter, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
 	if err := os.MkdirAll(config.DataDirectory, 0700); err != nil {
-		log.Fatalf("Could not create ChainWriter's data directory")
+		return nil, fmt.Errorf("[chainwriter.New] could not create data directory {%v}: %w", config.DataDirectory, err)
 	}
-	return &ChainWriter{
+	cw := &ChainWriter{
 		FileExtension:          config.FileExtension,
 		DataDirectory:          config.DataDirectory,
 		BlockFileName:          config.BlockFileName,
 		CurrentBlockFileNumber: 0,
 		CurrentBlockOffset:     0,
 		MaxBlockFileSize:       config.MaxBlockFileSize,
+		blockAlignment:         uint64(config.BlockAlignment),
 		UndoFileName:           config.UndoFileName,
 		CurrentUndoFileNumber:  0,
 		CurrentUndoOffset:      0,
 		MaxUndoFileSize:        config.MaxUndoFileSize,
+		undoFileHeights:        make(map[uint32]uint32),
+		disableUndo:            config.DisableUndo,
+		buffered:               config.BufferedWrites,
+	}
+	if err := cw.resume(); err != nil {
+		return nil, err
+	}
+	if config.MmapReads && mmapSupported {
+		cw.mapped = newMappedFiles()
+	}
+	return cw, nil
+}
+
+// resume sets the current block and undo file numbers and offsets to the
+// end of the highest-numbered files already in the DataDirectory, so that
+// writes carry on after them. The heights of the UndoBlocks in existing
+// undo files are not known, so PruneUndoBelow leaves those files alone.
+func (cw *ChainWriter) resume() error {
+	blockNumbers, err := cw.fileNumbers(cw.BlockFileName)
+	if err != nil {
+		return fmt.Errorf("[chainwriter.New] %w", err)
+	}
+	undoNumbers, err := cw.fileNumbers(cw.UndoFileName)
+	if err != nil {
+		return fmt.Errorf("[chainwriter.New] %w", err)
+	}
+	if len(blockNumbers) > 0 {
+		cw.CurrentBlockFileNumber = blockNumbers[len(blockNumbers)-1]
+	}
+	if len(undoNumbers) > 0 {
+		cw.CurrentUndoFileNumber = undoNumbers[len(undoNumbers)-1]
+	}
+	if cw.CurrentBlockOffset, err = fileSize(cw.blockFilePath(cw.CurrentBlockFileNumber)); err != nil {
+		return fmt.Errorf("[chainwriter.New] %w", err)
+	}
+	if cw.CurrentUndoOffset, err = fileSize(cw.undoFilePath(cw.CurrentUndoFileNumber)); err != nil {
+		return fmt.Errorf("[chainwriter.New] %w", err)
+	}
+	return nil
+}
+
+// fileSize returns the size of a file, 0 if it does not exist.
+func fileSize(fileName string) (uint64, error) {
+	info, err := os.Stat(fileName)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("unable to stat file {%v}: %w", fileName, err)
+	}
+	return uint64(info.Size()), nil
+}
+
+// Close writes any buffered Blocks and UndoBlocks to Disk and releases
+// any files held by the ChainWriter.
+func (cw *ChainWriter) Close() error {
+	cw.mu.Lock()
+	err := cw.closeBuffers()
+	cw.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("[Close] %w", err)
+	}
+	if cw.mapped == nil {
+		return nil
+	}
+	return cw.mapped.close()
+}
+
+// Reset deletes every block and undo file written by the ChainWriter and
+// starts writing again from the first block and undo file.
+func (cw *ChainWriter) Reset() error {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	if err := cw.closeBuffers(); err != nil {
+		return fmt.Errorf("[Reset] %w", err)
 	}
+	if cw.mapped != nil {
+		if err := cw.mapped.close(); err != nil {
+			return fmt.Errorf("[Reset] %w", err)
+		}
+	}
+	for _, fileName := range cw.managedFiles() {
+		if err := os.Remove(fileName); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("[Reset] failed to remove file {%v}: %w", fileName, err)
+		}
+	}
+	cw.CurrentBlockFileNumber = 0
+	cw.CurrentBlockOffset = 0
+	cw.CurrentUndoFileNumber = 0
+	cw.CurrentUndoOffset = 0
+	cw.undoFileHeights = make(map[uint32]uint32)
+	return nil
+}
+
+// Relocate moves every block and undo file to newDir, creating it if
+// needed, and makes newDir the DataDirectory. Files are copied and then
+// removed if newDir is on another filesystem. Relocate holds the
+// ChainWriter's lock, so it waits for a write in progress to finish and
+// no write can start until it returns. Files are read from the current
+// DataDirectory, so FileInfos stored before the move stay valid.
+func (cw *ChainWriter) Relocate(newDir string) error {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	if err := cw.closeBuffers(); err != nil {
+		return fmt.Errorf("[Relocate] %w", err)
+	}
+	if err := os.MkdirAll(newDir, 0700); err != nil {
+		return fmt.Errorf("[Relocate] could not create data directory {%v}: %w", newDir, err)
+	}
+	if cw.mapped != nil {
+		if err := cw.mapped.close(); err != nil {
+			return fmt.Errorf("[Relocate] %w", err)
+		}
+	}
+	for _, fileName := range cw.managedFiles() {
+		newName := filepath.Join(newDir, filepath.Base(fileName))
+		if err := moveFile(fileName, newName); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("[Relocate] failed to move file {%v}: %w", fileName, err)
+		}
+	}
+	cw.DataDirectory = newDir
+	return nil
+}
+
+// managedFiles returns the paths of every block and undo file the
+// ChainWriter may have written. Some of them may not exist.
+func (cw *ChainWriter) managedFiles() []string {
+	var fileNames []string
+	for i := uint32(0); i <= cw.CurrentBlockFileNumber; i++ {
+		fileNames = append(fileNames, cw.blockFilePath(i))
+	}
+	for i := uint32(0); i <= cw.CurrentUndoFileNumber; i++ {
+		fileNames = append(fileNames, cw.undoFilePath(i))
+	}
+	return fileNames
+}
+
+// ErrNotWritten is returned when reading past the end of what has been
+// written to the current block or undo file.
+var ErrNotWritten = errors.New("offset not yet written")
+
+// checkWritten returns an error wrapping ErrNotWritten if a FileInfo
+// reaches past the data written to the current block or undo file, such
+// as a Block still being appended by another goroutine. The caller must
+// hold mu.
+func (cw *ChainWriter) checkWritten(fi *FileInfo) error {
+	var written uint64
+	switch filepath.Clean(fi.FileName) {
+	case filepath.Clean(cw.blockFilePath(cw.CurrentBlockFileNumber)):
+		written = cw.CurrentBlockOffset
+	case filepath.Clean(cw.undoFilePath(cw.CurrentUndoFileNumber)):
+		written = cw.CurrentUndoOffset
+	default:
+		return nil
+	}
+	if fi.EndOffset > written {
+		return fmt.Errorf("%w: {%v} ends past offset {%v}", ErrNotWritten, fi, written)
+	}
+	return nil
+}
+
+// readBytes returns the bytes described by a FileInfo, from a memory
+// mapping if reads are memory-mapped, or from Disk otherwise. The file
+// is looked up in the current DataDirectory. Buffered writes are flushed
+// first, so that they can be read. Reads may run concurrently with
+// writes. It returns an error if the FileInfo is invalid.
+func (cw *ChainWriter) readBytes(fi *FileInfo) ([]byte, error) {
+	if err := fi.Validate(); err != nil {
+		return nil, err
+	}
+	cw.mu.Lock()
+	fi = &FileInfo{filepath.Join(cw.DataDirectory, filepath.Base(fi.FileName)), fi.FileNumber, fi.StartOffset, fi.EndOffset}
+	err := cw.checkWritten(fi)
+	if err == nil {
+		err = cw.flushBuffers()
+	}
+	cw.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if cw.mapped != nil {
+		return cw.mapped.read(fi)
+	}
+	return readFromDisk(fi)
 }
 
 // StoreBlock stores a Block and its corresponding UndoBlock to Disk,
 // returning a BlockRecord that contains information for later retrieval.
-func (cw *ChainWriter) StoreBlock(bl *block.Block, undoBlock *UndoBlock, height uint32) *blockinfodatabase.BlockRecord {
+// If undo is disabled, the UndoBlock is ignored. It returns an error if
+// either cannot be serialized or written.
+func (cw *ChainWriter) StoreBlock(bl *block.Block, undoBlock *UndoBlock, height uint32) (*blockinfodatabase.BlockRecord, error) {
 	// serialize block
 	b := block.EncodeBlock(bl)
 	serializedBlock, err := proto.Marshal(b)
 	if err != nil {
-		utils.Debug.Printf("Failed to marshal block")
+		return nil, fmt.Errorf("[StoreBlock] failed to marshal block: %w", err)
+	}
+	var serializedUndoBlock []byte
+	if !cw.disableUndo {
+		serializedUndoBlock, err = serializeUndoBlock(undoBlock)
+		if err != nil {
+			return nil, fmt.Errorf("[StoreBlock] %w", err)
+		}
 	}
-	// serialize undo block
-	ub := EncodeUndoBlock(undoBlock)
-	serializedUndoBlock, err := proto.Marshal(ub)
+	// write block and undo block to disk
+	bfi, ufi, err := cw.WriteBlockAndUndo(serializedBlock, serializedUndoBlock)
 	if err != nil {
-		utils.Debug.Printf("Failed to marshal undo block")
+		return nil, fmt.Errorf("[StoreBlock] %w", err)
 	}
-	// write block to disk
-	bfi := cw.WriteBlock(serializedBlock)
-	// create an empty file info, which we will update if the function is passed an undo block.
-	ufi := &FileInfo{}
-	if undoBlock.Amounts != nil {
-		ufi = cw.WriteUndoBlock(serializedUndoBlock)
+	if serializedUndoBlock != nil {
+		cw.noteUndoHeight(ufi.FileNumber, height)
 	}
 
 	return &blockinfodatabase.BlockRecord{
@@ -87,63 +306,298 @@ func (cw *ChainWriter) StoreBlock(bl *block.Block, undoBlock *UndoBlock, height
 		Height:               height,
 		NumberOfTransactions: uint32(len(bl.Transactions)),
 		BlockFile:            bfi.FileName,
+		BlockFileNumber:      bfi.FileNumber,
 		BlockStartOffset:     bfi.StartOffset,
 		BlockEndOffset:       bfi.EndOffset,
 		UndoFile:             ufi.FileName,
+		UndoFileNumber:       ufi.FileNumber,
 		UndoStartOffset:      ufi.StartOffset,
 		UndoEndOffset:        ufi.EndOffset,
+		HasUndo:              serializedUndoBlock != nil,
+	}, nil
+}
+
+// StoreUndoBlock stores the UndoBlock of the Block at a given height to
+// Disk, returning a FileInfo for later retrieval. If the UndoBlock is
+// empty, nothing is written and an empty FileInfo is returned. It
+// returns an error if the UndoBlock cannot be serialized or written, or
+// ErrUndoDisabled if undo is disabled.
+func (cw *ChainWriter) StoreUndoBlock(undoBlock *UndoBlock, height uint32) (*FileInfo, error) {
+	if cw.disableUndo {
+		return nil, fmt.Errorf("[StoreUndoBlock] %w", ErrUndoDisabled)
+	}
+	serializedUndoBlock, err := serializeUndoBlock(undoBlock)
+	if err != nil {
+		return nil, fmt.Errorf("[StoreUndoBlock] %w", err)
+	}
+	if serializedUndoBlock == nil {
+		return &FileInfo{}, nil
 	}
+	ufi, err := cw.WriteUndoBlock(serializedUndoBlock)
+	if err != nil {
+		return nil, fmt.Errorf("[StoreUndoBlock] %w", err)
+	}
+	cw.noteUndoHeight(ufi.FileNumber, height)
+	return ufi, nil
+}
+
+// serializeUndoBlock returns the serialized UndoBlock, or nil if the
+// UndoBlock is empty and so is not written to Disk.
+func serializeUndoBlock(undoBlock *UndoBlock) ([]byte, error) {
+	if undoBlock.Amounts == nil {
+		return nil, nil
+	}
+	serializedUndoBlock, err := proto.Marshal(EncodeUndoBlock(undoBlock))
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal undo block: %w", err)
+	}
+	return serializedUndoBlock, nil
+}
+
+// noteUndoHeight records that an undo file holds the UndoBlock of the
+// Block at a height, so that PruneUndoBelow keeps it until that height
+// is pruned.
+func (cw *ChainWriter) noteUndoHeight(fileNumber uint32, height uint32) {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	if height > cw.undoFileHeights[fileNumber] {
+		cw.undoFileHeights[fileNumber] = height
+	}
+}
+
+// WriteBlockAndUndo writes a serialized Block and its serialized
+// UndoBlock to Disk, returning a FileInfo for each. A nil
+// serializedUndo is not written, and gets an empty FileInfo. It is the
+// primitive StoreBlock builds on, for callers that keep their own
+// records. If the UndoBlock cannot be written, the Block stays written
+// and its FileInfo is returned along with the error.
+func (cw *ChainWriter) WriteBlockAndUndo(serializedBlock, serializedUndo []byte) (blockFI, undoFI *FileInfo, err error) {
+	blockFI, err = cw.WriteBlock(serializedBlock)
+	if err != nil {
+		return nil, nil, err
+	}
+	if serializedUndo == nil {
+		return blockFI, &FileInfo{}, nil
+	}
+	undoFI, err = cw.WriteUndoBlock(serializedUndo)
+	if err != nil {
+		return blockFI, nil, err
+	}
+	return blockFI, undoFI, nil
+}
+
+// PruneUndoBelow deletes the undo files that only hold UndoBlocks of
+// Blocks below the given height, returning the numbers of the deleted
+// files in ascending order. The current undo file is never deleted.
+func (cw *ChainWriter) PruneUndoBelow(height uint32) ([]uint32, error) {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	var pruned []uint32
+	for fileNumber, maxHeight := range cw.undoFileHeights {
+		if fileNumber == cw.CurrentUndoFileNumber || maxHeight >= height {
+			continue
+		}
+		fileName := cw.undoFilePath(fileNumber)
+		if cw.mapped != nil {
+			if err := cw.mapped.unmap(fileName); err != nil {
+				return nil, fmt.Errorf("[PruneUndoBelow] %w", err)
+			}
+		}
+		if err := os.Remove(fileName); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("[PruneUndoBelow] failed to remove file {%v}: %w", fileName, err)
+		}
+		delete(cw.undoFileHeights, fileNumber)
+		pruned = append(pruned, fileNumber)
+	}
+	sort.Slice(pruned, func(i, j int) bool { return pruned[i] < pruned[j] })
+	return pruned, nil
 }
 
 // WriteBlock writes a serialized Block to Disk and returns
-// a FileInfo for storage information.
-func (cw *ChainWriter) WriteBlock(serializedBlock []byte) *FileInfo {
+// a FileInfo for storage information. It returns an error if the
+// Block cannot be written, in which case the file position is unchanged.
+func (cw *ChainWriter) WriteBlock(serializedBlock []byte) (*FileInfo, error) {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
 	// Before writing a block to a file, check that doing so will not cause the file to be larger than the maximum allowable file size.
 	// If your Block/UndoBlock is too large to store in the current file, you’ll have to update where you’re writing to!
-	blockSize := uint32(len(serializedBlock))
-	if blockSize+cw.CurrentBlockOffset > cw.MaxBlockFileSize {
-		cw.CurrentBlockFileNumber += 1
-		cw.CurrentBlockOffset = 0
+	blockSize := uint64(len(serializedBlock))
+	data := cw.padBlock(serializedBlock)
+	fileNumber, offset := cw.CurrentBlockFileNumber, cw.CurrentBlockOffset
+	if shouldRotate(offset, uint64(len(data)), cw.MaxBlockFileSize) {
+		fileNumber += 1
+		offset = 0
 	}
-	// https://stackoverflow.com/questions/11123865/format-a-go-string-without-printing
-	// dataDirectory/fileName_fileNumber.<file extension>
-	fileName := fmt.Sprintf("%v/%v_%v%v", cw.DataDirectory, cw.BlockFileName, cw.CurrentBlockFileNumber, cw.FileExtension)
-	writeToDisk(fileName, serializedBlock)
-	cw.CurrentBlockOffset += blockSize
-	return &FileInfo{fileName, cw.CurrentBlockOffset - blockSize, cw.CurrentBlockOffset}
+	fileName := cw.blockFilePath(fileNumber)
+	if err := cw.write(&cw.blockFile, fileName, offset, data); err != nil {
+		return nil, fmt.Errorf("[WriteBlock] %w", err)
+	}
+	cw.CurrentBlockFileNumber = fileNumber
+	cw.CurrentBlockOffset = offset + uint64(len(data))
+	// the FileInfo ends at the end of the Block, so reads skip the padding
+	return &FileInfo{fileName, fileNumber, offset, offset + blockSize}, nil
+}
+
+// padBlock returns a serialized Block padded with zeros up to a multiple
+// of blockAlignment, so that the next Block written after it is aligned.
+func (cw *ChainWriter) padBlock(serializedBlock []byte) []byte {
+	size := uint64(len(serializedBlock))
+	if cw.blockAlignment == 0 || size%cw.blockAlignment == 0 {
+		return serializedBlock
+	}
+	padded := make([]byte, (size/cw.blockAlignment+1)*cw.blockAlignment)
+	copy(padded, serializedBlock)
+	return padded
 }
 
 // WriteUndoBlock writes a serialized UndoBlock to Disk and returns
-// a FileInfo for storage information.
-func (cw *ChainWriter) WriteUndoBlock(serializedUndoBlock []byte) *FileInfo {
+// a FileInfo for storage information. It returns an error if the
+// UndoBlock cannot be written, in which case the file position is
+// unchanged.
+func (cw *ChainWriter) WriteUndoBlock(serializedUndoBlock []byte) (*FileInfo, error) {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
 	// Similar to WriteBlock
-	blockSize := uint32(len(serializedUndoBlock))
-	if blockSize+cw.CurrentUndoOffset > cw.MaxUndoFileSize {
-		cw.CurrentUndoFileNumber += 1
-		cw.CurrentUndoOffset = 0
+	blockSize := uint64(len(serializedUndoBlock))
+	fileNumber, offset := cw.CurrentUndoFileNumber, cw.CurrentUndoOffset
+	if shouldRotate(offset, blockSize, cw.MaxUndoFileSize) {
+		fileNumber += 1
+		offset = 0
+	}
+	fileName := cw.undoFilePath(fileNumber)
+	if err := cw.write(&cw.undoFile, fileName, offset, serializedUndoBlock); err != nil {
+		return nil, fmt.Errorf("[WriteUndoBlock] %w", err)
+	}
+	cw.CurrentUndoFileNumber = fileNumber
+	cw.CurrentUndoOffset = offset + blockSize
+	return &FileInfo{fileName, fileNumber, offset, cw.CurrentUndoOffset}, nil
+}
+
+// BlockFileNumbers returns the numbers of the block files in the
+// DataDirectory, in ascending order.
+func (cw *ChainWriter) BlockFileNumbers() ([]uint32, error) {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	numbers, err := cw.fileNumbers(cw.BlockFileName)
+	if err != nil {
+		return nil, fmt.Errorf("[BlockFileNumbers] %w", err)
+	}
+	return numbers, nil
+}
+
+// UndoFileNumbers returns the numbers of the undo files in the
+// DataDirectory, in ascending order.
+func (cw *ChainWriter) UndoFileNumbers() ([]uint32, error) {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	numbers, err := cw.fileNumbers(cw.UndoFileName)
+	if err != nil {
+		return nil, fmt.Errorf("[UndoFileNumbers] %w", err)
+	}
+	return numbers, nil
+}
+
+// Fragmentation returns the total size of the block files in the
+// DataDirectory and how much they could hold, MaxBlockFileSize for each
+// file. Since files are rotated before they are full, usedBytes is less
+// than capacityBytes, and their ratio shows how much space rotation
+// wastes.
+func (cw *ChainWriter) Fragmentation() (usedBytes, capacityBytes uint64, err error) {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	if err := cw.flushBuffers(); err != nil {
+		return 0, 0, fmt.Errorf("[Fragmentation] %w", err)
+	}
+	numbers, err := cw.fileNumbers(cw.BlockFileName)
+	if err != nil {
+		return 0, 0, fmt.Errorf("[Fragmentation] %w", err)
+	}
+	for _, number := range numbers {
+		info, err := os.Stat(cw.blockFilePath(number))
+		if err != nil {
+			return 0, 0, fmt.Errorf("[Fragmentation] %w", err)
+		}
+		usedBytes += uint64(info.Size())
+	}
+	return usedBytes, cw.MaxBlockFileSize * uint64(len(numbers)), nil
+}
+
+// fileNumbers returns the numbers of the files in the DataDirectory
+// named "baseName_<number>.FileExtension", in ascending order. Other
+// files are ignored.
+func (cw *ChainWriter) fileNumbers(baseName string) ([]uint32, error) {
+	entries, err := os.ReadDir(cw.DataDirectory)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read data directory {%v}: %w", cw.DataDirectory, err)
 	}
-	fileName := fmt.Sprintf("%v/%v_%v%v", cw.DataDirectory, cw.UndoFileName, cw.CurrentUndoFileNumber, cw.FileExtension)
-	writeToDisk(fileName, serializedUndoBlock)
-	cw.CurrentUndoOffset += blockSize
-	return &FileInfo{fileName, cw.CurrentUndoOffset - blockSize, cw.CurrentUndoOffset}
+	prefix := baseName + "_"
+	var numbers []uint32
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, cw.FileExtension) {
+			continue
+		}
+		digits := strings.TrimSuffix(strings.TrimPrefix(name, prefix), cw.FileExtension)
+		number, err := strconv.ParseUint(digits, 10, 32)
+		if err != nil || strconv.FormatUint(number, 10) != digits {
+			continue
+		}
+		numbers = append(numbers, uint32(number))
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+	return numbers, nil
+}
+
+// shouldRotate returns whether writing size bytes to a file already
+// holding offset bytes must move on to a new file, because the file is
+// full or the bytes do not fit. A write to an empty file never rotates,
+// so a Block larger than maxSize gets a file to itself instead of
+// leaving empty files behind.
+func shouldRotate(offset uint64, size uint64, maxSize uint64) bool {
+	return offset > 0 && (offset >= maxSize || size > maxSize-offset)
+}
+
+// blockFilePath returns the path of the block file with the given number.
+func (cw *ChainWriter) blockFilePath(fileNumber uint32) string {
+	// https://stackoverflow.com/questions/11123865/format-a-go-string-without-printing
+	// dataDirectory/fileName_fileNumber.<file extension>
+	return fmt.Sprintf("%v/%v_%v%v", cw.DataDirectory, cw.BlockFileName, fileNumber, cw.FileExtension)
 }
 
-// ReadBlock returns a Block given a FileInfo.
-func (cw *ChainWriter) ReadBlock(fi *FileInfo) *block.Block {
-	bytes := readFromDisk(fi)
+// undoFilePath returns the path of the undo file with the given number.
+func (cw *ChainWriter) undoFilePath(fileNumber uint32) string {
+	return fmt.Sprintf("%v/%v_%v%v", cw.DataDirectory, cw.UndoFileName, fileNumber, cw.FileExtension)
+}
+
+// ReadBlock returns a Block given a FileInfo. It returns an error
+// wrapping ErrBlockFileMissing if the Block's file does not exist.
+func (cw *ChainWriter) ReadBlock(fi *FileInfo) (*block.Block, error) {
+	bytes, err := cw.readBytes(fi)
+	if err != nil {
+		return nil, fmt.Errorf("[ReadBlock] %w", err)
+	}
 	pb := &pro.Block{}
-	if err := proto.Unmarshal(bytes, pb); err != nil {
-		utils.Debug.Printf("failed to unmarshal block from file info {%v}", fi)
+	if err := pro.Unmarshal(fi.String(), bytes, pb); err != nil {
+		return nil, fmt.Errorf("[ReadBlock] %w", err)
 	}
-	return block.DecodeBlock(pb)
+	return block.DecodeBlock(pb), nil
 }
 
-// ReadUndoBlock returns an UndoBlock given a FileInfo.
-func (cw *ChainWriter) ReadUndoBlock(fi *FileInfo) *UndoBlock {
-	bytes := readFromDisk(fi)
+// ReadUndoBlock returns an UndoBlock given a FileInfo. It returns an
+// error wrapping ErrBlockFileMissing if the UndoBlock's file does not
+// exist.
+func (cw *ChainWriter) ReadUndoBlock(fi *FileInfo) (*UndoBlock, error) {
+	bytes, err := cw.readBytes(fi)
+	if err != nil {
+		return nil, fmt.Errorf("[ReadUndoBlock] %w", err)
+	}
 	pub := &pro.UndoBlock{}
-	if err := proto.Unmarshal(bytes, pub); err != nil {
-		utils.Debug.Printf("failed to unmarshal undo block from file info {%v}", fi)
+	if err := pro.Unmarshal(fi.String(), bytes, pub); err != nil {
+		return nil, fmt.Errorf("[ReadUndoBlock] %w", err)
+	}
+	ub, err := DecodeUndoBlock(pub)
+	if err != nil {
+		return nil, fmt.Errorf("[ReadUndoBlock] %w", err)
 	}
-	return DecodeUndoBlock(pub)
+	return ub, nil
 }
@@ -0,0 +1,966 @@
+package chainwriter_test
+
+import (
+	"Chain/pkg/block"
+	"Chain/pkg/blockchain/blockinfodatabase"
+	"Chain/pkg/blockchain/chainwriter"
+	"Chain/test"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newTestWriter returns a ChainWriter writing to dir, with files small
+// enough that a few Blocks fill one.
+func newTestWriter(t *testing.T, dir string) *chainwriter.ChainWriter {
+	t.Helper()
+	config := chainwriter.DefaultConfig()
+	config.DataDirectory = dir
+	config.MaxBlockFileSize = 256
+	config.MaxUndoFileSize = 256
+	cw, err := chainwriter.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cw
+}
+
+// readBack reads the Block and UndoBlock described by a BlockRecord and
+// fails the test unless they hash and match as b and ub do.
+func readBack(t *testing.T, cw *chainwriter.ChainWriter, br *blockinfodatabase.BlockRecord, b *block.Block, ub *chainwriter.UndoBlock) {
+	t.Helper()
+	got, err := cw.ReadBlock(&chainwriter.FileInfo{FileName: br.BlockFile, FileNumber: br.BlockFileNumber, StartOffset: br.BlockStartOffset, EndOffset: br.BlockEndOffset})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Hash() != b.Hash() {
+		t.Errorf("read block %v, want %v", got.Hash(), b.Hash())
+	}
+	gotUndo, err := cw.ReadUndoBlock(&chainwriter.FileInfo{FileName: br.UndoFile, FileNumber: br.UndoFileNumber, StartOffset: br.UndoStartOffset, EndOffset: br.UndoEndOffset})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotUndo.Amounts[0] != ub.Amounts[0] {
+		t.Errorf("read undo block with amount %v, want %v", gotUndo.Amounts[0], ub.Amounts[0])
+	}
+}
+
+func TestNewResumesExistingFiles(t *testing.T) {
+	dir := t.TempDir()
+	cw := newTestWriter(t, dir)
+	var blocks []*block.Block
+	var undoBlocks []*chainwriter.UndoBlock
+	var records []*blockinfodatabase.BlockRecord
+	b := test.GenesisBlock()
+	for height := uint32(1); height <= 8; height++ {
+		b = test.MakeBlockFromPrev(b)
+		ub := test.MockedUndoBlock()
+		ub.Amounts[0] = height
+		br, err := cw.StoreBlock(b, ub, height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, b)
+		undoBlocks = append(undoBlocks, ub)
+		records = append(records, br)
+	}
+	if err := cw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	lastFile := cw.CurrentBlockFileNumber
+	if lastFile == 0 {
+		t.Fatalf("blocks fit in one file, so rotation is not tested")
+	}
+
+	// a second ChainWriter on the same directory appends after the first
+	cw = newTestWriter(t, dir)
+	defer cw.Close()
+	if cw.CurrentBlockFileNumber != lastFile {
+		t.Errorf("resumed at block file %v, want %v", cw.CurrentBlockFileNumber, lastFile)
+	}
+	b = test.MakeBlockFromPrev(b)
+	ub := test.MockedUndoBlock()
+	ub.Amounts[0] = 9
+	br, err := cw.StoreBlock(b, ub, 9)
+	if err != nil {
+		t.Fatalf("storing a block after reopening: %v", err)
+	}
+	last := records[len(records)-1]
+	if br.BlockFileNumber == last.BlockFileNumber && br.BlockStartOffset != last.BlockEndOffset {
+		t.Errorf("block written at offset %v, want %v", br.BlockStartOffset, last.BlockEndOffset)
+	}
+	readBack(t, cw, br, b, ub)
+	for i := range blocks {
+		readBack(t, cw, records[i], blocks[i], undoBlocks[i])
+	}
+}
+
+func TestDisableUndoWritesNoUndoFiles(t *testing.T) {
+	config := chainwriter.DefaultConfig()
+	config.DataDirectory = t.TempDir()
+	config.DisableUndo = true
+	cw, err := chainwriter.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cw.Close()
+	b := test.GenesisBlock()
+	for height := uint32(1); height <= 3; height++ {
+		b = test.MakeBlockFromPrev(b)
+		br, err := cw.StoreBlock(b, test.UndoBlockFromBlock(b), height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if br.HasUndo {
+			t.Errorf("block record at height {%v} has an undo block", height)
+		}
+	}
+	if _, err := cw.StoreUndoBlock(test.MockedUndoBlock(), 4); !errors.Is(err, chainwriter.ErrUndoDisabled) {
+		t.Errorf("storing an undo block returned %v, want ErrUndoDisabled", err)
+	}
+	numbers, err := cw.UndoFileNumbers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(numbers) != 0 {
+		t.Errorf("undo files %v were created with undo disabled", numbers)
+	}
+}
+
+// TestConcurrentReadsAndWrites is meant to be run with -race.
+func TestConcurrentReadsAndWrites(t *testing.T) {
+	for _, buffered := range []bool{false, true} {
+		config := chainwriter.DefaultConfig()
+		config.DataDirectory = t.TempDir()
+		config.BufferedWrites = buffered
+		cw, err := chainwriter.New(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored := make(chan *blockinfodatabase.BlockRecord)
+		hashes := make(chan block.BlockHash, 32)
+		go func() {
+			defer close(stored)
+			b := test.GenesisBlock()
+			for height := uint32(1); height <= 32; height++ {
+				b = test.MakeBlockFromPrev(b)
+				br, err := cw.StoreBlock(b, test.UndoBlockFromBlock(b), height)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				hashes <- b.Hash()
+				stored <- br
+			}
+		}()
+		var last *chainwriter.FileInfo
+		for br := range stored {
+			fi := &chainwriter.FileInfo{FileName: br.BlockFile, FileNumber: br.BlockFileNumber, StartOffset: br.BlockStartOffset, EndOffset: br.BlockEndOffset}
+			got, err := cw.ReadBlock(fi)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := <-hashes; got.Hash() != want {
+				t.Errorf("read block %v, want %v", got.Hash(), want)
+			}
+			// the region past the Block may be mid-append, and must not
+			// be read as a Block
+			ahead := *fi
+			ahead.StartOffset = fi.EndOffset
+			ahead.EndOffset = fi.EndOffset + 1<<20
+			if _, err := cw.ReadBlock(&ahead); err == nil {
+				t.Errorf("read a block past the written data at %v", &ahead)
+			}
+			last = fi
+		}
+		// the last Block's file is still the current one
+		ahead := *last
+		ahead.StartOffset = last.EndOffset
+		ahead.EndOffset = last.EndOffset + 1
+		if _, err := cw.ReadBlock(&ahead); !errors.Is(err, chainwriter.ErrNotWritten) {
+			t.Errorf("reading past the written data returned %v, want ErrNotWritten", err)
+		}
+		if err := cw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDirectoryCreationFailureReturnsError(t *testing.T) {
+	// a data directory under a regular file cannot be created
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	config := chainwriter.DefaultConfig()
+	config.DataDirectory = filepath.Join(file, "data")
+	if _, err := chainwriter.New(config); err == nil {
+		t.Error("New succeeded with a data directory under a regular file")
+	}
+	cw := newTestWriter(t, t.TempDir())
+	defer cw.Close()
+	if err := cw.Relocate(filepath.Join(file, "data")); err == nil {
+		t.Error("Relocate succeeded to a directory under a regular file")
+	}
+}
+
+func TestFragmentation(t *testing.T) {
+	cw := newTestWriter(t, t.TempDir())
+	defer cw.Close()
+	var ends []uint64
+	b := test.GenesisBlock()
+	for height := uint32(1); height <= 8; height++ {
+		b = test.MakeBlockFromPrev(b)
+		br, err := cw.StoreBlock(b, test.UndoBlockFromBlock(b), height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the end of the last Block written to each file is its size
+		for uint32(len(ends)) <= br.BlockFileNumber {
+			ends = append(ends, 0)
+		}
+		ends[br.BlockFileNumber] = br.BlockEndOffset
+	}
+	if len(ends) < 2 {
+		t.Fatalf("blocks fit in one file, so rotation is not tested")
+	}
+	var want uint64
+	for _, end := range ends {
+		want += end
+	}
+	used, capacity, err := cw.Fragmentation()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used != want {
+		t.Errorf("got {%v} used bytes, want {%v}", used, want)
+	}
+	if capacity != cw.MaxBlockFileSize*uint64(len(ends)) {
+		t.Errorf("got {%v} capacity bytes for {%v} files of {%v}", capacity, len(ends), cw.MaxBlockFileSize)
+	}
+	if used >= capacity {
+		t.Errorf("rotated files use {%v} of {%v} bytes, want less", used, capacity)
+	}
+}
+
+func TestWriteBlockAndUndo(t *testing.T) {
+	dir := t.TempDir()
+	cw := newTestWriter(t, dir)
+	// undo blocks are larger than blocks, so the undo files rotate first
+	blocks := [][]byte{make([]byte, 100), make([]byte, 100), make([]byte, 100)}
+	undos := [][]byte{make([]byte, 150), make([]byte, 150), nil}
+	want := []struct {
+		blockFile, undoFile     string
+		blockNumber, undoNumber uint32
+		blockStart, undoStart   uint64
+	}{
+		{"block_0.txt", "undo_0.txt", 0, 0, 0, 0},
+		{"block_0.txt", "undo_1.txt", 0, 1, 100, 0},
+		{"block_1.txt", "", 1, 0, 0, 0},
+	}
+	for i := range blocks {
+		blocks[i][0] = byte(i + 1)
+		if undos[i] != nil {
+			undos[i][0] = byte(i + 10)
+		}
+		blockFI, undoFI, err := cw.WriteBlockAndUndo(blocks[i], undos[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := want[i]
+		if blockFI.FileName != filepath.Join(dir, w.blockFile) || blockFI.FileNumber != w.blockNumber || blockFI.StartOffset != w.blockStart || blockFI.EndOffset != w.blockStart+100 {
+			t.Errorf("block %v was written to %v in file %v, want %v[%v:%v] in file %v", i, blockFI, blockFI.FileNumber, w.blockFile, w.blockStart, w.blockStart+100, w.blockNumber)
+		}
+		if undos[i] == nil {
+			if *undoFI != (chainwriter.FileInfo{}) {
+				t.Errorf("got undo FileInfo %v without an undo block, want an empty one", undoFI)
+			}
+			continue
+		}
+		if undoFI.FileName != filepath.Join(dir, w.undoFile) || undoFI.FileNumber != w.undoNumber || undoFI.StartOffset != w.undoStart || undoFI.EndOffset != w.undoStart+150 {
+			t.Errorf("undo block %v was written to %v in file %v, want %v[%v:%v] in file %v", i, undoFI, undoFI.FileNumber, w.undoFile, w.undoStart, w.undoStart+150, w.undoNumber)
+		}
+	}
+	if err := cw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// each FileInfo frames exactly the bytes that were written
+	for i, w := range want {
+		data, err := os.ReadFile(filepath.Join(dir, w.blockFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data[w.blockStart] != byte(i+1) {
+			t.Errorf("block %v does not start at offset %v of %v", i, w.blockStart, w.blockFile)
+		}
+		if undos[i] == nil {
+			continue
+		}
+		data, err = os.ReadFile(filepath.Join(dir, w.undoFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data[w.undoStart] != byte(i+10) {
+			t.Errorf("undo block %v does not start at offset %v of %v", i, w.undoStart, w.undoFile)
+		}
+	}
+}
+
+func TestDecodeUndoBlockRejectsUnknownVersion(t *testing.T) {
+	pub := chainwriter.EncodeUndoBlock(&chainwriter.UndoBlock{
+		TransactionInputHashes: []block.TxHash{"hash"},
+		OutputIndexes:          []uint32{0},
+		Amounts:                []uint32{5},
+		LockingScripts:         []string{"alice"},
+	})
+	pub.Version = chainwriter.UndoBlockVersion + 1
+	if ub, err := chainwriter.DecodeUndoBlock(pub); err == nil || !strings.Contains(err.Error(), "version") {
+		t.Errorf("decoded undo block %v of an unknown version with error %v, want a version error", ub, err)
+	}
+}
+
+func TestRelocate(t *testing.T) {
+	oldDir := t.TempDir()
+	cw := newTestWriter(t, oldDir)
+	defer cw.Close()
+	var blocks []*block.Block
+	var undoBlocks []*chainwriter.UndoBlock
+	var records []*blockinfodatabase.BlockRecord
+	b := test.GenesisBlock()
+	for height := uint32(1); height <= 4; height++ {
+		b = test.MakeBlockFromPrev(b)
+		ub := test.UndoBlockFromBlock(b)
+		br, err := cw.StoreBlock(b, ub, height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blocks, undoBlocks, records = append(blocks, b), append(undoBlocks, ub), append(records, br)
+	}
+	newDir := filepath.Join(t.TempDir(), "moved")
+	if err := cw.Relocate(newDir); err != nil {
+		t.Fatal(err)
+	}
+	if cw.DataDirectory != newDir {
+		t.Errorf("got data directory {%v} after relocating, want {%v}", cw.DataDirectory, newDir)
+	}
+	if left, err := os.ReadDir(oldDir); err != nil || len(left) != 0 {
+		t.Errorf("old data directory holds %v after relocating (error %v)", left, err)
+	}
+	// records stored before the move still read back
+	for i := range blocks {
+		readBack(t, cw, records[i], blocks[i], undoBlocks[i])
+	}
+	// and writing carries on in the new directory
+	b = test.MakeBlockFromPrev(b)
+	br, err := cw.StoreBlock(b, test.UndoBlockFromBlock(b), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(br.BlockFile) != newDir {
+		t.Errorf("wrote block to {%v} after relocating to {%v}", br.BlockFile, newDir)
+	}
+	readBack(t, cw, br, b, test.UndoBlockFromBlock(b))
+}
+
+func TestWriteBlockAndUndoReturnsBlockWhenUndoFails(t *testing.T) {
+	dir := t.TempDir()
+	cw := newTestWriter(t, dir)
+	defer cw.Close()
+	// a directory in place of the undo file makes the undo write fail
+	if err := os.Mkdir(filepath.Join(dir, "undo_0.txt"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	serializedBlock := []byte("block")
+	blockFI, undoFI, err := cw.WriteBlockAndUndo(serializedBlock, []byte("undo"))
+	if err == nil {
+		t.Fatal("wrote an undo block over a directory")
+	}
+	if undoFI != nil {
+		t.Errorf("got undo FileInfo %v for a failed write, want nil", undoFI)
+	}
+	if blockFI == nil {
+		t.Fatal("got no block FileInfo for a block that was written")
+	}
+	if err := cw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(blockFI.FileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(data[blockFI.StartOffset:blockFI.EndOffset]); got != string(serializedBlock) {
+		t.Errorf("block FileInfo frames %q, want %q", got, serializedBlock)
+	}
+}
+
+func TestWriteBlockDetectsTamperedFile(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(fileName string) error
+	}{
+		{"truncated", func(fileName string) error { return os.Truncate(fileName, 2) }},
+		{"extended", func(fileName string) error {
+			file, err := os.OpenFile(fileName, os.O_APPEND|os.O_WRONLY, 0644)
+			if err != nil {
+				return err
+			}
+			if _, err := file.Write([]byte("extra")); err != nil {
+				file.Close() // ignore error; Write error takes precedence
+				return err
+			}
+			return file.Close()
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cw := newTestWriter(t, t.TempDir())
+			defer cw.Close()
+			fi, err := cw.WriteBlock([]byte("block"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.tamper(fi.FileName); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := cw.WriteBlock([]byte("next")); err == nil || !strings.Contains(err.Error(), "expected offset") {
+				t.Errorf("writing to a %v file returned %v, want a size mismatch error", tt.name, err)
+			}
+			if cw.CurrentBlockOffset != fi.EndOffset {
+				t.Errorf("block offset moved to %v after a failed write, want %v", cw.CurrentBlockOffset, fi.EndOffset)
+			}
+		})
+	}
+}
+
+// BenchmarkReadBlock compares random-access reads from memory-mapped
+// files with reads that open and seek the file each time.
+func BenchmarkReadBlock(b *testing.B) {
+	for _, mmap := range []bool{false, true} {
+		name := "file"
+		if mmap {
+			name = "mmap"
+		}
+		b.Run(name, func(b *testing.B) {
+			config := chainwriter.DefaultConfig()
+			config.DataDirectory = b.TempDir()
+			config.MmapReads = mmap
+			cw, err := chainwriter.New(config)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer cw.Close()
+			var infos []*chainwriter.FileInfo
+			bl := test.GenesisBlock()
+			for i := 0; i < 1000; i++ {
+				bl = test.MakeBlockFromPrev(bl)
+				br, err := cw.StoreBlock(bl, test.UndoBlockFromBlock(bl), uint32(i+1))
+				if err != nil {
+					b.Fatal(err)
+				}
+				infos = append(infos, &chainwriter.FileInfo{FileName: br.BlockFile, FileNumber: br.BlockFileNumber, StartOffset: br.BlockStartOffset, EndOffset: br.BlockEndOffset})
+			}
+			r := rand.New(rand.NewSource(1))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := cw.ReadBlock(infos[r.Intn(len(infos))]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// fileSize returns the size of a file on Disk.
+func fileSize(t *testing.T, fileName string) int64 {
+	t.Helper()
+	info, err := os.Stat(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+func TestBufferedWrites(t *testing.T) {
+	config := chainwriter.DefaultConfig()
+	config.DataDirectory = t.TempDir()
+	config.BufferedWrites = true
+	cw, err := chainwriter.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := cw.WriteBlock([]byte("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := fileSize(t, first.FileName); size != 0 {
+		t.Errorf("block file holds %v bytes before Flush, want 0", size)
+	}
+	if err := cw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if size := fileSize(t, first.FileName); size != int64(first.EndOffset) {
+		t.Errorf("block file holds %v bytes after Flush, want %v", size, first.EndOffset)
+	}
+	data, err := os.ReadFile(first.FileName)
+	if err != nil || string(data[first.StartOffset:first.EndOffset]) != "first" {
+		t.Errorf("read %q (error %v) after Flush, want \"first\"", data, err)
+	}
+	second, err := cw.WriteBlock([]byte("second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.StartOffset != first.EndOffset {
+		t.Errorf("second block starts at %v, want %v", second.StartOffset, first.EndOffset)
+	}
+	if size := fileSize(t, second.FileName); size != int64(first.EndOffset) {
+		t.Errorf("block file holds %v bytes before Close, want %v", size, first.EndOffset)
+	}
+	if err := cw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err = os.ReadFile(second.FileName)
+	if err != nil || string(data[second.StartOffset:second.EndOffset]) != "second" {
+		t.Errorf("read %q (error %v) after Close, want \"second\"", data, err)
+	}
+}
+
+// BenchmarkWriteBlock compares buffered writes with writes that open
+// and close the file each time.
+func BenchmarkWriteBlock(b *testing.B) {
+	serializedBlock := make([]byte, 200)
+	for _, buffered := range []bool{false, true} {
+		name := "unbuffered"
+		if buffered {
+			name = "buffered"
+		}
+		b.Run(name, func(b *testing.B) {
+			config := chainwriter.DefaultConfig()
+			config.DataDirectory = b.TempDir()
+			config.BufferedWrites = buffered
+			// one file, so that the benchmark measures writes, not rotation
+			config.MaxBlockFileSize = 1 << 30
+			cw, err := chainwriter.New(config)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.SetBytes(int64(len(serializedBlock)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := cw.WriteBlock(serializedBlock); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if err := cw.Close(); err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestWriteBlockRotatesAtExactBoundary(t *testing.T) {
+	tests := []struct {
+		name        string
+		second      int
+		rotates     bool
+		thirdRotate bool
+	}{
+		{"fills the file exactly", 56, false, true},
+		{"overflows the file by one byte", 57, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cw := newTestWriter(t, t.TempDir())
+			defer cw.Close()
+			if _, err := cw.WriteBlock(make([]byte, 200)); err != nil {
+				t.Fatal(err)
+			}
+			// 256-byte files leave 56 bytes after the first block
+			fi, err := cw.WriteBlock(make([]byte, tt.second))
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantFile, wantStart := uint32(0), uint64(200)
+			if tt.rotates {
+				wantFile, wantStart = 1, 0
+			}
+			if fi.FileNumber != wantFile || fi.StartOffset != wantStart || fi.EndOffset != wantStart+uint64(tt.second) {
+				t.Errorf("wrote %v-byte block to file %v at [%v:%v], want file %v at [%v:%v]", tt.second, fi.FileNumber, fi.StartOffset, fi.EndOffset, wantFile, wantStart, wantStart+uint64(tt.second))
+			}
+			// any write to a full file, even an empty one, moves on
+			fi, err = cw.WriteBlock([]byte{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rotated := fi.FileNumber != wantFile; rotated != tt.thirdRotate || (rotated && fi.StartOffset != 0) {
+				t.Errorf("empty block after a full file went to file %v at %v, want rotation %v", fi.FileNumber, fi.StartOffset, tt.thirdRotate)
+			}
+		})
+	}
+}
+
+func TestNewValidatesFileNames(t *testing.T) {
+	tests := []struct {
+		name  string
+		edit  func(config *chainwriter.Config)
+		valid bool
+	}{
+		{"clean names", func(config *chainwriter.Config) {
+			config.BlockFileName, config.UndoFileName, config.FileExtension = "blk", "rev", ".dat"
+		}, true},
+		{"empty block file name", func(config *chainwriter.Config) { config.BlockFileName = "" }, false},
+		{"empty undo file name", func(config *chainwriter.Config) { config.UndoFileName = "" }, false},
+		{"empty file extension", func(config *chainwriter.Config) { config.FileExtension = "" }, false},
+		{"slash in block file name", func(config *chainwriter.Config) { config.BlockFileName = "../../etc/block" }, false},
+		{"slash in undo file name", func(config *chainwriter.Config) { config.UndoFileName = "sub/undo" }, false},
+		{"backslash in block file name", func(config *chainwriter.Config) { config.BlockFileName = `..\block` }, false},
+		{"dot dot in file extension", func(config *chainwriter.Config) { config.FileExtension = ".." }, false},
+		{"dot dot in undo file name", func(config *chainwriter.Config) { config.UndoFileName = "undo..txt" }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := chainwriter.DefaultConfig()
+			config.DataDirectory = filepath.Join(t.TempDir(), "data")
+			tt.edit(config)
+			cw, err := chainwriter.New(config)
+			if !tt.valid {
+				if err == nil {
+					cw.Close()
+					t.Fatal("created a ChainWriter with an unsafe file name")
+				}
+				if _, err := os.Stat(config.DataDirectory); !os.IsNotExist(err) {
+					t.Errorf("rejected config created the data directory (error %v)", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cw.Close()
+			fi, err := cw.WriteBlock([]byte("block"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := filepath.Join(config.DataDirectory, "blk_0.dat"); filepath.Clean(fi.FileName) != want {
+				t.Errorf("wrote block to {%v}, want {%v}", fi.FileName, want)
+			}
+		})
+	}
+}
+
+func TestReadFromEmptyDirectory(t *testing.T) {
+	for _, mmap := range []bool{false, true} {
+		config := chainwriter.DefaultConfig()
+		config.DataDirectory = filepath.Join(t.TempDir(), "fresh")
+		config.MmapReads = mmap
+		cw, err := chainwriter.New(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blockFI := &chainwriter.FileInfo{FileName: filepath.Join(config.DataDirectory, "block_2.txt"), FileNumber: 2, StartOffset: 0, EndOffset: 10}
+		if b, err := cw.ReadBlock(blockFI); !errors.Is(err, chainwriter.ErrBlockFileMissing) {
+			t.Errorf("with mmap %v, got block %v and error %v from an empty directory, want ErrBlockFileMissing", mmap, b, err)
+		}
+		undoFI := &chainwriter.FileInfo{FileName: filepath.Join(config.DataDirectory, "undo_2.txt"), FileNumber: 2, StartOffset: 0, EndOffset: 10}
+		if ub, err := cw.ReadUndoBlock(undoFI); !errors.Is(err, chainwriter.ErrBlockFileMissing) {
+			t.Errorf("with mmap %v, got undo block %v and error %v from an empty directory, want ErrBlockFileMissing", mmap, ub, err)
+		}
+		if err := cw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFileNumbers(t *testing.T) {
+	dir := t.TempDir()
+	cw := newTestWriter(t, dir)
+	defer cw.Close()
+	var blockNumber, undoNumber uint32
+	b := test.GenesisBlock()
+	for height := uint32(1); height <= 10; height++ {
+		b = test.MakeBlockFromPrev(b)
+		br, err := cw.StoreBlock(b, test.UndoBlockFromBlock(b), height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// each number is the one in the file name, and moves on by one
+		// when the file rotates
+		if want := filepath.Join(dir, fmt.Sprintf("block_%v.txt", br.BlockFileNumber)); br.BlockFile != want {
+			t.Errorf("block at height %v is in {%v} but has file number %v", height, br.BlockFile, br.BlockFileNumber)
+		}
+		if want := filepath.Join(dir, fmt.Sprintf("undo_%v.txt", br.UndoFileNumber)); br.UndoFile != want {
+			t.Errorf("undo block at height %v is in {%v} but has file number %v", height, br.UndoFile, br.UndoFileNumber)
+		}
+		if br.BlockFileNumber != blockNumber && br.BlockFileNumber != blockNumber+1 {
+			t.Errorf("block file number went from %v to %v", blockNumber, br.BlockFileNumber)
+		}
+		if br.UndoFileNumber != undoNumber && br.UndoFileNumber != undoNumber+1 {
+			t.Errorf("undo file number went from %v to %v", undoNumber, br.UndoFileNumber)
+		}
+		blockNumber, undoNumber = br.BlockFileNumber, br.UndoFileNumber
+	}
+	if blockNumber == 0 || undoNumber == 0 {
+		t.Fatalf("blocks fit in one file, so rotation is not tested")
+	}
+}
+
+func TestReset(t *testing.T) {
+	dir := t.TempDir()
+	cw := newTestWriter(t, dir)
+	defer cw.Close()
+	b := test.GenesisBlock()
+	for height := uint32(1); height <= 4; height++ {
+		b = test.MakeBlockFromPrev(b)
+		if _, err := cw.StoreBlock(b, test.UndoBlockFromBlock(b), height); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cw.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if files, err := os.ReadDir(dir); err != nil || len(files) != 0 {
+		t.Errorf("data directory holds %v after Reset (error %v)", files, err)
+	}
+	if cw.CurrentBlockFileNumber != 0 || cw.CurrentBlockOffset != 0 || cw.CurrentUndoFileNumber != 0 || cw.CurrentUndoOffset != 0 {
+		t.Errorf("file positions are %v, %v, %v, %v after Reset, want 0", cw.CurrentBlockFileNumber, cw.CurrentBlockOffset, cw.CurrentUndoFileNumber, cw.CurrentUndoOffset)
+	}
+	ub := test.UndoBlockFromBlock(b)
+	br, err := cw.StoreBlock(b, ub, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if br.BlockFileNumber != 0 || br.BlockStartOffset != 0 {
+		t.Errorf("first block after Reset went to file %v at %v, want file 0 at 0", br.BlockFileNumber, br.BlockStartOffset)
+	}
+	readBack(t, cw, br, b, ub)
+}
+
+func TestOffsetsPastFourGiB(t *testing.T) {
+	dir := t.TempDir()
+	// a sparse file takes no space, but puts the next write past 4 GiB
+	const size = 5 << 30
+	file, err := os.Create(filepath.Join(dir, "block_0.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Truncate(size); err != nil {
+		file.Close() // ignore error; Truncate error takes precedence
+		t.Skipf("cannot create a sparse file: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+	config := chainwriter.DefaultConfig()
+	config.DataDirectory = dir
+	config.MaxBlockFileSize = size + 1024
+	cw, err := chainwriter.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cw.Close()
+	if cw.CurrentBlockOffset != size {
+		t.Fatalf("resumed at offset %v, want %v", cw.CurrentBlockOffset, uint64(size))
+	}
+	b := test.MakeBlockFromPrev(test.GenesisBlock())
+	br, err := cw.StoreBlock(b, test.UndoBlockFromBlock(b), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if br.BlockFileNumber != 0 || br.BlockStartOffset != size {
+		t.Errorf("wrote block to file %v at %v, want file 0 at %v", br.BlockFileNumber, br.BlockStartOffset, uint64(size))
+	}
+	readBack(t, cw, br, b, test.UndoBlockFromBlock(b))
+	// and a block that would take the file past its maximum rotates
+	fi, err := cw.WriteBlock(make([]byte, 1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.FileNumber != 1 || fi.StartOffset != 0 {
+		t.Errorf("wrote block past the maximum file size to file %v at %v, want file 1 at 0", fi.FileNumber, fi.StartOffset)
+	}
+}
+
+func TestBlockAndUndoFileNumbers(t *testing.T) {
+	dir := t.TempDir()
+	cw := newTestWriter(t, dir)
+	defer cw.Close()
+	// numbers sort numerically, not by name, and files whose names do not
+	// parse are skipped
+	for _, name := range []string{
+		"block_10.txt", "block_2.txt", "block_0.txt", "undo_11.txt", "undo_1.txt",
+		"block_x.txt", "block_3.dat", "block_04.txt", "block_.txt", "blocks_5.txt", "undo_7",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "block_6.txt"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	blocks, err := cw.BlockFileNumbers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint32{0, 2, 10}; !reflect.DeepEqual(blocks, want) {
+		t.Errorf("got block file numbers %v, want %v", blocks, want)
+	}
+	undos, err := cw.UndoFileNumbers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint32{1, 11}; !reflect.DeepEqual(undos, want) {
+		t.Errorf("got undo file numbers %v, want %v", undos, want)
+	}
+}
+
+func TestVerifyRecordOffsets(t *testing.T) {
+	config := chainwriter.DefaultConfig()
+	config.DataDirectory = t.TempDir()
+	cw, err := chainwriter.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cw.Close()
+	var records []*blockinfodatabase.BlockRecord
+	b := test.GenesisBlock()
+	for height := uint32(1); height <= 3; height++ {
+		b = test.MakeBlockFromPrev(b)
+		br, err := cw.StoreBlock(b, test.UndoBlockFromBlock(b), height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, br)
+	}
+	// the middle Block has Blocks on either side, so shifted offsets still
+	// read bytes from the file
+	if records[1].BlockFile != records[0].BlockFile || records[1].BlockFile != records[2].BlockFile {
+		t.Fatal("blocks do not share a file")
+	}
+	for _, br := range records {
+		if err := chainwriter.VerifyRecordOffsets(cw, br); err != nil {
+			t.Errorf("record for block at height %v failed verification: %v", br.Height, err)
+		}
+	}
+	for _, tc := range []struct {
+		name       string
+		start, end int64
+	}{
+		{"start late", 3, 0},
+		{"start early", -3, 0},
+		{"end early", 0, -2},
+		{"end late", 0, 2},
+		{"shifted", 3, 3},
+	} {
+		br := *records[1]
+		br.BlockStartOffset = uint64(int64(br.BlockStartOffset) + tc.start)
+		br.BlockEndOffset = uint64(int64(br.BlockEndOffset) + tc.end)
+		if err := chainwriter.VerifyRecordOffsets(cw, &br); !errors.Is(err, chainwriter.ErrOffsetMismatch) {
+			t.Errorf("%v: got error %v, want %v", tc.name, err, chainwriter.ErrOffsetMismatch)
+		}
+	}
+	// offsets of another Block do not match the record's Header
+	br := *records[1]
+	br.BlockStartOffset, br.BlockEndOffset = records[0].BlockStartOffset, records[0].BlockEndOffset
+	if err := chainwriter.VerifyRecordOffsets(cw, &br); !errors.Is(err, chainwriter.ErrOffsetMismatch) {
+		t.Errorf("got error %v for another block's offsets, want %v", err, chainwriter.ErrOffsetMismatch)
+	}
+}
+
+func TestNewFileInfo(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		start, end uint64
+		valid      bool
+	}{
+		{"block_0.txt", 0, 10, true},
+		{"block_0.txt", 10, 10, true},
+		{"block_0.txt", 11, 10, false},
+		{"", 0, 10, false},
+	} {
+		fi, err := chainwriter.NewFileInfo(tc.name, tc.start, tc.end)
+		switch {
+		case tc.valid && err != nil:
+			t.Errorf("rejected file info %v[%v:%v]: %v", tc.name, tc.start, tc.end, err)
+		case tc.valid && (fi.FileName != tc.name || fi.StartOffset != tc.start || fi.EndOffset != tc.end):
+			t.Errorf("got file info %v, want %v[%v:%v]", fi, tc.name, tc.start, tc.end)
+		case !tc.valid && !errors.Is(err, chainwriter.ErrInvalidFileInfo):
+			t.Errorf("got file info %v and error %v for %v[%v:%v], want %v", fi, err, tc.name, tc.start, tc.end, chainwriter.ErrInvalidFileInfo)
+		}
+	}
+	// reads check the FileInfo before touching the file
+	cw := newTestWriter(t, t.TempDir())
+	defer cw.Close()
+	b := test.MakeBlockFromPrev(test.GenesisBlock())
+	br, err := cw.StoreBlock(b, test.UndoBlockFromBlock(b), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inverted := &chainwriter.FileInfo{FileName: br.BlockFile, FileNumber: br.BlockFileNumber, StartOffset: br.BlockEndOffset, EndOffset: br.BlockStartOffset}
+	if _, err := cw.ReadBlock(inverted); !errors.Is(err, chainwriter.ErrInvalidFileInfo) {
+		t.Errorf("got error %v reading a block with inverted offsets, want %v", err, chainwriter.ErrInvalidFileInfo)
+	}
+	inverted = &chainwriter.FileInfo{FileName: br.UndoFile, FileNumber: br.UndoFileNumber, StartOffset: br.UndoEndOffset, EndOffset: br.UndoStartOffset}
+	if _, err := cw.ReadUndoBlock(inverted); !errors.Is(err, chainwriter.ErrInvalidFileInfo) {
+		t.Errorf("got error %v reading an undo block with inverted offsets, want %v", err, chainwriter.ErrInvalidFileInfo)
+	}
+}
+
+func TestBlockAlignment(t *testing.T) {
+	config := chainwriter.DefaultConfig()
+	config.DataDirectory = t.TempDir()
+	config.BlockAlignment = 64
+	cw, err := chainwriter.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cw.Close()
+	var blocks []*block.Block
+	var undoBlocks []*chainwriter.UndoBlock
+	var records []*blockinfodatabase.BlockRecord
+	b := test.GenesisBlock()
+	for height := uint32(1); height <= 4; height++ {
+		b = test.MakeBlockFromPrev(b)
+		ub := test.MockedUndoBlock()
+		ub.Amounts[0] = height
+		br, err := cw.StoreBlock(b, ub, height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if br.BlockStartOffset%64 != 0 {
+			t.Errorf("block %v starts at unaligned offset %v", height, br.BlockStartOffset)
+		}
+		if (br.BlockEndOffset-br.BlockStartOffset)%64 == 0 {
+			t.Fatalf("block %v is already aligned, so padding is not tested", height)
+		}
+		blocks = append(blocks, b)
+		undoBlocks = append(undoBlocks, ub)
+		records = append(records, br)
+	}
+	if err := cw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// each Block's padding is zeros up to the start of the next
+	data, err := os.ReadFile(records[0].BlockFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, br := range records[:len(records)-1] {
+		next := records[i+1].BlockStartOffset
+		if next != (br.BlockEndOffset/64+1)*64 {
+			t.Errorf("block %v starts at %v, want the aligned offset after %v", i+2, next, br.BlockEndOffset)
+		}
+		for _, c := range data[br.BlockEndOffset:next] {
+			if c != 0 {
+				t.Errorf("padding after block %v is %v, want zeros", i+1, data[br.BlockEndOffset:next])
+				break
+			}
+		}
+	}
+	for i := range blocks {
+		readBack(t, cw, records[i], blocks[i], undoBlocks[i])
+	}
+}
@@ -1,13 +1,37 @@
 package chainwriter
 
+import (
+	"fmt"
+	"strings"
+)
+
 // Config is the ChainWriter's configuration options.
+// MaxBlockFileSize and MaxUndoFileSize are in bytes, and may exceed
+// 4 GiB.
+// MmapReads memory-maps block and undo files for reading, where the
+// platform supports it. Writes are unaffected.
+// BufferedWrites keeps the current block and undo files open and
+// buffers writes to them in memory. Buffered writes reach Disk when the
+// ChainWriter moves on to a new file, on Flush, on Close, or before a
+// read.
+// BlockAlignment, if non-zero, pads each Block written with zeros up to
+// a multiple of BlockAlignment bytes, so that every Block starts at an
+// aligned offset in its file. The padding is not part of a Block's
+// FileInfo, so reads ignore it.
+// DisableUndo, for append-only chains that never reorg, skips
+// serializing and writing UndoBlocks. StoreBlock then writes only the
+// Block, and StoreUndoBlock returns ErrUndoDisabled.
 type Config struct {
 	FileExtension    string
 	DataDirectory    string
 	BlockFileName    string
 	UndoFileName     string
-	MaxBlockFileSize uint32
-	MaxUndoFileSize  uint32
+	MaxBlockFileSize uint64
+	MaxUndoFileSize  uint64
+	MmapReads        bool
+	BufferedWrites   bool
+	BlockAlignment   uint32
+	DisableUndo      bool
 }
 
 // DefaultConfig returns the default Config for the ChainWriter.
@@ -21,3 +45,29 @@ func DefaultConfig() *Config {
 		MaxUndoFileSize:  1024,
 	}
 }
+
+// Validate returns an error if the Config's file names could be used to
+// write outside of the DataDirectory.
+func (config *Config) Validate() error {
+	if err := validateFileName("FileExtension", config.FileExtension); err != nil {
+		return err
+	}
+	if err := validateFileName("BlockFileName", config.BlockFileName); err != nil {
+		return err
+	}
+	return validateFileName("UndoFileName", config.UndoFileName)
+}
+
+// validateFileName returns an error if a file name is empty, contains a
+// path separator, or contains "..".
+func validateFileName(field string, name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("[chainwriter.Config] %v must not be empty", field)
+	case strings.ContainsAny(name, `/\`):
+		return fmt.Errorf("[chainwriter.Config] %v {%v} must not contain a path separator", field, name)
+	case strings.Contains(name, ".."):
+		return fmt.Errorf("[chainwriter.Config] %v {%v} must not contain \"..\"", field, name)
+	}
+	return nil
+}
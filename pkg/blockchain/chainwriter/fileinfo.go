@@ -1,8 +1,47 @@
 package chainwriter
 
+import (
+	"errors"
+	"fmt"
+)
+
 // FileInfo determines where a Block or UndoBlock is stored.
+// FileNumber is the number of the file, as in "block_<FileNumber>.txt".
 type FileInfo struct {
 	FileName    string
-	StartOffset uint32
-	EndOffset   uint32
+	FileNumber  uint32
+	StartOffset uint64
+	EndOffset   uint64
+}
+
+// String returns the FileInfo's location as "FileName[StartOffset:EndOffset]".
+func (fi *FileInfo) String() string {
+	return fmt.Sprintf("%v[%v:%v]", fi.FileName, fi.StartOffset, fi.EndOffset)
+}
+
+// ErrInvalidFileInfo is returned for a FileInfo with no file name or
+// with its start offset after its end offset.
+var ErrInvalidFileInfo = errors.New("invalid file info")
+
+// NewFileInfo returns a FileInfo for the bytes between start and end of
+// a file. It returns an error wrapping ErrInvalidFileInfo if the name is
+// empty or start is after end.
+func NewFileInfo(name string, start, end uint64) (*FileInfo, error) {
+	fi := &FileInfo{FileName: name, StartOffset: start, EndOffset: end}
+	if err := fi.Validate(); err != nil {
+		return nil, err
+	}
+	return fi, nil
+}
+
+// Validate returns an error wrapping ErrInvalidFileInfo if the
+// FileInfo's name is empty or its start offset is after its end offset.
+func (fi *FileInfo) Validate() error {
+	if fi.FileName == "" {
+		return fmt.Errorf("%w: empty file name", ErrInvalidFileInfo)
+	}
+	if fi.StartOffset > fi.EndOffset {
+		return fmt.Errorf("%w: start offset {%v} is after end offset {%v} in file {%v}", ErrInvalidFileInfo, fi.StartOffset, fi.EndOffset, fi.FileName)
+	}
+	return nil
 }
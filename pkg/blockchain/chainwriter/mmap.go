@@ -0,0 +1,111 @@
+package chainwriter
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// mappedFiles caches read-only memory mappings of block and undo files,
+// so that reads slice directly from memory instead of opening and
+// seeking the file each time.
+// A mapping is replaced when a read goes past its end, which happens
+// when the file has been appended to since it was mapped.
+type mappedFiles struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+// newMappedFiles returns an empty mappedFiles.
+func newMappedFiles() *mappedFiles {
+	return &mappedFiles{files: make(map[string][]byte)}
+}
+
+// read returns a copy of the bytes described by a FileInfo, mapping the
+// file if it is not mapped or its mapping is too short.
+func (m *mappedFiles) read(info *FileInfo) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.files[info.FileName]
+	if !ok || uint64(len(data)) < info.EndOffset {
+		if ok {
+			if err := unmapFile(data); err != nil {
+				return nil, fmt.Errorf("failed to unmap file {%v}: %w", info.FileName, err)
+			}
+			delete(m.files, info.FileName)
+		}
+		mapped, err := mapFile(info.FileName)
+		if err != nil {
+			return nil, err
+		}
+		m.files[info.FileName] = mapped
+		data = mapped
+	}
+	if info.StartOffset > info.EndOffset || uint64(len(data)) < info.EndOffset {
+		return nil, fmt.Errorf("failed to read {%v} bytes from file {%v}", info.EndOffset-info.StartOffset, info.FileName)
+	}
+	buf := make([]byte, info.EndOffset-info.StartOffset)
+	copy(buf, data[info.StartOffset:info.EndOffset])
+	return buf, nil
+}
+
+// unmap unmaps a file if it is mapped, so that it can be removed.
+func (m *mappedFiles) unmap(fileName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.files[fileName]
+	if !ok {
+		return nil
+	}
+	if err := unmapFile(data); err != nil {
+		return fmt.Errorf("failed to unmap file {%v}: %w", fileName, err)
+	}
+	delete(m.files, fileName)
+	return nil
+}
+
+// close unmaps every mapped file.
+func (m *mappedFiles) close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for name, data := range m.files {
+		if err := unmapFile(data); err != nil {
+			return fmt.Errorf("failed to unmap file {%v}: %w", name, err)
+		}
+		delete(m.files, name)
+	}
+	return nil
+}
+
+// mapFile returns a read-only memory mapping of a whole file. It returns
+// ErrBlockFileMissing if the file does not exist.
+func mapFile(fileName string) ([]byte, error) {
+	file, err := os.Open(fileName)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: {%v}", ErrBlockFileMissing, fileName)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to open file {%v}: %w", fileName, err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("unable to stat file {%v}: %w", fileName, err)
+	}
+	if info.Size() == 0 {
+		return nil, nil
+	}
+	data, err := mmap(file, int(info.Size()))
+	if err != nil {
+		return nil, fmt.Errorf("unable to map file {%v}: %w", fileName, err)
+	}
+	return data, nil
+}
+
+// unmapFile releases a mapping returned by mapFile.
+func unmapFile(data []byte) error {
+	if data == nil {
+		return nil
+	}
+	return munmap(data)
+}
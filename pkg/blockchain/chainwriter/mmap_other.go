@@ -0,0 +1,26 @@
+//go:build !darwin && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!freebsd,!linux,!netbsd,!openbsd
+
+package chainwriter
+
+import (
+	"errors"
+	"os"
+)
+
+// mmapSupported is whether memory-mapped reads are available on this platform.
+const mmapSupported = false
+
+// errMmapUnsupported is returned when memory-mapped reads are not
+// available on this platform.
+var errMmapUnsupported = errors.New("memory-mapped reads are not supported on this platform")
+
+// mmap maps the first size bytes of a file read-only.
+func mmap(file *os.File, size int) ([]byte, error) {
+	return nil, errMmapUnsupported
+}
+
+// munmap releases a mapping returned by mmap.
+func munmap(data []byte) error {
+	return errMmapUnsupported
+}
@@ -0,0 +1,59 @@
+package chainwriter
+
+import (
+	"Chain/pkg/block"
+	"testing"
+)
+
+func TestPruneUndoBelowUnmapsFiles(t *testing.T) {
+	if !mmapSupported {
+		t.Skip("memory-mapped reads are not supported on this platform")
+	}
+	config := DefaultConfig()
+	config.DataDirectory = t.TempDir()
+	config.MaxUndoFileSize = 64
+	config.MmapReads = true
+	cw, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cw.Close()
+	var infos []*FileInfo
+	for height := uint32(1); height <= 4; height++ {
+		ub := &UndoBlock{
+			TransactionInputHashes: []block.TxHash{"0123456789abcdef0123456789abcdef"},
+			OutputIndexes:          []uint32{0},
+			Amounts:                []uint32{height},
+			LockingScripts:         []string{"script"},
+		}
+		fi, err := cw.StoreUndoBlock(ub, height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		infos = append(infos, fi)
+	}
+	first := infos[0]
+	if first.FileNumber == cw.CurrentUndoFileNumber {
+		t.Fatal("undo blocks fit in one file, so pruning is not tested")
+	}
+	// reading maps the file
+	if _, err := cw.ReadUndoBlock(first); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cw.mapped.files[first.FileName]; !ok {
+		t.Fatalf("reading undo file {%v} did not map it", first.FileName)
+	}
+	pruned, err := cw.PruneUndoBelow(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pruned) == 0 {
+		t.Fatal("pruned no undo files")
+	}
+	if _, ok := cw.mapped.files[first.FileName]; ok {
+		t.Errorf("undo file {%v} is still mapped after it was pruned", first.FileName)
+	}
+	if _, err := cw.ReadUndoBlock(first); err == nil {
+		t.Error("read an undo block from a pruned file")
+	}
+}
@@ -0,0 +1,22 @@
+//go:build darwin || freebsd || linux || netbsd || openbsd
+// +build darwin freebsd linux netbsd openbsd
+
+package chainwriter
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmapSupported is whether memory-mapped reads are available on this platform.
+const mmapSupported = true
+
+// mmap maps the first size bytes of a file read-only.
+func mmap(file *os.File, size int) ([]byte, error) {
+	return syscall.Mmap(int(file.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+// munmap releases a mapping returned by mmap.
+func munmap(data []byte) error {
+	return syscall.Munmap(data)
+}
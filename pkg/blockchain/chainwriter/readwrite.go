@@ -1,41 +1,116 @@
 package chainwriter
 
 import (
-	"log"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"syscall"
 )
 
-// writeToDisk appends a slice of bytes to a file.
-func writeToDisk(fileName string, data []byte) {
+// ErrBlockFileMissing is returned when reading from a block or undo
+// file that has not been written yet.
+var ErrBlockFileMissing = errors.New("block file missing")
+
+// writeToDisk appends a slice of bytes to a file, which is never
+// truncated. The file's size before the write must equal offset,
+// the offset the ChainWriter expects the data to be written at;
+// otherwise the file was changed outside the ChainWriter and an error
+// is returned without writing.
+func writeToDisk(fileName string, offset uint64, data []byte) error {
 	file, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
-		log.Fatalf("Unable to open file {%v}", fileName)
+		return fmt.Errorf("unable to open file {%v}: %w", fileName, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close() // ignore error; Stat error takes precedence
+		return fmt.Errorf("unable to stat file {%v}: %w", fileName, err)
+	}
+	if info.Size() != int64(offset) {
+		file.Close() // ignore error; size mismatch takes precedence
+		return fmt.Errorf("file {%v} has size {%v} but expected offset {%v}", fileName, info.Size(), offset)
 	}
 	if _, err := file.Write(data); err != nil {
 		file.Close() // ignore error; Write error takes precedence
-		log.Fatalf("Failed to write to file {%v}", fileName)
+		return fmt.Errorf("failed to write to file {%v}: %w", fileName, err)
 	}
 	if err := file.Close(); err != nil {
-		log.Fatalf("Failed to close file {%v}", fileName)
+		return fmt.Errorf("failed to close file {%v}: %w", fileName, err)
 	}
+	return nil
 }
 
 // readFromDisk return a slice of bytes from a file, given a FileInfo.
-func readFromDisk(info *FileInfo) []byte {
+// It returns ErrBlockFileMissing if the file does not exist.
+func readFromDisk(info *FileInfo) ([]byte, error) {
+	if err := info.Validate(); err != nil {
+		return nil, err
+	}
 	file, err := os.Open(info.FileName)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: {%v}", ErrBlockFileMissing, info.FileName)
+	}
 	if err != nil {
-		log.Fatalf("Unable to open file {%v}", info.FileName)
+		return nil, fmt.Errorf("unable to open file {%v}: %w", info.FileName, err)
 	}
+	defer file.Close()
 	if _, err2 := file.Seek(int64(info.StartOffset), 0); err2 != nil {
-		log.Fatalf("Failed to seek to {%v} in file {%v}", info.StartOffset, info.FileName)
+		return nil, fmt.Errorf("failed to seek to {%v} in file {%v}: %w", info.StartOffset, info.FileName, err2)
 	}
 	numBytes := info.EndOffset - info.StartOffset
 	buf := make([]byte, numBytes)
-	if n, err3 := file.Read(buf); uint32(n) != info.EndOffset-info.StartOffset || err3 != nil {
-		log.Fatalf("Failed to read {%v} bytes from file {%v}", numBytes, info.FileName)
+	if n, err3 := io.ReadFull(file, buf); uint64(n) != numBytes || err3 != nil {
+		return nil, fmt.Errorf("failed to read {%v} bytes from file {%v}", numBytes, info.FileName)
+	}
+	return buf, nil
+}
+
+// rename renames a file. It is a variable so that tests can simulate a
+// rename across filesystems.
+var rename = os.Rename
+
+// moveFile moves a file from one path to another. If the file cannot be
+// renamed because the paths are on different filesystems, it is copied,
+// synced to Disk, and only then removed. It returns an error wrapping
+// os.ErrNotExist if the file does not exist.
+func moveFile(from, to string) error {
+	err := rename(from, to)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	if err := copyFile(from, to); err != nil {
+		os.Remove(to) // ignore error; copy error takes precedence
+		return err
+	}
+	if err := os.Remove(from); err != nil {
+		return fmt.Errorf("failed to remove file {%v} after copying it: %w", from, err)
+	}
+	return nil
+}
+
+// copyFile copies a file to a new path, which must not exist, and syncs
+// the copy to Disk.
+func copyFile(from, to string) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return fmt.Errorf("unable to open file {%v}: %w", from, err)
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(to, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to create file {%v}: %w", to, err)
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close() // ignore error; Copy error takes precedence
+		return fmt.Errorf("failed to copy file {%v} to {%v}: %w", from, to, err)
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close() // ignore error; Sync error takes precedence
+		return fmt.Errorf("failed to sync file {%v}: %w", to, err)
 	}
-	if err4 := file.Close(); err4 != nil {
-		log.Fatalf("Failed to close file {%v}", info.FileName)
+	if err := dst.Close(); err != nil {
+		return fmt.Errorf("failed to close file {%v}: %w", to, err)
 	}
-	return buf
+	return nil
 }
@@ -0,0 +1,34 @@
+package chainwriter
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestMoveFileAcrossFilesystems(t *testing.T) {
+	defer func(r func(string, string) error) { rename = r }(rename)
+	rename = func(from, to string) error {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: syscall.EXDEV}
+	}
+	dir := t.TempDir()
+	from, to := filepath.Join(dir, "block_0.txt"), filepath.Join(dir, "moved.txt")
+	if err := os.WriteFile(from, []byte("block"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := moveFile(from, to); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(to); err != nil || string(data) != "block" {
+		t.Errorf("moved file holds %q (error %v), want %q", data, err, "block")
+	}
+	if _, err := os.Stat(from); !os.IsNotExist(err) {
+		t.Errorf("original file still exists after moving it (error %v)", err)
+	}
+	// a missing file is reported as such
+	if err := moveFile(from, to); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("moving a missing file returned %v, want os.ErrNotExist", err)
+	}
+}
@@ -1,6 +1,14 @@
 package chainwriter
 
-import "Chain/pkg/pro"
+import (
+	"Chain/pkg/block"
+	"Chain/pkg/pro"
+	"fmt"
+)
+
+// UndoBlockVersion is the version of the UndoBlock format written to
+// Disk. UndoBlocks of any other version cannot be decoded.
+const UndoBlockVersion uint32 = 0
 
 // UndoBlock is used to reverse the side effects causes by a Block.
 // It contains information necessary for reverting a specific block.
@@ -17,10 +25,10 @@ import "Chain/pkg/pro"
 // Amounts are the amounts of the parent TransactionOutputs.
 // LockingScripts are the locking scripts of the parent TransactionOutputs.
 type UndoBlock struct {
-	TransactionInputHashes []string // the hashes of the TransactionInputs that the UndoBlock must revert
-	OutputIndexes          []uint32 // the OutputIndexes of the TransactionInputs
-	Amounts                []uint32 // the amounts of the parent TransactionOutputs
-	LockingScripts         []string // the locking scripts of the parent TransactionOutputs
+	TransactionInputHashes []block.TxHash // the hashes of the TransactionInputs that the UndoBlock must revert
+	OutputIndexes          []uint32       // the OutputIndexes of the TransactionInputs
+	Amounts                []uint32       // the amounts of the parent TransactionOutputs
+	LockingScripts         []string       // the locking scripts of the parent TransactionOutputs
 }
 
 // EncodeUndoBlock returns a pro.UndoBlock given an UndoBlock.
@@ -30,7 +38,7 @@ func EncodeUndoBlock(ub *UndoBlock) *pro.UndoBlock {
 	var amounts []uint32
 	var lockingScripts []string
 	for i := 0; i < len(ub.TransactionInputHashes); i++ {
-		transactionInputHashes = append(transactionInputHashes, ub.TransactionInputHashes[i])
+		transactionInputHashes = append(transactionInputHashes, string(ub.TransactionInputHashes[i]))
 		outputIndexes = append(outputIndexes, ub.OutputIndexes[i])
 		amounts = append(amounts, ub.Amounts[i])
 		lockingScripts = append(lockingScripts, ub.LockingScripts[i])
@@ -40,17 +48,22 @@ func EncodeUndoBlock(ub *UndoBlock) *pro.UndoBlock {
 		OutputIndexes:          outputIndexes,
 		Amounts:                amounts,
 		LockingScripts:         lockingScripts,
+		Version:                UndoBlockVersion,
 	}
 }
 
-// DecodeUndoBlock returns an UndoBlock given a pro.UndoBlock
-func DecodeUndoBlock(pub *pro.UndoBlock) *UndoBlock {
-	var transactionInputHashes []string
+// DecodeUndoBlock returns an UndoBlock given a pro.UndoBlock. It
+// returns an error if the pro.UndoBlock's version is unknown.
+func DecodeUndoBlock(pub *pro.UndoBlock) (*UndoBlock, error) {
+	if pub.GetVersion() != UndoBlockVersion {
+		return nil, fmt.Errorf("[DecodeUndoBlock] unknown undo block version {%v}, expected {%v}", pub.GetVersion(), UndoBlockVersion)
+	}
+	var transactionInputHashes []block.TxHash
 	var outputIndexes []uint32
 	var amounts []uint32
 	var lockingScripts []string
 	for i := 0; i < len(pub.GetTransactionInputHashes()); i++ {
-		transactionInputHashes = append(transactionInputHashes, pub.GetTransactionInputHashes()[i])
+		transactionInputHashes = append(transactionInputHashes, block.TxHash(pub.GetTransactionInputHashes()[i]))
 		outputIndexes = append(outputIndexes, pub.GetOutputIndexes()[i])
 		amounts = append(amounts, pub.GetAmounts()[i])
 		lockingScripts = append(lockingScripts, pub.GetLockingScripts()[i])
@@ -60,5 +73,5 @@ func DecodeUndoBlock(pub *pro.UndoBlock) *UndoBlock {
 		OutputIndexes:          outputIndexes,
 		Amounts:                amounts,
 		LockingScripts:         lockingScripts,
-	}
+	}, nil
 }
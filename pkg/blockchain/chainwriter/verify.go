@@ -0,0 +1,47 @@
+package chainwriter
+
+import (
+	"Chain/pkg/block"
+	"Chain/pkg/blockchain/blockinfodatabase"
+	"Chain/pkg/pro"
+	"errors"
+	"fmt"
+)
+
+// ErrOffsetMismatch is returned when a BlockRecord's offsets do not
+// describe the Block whose Header the BlockRecord holds.
+var ErrOffsetMismatch = errors.New("block record offsets do not match block")
+
+// VerifyRecordOffsets reads the bytes a BlockRecord's block offsets
+// describe and checks that they parse as a Block whose hash matches the
+// hash of the BlockRecord's Header. It returns an error wrapping
+// ErrOffsetMismatch if they do not, such as when the offsets are off by
+// a few bytes. Errors reading the bytes are returned as they are.
+func VerifyRecordOffsets(cw *ChainWriter, r *blockinfodatabase.BlockRecord) error {
+	if r.Header == nil {
+		return fmt.Errorf("[VerifyRecordOffsets] %w: record has no header", ErrOffsetMismatch)
+	}
+	fi := &FileInfo{
+		FileName:    r.BlockFile,
+		FileNumber:  r.BlockFileNumber,
+		StartOffset: r.BlockStartOffset,
+		EndOffset:   r.BlockEndOffset,
+	}
+	bytes, err := cw.readBytes(fi)
+	if err != nil {
+		return fmt.Errorf("[VerifyRecordOffsets] %w", err)
+	}
+	pb := &pro.Block{}
+	if err := pro.Unmarshal(fi.String(), bytes, pb); err != nil {
+		return fmt.Errorf("[VerifyRecordOffsets] %w: %v", ErrOffsetMismatch, err)
+	}
+	b := block.DecodeBlock(pb)
+	if b.Header == nil {
+		return fmt.Errorf("[VerifyRecordOffsets] %w: block at {%v} has no header", ErrOffsetMismatch, fi)
+	}
+	want := (&block.Block{Header: r.Header}).Hash()
+	if got := b.Hash(); got != want {
+		return fmt.Errorf("[VerifyRecordOffsets] %w: block at {%v} has hash {%v}, record has {%v}", ErrOffsetMismatch, fi, got, want)
+	}
+	return nil
+}
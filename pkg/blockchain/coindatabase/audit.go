@@ -0,0 +1,63 @@
+package coindatabase
+
+import (
+	"Chain/pkg/block"
+	"Chain/pkg/blockchain/kvstore"
+	"Chain/pkg/pro"
+	"errors"
+	"fmt"
+)
+
+// AuditCacheDbConsistency checks that every Coin marked spent in the
+// mainCache is still an unspent output of its CoinRecord in the db, so
+// that flushing the spend, and later undoing it, can succeed. It returns
+// the CoinLocators of the spent Coins whose CoinRecord is missing,
+// corrupt, or no longer has them, sorted, and an error only if the db
+// cannot be read.
+func (coinDB *CoinDatabase) AuditCacheDbConsistency() ([]CoinLocator, error) {
+	coinDB.mu.Lock()
+	defer coinDB.mu.Unlock()
+	var inconsistent []CoinLocator
+	records := make(map[block.TxHash]*CoinRecord)
+	for cl, coin := range coinDB.MainCache {
+		if !coin.IsSpent {
+			continue
+		}
+		cr, ok := records[cl.ReferenceTransactionHash]
+		if !ok {
+			var err error
+			cr, err = coinDB.auditRecord(cl.ReferenceTransactionHash)
+			if err != nil {
+				return nil, fmt.Errorf("[AuditCacheDbConsistency] %w", err)
+			}
+			records[cl.ReferenceTransactionHash] = cr
+		}
+		if cr == nil || cr.unspentIndex(cl.OutputIndex) < 0 {
+			inconsistent = append(inconsistent, cl)
+		}
+	}
+	sortLocators(inconsistent)
+	return inconsistent, nil
+}
+
+// auditRecord returns the CoinRecord stored under a Transaction hash, or
+// nil if it is missing or cannot be decoded. It returns an error only if
+// the db cannot be read.
+func (coinDB *CoinDatabase) auditRecord(txHash block.TxHash) (*CoinRecord, error) {
+	data, err := coinDB.db.Get(coinDB.recordKey(txHash))
+	if errors.Is(err, kvstore.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	pcr := &pro.CoinRecord{}
+	if err := pro.Unmarshal(string(txHash), data, pcr); err != nil {
+		return nil, nil
+	}
+	cr, err := DecodeCoinRecord(pcr)
+	if err != nil {
+		return nil, nil
+	}
+	return cr, nil
+}
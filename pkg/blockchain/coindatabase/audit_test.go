@@ -0,0 +1,41 @@
+package coindatabase
+
+import (
+	"Chain/pkg/block"
+	"reflect"
+	"testing"
+)
+
+func TestAuditCacheDbConsistency(t *testing.T) {
+	coinDB := newTestDB(20)
+	alice, bob := coinbase("alice", 0, 5, 7), coinbase("bob", 1, 3)
+	coinDB.StoreBlock([]*block.Transaction{alice, bob}, 1)
+	miner := coinbase("miner", 2, 1)
+	coinDB.StoreBlock([]*block.Transaction{miner, spend(alice, 0, 5, "carol"), spend(alice, 1, 7, "carol"), spend(bob, 0, 3, "carol")}, 2)
+	if inconsistent, err := coinDB.AuditCacheDbConsistency(); err != nil || len(inconsistent) != 0 {
+		t.Fatalf("got inconsistent coins %v and error %v before any corruption", inconsistent, err)
+	}
+	// bob's CoinRecord is deleted and alice's loses output 1 behind the
+	// mainCache's back, so neither spend could be undone
+	if err := coinDB.db.Delete(coinDB.recordKey(bob.Hash())); err != nil {
+		t.Fatal(err)
+	}
+	cr, err := coinDB.getCoinRecordFromDB(alice.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	coinDB.putRecordInDB(alice.Hash(), coinDB.removeCoinFromRecord(cr, 1))
+	// an unspent cached Coin is not audited, even without its CoinRecord
+	if err := coinDB.db.Delete(coinDB.recordKey(miner.Hash())); err != nil {
+		t.Fatal(err)
+	}
+	inconsistent, err := coinDB.AuditCacheDbConsistency()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []CoinLocator{{alice.Hash(), 1}, {bob.Hash(), 0}}
+	sortLocators(want)
+	if !reflect.DeepEqual(inconsistent, want) {
+		t.Errorf("got inconsistent coins %v, want %v", inconsistent, want)
+	}
+}
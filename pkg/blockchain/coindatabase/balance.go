@@ -0,0 +1,93 @@
+package coindatabase
+
+import (
+	"Chain/pkg/block"
+	"Chain/pkg/blockchain/chainwriter"
+	"fmt"
+)
+
+// GetBalance returns the total amount of the unspent Coins locked by a
+// script. The balances of every script are built from the db the first
+// time GetBalance is called, flushing the mainCache, and are then kept
+// up to date as Blocks are stored and undone, so later calls do not
+// scan the db.
+func (coinDB *CoinDatabase) GetBalance(script string) (uint64, error) {
+	coinDB.mu.Lock()
+	defer coinDB.mu.Unlock()
+	if coinDB.balances == nil {
+		if err := coinDB.buildBalances(); err != nil {
+			return 0, fmt.Errorf("[GetBalance] %w", err)
+		}
+	}
+	return coinDB.balances[script], nil
+}
+
+// buildBalances flushes the mainCache and sums the unspent Coins in the
+// db by locking script. The caller must hold mu.
+func (coinDB *CoinDatabase) buildBalances() error {
+	if err := coinDB.flushMainCache(); err != nil {
+		return err
+	}
+	records, _, err := coinDB.sortedRecords()
+	if err != nil {
+		return err
+	}
+	balances := make(map[string]uint64)
+	for _, cr := range records {
+		for _, i := range cr.sortedPositions() {
+			balances[cr.LockingScripts[i]] += uint64(cr.Amounts[i])
+		}
+	}
+	coinDB.balances = balances
+	return nil
+}
+
+// creditBalance adds an unspent Coin's amount to the balance of its
+// locking script, if balances are being kept.
+func (coinDB *CoinDatabase) creditBalance(txo *block.TransactionOutput) {
+	if coinDB.balances != nil {
+		coinDB.balances[txo.LockingScript] += uint64(txo.Amount)
+	}
+}
+
+// debitBalance subtracts a spent Coin's amount from the balance of its
+// locking script, if balances are being kept. A balance that reaches
+// zero is dropped.
+func (coinDB *CoinDatabase) debitBalance(txo *block.TransactionOutput) {
+	if coinDB.balances == nil {
+		return
+	}
+	balance := coinDB.balances[txo.LockingScript]
+	if balance <= uint64(txo.Amount) {
+		delete(coinDB.balances, txo.LockingScript)
+		return
+	}
+	coinDB.balances[txo.LockingScript] = balance - uint64(txo.Amount)
+}
+
+// undoBalances reverses the balance changes made by storing a Block:
+// every Coin the Block created is debited, and every Coin it spent is
+// credited back. Coins the Block both created and spent cancel out.
+func (coinDB *CoinDatabase) undoBalances(b *block.Block, undoBlock *chainwriter.UndoBlock) {
+	if coinDB.balances == nil {
+		return
+	}
+	created := make(map[CoinLocator]*block.TransactionOutput)
+	for _, tx := range b.Transactions {
+		for _, txi := range tx.Inputs {
+			if txo, ok := created[makeCoinLocator(txi)]; ok {
+				coinDB.creditBalance(txo)
+			}
+		}
+		txHash := tx.Hash()
+		for i, txo := range tx.Outputs {
+			created[CoinLocator{txHash, uint32(i)}] = txo
+		}
+	}
+	for _, txo := range created {
+		coinDB.debitBalance(txo)
+	}
+	for i := range undoBlock.Amounts {
+		coinDB.creditBalance(&block.TransactionOutput{Amount: undoBlock.Amounts[i], LockingScript: undoBlock.LockingScripts[i]})
+	}
+}
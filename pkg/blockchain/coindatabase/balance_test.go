@@ -0,0 +1,56 @@
+package coindatabase
+
+import (
+	"Chain/pkg/block"
+	"Chain/pkg/blockchain/chainwriter"
+	"testing"
+)
+
+// checkBalances fails the test unless the tracked balances match want,
+// and match balances rebuilt from the db.
+func checkBalances(t *testing.T, coinDB *CoinDatabase, want map[string]uint64) {
+	t.Helper()
+	for rebuild := 0; rebuild < 2; rebuild++ {
+		for script, amount := range want {
+			balance, err := coinDB.GetBalance(script)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if balance != amount {
+				t.Errorf("got balance {%v} for %v (rebuilt: %v), want {%v}", balance, script, rebuild == 1, amount)
+			}
+		}
+		coinDB.mu.Lock()
+		coinDB.balances = nil
+		coinDB.mu.Unlock()
+	}
+	// keep tracking incrementally from here on
+	if _, err := coinDB.GetBalance(""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBalances(t *testing.T) {
+	coinDB := newTestDB(10)
+	alice := coinbase("alice", 0, 5, 7)
+	coinDB.StoreBlock([]*block.Transaction{alice}, 1)
+	checkBalances(t, coinDB, map[string]uint64{"alice": 12, "bob": 0})
+
+	// bob is paid 5 from alice, and immediately pays 5 of it to carol
+	toBob := spend(alice, 0, 5, "bob")
+	toCarol := spend(toBob, 0, 5, "carol")
+	b2 := &block.Block{Header: &block.Header{}, Transactions: []*block.Transaction{coinbase("bob", 1, 1), toBob, toCarol}}
+	coinDB.StoreBlock(b2.Transactions, 2)
+	checkBalances(t, coinDB, map[string]uint64{"alice": 7, "bob": 1, "carol": 5})
+
+	ub2 := &chainwriter.UndoBlock{
+		TransactionInputHashes: []block.TxHash{alice.Hash()},
+		OutputIndexes:          []uint32{0},
+		Amounts:                []uint32{5},
+		LockingScripts:         []string{"alice"},
+	}
+	if err := coinDB.UndoCoins([]*block.Block{b2}, []*chainwriter.UndoBlock{ub2}); err != nil {
+		t.Fatal(err)
+	}
+	checkBalances(t, coinDB, map[string]uint64{"alice": 12, "bob": 0, "carol": 0})
+}
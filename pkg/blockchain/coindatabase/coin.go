@@ -1,22 +1,27 @@
 package coindatabase
 
-import "Chain/pkg/block"
+import (
+	"Chain/pkg/block"
+	"sort"
+)
 
 // Coin is used by the CoinDatabase to keep track of unspent
 // TransactionOutputs.
 // TransactionOutput is the underlying TransactionOutput.
 // IsSpent is whether that TransactionOutput has been spent.
+// SpentHeight is the height of the Block that spent it, if it is spent.
 // Active is whether that TransactionOutput is one created by
 // Blocks on the active Chain.
 type Coin struct {
 	TransactionOutput *block.TransactionOutput
 	IsSpent           bool
+	SpentHeight       uint32
 }
 
 // CoinLocator is a dumbed down TransactionInput, used
 // as a key to Coins in the CoinDatabase's mainCache.
 type CoinLocator struct {
-	ReferenceTransactionHash string
+	ReferenceTransactionHash block.TxHash
 	OutputIndex              uint32
 }
 
@@ -27,3 +32,56 @@ func makeCoinLocator(txi *block.TransactionInput) CoinLocator {
 		OutputIndex:              txi.OutputIndex,
 	}
 }
+
+// isCoinbase returns whether the Transaction at index i of a Block is
+// a coinbase Transaction, which is the first Transaction in a Block and
+// has no inputs.
+func isCoinbase(i int, tx *block.Transaction) bool {
+	return i == 0 && len(tx.Inputs) == 0
+}
+
+// sortLocators sorts a slice of CoinLocators by ReferenceTransactionHash,
+// then OutputIndex.
+func sortLocators(locators []CoinLocator) {
+	sort.Slice(locators, func(i, j int) bool {
+		if locators[i].ReferenceTransactionHash != locators[j].ReferenceTransactionHash {
+			return locators[i].ReferenceTransactionHash < locators[j].ReferenceTransactionHash
+		}
+		return locators[i].OutputIndex < locators[j].OutputIndex
+	})
+}
+
+// DiffBlockEffects returns the Coins created by Block a but not by Block
+// b, and those created by b but not by a, each sorted. Two Blocks at the
+// same height that share Transactions create some of the same Coins, so
+// the difference shows where they diverge.
+func DiffBlockEffects(a, b *block.Block) (onlyA, onlyB []CoinLocator) {
+	createdA := createdCoins(a)
+	createdB := createdCoins(b)
+	for cl := range createdA {
+		if !createdB[cl] {
+			onlyA = append(onlyA, cl)
+		}
+	}
+	for cl := range createdB {
+		if !createdA[cl] {
+			onlyB = append(onlyB, cl)
+		}
+	}
+	sortLocators(onlyA)
+	sortLocators(onlyB)
+	return onlyA, onlyB
+}
+
+// createdCoins returns the set of Coins created by a Block's
+// Transactions.
+func createdCoins(b *block.Block) map[CoinLocator]bool {
+	created := make(map[CoinLocator]bool)
+	for _, tx := range b.Transactions {
+		txHash := tx.Hash()
+		for i := range tx.Outputs {
+			created[CoinLocator{txHash, uint32(i)}] = true
+		}
+	}
+	return created
+}
@@ -0,0 +1,30 @@
+package coindatabase
+
+import (
+	"Chain/pkg/block"
+	"reflect"
+	"testing"
+)
+
+func TestDiffBlockEffects(t *testing.T) {
+	alice := coinbase("alice", 0, 5, 7)
+	shared := spend(alice, 0, 5, "bob")
+	onlyInA := spend(alice, 1, 3, "carol")
+	onlyInA.Outputs = append(onlyInA.Outputs, &block.TransactionOutput{Amount: 4, LockingScript: "alice"})
+	onlyInB := spend(alice, 1, 7, "dave")
+	a := &block.Block{Header: &block.Header{}, Transactions: []*block.Transaction{shared, onlyInA}}
+	b := &block.Block{Header: &block.Header{Nonce: 1}, Transactions: []*block.Transaction{shared, onlyInB}}
+	onlyA, onlyB := DiffBlockEffects(a, b)
+	wantA := []CoinLocator{{onlyInA.Hash(), 0}, {onlyInA.Hash(), 1}}
+	wantB := []CoinLocator{{onlyInB.Hash(), 0}}
+	if !reflect.DeepEqual(onlyA, wantA) || !reflect.DeepEqual(onlyB, wantB) {
+		t.Errorf("got differences %v and %v, want %v and %v", onlyA, onlyB, wantA, wantB)
+	}
+	// the difference is symmetric
+	if gotB, gotA := DiffBlockEffects(b, a); !reflect.DeepEqual(gotA, wantA) || !reflect.DeepEqual(gotB, wantB) {
+		t.Errorf("swapping the blocks gave differences %v and %v, want %v and %v", gotB, gotA, wantB, wantA)
+	}
+	if onlyA, onlyB := DiffBlockEffects(a, a); len(onlyA) != 0 || len(onlyB) != 0 {
+		t.Errorf("a block differs from itself by %v and %v", onlyA, onlyB)
+	}
+}
@@ -7,108 +7,859 @@ package coindatabase
 import (
 	"Chain/pkg/block"
 	"Chain/pkg/blockchain/chainwriter"
+	"Chain/pkg/blockchain/kvstore"
 	"Chain/pkg/pro"
 	"Chain/pkg/utils"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"github.com/syndtr/goleveldb/leveldb"
 	"google.golang.org/protobuf/proto"
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"time"
 )
 
 // CoinDatabase keeps track of Coins.
-// db is a levelDB for persistent storage.
+// db is a KVStore for persistent storage, a levelDB by default.
 // mainCache stores as many Coins as possible for rapid validation.
 // mainCacheSize is how many Coins are currently in the mainCache.
 // mainCacheCapacity is the maximum number of Coins that the mainCache
-// can store before it must flush.
+// can store before it must flush, 0 if there is no mainCache.
+// reserved is the set of Coins reserved by ReserveCoins.
+// validated caches the Transactions whose inputs were found valid.
+// subsidy returns how much a Block's coinbase may mint at a height.
+// deletes counts the Coins deleted from the db since it was last
+// compacted, and compactAfter is how many trigger a compaction.
+// spentLog holds the Coins spent since DrainSpentLog was last called,
+// if logSpends is set.
+// opLog, if set, receives an entry for every change to the CoinDatabase.
+// stats counts mainCache hits and misses and db reads since the
+// CoinDatabase was created or ResetCacheStats was last called.
+// balances is the total amount of unspent Coins by locking script, nil
+// until GetBalance first builds it or after a change it cannot track.
+// mu guards the mainCache and db against the background flusher.
+// stopFlush and flushDone stop and wait for the background flusher.
+// compacting is set while a background compaction runs, and compactions
+// waits for it.
 type CoinDatabase struct {
-	db                *leveldb.DB
+	db                kvstore.KVStore
 	MainCache         map[CoinLocator]*Coin // stores as many Coins as possible for rapid validation
 	MainCacheSize     uint32                // number of Coins currently in the MainCache
 	MainCacheCapacity uint32                // the maximum number of Coins that the MainCache can store before it must flush
+	rawKeys           bool                  // whether CoinRecords are keyed by raw hash bytes instead of hex strings
+	sortedFlush       bool                  // whether the MainCache is flushed in sorted CoinLocator order
+	requireScript     bool                  // whether spends of Coins with empty LockingScripts are rejected
+	rejectZero        bool                  // whether outputs with amount zero are rejected
+	keepSpent         bool                  // whether spent Coins are marked spent in their CoinRecords instead of removed
+	binaryScripts     bool                  // whether LockingScripts are stored as bytes instead of strings
+	disableUndo       bool                  // whether UndoCoins is refused
+
+	reserved  map[CoinLocator]bool
+	validated *validationCache           // Transactions whose inputs were found valid, nil if disabled
+	subsidy   func(height uint32) uint32 // the coinbase subsidy at each height, nil if not checked
+	maxOutput uint32                     // the largest amount an output may have, 0 if unlimited
+
+	deletes      int
+	compactAfter int
+
+	stats    CacheStats
+	balances map[string]uint64
+
+	logSpends bool
+	spentLog  []SpentCoin
+	opLog     io.Writer
+
+	mu          sync.Mutex
+	stopFlush   chan struct{}
+	flushDone   chan struct{}
+	compacting  bool
+	compactions sync.WaitGroup
 }
 
-// New returns a CoinDatabase given a Config.
-func New(config *Config) *CoinDatabase {
-	db, err := leveldb.OpenFile(config.DatabasePath, nil)
+// New returns a CoinDatabase given a Config, storing CoinRecords in a
+// levelDB at the Config's DatabasePath. It returns an error if the
+// levelDB cannot be opened, wrapping kvstore.ErrLocked if another
+// process has it open.
+func New(config *Config) (*CoinDatabase, error) {
+	db, err := kvstore.OpenLevelDB(config.DatabasePath, config.RecoverFromLock)
 	if err != nil {
-		utils.Debug.Printf("Unable to initialize BlockInfoDatabase with path {%v}", config.DatabasePath)
+		return nil, fmt.Errorf("[coindatabase.New] %w", err)
+	}
+	if len(config.KeyPrefix) > 0 {
+		return newWithStore(kvstore.NewPrefixed(db, config.KeyPrefix, true), config), nil
 	}
-	return &CoinDatabase{
+	return newWithStore(db, config), nil
+}
+
+// NewWithStore returns a CoinDatabase given a Config, storing
+// CoinRecords in a KVStore. The Config's DatabasePath is ignored.
+// If the Config has a KeyPrefix, the KVStore is assumed to be shared,
+// and is left open by Close.
+func NewWithStore(db kvstore.KVStore, config *Config) *CoinDatabase {
+	if len(config.KeyPrefix) > 0 {
+		db = kvstore.NewPrefixed(db, config.KeyPrefix, false)
+	}
+	return newWithStore(db, config)
+}
+
+// newWithStore returns a CoinDatabase given a Config, storing CoinRecords
+// in a KVStore that any KeyPrefix has already been applied to.
+func newWithStore(db kvstore.KVStore, config *Config) *CoinDatabase {
+	coinDB := &CoinDatabase{
 		db:                db,
 		MainCache:         make(map[CoinLocator]*Coin),
 		MainCacheSize:     0,
 		MainCacheCapacity: config.MainCacheCapacity,
+		rawKeys:           config.RawKeys,
+		sortedFlush:       config.SortedFlush,
+		requireScript:     config.RequireNonEmptyScript,
+		rejectZero:        config.RejectZeroOutputs,
+		keepSpent:         config.KeepSpentOutputs,
+		binaryScripts:     config.BinaryLockingScripts,
+		disableUndo:       config.DisableUndo,
+		subsidy:           config.Subsidy,
+		maxOutput:         config.MaxOutputAmount,
+		reserved:          make(map[CoinLocator]bool),
+		compactAfter:      config.CompactAfterDeletes,
+		logSpends:         config.LogSpentCoins,
+		opLog:             config.OpLog,
+	}
+	if config.ValidationCacheSize > 0 {
+		coinDB.validated = newValidationCache(config.ValidationCacheSize)
+	}
+	if config.FlushInterval > 0 {
+		coinDB.stopFlush = make(chan struct{})
+		coinDB.flushDone = make(chan struct{})
+		go coinDB.flushPeriodically(config.FlushInterval)
+	}
+	return coinDB
+}
+
+// flushPeriodically flushes the mainCache every interval until Close
+// is called.
+func (coinDB *CoinDatabase) flushPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	defer close(coinDB.flushDone)
+	for {
+		select {
+		case <-ticker.C:
+			if err := coinDB.FlushMainCache(); err != nil {
+				utils.Debug.Printf("[flushPeriodically] %v", err)
+			}
+		case <-coinDB.stopFlush:
+			return
+		}
+	}
+}
+
+// Close stops the background flusher, if there is one, and closes
+// the db.
+func (coinDB *CoinDatabase) Close() error {
+	if coinDB.stopFlush != nil {
+		close(coinDB.stopFlush)
+		<-coinDB.flushDone
+		coinDB.stopFlush = nil
 	}
+	coinDB.compactions.Wait()
+	return coinDB.db.Close()
+}
+
+// Reset deletes every CoinRecord in the db and empties the mainCache,
+// reservations, and spent-coin log, leaving the db open and ready for
+// reuse.
+func (coinDB *CoinDatabase) Reset() error {
+	coinDB.mu.Lock()
+	defer coinDB.mu.Unlock()
+	batch := new(kvstore.Batch)
+	iter := coinDB.db.NewIterator()
+	for iter.Next() {
+		batch.Delete(append([]byte{}, iter.Key()...))
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return fmt.Errorf("[Reset] failed to iterate db: %w", err)
+	}
+	if err := coinDB.db.Write(batch); err != nil {
+		return fmt.Errorf("[Reset] failed to delete coin records: %w", err)
+	}
+	coinDB.MainCache = make(map[CoinLocator]*Coin)
+	coinDB.MainCacheSize = 0
+	coinDB.reserved = make(map[CoinLocator]bool)
+	coinDB.spentLog = nil
+	coinDB.balances = nil
+	if coinDB.validated != nil {
+		coinDB.validated.clear()
+	}
+	coinDB.logOp(&opEntry{Op: opReset})
+	return nil
 }
 
 // ValidateBlock returns whether a Block's Transactions are valid.
-func (coinDB *CoinDatabase) ValidateBlock(transactions []*block.Transaction) bool {
+// Transactions are validated in order, so a Transaction may spend a Coin
+// created by an earlier Transaction in the same Block, but not one
+// created by a later Transaction. No Coin may be spent twice. The total
+// of the Block's output amounts must fit in a uint64, and if rejectZero
+// is set, no output may have amount zero. If subsidy is set, no
+// Transaction may spend more than its inputs, and the coinbase output
+// total must equal subsidy(height) plus the fees of the Block's other
+// Transactions. See BlockValidator to validate Transactions as they
+// arrive.
+func (coinDB *CoinDatabase) ValidateBlock(transactions []*block.Transaction, height uint32) bool {
+	coinDB.mu.Lock()
+	defer coinDB.mu.Unlock()
+	if err := checkSpendOrder(transactions); err != nil {
+		utils.Debug.Printf("[ValidateBlock] %v", err)
+		return false
+	}
+	v := coinDB.NewBlockValidator(height)
+	// mu is held throughout, so CoinRecords cannot change between reads
+	v.records = make(map[block.TxHash]*CoinRecord)
 	for _, tx := range transactions {
-		if err := coinDB.validateTransaction(tx); err != nil {
-			utils.Debug.Printf("%v", err)
+		if err := v.feed(tx); err != nil {
+			utils.Debug.Printf("[ValidateBlock] %v", err)
 			return false
 		}
 	}
+	if err := v.Finish(); err != nil {
+		utils.Debug.Printf("[ValidateBlock] %v", err)
+		return false
+	}
 	return true
 }
 
+// checkSpendOrder returns an error if a Transaction spends a Coin created
+// by itself or by a later Transaction in the same Block, or if a
+// Transaction other than the coinbase has malformed inputs.
+func checkSpendOrder(transactions []*block.Transaction) error {
+	positions := make(map[block.TxHash]int, len(transactions))
+	for i, tx := range transactions {
+		// malformed inputs are rejected before hashing
+		if !isCoinbase(i, tx) {
+			if err := checkInputs(tx); err != nil {
+				return fmt.Errorf("transaction {%v}: %w", i, err)
+			}
+		}
+		if _, ok := positions[tx.Hash()]; !ok {
+			positions[tx.Hash()] = i
+		}
+	}
+	for i, tx := range transactions {
+		if isCoinbase(i, tx) {
+			continue
+		}
+		for _, txi := range tx.Inputs {
+			if j, ok := positions[txi.ReferenceTransactionHash]; ok && j >= i {
+				return fmt.Errorf("transaction {%v} spends a coin created by transaction {%v}", i, j)
+			}
+		}
+	}
+	return nil
+}
+
+// PreviewBlock returns the Coins a Block's Transactions would spend and
+// create if the Block were stored, without changing the CoinDatabase.
+// It returns an error if any Transaction is invalid. Since the Block's
+// height is not known, a Config's Subsidy is not checked.
+func (coinDB *CoinDatabase) PreviewBlock(transactions []*block.Transaction) (spends []CoinLocator, creates []CoinLocator, err error) {
+	coinDB.mu.Lock()
+	defer coinDB.mu.Unlock()
+	if err := checkSpendOrder(transactions); err != nil {
+		return nil, nil, fmt.Errorf("[PreviewBlock] %w", err)
+	}
+	v := coinDB.NewBlockValidator(0)
+	for i, tx := range transactions {
+		if err := v.feed(tx); err != nil {
+			return nil, nil, fmt.Errorf("[PreviewBlock] %w", err)
+		}
+		if !isCoinbase(i, tx) {
+			for _, txi := range tx.Inputs {
+				spends = append(spends, makeCoinLocator(txi))
+			}
+		}
+		txHash := tx.Hash()
+		for j := range tx.Outputs {
+			creates = append(creates, CoinLocator{txHash, uint32(j)})
+		}
+	}
+	return spends, creates, nil
+}
+
+// transactionFee returns how much a Transaction's input amounts exceed
+// its output amounts. Inputs spending Coins in created are looked up
+// there, and all others in the CoinDatabase, reusing and adding to
+// records if it is non-nil. It returns an error if an input cannot be
+// found or if the outputs exceed the inputs.
+func (coinDB *CoinDatabase) transactionFee(tx *block.Transaction, created map[CoinLocator]*Coin, records map[block.TxHash]*CoinRecord) (uint64, error) {
+	var inputTotal, outputTotal uint64
+	for _, txi := range tx.Inputs {
+		cl := makeCoinLocator(txi)
+		coin, ok := created[cl]
+		if !ok {
+			var err error
+			if coin, err = coinDB.getCoinWithRecords(cl, records); err != nil {
+				return 0, fmt.Errorf("[transactionFee] %w", err)
+			}
+		}
+		if coin == nil {
+			return 0, fmt.Errorf("[transactionFee] coin {%v} not found", cl)
+		}
+		inputTotal += uint64(coin.TransactionOutput.Amount)
+	}
+	for _, txo := range tx.Outputs {
+		outputTotal += uint64(txo.Amount)
+	}
+	if outputTotal > inputTotal {
+		return 0, fmt.Errorf("[transactionFee] transaction {%v} spends {%v} but its inputs total {%v}", tx.Hash(), outputTotal, inputTotal)
+	}
+	return inputTotal - outputTotal, nil
+}
+
 // validateTransaction checks whether a Transaction's inputs are valid Coins.
-// If the Coins have already been spent or do not exist, validateTransaction
-// returns an error.
-func (coinDB *CoinDatabase) validateTransaction(transaction *block.Transaction) error {
+// The caller has already rejected malformed inputs with checkInputs and
+// passes the Transaction's hash, so that it is computed only once.
+// Inputs spending Coins in created, which were created earlier in the
+// same Block, are valid. Transactions in the validation cache are valid
+// without checking, and Transactions whose inputs are all found valid in
+// the mainCache or db are added to it. If the Coins have already been spent or do not
+// exist, or if requireScript is set and a Coin's LockingScript is empty,
+// validateTransaction returns an error.
+func (coinDB *CoinDatabase) validateTransaction(transaction *block.Transaction, txHash block.TxHash, created map[CoinLocator]*Coin, records map[block.TxHash]*CoinRecord) error {
+	if coinDB.validated != nil && coinDB.validated.contains(txHash) {
+		return nil
+	}
+	cacheable := true
 	for _, txi := range transaction.Inputs {
 		key := makeCoinLocator(txi)
+		if coin, ok := created[key]; ok {
+			// validity depends on the rest of the Block, so it is not cached
+			cacheable = false
+			if err := coinDB.checkLockingScript(key, coin.TransactionOutput.LockingScript); err != nil {
+				return err
+			}
+			continue
+		}
 		if coin, ok := coinDB.MainCache[key]; ok {
+			coinDB.stats.Hits++
 			if coin.IsSpent {
 				return fmt.Errorf("[validateTransaction] coin already spent")
 			}
+			if err := coinDB.checkLockingScript(key, coin.TransactionOutput.LockingScript); err != nil {
+				return err
+			}
 			continue
 		}
-		if data, err := coinDB.db.Get([]byte(txi.ReferenceTransactionHash), nil); err != nil {
-			return fmt.Errorf("[validateTransaction] coin not in leveldb")
-		} else {
-			pcr := &pro.CoinRecord{}
-			if err2 := proto.Unmarshal(data, pcr); err2 != nil {
-				utils.Debug.Printf("Failed to unmarshal record from hash {%v}:", txi.ReferenceTransactionHash, err)
+		coinDB.stats.Misses++
+		cr, err := coinDB.decodedRecord(txi.ReferenceTransactionHash, records)
+		if err != nil {
+			return fmt.Errorf("[validateTransaction] %w", err)
+		}
+		txo, ok := cr.output(cr.unspentIndex(txi.OutputIndex))
+		if !ok {
+			return fmt.Errorf("[validateTransaction] coin record did not still contain output required for transaction input ")
+		}
+		if err := coinDB.checkLockingScript(key, txo.LockingScript); err != nil {
+			return err
+		}
+	}
+	if coinDB.validated != nil && cacheable {
+		coinDB.validated.add(txHash, transaction)
+	}
+	return nil
+}
+
+// checkInputs returns an error if a Transaction has no inputs, or if
+// one of its inputs is nil or does not reference a well-formed
+// Transaction hash, so that malformed Transactions are rejected before
+// any db lookup.
+func checkInputs(tx *block.Transaction) error {
+	if len(tx.Inputs) == 0 {
+		return fmt.Errorf("transaction has no inputs")
+	}
+	for i, txi := range tx.Inputs {
+		switch {
+		case txi == nil:
+			return fmt.Errorf("input {%v} is nil", i)
+		case txi.ReferenceTransactionHash == "":
+			return fmt.Errorf("input {%v} has an empty reference transaction hash", i)
+		case len(txi.ReferenceTransactionHash) != hex.EncodedLen(sha256.Size):
+			return fmt.Errorf("input {%v} has reference transaction hash {%v} of length {%v}, expected {%v}", i, txi.ReferenceTransactionHash, len(txi.ReferenceTransactionHash), hex.EncodedLen(sha256.Size))
+		}
+	}
+	return nil
+}
+
+// checkLockingScript returns an error if requireScript is set and the
+// LockingScript of the Coin being spent is empty.
+func (coinDB *CoinDatabase) checkLockingScript(cl CoinLocator, lockingScript string) error {
+	if coinDB.requireScript && lockingScript == "" {
+		return fmt.Errorf("[validateTransaction] coin {%v} has an empty locking script", cl)
+	}
+	return nil
+}
+
+// ValidateWithOverlay checks whether a Transaction's inputs are valid
+// Coins as if a set of pending Transactions had already been applied,
+// without changing the CoinDatabase. Coins in spent are treated as
+// spent, and Coins in created are treated as unspent; all other Coins
+// are checked against the CoinDatabase. Coins reserved by ReserveCoins
+// are rejected, so that pending Transactions do not reuse them.
+// Malformed inputs are rejected, as by ValidateBlock, before any Coin is
+// looked up.
+func (coinDB *CoinDatabase) ValidateWithOverlay(tx *block.Transaction, spent map[CoinLocator]bool, created map[CoinLocator]*Coin) error {
+	if err := checkInputs(tx); err != nil {
+		return fmt.Errorf("[ValidateWithOverlay] %w", err)
+	}
+	coinDB.mu.Lock()
+	defer coinDB.mu.Unlock()
+	seen := make(map[CoinLocator]bool, len(tx.Inputs))
+	for _, txi := range tx.Inputs {
+		cl := makeCoinLocator(txi)
+		if spent[cl] || seen[cl] {
+			return fmt.Errorf("[ValidateWithOverlay] coin {%v} already spent", cl)
+		}
+		seen[cl] = true
+		if coinDB.reserved[cl] {
+			return fmt.Errorf("[ValidateWithOverlay] coin {%v} is reserved", cl)
+		}
+		if coin, ok := created[cl]; ok && !coin.IsSpent {
+			continue
+		}
+		unspent, err := coinDB.isUnspent(cl)
+		if err != nil {
+			return fmt.Errorf("[ValidateWithOverlay] %w", err)
+		}
+		if !unspent {
+			return fmt.Errorf("[ValidateWithOverlay] coin {%v} is spent or does not exist", cl)
+		}
+	}
+	return nil
+}
+
+// ReserveCoins reserves a set of Coins, so that later calls to
+// ReserveCoins cannot reserve them again and ValidateWithOverlay
+// rejects Transactions spending them. Either all of the Coins are
+// reserved, or, if any Coin is spent, missing, or already reserved,
+// none are and an error naming the first such Coin is returned.
+// Reservations are kept in memory only and are dropped when the Coin
+// is spent by a stored Block.
+func (coinDB *CoinDatabase) ReserveCoins(locators []CoinLocator) error {
+	coinDB.mu.Lock()
+	defer coinDB.mu.Unlock()
+	seen := make(map[CoinLocator]bool, len(locators))
+	for _, cl := range locators {
+		if coinDB.reserved[cl] || seen[cl] {
+			return fmt.Errorf("[ReserveCoins] coin {%v} is already reserved", cl)
+		}
+		unspent, err := coinDB.isUnspent(cl)
+		if err != nil {
+			return fmt.Errorf("[ReserveCoins] %w", err)
+		}
+		if !unspent {
+			return fmt.Errorf("[ReserveCoins] coin {%v} is spent or does not exist", cl)
+		}
+		seen[cl] = true
+	}
+	for cl := range seen {
+		coinDB.reserved[cl] = true
+	}
+	return nil
+}
+
+// ReleaseCoins releases Coins reserved by ReserveCoins. Coins that are
+// not reserved are ignored.
+func (coinDB *CoinDatabase) ReleaseCoins(locators []CoinLocator) {
+	coinDB.mu.Lock()
+	defer coinDB.mu.Unlock()
+	for _, cl := range locators {
+		delete(coinDB.reserved, cl)
+	}
+}
+
+// isUnspent returns whether a Coin exists and has not been spent,
+// checking the mainCache before the db. It returns an error if the
+// Coin's CoinRecord cannot be read.
+func (coinDB *CoinDatabase) isUnspent(cl CoinLocator) (bool, error) {
+	if coin, ok := coinDB.MainCache[cl]; ok {
+		return !coin.IsSpent, nil
+	}
+	cr, err := coinDB.getCoinRecordFromDB(cl.ReferenceTransactionHash)
+	if err != nil {
+		return false, err
+	}
+	return cr != nil && cr.unspentIndex(cl.OutputIndex) >= 0, nil
+}
+
+// recordKey returns the db key for the CoinRecord of a Transaction.
+// If the CoinDatabase uses raw keys, the hex-encoded hash is decoded
+// to its raw bytes. Hashes that are not valid hex are used as is.
+func (coinDB *CoinDatabase) recordKey(txHash block.TxHash) []byte {
+	if coinDB.rawKeys {
+		if key, err := hex.DecodeString(string(txHash)); err == nil {
+			return key
+		}
+	}
+	return []byte(txHash)
+}
+
+// txHashFromKey returns the Transaction hash for a CoinRecord's db key,
+// undoing recordKey.
+func (coinDB *CoinDatabase) txHashFromKey(key []byte) block.TxHash {
+	if coinDB.rawKeys && len(key) == sha256.Size {
+		return block.TxHash(hex.EncodeToString(key))
+	}
+	return block.TxHash(key)
+}
+
+// MigrateToRawKeys rewrites every CoinRecord keyed by a hex-encoded
+// hash to be keyed by the raw hash bytes instead. It is the migration
+// path for turning on RawKeys for an existing db, and must be called
+// before any other method once RawKeys is set. All keys are rewritten
+// in a single batch.
+func (coinDB *CoinDatabase) MigrateToRawKeys() error {
+	coinDB.mu.Lock()
+	defer coinDB.mu.Unlock()
+	batch := new(kvstore.Batch)
+	iter := coinDB.db.NewIterator()
+	for iter.Next() {
+		key := string(iter.Key())
+		rawKey, err := hex.DecodeString(key)
+		if err != nil || len(rawKey) == 0 {
+			continue
+		}
+		batch.Delete([]byte(key))
+		batch.Put(rawKey, append([]byte{}, iter.Value()...))
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return fmt.Errorf("[MigrateToRawKeys] failed to iterate db: %w", err)
+	}
+	if err := coinDB.db.Write(batch); err != nil {
+		return fmt.Errorf("[MigrateToRawKeys] failed to write coin records: %w", err)
+	}
+	coinDB.logOp(&opEntry{Op: opRawKeys})
+	return nil
+}
+
+// MigrateRecords rewrites every CoinRecord in the db of an older version
+// to the current CoinRecordVersion. Each such record is passed to
+// upgrade, and the returned record is written back with its version set
+// to CoinRecordVersion, encoded as the CoinDatabase encodes any other
+// record. Records already at CoinRecordVersion are left as they are.
+// The mainCache is flushed first, so that it cannot later overwrite the
+// migrated records, and Coins of records that needed migrating are
+// flushed once they are migrated. All records are written in a single
+// batch, so either every record is migrated or none are. It returns an
+// error if an upgraded record cannot be decoded or a Coin still cannot
+// be flushed.
+func (coinDB *CoinDatabase) MigrateRecords(upgrade func(old *pro.CoinRecord) *pro.CoinRecord) error {
+	coinDB.mu.Lock()
+	defer coinDB.mu.Unlock()
+	coinDB.flushMainCache() // ignore error; Coins of old records are flushed after migrating
+	batch := new(kvstore.Batch)
+	// upgrade cannot be logged, so the records it produced are instead
+	var migrated []loggedRecord
+	iter := coinDB.db.NewIterator()
+	for iter.Next() {
+		old := &pro.CoinRecord{}
+		if err := pro.Unmarshal(string(coinDB.txHashFromKey(iter.Key())), iter.Value(), old); err != nil {
+			iter.Release()
+			return fmt.Errorf("[MigrateRecords] %w", err)
+		}
+		if old.GetVersion() == CoinRecordVersion {
+			continue
+		}
+		record := upgrade(old)
+		record.Version = CoinRecordVersion
+		cr, err := DecodeCoinRecord(record)
+		if err != nil {
+			iter.Release()
+			return fmt.Errorf("[MigrateRecords] upgraded record {%v}: %w", string(iter.Key()), err)
+		}
+		bytes, err := proto.Marshal(coinDB.encodeRecord(cr))
+		if err != nil {
+			iter.Release()
+			return fmt.Errorf("[MigrateRecords] failed to marshal record {%v}: %w", string(iter.Key()), err)
+		}
+		key := append([]byte{}, iter.Key()...)
+		batch.Put(key, bytes)
+		migrated = append(migrated, loggedRecord{Key: key, Value: bytes})
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return fmt.Errorf("[MigrateRecords] failed to iterate db: %w", err)
+	}
+	if err := coinDB.db.Write(batch); err != nil {
+		return fmt.Errorf("[MigrateRecords] failed to write coin records: %w", err)
+	}
+	// upgrade may change any record, so balances are rebuilt
+	coinDB.balances = nil
+	coinDB.logOp(&opEntry{Op: opMigrate, Records: migrated})
+	if err := coinDB.flushMainCache(); err != nil {
+		return fmt.Errorf("[MigrateRecords] %w", err)
+	}
+	return nil
+}
+
+// UTXOSetHash returns a SHA-256 digest of the entire UTXO set. It
+// flushes the mainCache, then folds every unspent Coin's Transaction
+// hash, output index, amount, and locking script into the digest in
+// sorted CoinLocator order, so two CoinDatabases with identical UTXO
+// sets produce identical hashes.
+func (coinDB *CoinDatabase) UTXOSetHash() ([]byte, error) {
+	coinDB.mu.Lock()
+	defer coinDB.mu.Unlock()
+	if err := coinDB.flushMainCache(); err != nil {
+		return nil, fmt.Errorf("[UTXOSetHash] %w", err)
+	}
+	records, txHashes, err := coinDB.sortedRecords()
+	if err != nil {
+		return nil, fmt.Errorf("[UTXOSetHash] %w", err)
+	}
+	h := sha256.New()
+	buf := make([]byte, 4)
+	writeString := func(str string) {
+		binary.BigEndian.PutUint32(buf, uint32(len(str)))
+		h.Write(buf)
+		h.Write([]byte(str))
+	}
+	for _, txHash := range txHashes {
+		cr := records[txHash]
+		for _, i := range cr.sortedPositions() {
+			writeString(string(txHash))
+			binary.BigEndian.PutUint32(buf, cr.OutputIndexes[i])
+			h.Write(buf)
+			binary.BigEndian.PutUint32(buf, cr.Amounts[i])
+			h.Write(buf)
+			writeString(cr.LockingScripts[i])
+		}
+	}
+	return h.Sum(nil), nil
+}
+
+// ErrInsufficientFunds is returned by SelectCoins when the unspent Coins
+// of a locking script do not add up to the target amount.
+var ErrInsufficientFunds = errors.New("insufficient funds")
+
+// SelectCoins selects unspent, unreserved Coins locked by a script until
+// their amounts add up to at least target, returning their CoinLocators
+// and total amount. Coins are considered in sorted CoinLocator order, so
+// the same CoinDatabase always gives the same selection. It returns an
+// error wrapping ErrInsufficientFunds if there are not enough Coins.
+func (coinDB *CoinDatabase) SelectCoins(script string, target uint32) ([]CoinLocator, uint32, error) {
+	coinDB.mu.Lock()
+	defer coinDB.mu.Unlock()
+	if err := coinDB.flushMainCache(); err != nil {
+		return nil, 0, fmt.Errorf("[SelectCoins] %w", err)
+	}
+	records, txHashes, err := coinDB.sortedRecords()
+	if err != nil {
+		return nil, 0, fmt.Errorf("[SelectCoins] %w", err)
+	}
+	var selected []CoinLocator
+	var total uint64
+	for _, txHash := range txHashes {
+		if total >= uint64(target) {
+			break
+		}
+		cr := records[txHash]
+		for _, i := range cr.sortedPositions() {
+			if total >= uint64(target) {
+				break
+			}
+			cl := CoinLocator{txHash, cr.OutputIndexes[i]}
+			if cr.LockingScripts[i] != script || coinDB.reserved[cl] {
+				continue
 			}
-			cr := DecodeCoinRecord(pcr)
-			if !contains(cr.OutputIndexes, txi.OutputIndex) {
-				return fmt.Errorf("[validateTransaction] coin record did not still contain output required for transaction input ")
+			selected = append(selected, cl)
+			total += uint64(cr.Amounts[i])
+		}
+	}
+	if total < uint64(target) {
+		return nil, 0, fmt.Errorf("[SelectCoins] %w: have {%v}, need {%v}", ErrInsufficientFunds, total, target)
+	}
+	if total > math.MaxUint32 {
+		return nil, 0, fmt.Errorf("[SelectCoins] selected total {%v} overflows uint32", total)
+	}
+	return selected, uint32(total), nil
+}
+
+// sortedRecords returns every CoinRecord in the db, keyed by Transaction
+// hash, along with the sorted Transaction hashes. The caller must hold
+// mu and should flush the mainCache first.
+func (coinDB *CoinDatabase) sortedRecords() (map[block.TxHash]*CoinRecord, []block.TxHash, error) {
+	records := make(map[block.TxHash]*CoinRecord)
+	var txHashes []block.TxHash
+	iter := coinDB.db.NewIterator()
+	defer iter.Release()
+	for iter.Next() {
+		txHash := coinDB.txHashFromKey(iter.Key())
+		pcr := &pro.CoinRecord{}
+		if err := pro.Unmarshal(string(txHash), iter.Value(), pcr); err != nil {
+			return nil, nil, err
+		}
+		cr, err := DecodeCoinRecord(pcr)
+		if err != nil {
+			return nil, nil, err
+		}
+		records[txHash] = cr
+		txHashes = append(txHashes, txHash)
+	}
+	if err := iter.Error(); err != nil {
+		return nil, nil, fmt.Errorf("failed to iterate db: %w", err)
+	}
+	sort.Slice(txHashes, func(i, j int) bool { return txHashes[i] < txHashes[j] })
+	return records, txHashes, nil
+}
+
+// RemoveBlockCoins removes every Coin created by a Block's Transactions,
+// deleting their CoinRecords in a single batch and dropping the Coins
+// from the mainCache, to clean up after a Block that failed partway
+// through being applied. Coins the Block spent are not restored; use
+// UndoCoins for a Block that was fully applied.
+func (coinDB *CoinDatabase) RemoveBlockCoins(transactions []*block.Transaction) error {
+	coinDB.mu.Lock()
+	defer coinDB.mu.Unlock()
+	batch := new(kvstore.Batch)
+	for _, tx := range transactions {
+		batch.Delete(coinDB.recordKey(tx.Hash()))
+	}
+	if err := coinDB.db.Write(batch); err != nil {
+		return fmt.Errorf("[RemoveBlockCoins] failed to delete coin records: %w", err)
+	}
+	// the Block may have been applied only in part, so balances are
+	// rebuilt rather than adjusted
+	coinDB.balances = nil
+	for _, tx := range transactions {
+		txHash := tx.Hash()
+		for i := range tx.Outputs {
+			cl := CoinLocator{txHash, uint32(i)}
+			coinDB.invalidateSpends(cl)
+			if _, ok := coinDB.MainCache[cl]; ok {
+				delete(coinDB.MainCache, cl)
+				coinDB.MainCacheSize -= 1
 			}
 		}
 	}
+	coinDB.logOp(&opEntry{Op: opRemove, Transactions: transactions})
 	return nil
 }
 
-// UndoCoins handles reverting a Block. It:
+// UndoCoins handles reverting Blocks. For each Block, it:
 //
-//	(1) erases the Coins created by a Block
+//	(1) erases the Coins created by the Block
 //	(2) marks the Coins used to create those Transactions as unspent.
 //
+// The changes are staged and only applied once every Block has been
+// reverted, with all db changes written in a single batch, so if any
+// UndoBlock is invalid UndoCoins returns an error and leaves the
+// CoinDatabase unchanged. An UndoBlock that restores a Coin that is not
+// spent is invalid. If undo is disabled, UndoCoins returns an error
+// wrapping chainwriter.ErrUndoDisabled.
+//
 // Block inputs are in reversed order. https://edstem.org/us/courses/36337/discussion/2578832
-func (coinDB *CoinDatabase) UndoCoins(blocks []*block.Block, undoBlocks []*chainwriter.UndoBlock) {
+func (coinDB *CoinDatabase) UndoCoins(blocks []*block.Block, undoBlocks []*chainwriter.UndoBlock) error {
+	coinDB.mu.Lock()
+	defer coinDB.mu.Unlock()
+	if coinDB.disableUndo {
+		return fmt.Errorf("[UndoCoins] %w", chainwriter.ErrUndoDisabled)
+	}
+	if err := coinDB.undoCoins(blocks, undoBlocks, false); err != nil {
+		return fmt.Errorf("[UndoCoins] %w", err)
+	}
+	coinDB.logOp(&opEntry{Op: opUndo, Blocks: blocks, UndoBlocks: undoBlocks})
+	for i := range blocks {
+		coinDB.undoBalances(blocks[i], undoBlocks[i])
+	}
+	return nil
+}
+
+// RollbackCoins reverts a Block like UndoCoins, except that the Block
+// may have been only partly stored, as after a crash, so Coins its
+// UndoBlock lists that are still unspent are left as they are instead
+// of being rejected.
+func (coinDB *CoinDatabase) RollbackCoins(b *block.Block, undoBlock *chainwriter.UndoBlock) error {
+	coinDB.mu.Lock()
+	defer coinDB.mu.Unlock()
+	if err := coinDB.undoCoins([]*block.Block{b}, []*chainwriter.UndoBlock{undoBlock}, true); err != nil {
+		return fmt.Errorf("[RollbackCoins] %w", err)
+	}
+	coinDB.logOp(&opEntry{Op: opRollback, Blocks: []*block.Block{b}, UndoBlocks: []*chainwriter.UndoBlock{undoBlock}})
+	// how much of the Block was applied is unknown, so balances are
+	// rebuilt rather than adjusted
+	coinDB.balances = nil
+	return nil
+}
+
+// undoCoins stages and commits the reversion of Blocks for UndoCoins and
+// RollbackCoins. If partial is set, UndoBlocks may restore Coins that
+// are not spent. The caller must hold mu.
+func (coinDB *CoinDatabase) undoCoins(blocks []*block.Block, undoBlocks []*chainwriter.UndoBlock, partial bool) error {
+	if len(blocks) != len(undoBlocks) {
+		return fmt.Errorf("got {%v} blocks but {%v} undo blocks", len(blocks), len(undoBlocks))
+	}
+	stage := &undoStage{
+		coinDB:   coinDB,
+		records:  make(map[block.TxHash]*CoinRecord),
+		restored: make(map[CoinLocator]bool),
+		partial:  partial,
+	}
 	for i := 0; i < len(blocks); i++ {
 		for _, tx := range blocks[i].Transactions {
-			coinDB.removeCreatedCoins(tx)
+			if err := stage.removeCreatedCoins(tx); err != nil {
+				return fmt.Errorf("block {%v}: %w", i, err)
+			}
+		}
+		if err := stage.markCoinsUnspent(undoBlocks[i]); err != nil {
+			return fmt.Errorf("block {%v}: %w", i, err)
 		}
-		coinDB.markCoinsUnspent(undoBlocks[i])
 	}
+	return stage.commit()
 }
 
 // addCoinToRecord adds a Coin to a CoinRecord given an UndoBlock and index,
 // returning the updated CoinRecord.
 func (coinDB *CoinDatabase) addCoinToRecord(cr *CoinRecord, ub *chainwriter.UndoBlock, index int) *CoinRecord {
-	cr.OutputIndexes = append(cr.OutputIndexes, ub.OutputIndexes[index])
-	cr.Amounts = append(cr.Amounts, ub.Amounts[index])
-	cr.LockingScripts = append(cr.LockingScripts, ub.LockingScripts[index])
+	cr.addCoin(ub.OutputIndexes[index], ub.Amounts[index], ub.LockingScripts[index], false, 0)
 	return cr
 }
 
-// FlushMainCache flushes the mainCache to the db.
-func (coinDB *CoinDatabase) FlushMainCache() {
+// FlushMainCache flushes the mainCache to the db. It returns an error
+// if a Coin could not be flushed, as flushCoins does; every other Coin
+// is still flushed.
+func (coinDB *CoinDatabase) FlushMainCache() error {
+	coinDB.mu.Lock()
+	defer coinDB.mu.Unlock()
+	if err := coinDB.flushMainCache(); err != nil {
+		return fmt.Errorf("[FlushMainCache] %w", err)
+	}
+	coinDB.logOp(&opEntry{Op: opFlush})
+	return nil
+}
+
+// flushMainCache flushes the mainCache to the db. The caller must hold mu.
+func (coinDB *CoinDatabase) flushMainCache() error {
+	return coinDB.flushCoins(coinDB.cacheLocators())
+}
+
+// flushCoins writes the Coins at some of the mainCache's CoinLocators to
+// the db and removes them from the mainCache. Unspent Coins are merged
+// into their CoinRecords with MergeCoinRecords rather than assumed to be
+// there, so a CoinRecord that lost a cached Coin, or was deleted, gets it
+// back. A Coin whose CoinRecord is corrupt, of an unknown version, or
+// conflicts with it is kept in the mainCache and its CoinRecord is left
+// as it is; flushCoins returns the first such error after flushing the
+// other Coins.
+func (coinDB *CoinDatabase) flushCoins(locators []CoinLocator) error {
+	var firstErr error
 	// update coin records
-	updatedCoinRecords := make(map[string]*CoinRecord)
-	for cl := range coinDB.MainCache {
+	updatedCoinRecords := make(map[block.TxHash]*CoinRecord)
+	var updatedKeys []block.TxHash
+	for _, cl := range locators {
 		// check whether we already updated this record
 		var cr *CoinRecord
 
@@ -119,28 +870,50 @@ func (coinDB *CoinDatabase) FlushMainCache() {
 			cr = cr2
 		} else {
 			// if we haven't already update this coin record, retrieve from db
-			data, err := coinDB.db.Get([]byte(cl.ReferenceTransactionHash), nil)
+			var err error
+			cr, err = coinDB.decodedRecord(cl.ReferenceTransactionHash, nil)
+			if errors.Is(err, kvstore.ErrNotFound) {
+				cr, err = &CoinRecord{Version: CoinRecordVersion}, nil
+			}
 			if err != nil {
-				utils.Debug.Printf("[FlushMainCache] coin record not in leveldb")
+				// leave corrupt records and records of an unknown version untouched
+				if firstErr == nil {
+					firstErr = fmt.Errorf("[flushCoins] coin {%v}: %w", cl, err)
+				}
+				continue
 			}
-			pcr := &pro.CoinRecord{}
-			if err = proto.Unmarshal(data, pcr); err != nil {
-				utils.Debug.Printf("Failed to unmarshal record from hash {%v}:%v", cl.ReferenceTransactionHash, err)
+		}
+		// (2) remove the coin from the record if it's been spent, and
+		// otherwise make sure the record holds it
+		if coin := coinDB.MainCache[cl]; coin.IsSpent {
+			cr = coinDB.spendCoinInRecord(cr, cl.OutputIndex, coin.SpentHeight)
+			if !coinDB.keepSpent {
+				coinDB.noteDeletes(1)
 			}
-			cr = DecodeCoinRecord(pcr)
+		} else {
+			cached := &CoinRecord{Version: CoinRecordVersion}
+			cached.addCoin(cl.OutputIndex, coin.TransactionOutput.Amount, coin.TransactionOutput.LockingScript, false, 0)
+			merged, err := MergeCoinRecords(cr, cached)
+			if err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("[flushCoins] coin {%v}: %w", cl, err)
+				}
+				continue
+			}
+			cr = merged
 		}
-		// (2) remove the coin from the record if it's been spent
-		if coinDB.MainCache[cl].IsSpent {
-			cr = coinDB.removeCoinFromRecord(cr, cl.OutputIndex)
+		if _, ok := updatedCoinRecords[cl.ReferenceTransactionHash]; !ok {
+			updatedKeys = append(updatedKeys, cl.ReferenceTransactionHash)
 		}
 		updatedCoinRecords[cl.ReferenceTransactionHash] = cr
 		delete(coinDB.MainCache, cl)
 	}
-	coinDB.MainCacheSize = 0
+	coinDB.MainCacheSize = uint32(len(coinDB.MainCache))
 	// write the new records
-	for key, cr := range updatedCoinRecords {
+	for _, key := range updatedKeys {
+		cr := updatedCoinRecords[key]
 		if len(cr.OutputIndexes) == 0 {
-			err := coinDB.db.Delete([]byte(key), nil)
+			err := coinDB.db.Delete(coinDB.recordKey(key))
 			if err != nil {
 				utils.Debug.Printf("[FlushMainCache] failed to delete key {%v}", key)
 			}
@@ -148,6 +921,130 @@ func (coinDB *CoinDatabase) FlushMainCache() {
 			coinDB.putRecordInDB(key, cr)
 		}
 	}
+	return firstErr
+}
+
+// SetCacheCapacity changes the MainCacheCapacity. If the mainCache
+// holds more Coins than the new capacity, it is flushed.
+func (coinDB *CoinDatabase) SetCacheCapacity(newCap uint32) {
+	coinDB.mu.Lock()
+	defer coinDB.mu.Unlock()
+	coinDB.MainCacheCapacity = newCap
+	if size := uint32(len(coinDB.MainCache)); size > newCap {
+		if err := coinDB.flushCoins(coinDB.evictionOrder()[:size-newCap]); err != nil {
+			utils.Debug.Printf("[SetCacheCapacity] %v", err)
+		}
+	}
+	coinDB.logOp(&opEntry{Op: opCapacity, Capacity: newCap})
+}
+
+// makeRoom flushes part of the mainCache if it is full, so that a Coin
+// can be added without the mainCache exceeding its capacity. Only a
+// quarter of the mainCache is flushed at a time, spent Coins first, so
+// its size stays near capacity instead of dropping to zero. It returns
+// false if the mainCache has no capacity at all.
+func (coinDB *CoinDatabase) makeRoom() bool {
+	if coinDB.MainCacheCapacity == 0 {
+		return false
+	}
+	size := uint32(len(coinDB.MainCache))
+	if size < coinDB.MainCacheCapacity {
+		return true
+	}
+	n := size - coinDB.MainCacheCapacity + coinDB.MainCacheCapacity/4
+	if n == 0 {
+		n = 1
+	}
+	if n > size {
+		n = size
+	}
+	if err := coinDB.flushCoins(coinDB.evictionOrder()[:n]); err != nil {
+		utils.Debug.Printf("[makeRoom] %v", err)
+	}
+	return true
+}
+
+// evictionOrder returns the mainCache's CoinLocators in the order they
+// should be flushed to make room: spent Coins, which must be written
+// anyway, before unspent ones.
+func (coinDB *CoinDatabase) evictionOrder() []CoinLocator {
+	locators := coinDB.cacheLocators()
+	sort.SliceStable(locators, func(i, j int) bool {
+		return coinDB.MainCache[locators[i]].IsSpent && !coinDB.MainCache[locators[j]].IsSpent
+	})
+	return locators
+}
+
+// Prefetch loads the unspent Coins in the CoinRecords of the given
+// Transactions into the mainCache, so that validating a Block whose
+// inputs spend them does not go to the db. Prefetching stops when the
+// mainCache is full rather than flushing it, and Coins already in the
+// mainCache are left as they are.
+func (coinDB *CoinDatabase) Prefetch(txHashes []block.TxHash) {
+	coinDB.mu.Lock()
+	defer coinDB.mu.Unlock()
+	seen := make(map[block.TxHash]bool, len(txHashes))
+	for _, txHash := range txHashes {
+		if seen[txHash] {
+			continue
+		}
+		seen[txHash] = true
+		cr, err := coinDB.getCoinRecordFromDB(txHash)
+		if err != nil {
+			// prefetching is only a hint, so a bad record is left for
+			// whoever reads it to report
+			utils.Debug.Printf("[Prefetch] %v", err)
+			continue
+		}
+		if cr == nil {
+			continue
+		}
+		for i, outputIndex := range cr.OutputIndexes {
+			cl := CoinLocator{txHash, outputIndex}
+			if _, ok := coinDB.MainCache[cl]; ok || cr.isSpent(i) {
+				continue
+			}
+			txo, ok := cr.output(i)
+			if !ok {
+				continue
+			}
+			if coinDB.MainCacheSize >= coinDB.MainCacheCapacity {
+				return
+			}
+			coinDB.MainCache[cl] = &Coin{TransactionOutput: txo}
+			coinDB.MainCacheSize += 1
+		}
+	}
+}
+
+// CacheBreakdown returns how many Coins in the mainCache are unspent and
+// how many are spent. Spent Coins are removed from their CoinRecords on
+// the next flush.
+func (coinDB *CoinDatabase) CacheBreakdown() (live int, spent int) {
+	coinDB.mu.Lock()
+	defer coinDB.mu.Unlock()
+	for _, coin := range coinDB.MainCache {
+		if coin.IsSpent {
+			spent++
+		} else {
+			live++
+		}
+	}
+	return live, spent
+}
+
+// cacheLocators returns the CoinLocators of the Coins in the mainCache.
+// If the CoinDatabase flushes in sorted order, they are sorted by
+// ReferenceTransactionHash, then OutputIndex.
+func (coinDB *CoinDatabase) cacheLocators() []CoinLocator {
+	locators := make([]CoinLocator, 0, len(coinDB.MainCache))
+	for cl := range coinDB.MainCache {
+		locators = append(locators, cl)
+	}
+	if coinDB.sortedFlush {
+		sortLocators(locators)
+	}
+	return locators
 }
 
 // StoreBlock handles storing a newly minted Block. It:
@@ -157,39 +1054,124 @@ func (coinDB *CoinDatabase) FlushMainCache() {
 //	(3) stores CoinRecords for the Transactions in the db.
 //
 // We recommend you write a helper function for each subtask.
-func (coinDB *CoinDatabase) StoreBlock(transactions []*block.Transaction) {
-	for _, tx := range transactions {
-		coinDB.removeSpentCoins(tx)
+// height is the height of the Block, recorded on the Coins it spends.
+func (coinDB *CoinDatabase) StoreBlock(transactions []*block.Transaction, height uint32) {
+	coinDB.StoreBlockWithSpends(transactions, height)
+}
+
+// StoreBlockWithSpends stores a Block like StoreBlock, and also returns
+// the Coins its Transactions spent, in the order of their inputs, as
+// they were before being spent. It returns an error if any input spent
+// a Coin that does not exist; the rest of the Block is still stored,
+// as with StoreBlock.
+func (coinDB *CoinDatabase) StoreBlockWithSpends(transactions []*block.Transaction, height uint32) ([]*Coin, error) {
+	coinDB.mu.Lock()
+	defer coinDB.mu.Unlock()
+	var spent []*Coin
+	var firstErr error
+	for i, tx := range transactions {
+		// a coinbase Transaction spends no Coins
+		if !isCoinbase(i, tx) {
+			coins, err := coinDB.removeSpentCoins(tx, height)
+			spent = append(spent, coins...)
+			if err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("[StoreBlockWithSpends] %w", err)
+			}
+		}
+		// a Transaction without outputs creates no Coins, so it gets no CoinRecord
+		if len(tx.Outputs) == 0 {
+			continue
+		}
 		coinDB.storeTxOutInCache(tx)
 		coinDB.writeCrToDatabase(tx)
 	}
+	// logged even if an input was missing, since the Block was stored
+	coinDB.logOp(&opEntry{Op: opStore, Height: height, Transactions: transactions})
+	return spent, firstErr
 }
 
 // removeCoinFromDB removes a Coin from a CoinRecord, deleting the CoinRecord
 // from the db entirely if it is the last remaining Coin in the CoinRecord.
-func (coinDB *CoinDatabase) removeCoinFromDB(txHash string, cl CoinLocator) {
-	cr := coinDB.getCoinRecordFromDB(txHash)
+// If the CoinDatabase keeps spent outputs, the Coin is instead marked
+// spent at height. It returns an error if the CoinRecord cannot be read.
+func (coinDB *CoinDatabase) removeCoinFromDB(txHash block.TxHash, cl CoinLocator, height uint32) error {
+	cr, err := coinDB.getCoinRecordFromDB(txHash)
 	switch {
+	case err != nil:
+		return err
 	case cr == nil:
-		return
+		return nil
+	case coinDB.keepSpent:
+		coinDB.putRecordInDB(txHash, coinDB.spendCoinInRecord(cr, cl.OutputIndex, height))
 	case len(cr.Amounts) <= 1:
-		if err := coinDB.db.Delete([]byte(txHash), nil); err != nil {
+		if err := coinDB.db.Delete(coinDB.recordKey(txHash)); err != nil {
 			utils.Debug.Printf("[removeCoinFromDB] failed to remove {%v} from db", txHash)
 		}
+		coinDB.noteDeletes(1)
 	default:
 		cr = coinDB.removeCoinFromRecord(cr, cl.OutputIndex)
 		coinDB.putRecordInDB(txHash, cr)
+		coinDB.noteDeletes(1)
+	}
+	return nil
+}
+
+// noteDeletes counts Coins deleted from the db, and once compactAfter
+// have been deleted, compacts the db in the background if it supports
+// compaction. The caller must hold mu.
+func (coinDB *CoinDatabase) noteDeletes(n int) {
+	coinDB.deletes += n
+	if coinDB.compactAfter <= 0 || coinDB.deletes < coinDB.compactAfter || coinDB.compacting {
+		return
 	}
+	compacter, ok := coinDB.db.(kvstore.Compacter)
+	if !ok {
+		return
+	}
+	coinDB.deletes = 0
+	coinDB.compacting = true
+	coinDB.compactions.Add(1)
+	go func() {
+		defer coinDB.compactions.Done()
+		if err := compacter.Compact(); err != nil {
+			utils.Debug.Printf("[noteDeletes] failed to compact db: %v", err)
+		}
+		coinDB.mu.Lock()
+		coinDB.compacting = false
+		coinDB.mu.Unlock()
+	}()
+}
+
+// spendCoinInRecord returns an updated CoinRecord with the Coin with the
+// given outputIndex spent. The Coin is marked spent at height if the
+// CoinDatabase keeps spent outputs, and removed otherwise.
+func (coinDB *CoinDatabase) spendCoinInRecord(cr *CoinRecord, outputIndex uint32, height uint32) *CoinRecord {
+	if !coinDB.keepSpent {
+		return coinDB.removeCoinFromRecord(cr, outputIndex)
+	}
+	if index := indexOf(cr.OutputIndexes, outputIndex); index >= 0 {
+		cr.markSpent(index, height)
+	}
+	return cr
+}
+
+// encodeRecord returns a pro.CoinRecord given a CoinRecord, storing its
+// LockingScripts as bytes if the CoinDatabase uses binary scripts.
+func (coinDB *CoinDatabase) encodeRecord(cr *CoinRecord) *pro.CoinRecord {
+	if coinDB.binaryScripts {
+		return EncodeCoinRecordBinary(cr)
+	}
+	return EncodeCoinRecord(cr)
 }
 
 // putRecordInDB puts a CoinRecord into the db.
-func (coinDB *CoinDatabase) putRecordInDB(txHash string, cr *CoinRecord) {
-	record := EncodeCoinRecord(cr)
+func (coinDB *CoinDatabase) putRecordInDB(txHash block.TxHash, cr *CoinRecord) {
+	record := coinDB.encodeRecord(cr)
 	bytes, err := proto.Marshal(record)
 	if err != nil {
 		utils.Debug.Printf("[coindatabase.putRecordInDB] Unable to marshal coin record for key {%v}", txHash)
 	}
-	if err2 := coinDB.db.Put([]byte(txHash), bytes, nil); err2 != nil {
+	if err2 := coinDB.db.Put(coinDB.recordKey(txHash), bytes); err2 != nil {
 		utils.Debug.Printf("Unable to store coin record for key {%v}", txHash)
 	}
 }
@@ -204,6 +1186,12 @@ func (coinDB *CoinDatabase) removeCoinFromRecord(cr *CoinRecord, outputIndex uin
 	cr.OutputIndexes = append(cr.OutputIndexes[:index], cr.OutputIndexes[index+1:]...)
 	cr.Amounts = append(cr.Amounts[:index], cr.Amounts[index+1:]...)
 	cr.LockingScripts = append(cr.LockingScripts[:index], cr.LockingScripts[index+1:]...)
+	if index < len(cr.Spent) {
+		cr.Spent = append(cr.Spent[:index], cr.Spent[index+1:]...)
+	}
+	if index < len(cr.SpentHeights) {
+		cr.SpentHeights = append(cr.SpentHeights[:index], cr.SpentHeights[index+1:]...)
+	}
 	return cr
 }
 
@@ -218,7 +1206,7 @@ func (coinDB *CoinDatabase) createCoinRecord(tx *block.Transaction) *CoinRecord
 		LockingScripts = append(LockingScripts, txo.LockingScript)
 	}
 	cr := &CoinRecord{
-		Version:        0,
+		Version:        CoinRecordVersion,
 		OutputIndexes:  outputIndexes,
 		Amounts:        amounts,
 		LockingScripts: LockingScripts,
@@ -226,43 +1214,186 @@ func (coinDB *CoinDatabase) createCoinRecord(tx *block.Transaction) *CoinRecord
 	return cr
 }
 
-// getCoinRecordFromDB returns a CoinRecord from the db given a hash.
-func (coinDB *CoinDatabase) getCoinRecordFromDB(txHash string) *CoinRecord {
-	if data, err := coinDB.db.Get([]byte(txHash), nil); err != nil {
-		utils.Debug.Printf("[validateTransaction] coin not in leveldb")
-		return nil
-	} else {
-		pcr := &pro.CoinRecord{}
-		if err := proto.Unmarshal(data, pcr); err != nil {
-			utils.Debug.Printf("Failed to unmarshal record from hash {%v}:", txHash, err)
-		}
-		cr := DecodeCoinRecord(pcr)
-		return cr
+// getCoinRecordFromDB returns a CoinRecord from the db given a hash, or
+// nil if there is none. It returns an error, wrapping a
+// pro.UnmarshalError if the CoinRecord is corrupt, if the CoinRecord
+// cannot be read or decoded.
+func (coinDB *CoinDatabase) getCoinRecordFromDB(txHash block.TxHash) (*CoinRecord, error) {
+	cr, err := coinDB.decodedRecord(txHash, nil)
+	if errors.Is(err, kvstore.ErrNotFound) {
+		return nil, nil
+	}
+	return cr, err
+}
+
+// decodedRecord returns the CoinRecord of a Transaction from records if
+// it is there, and otherwise reads and decodes it from the db, adding it
+// to records if records is non-nil. Callers that pass records must hold
+// mu for as long as they use it, so that it cannot go stale.
+func (coinDB *CoinDatabase) decodedRecord(txHash block.TxHash, records map[block.TxHash]*CoinRecord) (*CoinRecord, error) {
+	if cr, ok := records[txHash]; ok {
+		return cr, nil
+	}
+	data, err := coinDB.readRecord(txHash)
+	if err != nil {
+		return nil, fmt.Errorf("coin record {%v} not in leveldb: %w", txHash, err)
+	}
+	pcr := &pro.CoinRecord{}
+	if err := pro.Unmarshal(string(txHash), data, pcr); err != nil {
+		return nil, err
+	}
+	cr, err := DecodeCoinRecord(pcr)
+	if err != nil {
+		return nil, err
+	}
+	if records != nil {
+		records[txHash] = cr
 	}
+	return cr, nil
+}
+
+// ErrRecordNotFound is returned by DumpRecord when there is no
+// CoinRecord stored under a Transaction hash.
+var ErrRecordNotFound = errors.New("coin record not found")
+
+// DumpRecord returns the CoinRecord stored in the db under a Transaction
+// hash, exactly as decoded, including any outputs marked spent. Coins in
+// the mainCache are not merged in, so unflushed changes are not seen.
+func (coinDB *CoinDatabase) DumpRecord(txHash block.TxHash) (*CoinRecord, error) {
+	coinDB.mu.Lock()
+	defer coinDB.mu.Unlock()
+	data, err := coinDB.db.Get(coinDB.recordKey(txHash))
+	if errors.Is(err, kvstore.ErrNotFound) {
+		return nil, fmt.Errorf("[DumpRecord] transaction {%v}: %w", txHash, ErrRecordNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("[DumpRecord] %w", err)
+	}
+	pcr := &pro.CoinRecord{}
+	if err := pro.Unmarshal(string(txHash), data, pcr); err != nil {
+		return nil, fmt.Errorf("[DumpRecord] %w", err)
+	}
+	cr, err := DecodeCoinRecord(pcr)
+	if err != nil {
+		return nil, fmt.Errorf("[DumpRecord] %w", err)
+	}
+	return cr, nil
 }
 
 // GetCoin returns a Coin given a CoinLocator. It first checks the
 // mainCache, then checks the db. If the Coin doesn't exist,
-// it returns nil.
-func (coinDB *CoinDatabase) GetCoin(cl CoinLocator) *Coin {
+// it returns nil. It returns an error, wrapping a pro.UnmarshalError if
+// the CoinRecord is corrupt, if the Coin's CoinRecord cannot be read or
+// decoded.
+func (coinDB *CoinDatabase) GetCoin(cl CoinLocator) (*Coin, error) {
+	coinDB.mu.Lock()
+	defer coinDB.mu.Unlock()
+	coin, err := coinDB.getCoin(cl)
+	if err != nil {
+		return nil, fmt.Errorf("[GetCoin] %w", err)
+	}
+	return coin, nil
+}
+
+// GetCoinCaching is GetCoin, except that a Coin read from the db is
+// also added to the mainCache, flushing part of the mainCache if it is
+// full, so that reading the Coin again does not touch the db.
+func (coinDB *CoinDatabase) GetCoinCaching(cl CoinLocator) (*Coin, error) {
+	coinDB.mu.Lock()
+	defer coinDB.mu.Unlock()
 	if coin, ok := coinDB.MainCache[cl]; ok {
-		return coin
+		return coin, nil
+	}
+	coin, err := coinDB.getCoin(cl)
+	if err != nil {
+		return nil, fmt.Errorf("[GetCoinCaching] %w", err)
+	}
+	if coin == nil || !coinDB.makeRoom() {
+		return coin, nil
+	}
+	coinDB.MainCache[cl] = coin
+	coinDB.MainCacheSize += 1
+	return coin, nil
+}
+
+// getCoin is GetCoin for callers that already hold mu.
+func (coinDB *CoinDatabase) getCoin(cl CoinLocator) (*Coin, error) {
+	return coinDB.getCoinWithRecords(cl, nil)
+}
+
+// getCoinWithRecords is getCoin, except that CoinRecords are looked up
+// in and added to records, as by decodedRecord.
+func (coinDB *CoinDatabase) getCoinWithRecords(cl CoinLocator, records map[block.TxHash]*CoinRecord) (*Coin, error) {
+	if coin, ok := coinDB.MainCache[cl]; ok {
+		coinDB.stats.Hits++
+		return coin, nil
+	}
+	coinDB.stats.Misses++
+	cr, err := coinDB.decodedRecord(cl.ReferenceTransactionHash, records)
+	if errors.Is(err, kvstore.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	txo, ok := cr.output(cr.unspentIndex(cl.OutputIndex))
+	if !ok {
+		return nil, nil
+	}
+	return &Coin{
+		TransactionOutput: txo,
+		IsSpent:           false,
+	}, nil
+}
+
+// GetSpentCoin returns a spent Coin given a CoinLocator, with IsSpent
+// set. It first checks the mainCache, then checks the db, where spent
+// Coins are only kept if the CoinDatabase keeps spent outputs. If the
+// Coin doesn't exist or is unspent, it returns nil. Like GetCoin, it
+// returns an error if the Coin's CoinRecord cannot be read or decoded.
+func (coinDB *CoinDatabase) GetSpentCoin(cl CoinLocator) (*Coin, error) {
+	coinDB.mu.Lock()
+	defer coinDB.mu.Unlock()
+	if coin, ok := coinDB.MainCache[cl]; ok {
+		if coin.IsSpent {
+			return coin, nil
+		}
+		return nil, nil
+	}
+	cr, err := coinDB.getCoinRecordFromDB(cl.ReferenceTransactionHash)
+	if err != nil {
+		return nil, fmt.Errorf("[GetSpentCoin] %w", err)
 	}
-	cr := coinDB.getCoinRecordFromDB(cl.ReferenceTransactionHash)
 	if cr == nil {
-		return nil
+		return nil, nil
 	}
 	index := indexOf(cr.OutputIndexes, cl.OutputIndex)
-	if index < 0 {
-		return nil
+	txo, ok := cr.output(index)
+	if !ok || !cr.isSpent(index) {
+		return nil, nil
 	}
 	return &Coin{
-		TransactionOutput: &block.TransactionOutput{
-			Amount:        cr.Amounts[index],
-			LockingScript: cr.LockingScripts[index],
-		},
-		IsSpent: false,
+		TransactionOutput: txo,
+		IsSpent:           true,
+		SpentHeight:       cr.spentHeight(index),
+	}, nil
+}
+
+// GetCoinWithLocator returns a Coin along with the CoinLocator used to
+// find it, so that callers handling many Coins keep track of which is
+// which. The bool reports whether the Coin exists and is unspent; a
+// Coin spent while in the mainCache is reported as not existing, as it
+// would be once the mainCache is flushed. Like GetCoin, it returns an
+// error if the Coin's CoinRecord cannot be read or decoded.
+func (coinDB *CoinDatabase) GetCoinWithLocator(cl CoinLocator) (*Coin, CoinLocator, bool, error) {
+	coin, err := coinDB.GetCoin(cl)
+	if err != nil {
+		return nil, cl, false, fmt.Errorf("[GetCoinWithLocator] %w", err)
 	}
+	if coin == nil || coin.IsSpent {
+		return nil, cl, false, nil
+	}
+	return coin, cl, true, nil
 }
 
 // contains returns true if an int slice s contains element e, false if it does not.
@@ -286,29 +1417,58 @@ func indexOf(s []uint32, e uint32) int {
 }
 
 // helper for StoreBlock
-func (coinDB *CoinDatabase) removeSpentCoins(tx *block.Transaction) {
+// It returns copies of the Coins spent, taken before they were spent,
+// and an error if any input's Coin does not exist.
+func (coinDB *CoinDatabase) removeSpentCoins(tx *block.Transaction, height uint32) ([]*Coin, error) {
+	var spent []*Coin
+	var err error
 	for _, input := range tx.Inputs {
 		cl := makeCoinLocator(input)
+		delete(coinDB.reserved, cl)
+		coinDB.invalidateSpends(cl)
 		if coin, ok := coinDB.MainCache[cl]; ok {
 			// coin is in mainCache
+			spent = append(spent, &Coin{TransactionOutput: coin.TransactionOutput})
+			coinDB.logSpend(cl, coin, height)
+			if !coin.IsSpent {
+				coinDB.debitBalance(coin.TransactionOutput)
+			}
 			coin.IsSpent = true
-		} else if cr := coinDB.getCoinRecordFromDB(cl.ReferenceTransactionHash); cr != nil {
+			coin.SpentHeight = height
+		} else if coin, getErr := coinDB.getCoin(cl); getErr != nil {
+			if err == nil {
+				err = fmt.Errorf("[removeSpentCoins] %w", getErr)
+			}
+		} else if coin != nil {
 			// coin is in db
-			coinDB.removeCoinFromDB(cl.ReferenceTransactionHash, cl)
+			spent = append(spent, coin)
+			coinDB.logSpend(cl, coin, height)
+			coinDB.debitBalance(coin.TransactionOutput)
+			if removeErr := coinDB.removeCoinFromDB(cl.ReferenceTransactionHash, cl, height); removeErr != nil && err == nil {
+				err = fmt.Errorf("[removeSpentCoins] %w", removeErr)
+			}
 		} else {
 			utils.Debug.Printf("[removeSpentCoins] failed. Coin in transaction {%v} doesn't exist!\n", cl.ReferenceTransactionHash)
+			if err == nil {
+				err = fmt.Errorf("[removeSpentCoins] coin {%v} does not exist", cl)
+			}
 		}
 	}
+	return spent, err
 }
 
 // helper for StoreBlock
 func (coinDB *CoinDatabase) storeTxOutInCache(tx *block.Transaction) {
+	for _, output := range tx.Outputs {
+		coinDB.creditBalance(output)
+	}
 	for idx, output := range tx.Outputs {
-		if coinDB.MainCacheSize >= coinDB.MainCacheCapacity {
-			coinDB.FlushMainCache()
+		// without a mainCache, the Coin is only in the CoinRecord written by writeCrToDatabase
+		if !coinDB.makeRoom() {
+			return
 		}
 		cl := CoinLocator{tx.Hash(), uint32(idx)}
-		coin := &Coin{output, false}
+		coin := &Coin{TransactionOutput: output}
 		coinDB.MainCache[cl] = coin
 		coinDB.MainCacheSize += 1
 	}
@@ -319,32 +1479,3 @@ func (coinDB *CoinDatabase) writeCrToDatabase(tx *block.Transaction) {
 	cr := coinDB.createCoinRecord(tx)
 	coinDB.putRecordInDB(tx.Hash(), cr)
 }
-
-// helper for UndoCoins
-func (coinDB *CoinDatabase) removeCreatedCoins(tx *block.Transaction) {
-	for idx, _ := range tx.Outputs {
-		cl := CoinLocator{tx.Hash(), uint32(idx)}
-		// remove from database
-		coinDB.removeCoinFromDB(cl.ReferenceTransactionHash, cl)
-		// remove from cache
-		delete(coinDB.MainCache, cl)
-		coinDB.MainCacheSize -= 1
-	}
-}
-
-// helper for UndoCoins
-// https://edstem.org/us/courses/36337/discussion/2593635
-func (coinDB *CoinDatabase) markCoinsUnspent(undoBlock *chainwriter.UndoBlock) {
-	for i := 0; i < len(undoBlock.TransactionInputHashes); i++ {
-		// get coinRecord from db -> add coin to coinRecord -> store to db
-		cr := coinDB.getCoinRecordFromDB(undoBlock.TransactionInputHashes[i])
-		coinDB.addCoinToRecord(cr, undoBlock, i)
-		coinDB.putRecordInDB(undoBlock.TransactionInputHashes[i], cr)
-
-		// if coin in mainCache -> mark as unspent
-		cl := CoinLocator{undoBlock.TransactionInputHashes[i], undoBlock.OutputIndexes[i]}
-		if coin, ok := coinDB.MainCache[cl]; ok {
-			coin.IsSpent = false
-		}
-	}
-}
@@ -0,0 +1,1276 @@
+package coindatabase
+
+import (
+	"Chain/pkg/block"
+	"Chain/pkg/blockchain/chainwriter"
+	"Chain/pkg/blockchain/kvstore"
+	"Chain/pkg/pro"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"google.golang.org/protobuf/proto"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestDB returns a CoinDatabase backed by an in-memory KVStore,
+// with a mainCache of the given capacity.
+func newTestDB(capacity uint32) *CoinDatabase {
+	config := DefaultConfig()
+	config.MainCacheCapacity = capacity
+	return NewWithStore(kvstore.NewMemoryStore(), config)
+}
+
+// mustGetCoin returns the Coin at cl, failing the test if its
+// CoinRecord cannot be read.
+func mustGetCoin(t *testing.T, coinDB *CoinDatabase, cl CoinLocator) *Coin {
+	t.Helper()
+	coin, err := coinDB.GetCoin(cl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return coin
+}
+
+// coinbase returns a Transaction without inputs that creates outputs
+// of the given amounts, all locked by script. lockTime tells apart
+// coinbases that would otherwise be identical.
+func coinbase(script string, lockTime uint32, amounts ...uint32) *block.Transaction {
+	tx := &block.Transaction{LockTime: lockTime}
+	for _, amount := range amounts {
+		tx.Outputs = append(tx.Outputs, &block.TransactionOutput{Amount: amount, LockingScript: script})
+	}
+	return tx
+}
+
+// spend returns a Transaction that spends output index of parent and
+// creates one output of amount locked by script.
+func spend(parent *block.Transaction, index uint32, amount uint32, script string) *block.Transaction {
+	return &block.Transaction{
+		Inputs:  []*block.TransactionInput{{ReferenceTransactionHash: parent.Hash(), OutputIndex: index}},
+		Outputs: []*block.TransactionOutput{{Amount: amount, LockingScript: script}},
+	}
+}
+
+func TestMigrateRecords(t *testing.T) {
+	coinDB := newTestDB(10)
+	tx := coinbase("alice", 0, 5, 7)
+	old := &pro.CoinRecord{
+		Version:        CoinRecordVersion - 1,
+		OutputIndexes:  []uint32{0, 1},
+		Amounts:        []uint32{5, 7},
+		LockingScripts: []string{"alice", "alice"},
+	}
+	data, err := proto.Marshal(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := coinDB.db.Put(coinDB.recordKey(tx.Hash()), data); err != nil {
+		t.Fatal(err)
+	}
+	cl := CoinLocator{tx.Hash(), 1}
+	if coin, err := coinDB.GetCoin(cl); err == nil {
+		t.Fatalf("got coin %v from a record of an old version, want an error", coin)
+	}
+	// the upgrade adds the spent flags of the current version
+	err = coinDB.MigrateRecords(func(old *pro.CoinRecord) *pro.CoinRecord {
+		old.Spent = make([]bool, len(old.OutputIndexes))
+		old.SpentHeights = make([]uint32, len(old.OutputIndexes))
+		return old
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cr, err := coinDB.DumpRecord(tx.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cr.Version != CoinRecordVersion || len(cr.Spent) != 2 {
+		t.Errorf("migrated record has version %v and %v spent flags, want %v and 2", cr.Version, len(cr.Spent), CoinRecordVersion)
+	}
+	if coin := mustGetCoin(t, coinDB, cl); coin == nil || coin.TransactionOutput.Amount != 7 {
+		t.Errorf("got coin %v after migrating, want amount 7", coin)
+	}
+}
+
+func TestMigrateRecordsFlushesMainCache(t *testing.T) {
+	coinDB := newTestDB(10)
+	tx := coinbase("alice", 0, 5)
+	coinDB.StoreBlock([]*block.Transaction{tx}, 1)
+	coinDB.StoreBlock([]*block.Transaction{coinbase("bob", 1, 1), spend(tx, 0, 5, "bob")}, 2)
+	upgraded := 0
+	err := coinDB.MigrateRecords(func(old *pro.CoinRecord) *pro.CoinRecord {
+		upgraded++
+		return old
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upgraded != 0 {
+		t.Errorf("upgraded %v records already at the current version", upgraded)
+	}
+	if coinDB.MainCacheSize != 0 {
+		t.Errorf("mainCache holds %v coins after migrating, want 0", coinDB.MainCacheSize)
+	}
+	if coin := mustGetCoin(t, coinDB, CoinLocator{tx.Hash(), 0}); coin != nil {
+		t.Errorf("spent coin %v is unspent after migrating", coin)
+	}
+}
+
+func TestFlushRestoresCoinMissingFromRecord(t *testing.T) {
+	coinDB := newTestDB(10)
+	tx := coinbase("alice", 0, 5, 7)
+	coinDB.StoreBlock([]*block.Transaction{tx}, 1)
+	// another path deleted the record while its coins were cached
+	if err := coinDB.db.Delete(coinDB.recordKey(tx.Hash())); err != nil {
+		t.Fatal(err)
+	}
+	coinDB.FlushMainCache()
+	for i, amount := range []uint32{5, 7} {
+		coin := mustGetCoin(t, coinDB, CoinLocator{tx.Hash(), uint32(i)})
+		if coin == nil || coin.TransactionOutput.Amount != amount {
+			t.Errorf("got coin %v for output %v after flushing, want amount %v", coin, i, amount)
+		}
+	}
+}
+
+func TestGetCoinReturnsCorruptRecordError(t *testing.T) {
+	coinDB := newTestDB(10)
+	tx := coinbase("alice", 0, 5)
+	if err := coinDB.db.Put(coinDB.recordKey(tx.Hash()), []byte{0xff, 0xff, 0xff}); err != nil {
+		t.Fatal(err)
+	}
+	cl := CoinLocator{tx.Hash(), 0}
+	coin, err := coinDB.GetCoin(cl)
+	var unmarshalErr *pro.UnmarshalError
+	if !errors.As(err, &unmarshalErr) || len(unmarshalErr.Preview) == 0 {
+		t.Fatalf("got coin %v and error %v from a corrupt record, want a pro.UnmarshalError", coin, err)
+	}
+	// a missing record is not an error
+	if coin, err := coinDB.GetCoin(CoinLocator{coinbase("bob", 1, 5).Hash(), 0}); coin != nil || err != nil {
+		t.Errorf("got coin %v and error %v for a missing record, want neither", coin, err)
+	}
+	if err := coinDB.ValidateWithOverlay(spend(tx, 0, 5, "bob"), nil, nil); !errors.As(err, &unmarshalErr) {
+		t.Errorf("validating a spend of a corrupt record returned %v, want a pro.UnmarshalError", err)
+	}
+}
+
+func TestGetCoinWithLocator(t *testing.T) {
+	coinDB := newTestDB(10)
+	tx := coinbase("alice", 0, 5, 7)
+	coinDB.StoreBlock([]*block.Transaction{tx}, 1)
+	coinDB.StoreBlock([]*block.Transaction{coinbase("bob", 1, 1), spend(tx, 0, 5, "bob")}, 2)
+	unspent := CoinLocator{tx.Hash(), 1}
+	coin, cl, ok, err := coinDB.GetCoinWithLocator(unspent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || coin == nil || coin.TransactionOutput.Amount != 7 {
+		t.Errorf("got coin %v (exists %v), want amount 7", coin, ok)
+	}
+	if cl != unspent {
+		t.Errorf("got locator %v, want %v", cl, unspent)
+	}
+	// the spent coin is still in the mainCache, but no longer exists
+	spent := CoinLocator{tx.Hash(), 0}
+	coin, cl, ok, err = coinDB.GetCoinWithLocator(spent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok || coin != nil {
+		t.Errorf("got spent coin %v (exists %v) from the mainCache", coin, ok)
+	}
+	if cl != spent {
+		t.Errorf("got locator %v, want %v", cl, spent)
+	}
+}
+
+func TestUndoCoinsDisabled(t *testing.T) {
+	config := DefaultConfig()
+	config.DisableUndo = true
+	coinDB := NewWithStore(kvstore.NewMemoryStore(), config)
+	tx := coinbase("alice", 0, 5)
+	coinDB.StoreBlock([]*block.Transaction{tx}, 1)
+	b := &block.Block{Header: &block.Header{}, Transactions: []*block.Transaction{tx}}
+	if err := coinDB.UndoCoins([]*block.Block{b}, []*chainwriter.UndoBlock{{}}); !errors.Is(err, chainwriter.ErrUndoDisabled) {
+		t.Fatalf("undoing a block returned %v, want ErrUndoDisabled", err)
+	}
+	if coin := mustGetCoin(t, coinDB, CoinLocator{tx.Hash(), 0}); coin == nil {
+		t.Error("refused undo erased the block's coin")
+	}
+}
+
+func TestValidateWithOverlayRejectsMalformedInputs(t *testing.T) {
+	coinDB := newTestDB(10)
+	tx := coinbase("alice", 0, 5)
+	coinDB.StoreBlock([]*block.Transaction{tx}, 1)
+	emptyHash := spend(tx, 0, 5, "bob")
+	emptyHash.Inputs[0].ReferenceTransactionHash = ""
+	shortHash := spend(tx, 0, 5, "bob")
+	shortHash.Inputs[0].ReferenceTransactionHash = "abcd"
+	nilInput := spend(tx, 0, 5, "bob")
+	nilInput.Inputs = append(nilInput.Inputs, nil)
+	noInputs := spend(tx, 0, 5, "bob")
+	noInputs.Inputs = nil
+	for name, malformed := range map[string]*block.Transaction{
+		"empty hash": emptyHash,
+		"short hash": shortHash,
+		"nil input":  nilInput,
+		"no inputs":  noInputs,
+	} {
+		if err := coinDB.ValidateWithOverlay(malformed, nil, nil); err == nil {
+			t.Errorf("validated a transaction with %v", name)
+		}
+	}
+	if err := coinDB.ValidateWithOverlay(spend(tx, 0, 5, "bob"), nil, nil); err != nil {
+		t.Errorf("rejected a well-formed transaction: %v", err)
+	}
+}
+
+// dbContents returns every key and value in a CoinDatabase's db, after
+// flushing its mainCache.
+func dbContents(t *testing.T, coinDB *CoinDatabase) map[string]string {
+	t.Helper()
+	if err := coinDB.FlushMainCache(); err != nil {
+		t.Fatal(err)
+	}
+	contents := make(map[string]string)
+	iter := coinDB.db.NewIterator()
+	for iter.Next() {
+		contents[string(iter.Key())] = string(iter.Value())
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		t.Fatal(err)
+	}
+	return contents
+}
+
+func TestApproxMemoryBytes(t *testing.T) {
+	coinDB := newTestDB(10)
+	if size := coinDB.ApproxMemoryBytes(); size != 0 {
+		t.Errorf("got {%v} bytes for an empty mainCache, want 0", size)
+	}
+	coinDB.StoreBlock([]*block.Transaction{coinbase("a", 0, 5)}, 1)
+	short := coinDB.ApproxMemoryBytes()
+	coinDB.StoreBlock([]*block.Transaction{coinbase(strings.Repeat("a", 1000), 1, 5)}, 2)
+	long := coinDB.ApproxMemoryBytes() - short
+	if short == 0 || long < short+999 {
+		t.Errorf("got {%v} bytes for a coin with a 1-byte script and {%v} for a 1000-byte one", short, long)
+	}
+	coinDB.FlushMainCache()
+	if size := coinDB.ApproxMemoryBytes(); size != 0 {
+		t.Errorf("got {%v} bytes after flushing the mainCache, want 0", size)
+	}
+}
+
+// coinDBRecord returns a CoinRecord of the current version holding one
+// Coin of amount.
+func coinDBRecord(amount uint32) *CoinRecord {
+	cr := &CoinRecord{Version: CoinRecordVersion}
+	cr.addCoin(0, amount, "alice", false, 0)
+	return cr
+}
+
+func TestDecodeCoinRecordRejectsUnknownVersion(t *testing.T) {
+	pcr := EncodeCoinRecord(coinDBRecord(5))
+	pcr.Version = CoinRecordVersion + 1
+	if cr, err := DecodeCoinRecord(pcr); err == nil || !strings.Contains(err.Error(), "version") {
+		t.Errorf("decoded record %v of an unknown version with error %v, want a version error", cr, err)
+	}
+}
+
+func TestFlushKeepsCoinsThatCannotBeFlushed(t *testing.T) {
+	for name, stored := range map[string]*pro.CoinRecord{
+		"unknown version":  {Version: CoinRecordVersion + 1, OutputIndexes: []uint32{0}, Amounts: []uint32{5}, LockingScripts: []string{"alice"}},
+		"conflicting coin": EncodeCoinRecord(coinDBRecord(6)),
+	} {
+		coinDB := newTestDB(10)
+		tx := coinbase("alice", 0, 5)
+		coinDB.StoreBlock([]*block.Transaction{tx}, 1)
+		data, err := proto.Marshal(stored)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := coinDB.db.Put(coinDB.recordKey(tx.Hash()), data); err != nil {
+			t.Fatal(err)
+		}
+		if err := coinDB.FlushMainCache(); err == nil {
+			t.Errorf("flushed a coin onto a record with %v without an error", name)
+		}
+		cl := CoinLocator{tx.Hash(), 0}
+		if coin, ok := coinDB.MainCache[cl]; !ok || coin.TransactionOutput.Amount != 5 {
+			t.Errorf("flushing onto a record with %v dropped the cached coin", name)
+		}
+		if after, err := coinDB.db.Get(coinDB.recordKey(tx.Hash())); err != nil || string(after) != string(data) {
+			t.Errorf("flushing onto a record with %v changed it", name)
+		}
+	}
+}
+
+func TestSetCacheCapacity(t *testing.T) {
+	coinDB := newTestDB(10)
+	tx := coinbase("alice", 0, 1, 2, 3, 4, 5, 6)
+	coinDB.StoreBlock([]*block.Transaction{tx}, 1)
+	if coinDB.MainCacheSize != 6 {
+		t.Fatalf("mainCache holds {%v} coins, want 6", coinDB.MainCacheSize)
+	}
+	// shrinking below the size flushes down to the new capacity
+	coinDB.SetCacheCapacity(2)
+	if coinDB.MainCacheSize != 2 || len(coinDB.MainCache) != 2 {
+		t.Errorf("mainCache holds {%v} coins after shrinking to 2", len(coinDB.MainCache))
+	}
+	for i := uint32(0); i < 6; i++ {
+		if coin := mustGetCoin(t, coinDB, CoinLocator{tx.Hash(), i}); coin == nil || coin.TransactionOutput.Amount != i+1 {
+			t.Errorf("got coin %v for output %v after shrinking, want amount %v", coin, i, i+1)
+		}
+	}
+	// growing flushes nothing
+	coinDB.SetCacheCapacity(20)
+	if coinDB.MainCacheSize != 2 {
+		t.Errorf("mainCache holds {%v} coins after growing, want 2", coinDB.MainCacheSize)
+	}
+	// a size counter that overstates the mainCache does not over-flush
+	coinDB.MainCacheSize = 50
+	coinDB.SetCacheCapacity(1)
+	if len(coinDB.MainCache) != 1 {
+		t.Errorf("mainCache holds {%v} coins after shrinking to 1, want 1", len(coinDB.MainCache))
+	}
+}
+
+func TestRawKeys(t *testing.T) {
+	store := kvstore.NewMemoryStore()
+	txs := []*block.Transaction{coinbase("alice", 0, 5, 7), coinbase("bob", 1, 3)}
+	hexDB := NewWithStore(store, DefaultConfig())
+	hexDB.StoreBlock(txs, 1)
+	hexSize := 0
+	for key := range dbContents(t, hexDB) {
+		hexSize += len(key)
+	}
+	config := DefaultConfig()
+	config.RawKeys = true
+	rawDB := NewWithStore(store, config)
+	if err := rawDB.MigrateToRawKeys(); err != nil {
+		t.Fatal(err)
+	}
+	rawSize := 0
+	for key := range dbContents(t, rawDB) {
+		if len(key) != sha256.Size {
+			t.Errorf("got key %q of %v bytes after migrating, want %v", key, len(key), sha256.Size)
+		}
+		rawSize += len(key)
+	}
+	if rawSize*2 != hexSize {
+		t.Errorf("raw keys take %v bytes, want half of the %v taken by hex keys", rawSize, hexSize)
+	}
+	// coins are found by their usual locators, whether stored before or
+	// after migrating
+	rawDB.StoreBlock([]*block.Transaction{coinbase("carol", 2, 9)}, 2)
+	if err := rawDB.FlushMainCache(); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		cl     CoinLocator
+		amount uint32
+	}{
+		{CoinLocator{txs[0].Hash(), 1}, 7},
+		{CoinLocator{txs[1].Hash(), 0}, 3},
+		{CoinLocator{coinbase("carol", 2, 9).Hash(), 0}, 9},
+	} {
+		if coin := mustGetCoin(t, rawDB, tt.cl); coin == nil || coin.TransactionOutput.Amount != tt.amount {
+			t.Errorf("got coin %v at %v with raw keys, want amount %v", coin, tt.cl, tt.amount)
+		}
+	}
+}
+
+func TestValidateWithOverlaySpendsPendingOutputs(t *testing.T) {
+	coinDB := newTestDB(10)
+	tx := coinbase("alice", 0, 5)
+	coinDB.StoreBlock([]*block.Transaction{tx}, 1)
+	// pending spends the coin of alice and creates one for bob
+	pending := spend(tx, 0, 5, "bob")
+	pendingCoin := &Coin{TransactionOutput: pending.Outputs[0]}
+	spent := map[CoinLocator]bool{{tx.Hash(), 0}: true}
+	created := map[CoinLocator]*Coin{{pending.Hash(), 0}: pendingCoin}
+	tests := []struct {
+		name    string
+		tx      *block.Transaction
+		spent   map[CoinLocator]bool
+		created map[CoinLocator]*Coin
+		valid   bool
+	}{
+		{"spends a pending output", spend(pending, 0, 5, "carol"), spent, created, true},
+		{"spends a pending output without the overlay", spend(pending, 0, 5, "carol"), nil, nil, false},
+		{"spends a coin a pending transaction spent", spend(tx, 0, 5, "carol"), spent, created, false},
+		{"spends a pending output another pending transaction spent", spend(pending, 0, 5, "carol"),
+			map[CoinLocator]bool{{tx.Hash(), 0}: true, {pending.Hash(), 0}: true}, created, false},
+		{"spends a missing output of a pending transaction", spend(pending, 1, 5, "carol"), spent, created, false},
+	}
+	for _, tt := range tests {
+		err := coinDB.ValidateWithOverlay(tt.tx, tt.spent, tt.created)
+		if tt.valid && err != nil {
+			t.Errorf("rejected a transaction that %v: %v", tt.name, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("validated a transaction that %v", tt.name)
+		}
+	}
+	// the overlay does not change the CoinDatabase
+	if coin := mustGetCoin(t, coinDB, CoinLocator{tx.Hash(), 0}); coin == nil || coin.IsSpent {
+		t.Errorf("got coin %v after validating against the overlay, want it unspent", coin)
+	}
+}
+
+func TestFlushInterval(t *testing.T) {
+	config := DefaultConfig()
+	config.MainCacheCapacity = 10
+	config.FlushInterval = 10 * time.Millisecond
+	coinDB := NewWithStore(kvstore.NewMemoryStore(), config)
+	tx := coinbase("alice", 0, 5)
+	coinDB.StoreBlock([]*block.Transaction{tx}, 1)
+	// the cache is far from full, so only the timer flushes it
+	deadline := time.Now().Add(100 * config.FlushInterval)
+	for {
+		has, err := coinDB.db.Has(coinDB.recordKey(tx.Hash()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if has {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("coin was not flushed to the db within %v", 100*config.FlushInterval)
+		}
+		time.Sleep(config.FlushInterval / 2)
+	}
+	if err := coinDB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-coinDB.flushDone:
+	default:
+		t.Error("background flusher is still running after Close")
+	}
+}
+
+func TestReserveCoins(t *testing.T) {
+	coinDB := newTestDB(10)
+	tx := coinbase("alice", 0, 5, 7)
+	coinDB.StoreBlock([]*block.Transaction{tx}, 1)
+	first, second := CoinLocator{tx.Hash(), 0}, CoinLocator{tx.Hash(), 1}
+	if err := coinDB.ReserveCoins([]CoinLocator{first}); err != nil {
+		t.Fatal(err)
+	}
+	if err := coinDB.ReserveCoins([]CoinLocator{first}); err == nil {
+		t.Error("reserved a coin twice")
+	}
+	// a failed reservation reserves none of its coins
+	if err := coinDB.ReserveCoins([]CoinLocator{second, first}); err == nil {
+		t.Error("reserved a coin twice alongside a free one")
+	}
+	if err := coinDB.ReserveCoins([]CoinLocator{second, second}); err == nil {
+		t.Error("reserved the same coin twice in one call")
+	}
+	if err := coinDB.ReserveCoins([]CoinLocator{{tx.Hash(), 2}}); err == nil {
+		t.Error("reserved a missing coin")
+	}
+	if err := coinDB.ValidateWithOverlay(spend(tx, 0, 5, "bob"), nil, nil); err == nil {
+		t.Error("validated a transaction spending a reserved coin")
+	}
+	if err := coinDB.ValidateWithOverlay(spend(tx, 1, 7, "bob"), nil, nil); err != nil {
+		t.Errorf("rejected a transaction spending a free coin: %v", err)
+	}
+	coinDB.ReleaseCoins([]CoinLocator{first})
+	if err := coinDB.ValidateWithOverlay(spend(tx, 0, 5, "bob"), nil, nil); err != nil {
+		t.Errorf("rejected a transaction spending a released coin: %v", err)
+	}
+	if err := coinDB.ReserveCoins([]CoinLocator{first, second}); err != nil {
+		t.Errorf("could not reserve released and free coins: %v", err)
+	}
+}
+
+// recordingStore is a KVStore that records the keys of the Puts and
+// Deletes made to it, in order.
+type recordingStore struct {
+	kvstore.KVStore
+	writes []string
+}
+
+func (s *recordingStore) Put(key, value []byte) error {
+	s.writes = append(s.writes, "put "+string(key))
+	return s.KVStore.Put(key, value)
+}
+
+func (s *recordingStore) Delete(key []byte) error {
+	s.writes = append(s.writes, "delete "+string(key))
+	return s.KVStore.Delete(key)
+}
+
+func TestSortedFlush(t *testing.T) {
+	var txs []*block.Transaction
+	for i := uint32(0); i < 20; i++ {
+		txs = append(txs, coinbase("alice", i, 1, 2, 3))
+	}
+	var runs [][]string
+	for run := 0; run < 2; run++ {
+		store := &recordingStore{KVStore: kvstore.NewMemoryStore()}
+		config := DefaultConfig()
+		config.SortedFlush = true
+		coinDB := NewWithStore(store, config)
+		coinDB.StoreBlock(txs, 1)
+		coinDB.StoreBlock([]*block.Transaction{coinbase("bob", 100, 1), spend(txs[3], 1, 2, "bob"), spend(txs[7], 0, 1, "bob")}, 2)
+		store.writes = nil
+		if err := coinDB.FlushMainCache(); err != nil {
+			t.Fatal(err)
+		}
+		runs = append(runs, store.writes)
+	}
+	if len(runs[0]) == 0 {
+		t.Fatal("flush wrote nothing, so its order is not tested")
+	}
+	if !reflect.DeepEqual(runs[0], runs[1]) {
+		t.Errorf("identical flushes wrote %v and %v", runs[0], runs[1])
+	}
+	if !sort.StringsAreSorted(runs[0]) {
+		t.Errorf("flush wrote %v, want keys in sorted order", runs[0])
+	}
+}
+
+func TestUTXOSetHash(t *testing.T) {
+	alice, bob, carol := coinbase("alice", 0, 5, 7), coinbase("bob", 1, 3), coinbase("carol", 2, 9)
+	// the same coins, stored in a different order and flushed at
+	// different times
+	small := newTestDB(1)
+	small.StoreBlock([]*block.Transaction{alice, bob, carol}, 1)
+	large := newTestDB(100)
+	large.StoreBlock([]*block.Transaction{carol}, 1)
+	large.StoreBlock([]*block.Transaction{bob, alice}, 2)
+	hashOf := func(coinDB *CoinDatabase) []byte {
+		t.Helper()
+		hash, err := coinDB.UTXOSetHash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hash
+	}
+	smallHash, largeHash := hashOf(small), hashOf(large)
+	if !bytes.Equal(smallHash, largeHash) {
+		t.Errorf("identical UTXO sets hash to %x and %x", smallHash, largeHash)
+	}
+	if again := hashOf(large); !bytes.Equal(again, largeHash) {
+		t.Errorf("hash changed from %x to %x without any change to the UTXO set", largeHash, again)
+	}
+	// spending a coin changes the hash
+	large.StoreBlock([]*block.Transaction{coinbase("dave", 3, 1), spend(alice, 1, 7, "alice")}, 3)
+	small.StoreBlock([]*block.Transaction{coinbase("dave", 3, 1)}, 2)
+	if bytes.Equal(hashOf(small), hashOf(large)) {
+		t.Error("UTXO sets that differ by one spent coin have the same hash")
+	}
+}
+
+func TestCoinbaseAndOutputlessTransactions(t *testing.T) {
+	coinDB := newTestDB(10)
+	tx := coinbase("alice", 0, 5)
+	coinDB.StoreBlock([]*block.Transaction{tx}, 1)
+	// only the first Transaction of a Block may have no inputs
+	if !coinDB.ValidateBlock([]*block.Transaction{coinbase("bob", 1, 1), spend(tx, 0, 5, "bob")}, 2) {
+		t.Error("rejected a block with a coinbase and a valid spend")
+	}
+	if coinDB.ValidateBlock([]*block.Transaction{coinbase("bob", 1, 1), coinbase("carol", 2, 1)}, 2) {
+		t.Error("validated a block with a second transaction without inputs")
+	}
+	// a Transaction without outputs gets no CoinRecord
+	burn := spend(tx, 0, 5, "bob")
+	burn.Outputs = nil
+	coinDB.StoreBlock([]*block.Transaction{coinbase("bob", 1, 1), burn}, 2)
+	if _, ok := dbContents(t, coinDB)[string(coinDB.recordKey(burn.Hash()))]; ok {
+		t.Error("stored a coin record for a transaction without outputs")
+	}
+	if coin := mustGetCoin(t, coinDB, CoinLocator{tx.Hash(), 0}); coin != nil {
+		t.Errorf("coin %v spent by a transaction without outputs is unspent", coin)
+	}
+}
+
+func TestValidateBlockSpendOrder(t *testing.T) {
+	coinDB := newTestDB(10)
+	tx := coinbase("alice", 0, 5, 7)
+	coinDB.StoreBlock([]*block.Transaction{tx}, 1)
+	first := spend(tx, 0, 5, "bob")
+	second := spend(first, 0, 5, "carol")
+	tests := []struct {
+		name  string
+		txs   []*block.Transaction
+		valid bool
+	}{
+		{"spends an earlier transaction's output", []*block.Transaction{coinbase("dave", 1, 1), first, second}, true},
+		{"spends a later transaction's output", []*block.Transaction{coinbase("dave", 1, 1), second, first}, false},
+		{"spends an output of a transaction not yet stored", []*block.Transaction{coinbase("dave", 1, 1), spend(first, 0, 5, "carol")}, false},
+		{"spends a stored coin twice", []*block.Transaction{coinbase("dave", 1, 1), first, spend(tx, 0, 5, "carol")}, false},
+		{"spends an in-block coin twice", []*block.Transaction{coinbase("dave", 1, 1), first, second, spend(first, 0, 5, "erin")}, false},
+	}
+	for _, tt := range tests {
+		if valid := coinDB.ValidateBlock(tt.txs, 2); valid != tt.valid {
+			t.Errorf("validated a block that %v as %v, want %v", tt.name, valid, tt.valid)
+		}
+	}
+}
+
+func TestReset(t *testing.T) {
+	coinDB := newTestDB(10)
+	tx := coinbase("alice", 0, 5, 7)
+	coinDB.StoreBlock([]*block.Transaction{tx}, 1)
+	if err := coinDB.ReserveCoins([]CoinLocator{{tx.Hash(), 0}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := coinDB.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if coinDB.MainCacheSize != 0 || len(coinDB.MainCache) != 0 {
+		t.Errorf("mainCache holds %v coins after Reset, want 0", len(coinDB.MainCache))
+	}
+	if contents := dbContents(t, coinDB); len(contents) != 0 {
+		t.Errorf("db holds %v keys after Reset, want 0", len(contents))
+	}
+	if coin := mustGetCoin(t, coinDB, CoinLocator{tx.Hash(), 0}); coin != nil {
+		t.Errorf("got coin %v after Reset", coin)
+	}
+	// the db is still open, and holds no reservations
+	coinDB.StoreBlock([]*block.Transaction{tx}, 1)
+	if err := coinDB.ReserveCoins([]CoinLocator{{tx.Hash(), 0}}); err != nil {
+		t.Errorf("could not reserve a coin stored after Reset: %v", err)
+	}
+	if coin := mustGetCoin(t, coinDB, CoinLocator{tx.Hash(), 1}); coin == nil || coin.TransactionOutput.Amount != 7 {
+		t.Errorf("got coin %v stored after Reset, want amount 7", coin)
+	}
+}
+
+func TestRequireNonEmptyScript(t *testing.T) {
+	for _, require := range []bool{false, true} {
+		config := DefaultConfig()
+		config.RequireNonEmptyScript = require
+		coinDB := NewWithStore(kvstore.NewMemoryStore(), config)
+		empty, locked := coinbase("", 0, 5), coinbase("alice", 1, 5)
+		coinDB.StoreBlock([]*block.Transaction{empty}, 1)
+		coinDB.StoreBlock([]*block.Transaction{locked}, 2)
+		// the coins are checked both in the mainCache and in the db
+		for _, flushed := range []bool{false, true} {
+			if flushed {
+				if err := coinDB.FlushMainCache(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !coinDB.ValidateBlock([]*block.Transaction{coinbase("bob", 2, 1), spend(locked, 0, 5, "bob")}, 3) {
+				t.Errorf("with RequireNonEmptyScript %v and flushed %v, rejected a spend of a coin with a locking script", require, flushed)
+			}
+			if valid := coinDB.ValidateBlock([]*block.Transaction{coinbase("bob", 2, 1), spend(empty, 0, 5, "bob")}, 3); valid == require {
+				t.Errorf("with RequireNonEmptyScript %v and flushed %v, validated a spend of a coin without a locking script as %v", require, flushed, valid)
+			}
+		}
+		// as are coins created earlier in the same Block
+		unlocked := spend(locked, 0, 5, "")
+		if valid := coinDB.ValidateBlock([]*block.Transaction{coinbase("bob", 2, 1), unlocked, spend(unlocked, 0, 5, "bob")}, 3); valid == require {
+			t.Errorf("with RequireNonEmptyScript %v, validated an in-block spend of a coin without a locking script as %v", require, valid)
+		}
+	}
+}
+
+func TestMemoryStoreMatchesLevelDB(t *testing.T) {
+	config := DefaultConfig()
+	config.DatabasePath = t.TempDir()
+	config.MainCacheCapacity = 30
+	levelDB, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer levelDB.Close()
+	memoryDB := newTestDB(30)
+	var hashes [][]byte
+	for _, coinDB := range []*CoinDatabase{levelDB, memoryDB} {
+		if stats := SimulateWorkload(coinDB, 50, 10, 1); stats.RejectedBlocks != 0 {
+			t.Fatalf("rejected %v blocks of a valid workload", stats.RejectedBlocks)
+		}
+		hash, err := coinDB.UTXOSetHash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, hash)
+	}
+	if !bytes.Equal(hashes[0], hashes[1]) {
+		t.Errorf("the same workload left UTXO set %x in LevelDB and %x in memory", hashes[0], hashes[1])
+	}
+}
+
+func TestCacheBreakdown(t *testing.T) {
+	coinDB := newTestDB(10)
+	tx := coinbase("alice", 0, 5, 7)
+	coinDB.StoreBlock([]*block.Transaction{tx}, 1)
+	if live, spent := coinDB.CacheBreakdown(); live != 2 || spent != 0 {
+		t.Errorf("got %v live and %v spent coins after storing two, want 2 and 0", live, spent)
+	}
+	coinDB.StoreBlock([]*block.Transaction{coinbase("bob", 1, 1), spend(tx, 0, 5, "bob")}, 2)
+	if live, spent := coinDB.CacheBreakdown(); live != 3 || spent != 1 {
+		t.Errorf("got %v live and %v spent coins after spending one, want 3 and 1", live, spent)
+	}
+	if err := coinDB.FlushMainCache(); err != nil {
+		t.Fatal(err)
+	}
+	if live, spent := coinDB.CacheBreakdown(); live != 0 || spent != 0 {
+		t.Errorf("got %v live and %v spent coins after flushing, want 0 and 0", live, spent)
+	}
+}
+
+func TestSelectCoins(t *testing.T) {
+	coinDB := newTestDB(10)
+	first, second := coinbase("alice", 0, 5, 7), coinbase("alice", 1, 3)
+	coinDB.StoreBlock([]*block.Transaction{first, second, coinbase("bob", 2, 100)}, 1)
+	// coins are selected in sorted CoinLocator order
+	amounts := map[CoinLocator]uint32{{first.Hash(), 0}: 5, {first.Hash(), 1}: 7, {second.Hash(), 0}: 3}
+	var order []CoinLocator
+	for cl := range amounts {
+		order = append(order, cl)
+	}
+	sortLocators(order)
+	tests := []struct {
+		name     string
+		target   uint32
+		selected []CoinLocator
+	}{
+		{"exact", amounts[order[0]] + amounts[order[1]], order[:2]},
+		{"over target", amounts[order[0]] + 1, order[:2]},
+		{"everything", 15, order},
+	}
+	for _, tt := range tests {
+		selected, total, err := coinDB.SelectCoins("alice", tt.target)
+		if err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		var want uint32
+		for _, cl := range tt.selected {
+			want += amounts[cl]
+		}
+		if !reflect.DeepEqual(selected, tt.selected) || total != want {
+			t.Errorf("%v: selected %v totalling %v for target %v, want %v totalling %v", tt.name, selected, total, tt.target, tt.selected, want)
+		}
+	}
+	if selected, _, err := coinDB.SelectCoins("alice", 16); !errors.Is(err, ErrInsufficientFunds) {
+		t.Errorf("selected %v and got error %v for more than alice has, want ErrInsufficientFunds", selected, err)
+	}
+	// reserved coins are skipped
+	if err := coinDB.ReserveCoins(order[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if selected, _, err := coinDB.SelectCoins("alice", 1); err != nil || !reflect.DeepEqual(selected, order[1:2]) {
+		t.Errorf("selected %v and got error %v with the first coin reserved, want %v", selected, err, order[1:2])
+	}
+}
+
+func TestRejectZeroOutputs(t *testing.T) {
+	for _, reject := range []bool{false, true} {
+		config := DefaultConfig()
+		config.RejectZeroOutputs = reject
+		coinDB := NewWithStore(kvstore.NewMemoryStore(), config)
+		funding := coinbase("alice", 0, 5)
+		coinDB.StoreBlock([]*block.Transaction{funding}, 1)
+		if !coinDB.ValidateBlock([]*block.Transaction{coinbase("bob", 2, 1), spend(funding, 0, 5, "bob")}, 2) {
+			t.Errorf("with RejectZeroOutputs %v, rejected a block without zero-amount outputs", reject)
+		}
+		if valid := coinDB.ValidateBlock([]*block.Transaction{coinbase("bob", 2, 1, 0)}, 2); valid == reject {
+			t.Errorf("with RejectZeroOutputs %v, validated a zero-amount coinbase output as %v", reject, valid)
+		}
+		if valid := coinDB.ValidateBlock([]*block.Transaction{coinbase("bob", 2, 1), spend(funding, 0, 0, "bob")}, 2); valid == reject {
+			t.Errorf("with RejectZeroOutputs %v, validated a zero-amount spend output as %v", reject, valid)
+		}
+	}
+}
+
+func TestOutputTotalOverflow(t *testing.T) {
+	coinDB := newTestDB(10)
+	// no uint32 amount overflows on its own, so the running total is
+	// started just below the limit
+	for _, tc := range []struct {
+		amount uint32
+		valid  bool
+	}{
+		{4, true},
+		{5, false},
+		{math.MaxUint32, false},
+	} {
+		v := coinDB.NewBlockValidator(1)
+		v.outputTotal = math.MaxUint64 - 4
+		err := v.Feed(coinbase("alice", 0, tc.amount))
+		if (err == nil) != tc.valid {
+			t.Errorf("fed an output of %v onto a total of %v and got error %v, want valid %v", tc.amount, uint64(math.MaxUint64-4), err, tc.valid)
+		}
+	}
+}
+
+func TestKeepSpentOutputs(t *testing.T) {
+	for _, keep := range []bool{false, true} {
+		config := DefaultConfig()
+		config.KeepSpentOutputs = keep
+		coinDB := NewWithStore(kvstore.NewMemoryStore(), config)
+		alice := coinbase("alice", 0, 5, 7)
+		coinDB.StoreBlock([]*block.Transaction{alice}, 1)
+		spentCL, unspentCL := CoinLocator{alice.Hash(), 0}, CoinLocator{alice.Hash(), 1}
+		if err := coinDB.FlushMainCache(); err != nil {
+			t.Fatal(err)
+		}
+		// the spend reaches the db's CoinRecord, not the mainCache
+		coinDB.StoreBlock([]*block.Transaction{coinbase("miner", 1, 1), spend(alice, 0, 5, "bob")}, 2)
+		if err := coinDB.FlushMainCache(); err != nil {
+			t.Fatal(err)
+		}
+		if coin := mustGetCoin(t, coinDB, spentCL); coin != nil {
+			t.Errorf("with KeepSpentOutputs %v, GetCoin returned spent coin %v", keep, coin)
+		}
+		if coin := mustGetCoin(t, coinDB, unspentCL); coin == nil || coin.TransactionOutput.Amount != 7 {
+			t.Errorf("with KeepSpentOutputs %v, GetCoin returned %v for the unspent coin, want amount 7", keep, coin)
+		}
+		coin, err := coinDB.GetSpentCoin(spentCL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case !keep && coin != nil:
+			t.Errorf("without KeepSpentOutputs, GetSpentCoin returned %v", coin)
+		case keep && (coin == nil || !coin.IsSpent || coin.TransactionOutput.Amount != 5 || coin.SpentHeight != 2):
+			t.Errorf("with KeepSpentOutputs, GetSpentCoin returned %+v, want amount 5 spent at height 2", coin)
+		}
+		if coin, err := coinDB.GetSpentCoin(unspentCL); err != nil || coin != nil {
+			t.Errorf("with KeepSpentOutputs %v, GetSpentCoin returned %v and error %v for an unspent coin", keep, coin, err)
+		}
+	}
+}
+
+func TestValidationCache(t *testing.T) {
+	config := DefaultConfig()
+	config.ValidationCacheSize = 10
+	coinDB := NewWithStore(kvstore.NewMemoryStore(), config)
+	alice := coinbase("alice", 0, 5, 7)
+	coinDB.StoreBlock([]*block.Transaction{alice}, 1)
+	toBob, toCarol := spend(alice, 0, 5, "bob"), spend(alice, 1, 7, "carol")
+	if !coinDB.ValidateBlock([]*block.Transaction{coinbase("miner", 1, 1), toBob, toCarol}, 2) {
+		t.Fatal("rejected a valid block")
+	}
+	for _, tx := range []*block.Transaction{toBob, toCarol} {
+		if !coinDB.validated.contains(tx.Hash()) {
+			t.Errorf("transaction {%v} was not cached after it was validated", tx.Hash())
+		}
+	}
+	// another Transaction spends Bob's input, so toBob is dropped from
+	// the cache and rejected, while toCarol stays valid
+	coinDB.StoreBlock([]*block.Transaction{coinbase("miner", 2, 1), spend(alice, 0, 5, "dave")}, 2)
+	if coinDB.validated.contains(toBob.Hash()) {
+		t.Error("transaction stayed cached after its input was spent")
+	}
+	if coinDB.ValidateBlock([]*block.Transaction{coinbase("miner", 3, 1), toBob}, 3) {
+		t.Error("validated a transaction whose input was spent after it was cached")
+	}
+	if !coinDB.ValidateBlock([]*block.Transaction{coinbase("miner", 3, 1), toCarol}, 3) {
+		t.Error("rejected a cached transaction whose input is unspent")
+	}
+}
+
+func BenchmarkValidationCache(b *testing.B) {
+	for _, size := range []int{0, 1000} {
+		b.Run(fmt.Sprintf("size=%v", size), func(b *testing.B) {
+			config := DefaultConfig()
+			config.ValidationCacheSize = size
+			config.DatabasePath = b.TempDir()
+			coinDB, err := New(config)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer coinDB.Close()
+			// each spend reads its own CoinRecord from the db, as after a
+			// reorg
+			txs := []*block.Transaction{coinbase("miner", 100, 1)}
+			for i := uint32(0); i < 100; i++ {
+				funding := coinbase("alice", i, 5)
+				coinDB.StoreBlock([]*block.Transaction{funding}, i+1)
+				txs = append(txs, spend(funding, 0, 5, "bob"))
+			}
+			if err := coinDB.FlushMainCache(); err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if !coinDB.ValidateBlock(txs, 101) {
+					b.Fatal("rejected a valid block")
+				}
+			}
+		})
+	}
+}
+
+func TestCoinsKeyedOnHashTransaction(t *testing.T) {
+	coinDB := newTestDB(10)
+	tx := coinbase("alice", 0, 5)
+	coinDB.StoreBlock([]*block.Transaction{tx}, 1)
+	key := string(coinDB.recordKey(block.HashTransaction(tx)))
+	if _, ok := dbContents(t, coinDB)[key]; !ok {
+		t.Errorf("no coin record under the key for hash {%v}", block.HashTransaction(tx))
+	}
+}
+
+func TestStoreBlockWithSpends(t *testing.T) {
+	coinDB := newTestDB(10)
+	alice := coinbase("alice", 0, 5, 7)
+	coinDB.StoreBlock([]*block.Transaction{alice}, 1)
+	// alice's Coins are read from the db and bob's from the mainCache
+	if err := coinDB.FlushMainCache(); err != nil {
+		t.Fatal(err)
+	}
+	bob := coinbase("bob", 1, 3)
+	coinDB.StoreBlock([]*block.Transaction{bob}, 2)
+	txs := []*block.Transaction{
+		coinbase("miner", 2, 1),
+		{
+			Inputs: []*block.TransactionInput{
+				{ReferenceTransactionHash: alice.Hash(), OutputIndex: 1},
+				{ReferenceTransactionHash: bob.Hash(), OutputIndex: 0},
+			},
+			Outputs: []*block.TransactionOutput{{Amount: 10, LockingScript: "carol"}},
+		},
+		spend(alice, 0, 5, "dave"),
+	}
+	spent, err := coinDB.StoreBlockWithSpends(txs, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the Coins come back in input order, unspent as they were
+	want := []struct {
+		amount uint32
+		script string
+	}{{7, "alice"}, {3, "bob"}, {5, "alice"}}
+	if len(spent) != len(want) {
+		t.Fatalf("got %v spent coins, want %v", len(spent), len(want))
+	}
+	for i, coin := range spent {
+		if coin.IsSpent || coin.TransactionOutput.Amount != want[i].amount || coin.TransactionOutput.LockingScript != want[i].script {
+			t.Errorf("spent coin %v is %+v, want amount %v locked by %v", i, coin, want[i].amount, want[i].script)
+		}
+	}
+	// a Coin spent in the mainCache is kept there, marked spent
+	for _, cl := range []CoinLocator{{alice.Hash(), 0}, {alice.Hash(), 1}, {bob.Hash(), 0}} {
+		if coin := mustGetCoin(t, coinDB, cl); coin != nil && !coin.IsSpent {
+			t.Errorf("coin %v is still unspent", cl)
+		}
+	}
+	// a missing input is reported, and the rest of the Block still stored
+	spent, err = coinDB.StoreBlockWithSpends([]*block.Transaction{coinbase("miner", 3, 1), spend(alice, 0, 5, "eve")}, 4)
+	if err == nil || len(spent) != 0 {
+		t.Errorf("got spent coins %v and error %v for an already-spent input", spent, err)
+	}
+}
+
+// compactingStore is a KVStore that counts how often it is compacted.
+type compactingStore struct {
+	kvstore.KVStore
+	compacted chan struct{}
+}
+
+func (s *compactingStore) Compact() error {
+	s.compacted <- struct{}{}
+	return nil
+}
+
+func TestCompactAfterDeletes(t *testing.T) {
+	store := &compactingStore{KVStore: kvstore.NewMemoryStore(), compacted: make(chan struct{}, 10)}
+	config := DefaultConfig()
+	config.CompactAfterDeletes = 3
+	coinDB := NewWithStore(store, config)
+	var txs []*block.Transaction
+	for i := uint32(0); i < 4; i++ {
+		txs = append(txs, coinbase("alice", i, 5))
+	}
+	coinDB.StoreBlock(txs, 1)
+	// spends only delete Coins from the db once they are out of the
+	// mainCache
+	if err := coinDB.FlushMainCache(); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []int{0, 0, 1, 1} {
+		coinDB.StoreBlock([]*block.Transaction{coinbase("miner", uint32(10+i), 1), spend(txs[i], 0, 5, "bob")}, uint32(i+2))
+		coinDB.compactions.Wait()
+		if got := len(store.compacted); got != want {
+			t.Errorf("after %v deletes, compacted %v times, want %v", i+1, got, want)
+		}
+	}
+}
+
+func TestRemoveBlockCoins(t *testing.T) {
+	coinDB := newTestDB(2)
+	alice := coinbase("alice", 0, 5, 7)
+	coinDB.StoreBlock([]*block.Transaction{alice}, 1)
+	before, err := coinDB.UTXOSetHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the Block's Coins overflow the mainCache, so some are only in the db
+	txs := []*block.Transaction{coinbase("miner", 1, 1, 2, 3), coinbase("bob", 2, 4)}
+	coinDB.StoreBlock(txs, 2)
+	if err := coinDB.RemoveBlockCoins(txs); err != nil {
+		t.Fatal(err)
+	}
+	for _, tx := range txs {
+		for i := range tx.Outputs {
+			if coin := mustGetCoin(t, coinDB, CoinLocator{tx.Hash(), uint32(i)}); coin != nil {
+				t.Errorf("coin %v of removed transaction {%v} is still there", i, tx.Hash())
+			}
+		}
+	}
+	after, err := coinDB.UTXOSetHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(after, before) {
+		t.Error("UTXO set after removing the block's coins differs from before it was stored")
+	}
+	for i, amount := range []uint32{5, 7} {
+		if coin := mustGetCoin(t, coinDB, CoinLocator{alice.Hash(), uint32(i)}); coin == nil || coin.TransactionOutput.Amount != amount {
+			t.Errorf("coin %v of an earlier block is %v, want amount %v", i, coin, amount)
+		}
+	}
+}
+
+func TestPreviewBlock(t *testing.T) {
+	coinDB := newTestDB(10)
+	alice := coinbase("alice", 0, 5, 7)
+	coinDB.StoreBlock([]*block.Transaction{alice}, 1)
+	toBob := spend(alice, 0, 5, "bob")
+	txs := []*block.Transaction{coinbase("miner", 1, 1, 2), toBob, spend(toBob, 0, 5, "carol")}
+	before, err := coinDB.UTXOSetHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	spends, creates, err := coinDB.PreviewBlock(txs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after, err := coinDB.UTXOSetHash(); err != nil || !bytes.Equal(after, before) {
+		t.Fatalf("previewing changed the UTXO set (error %v)", err)
+	}
+	wantSpends := []CoinLocator{{alice.Hash(), 0}, {toBob.Hash(), 0}}
+	wantCreates := []CoinLocator{{txs[0].Hash(), 0}, {txs[0].Hash(), 1}, {toBob.Hash(), 0}, {txs[2].Hash(), 0}}
+	if !reflect.DeepEqual(spends, wantSpends) || !reflect.DeepEqual(creates, wantCreates) {
+		t.Fatalf("preview spends %v and creates %v, want %v and %v", spends, creates, wantSpends, wantCreates)
+	}
+	// storing the Block has the previewed effect: every spent Coin is
+	// gone, and every created Coin not also spent is unspent
+	coinDB.StoreBlock(txs, 2)
+	if err := coinDB.FlushMainCache(); err != nil {
+		t.Fatal(err)
+	}
+	spent := make(map[CoinLocator]bool)
+	for _, cl := range spends {
+		spent[cl] = true
+		if coin := mustGetCoin(t, coinDB, cl); coin != nil {
+			t.Errorf("previewed spend %v is still unspent", cl)
+		}
+	}
+	for _, cl := range creates {
+		if coin := mustGetCoin(t, coinDB, cl); (coin != nil) == spent[cl] {
+			t.Errorf("previewed coin %v is %v after storing the block", cl, coin)
+		}
+	}
+	if coin := mustGetCoin(t, coinDB, CoinLocator{alice.Hash(), 1}); coin == nil {
+		t.Error("coin the block did not spend is gone")
+	}
+	// an input that is already spent makes the preview fail
+	if _, _, err := coinDB.PreviewBlock([]*block.Transaction{coinbase("miner", 2, 1), spend(alice, 0, 5, "eve")}); err == nil {
+		t.Error("previewed a block spending a coin that is already spent")
+	}
+}
+
+func TestMaxOutputAmount(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxOutputAmount = 10
+	coinDB := NewWithStore(kvstore.NewMemoryStore(), config)
+	alice := coinbase("alice", 0, 30)
+	coinDB.StoreBlock([]*block.Transaction{alice}, 1)
+	for _, tc := range []struct {
+		name  string
+		txs   []*block.Transaction
+		valid bool
+	}{
+		{"coinbase at the cap", []*block.Transaction{coinbase("miner", 1, 10)}, true},
+		{"coinbase over the cap", []*block.Transaction{coinbase("miner", 1, 11)}, false},
+		{"spend at the cap", []*block.Transaction{coinbase("miner", 1, 1), spend(alice, 0, 10, "bob")}, true},
+		{"spend over the cap", []*block.Transaction{coinbase("miner", 1, 1), spend(alice, 0, 11, "bob")}, false},
+	} {
+		if valid := coinDB.ValidateBlock(tc.txs, 2); valid != tc.valid {
+			t.Errorf("%v: validated as %v, want %v", tc.name, valid, tc.valid)
+		}
+	}
+	// without a cap, any amount is allowed
+	if !newTestDB(10).ValidateBlock([]*block.Transaction{coinbase("miner", 1, math.MaxUint32)}, 1) {
+		t.Error("rejected a large output without a cap")
+	}
+}
+
+func TestDumpRecord(t *testing.T) {
+	coinDB := newTestDB(10)
+	tx := coinbase("alice", 0, 5, 7, 9)
+	cr := &CoinRecord{Version: CoinRecordVersion}
+	cr.addCoin(0, 5, "alice", false, 0)
+	cr.addCoin(2, 9, "alice", true, 4)
+	stored, err := proto.Marshal(EncodeCoinRecord(cr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := coinDB.db.Put(coinDB.recordKey(tx.Hash()), stored); err != nil {
+		t.Fatal(err)
+	}
+	dumped, err := coinDB.DumpRecord(tx.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(dumped, cr) {
+		t.Errorf("dumped record %+v, want %+v", dumped, cr)
+	}
+	if encoded, err := proto.Marshal(EncodeCoinRecord(dumped)); err != nil || !bytes.Equal(encoded, stored) {
+		t.Errorf("dumped record encodes to %x (error %v), want the stored %x", encoded, err, stored)
+	}
+	if _, err := coinDB.DumpRecord(coinbase("bob", 1, 5).Hash()); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("got error %v for a missing record, want %v", err, ErrRecordNotFound)
+	}
+	// a spend still in the mainCache is not merged into the dump
+	bob := coinbase("bob", 1, 3)
+	coinDB.StoreBlock([]*block.Transaction{bob}, 1)
+	coinDB.StoreBlock([]*block.Transaction{coinbase("miner", 2, 1), spend(bob, 0, 3, "carol")}, 2)
+	if dumped, err := coinDB.DumpRecord(bob.Hash()); err != nil || len(dumped.OutputIndexes) != 1 || dumped.isSpent(0) {
+		t.Errorf("got record %+v and error %v for a coin spent only in the mainCache, want it unspent", dumped, err)
+	}
+}
+
+// checkingStore is a KVStore that calls check before every write, to
+// observe a CoinDatabase in the middle of storing a Block.
+type checkingStore struct {
+	kvstore.KVStore
+	check func()
+}
+
+func (s *checkingStore) Put(key, value []byte) error {
+	s.check()
+	return s.KVStore.Put(key, value)
+}
+
+func (s *checkingStore) Write(batch *kvstore.Batch) error {
+	s.check()
+	return s.KVStore.Write(batch)
+}
+
+func TestMainCacheNeverExceedsCapacity(t *testing.T) {
+	const capacity = 8
+	store := &checkingStore{KVStore: kvstore.NewMemoryStore()}
+	config := DefaultConfig()
+	config.MainCacheCapacity = capacity
+	coinDB := NewWithStore(store, config)
+	checks := 0
+	// the CoinDatabase's mu is held by the caller of the write
+	store.check = func() {
+		checks++
+		if len(coinDB.MainCache) > capacity || coinDB.MainCacheSize > capacity {
+			t.Errorf("mainCache holds %v coins (size %v) mid-block, over its capacity of %v", len(coinDB.MainCache), coinDB.MainCacheSize, capacity)
+		}
+	}
+	amounts := make([]uint32, 4*capacity+3)
+	for i := range amounts {
+		amounts[i] = uint32(i + 1)
+	}
+	tx := coinbase("alice", 0, amounts...)
+	coinDB.StoreBlock([]*block.Transaction{tx}, 1)
+	if checks == 0 {
+		t.Fatal("storing the block wrote nothing, so the mainCache was not observed")
+	}
+	// flushing part of the mainCache at a time keeps it from emptying
+	if size := len(coinDB.MainCache); size == 0 || size > capacity {
+		t.Errorf("mainCache holds %v coins after the block, want between 1 and %v", size, capacity)
+	}
+	for i, amount := range amounts {
+		if coin := mustGetCoin(t, coinDB, CoinLocator{tx.Hash(), uint32(i)}); coin == nil || coin.TransactionOutput.Amount != amount {
+			t.Errorf("coin %v is %v, want amount %v", i, coin, amount)
+		}
+	}
+}
+
+// readCountingStore is a KVStore that counts its Gets.
+type readCountingStore struct {
+	kvstore.KVStore
+	gets int
+}
+
+func (s *readCountingStore) Get(key []byte) ([]byte, error) {
+	s.gets++
+	return s.KVStore.Get(key)
+}
+
+func TestGetCoinCaching(t *testing.T) {
+	for _, capacity := range []uint32{0, 10} {
+		store := &readCountingStore{KVStore: kvstore.NewMemoryStore()}
+		config := DefaultConfig()
+		config.MainCacheCapacity = capacity
+		coinDB := NewWithStore(store, config)
+		tx := coinbase("alice", 0, 5)
+		coinDB.StoreBlock([]*block.Transaction{tx}, 1)
+		if err := coinDB.FlushMainCache(); err != nil {
+			t.Fatal(err)
+		}
+		cl := CoinLocator{tx.Hash(), 0}
+		// only the first read goes to the db, unless there is no mainCache
+		// to promote the Coin into
+		wantGets := []int{1, 1, 1}
+		if capacity == 0 {
+			wantGets = []int{1, 2, 3}
+		}
+		store.gets = 0
+		for i, want := range wantGets {
+			coin, err := coinDB.GetCoinCaching(cl)
+			if err != nil || coin == nil || coin.TransactionOutput.Amount != 5 {
+				t.Fatalf("read %v returned coin %v and error %v, want amount 5", i, coin, err)
+			}
+			if store.gets != want {
+				t.Errorf("with capacity %v, after read %v the db was read %v times, want %v", capacity, i, store.gets, want)
+			}
+		}
+	}
+}
+
+func TestZeroCacheCapacity(t *testing.T) {
+	store := &recordingStore{KVStore: kvstore.NewMemoryStore()}
+	config := DefaultConfig()
+	config.MainCacheCapacity = 0
+	coinDB := NewWithStore(store, config)
+	amounts := make([]uint32, 20)
+	for i := range amounts {
+		amounts[i] = uint32(i + 1)
+	}
+	alice := coinbase("alice", 0, amounts...)
+	coinDB.StoreBlock([]*block.Transaction{alice}, 1)
+	// the Transaction's CoinRecord is written once, with no flushes
+	if want := []string{"put " + string(coinDB.recordKey(alice.Hash()))}; !reflect.DeepEqual(store.writes, want) {
+		t.Errorf("storing a block wrote %v, want %v", store.writes, want)
+	}
+	if len(coinDB.MainCache) != 0 || coinDB.MainCacheSize != 0 {
+		t.Errorf("mainCache holds %v coins (size %v), want none", len(coinDB.MainCache), coinDB.MainCacheSize)
+	}
+	for i, amount := range amounts {
+		if coin := mustGetCoin(t, coinDB, CoinLocator{alice.Hash(), uint32(i)}); coin == nil || coin.TransactionOutput.Amount != amount {
+			t.Errorf("coin %v is %v, want amount %v", i, coin, amount)
+		}
+	}
+	// spends go straight to the db too
+	coinDB.StoreBlock([]*block.Transaction{coinbase("miner", 1, 1), spend(alice, 3, 4, "bob")}, 2)
+	if coin := mustGetCoin(t, coinDB, CoinLocator{alice.Hash(), 3}); coin != nil {
+		t.Errorf("spent coin is still in the db as %v", coin)
+	}
+	if len(coinDB.MainCache) != 0 {
+		t.Errorf("mainCache holds %v coins after a spend, want none", len(coinDB.MainCache))
+	}
+}
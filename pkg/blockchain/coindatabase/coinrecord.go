@@ -1,48 +1,258 @@
 package coindatabase
 
-import "Chain/pkg/pro"
+import (
+	"Chain/pkg/block"
+	"Chain/pkg/pro"
+	"fmt"
+	"sort"
+)
+
+// CoinRecordVersion is the version of the CoinRecord format written to
+// the db. Records of any other version must be migrated with
+// MigrateRecords before they can be decoded. Records written before
+// MigrateRecords existed are version 0.
+const CoinRecordVersion uint32 = 1
 
 // CoinRecord is a record of which coins created by a Transaction
 // have been spent. It is stored in the CoinDatabase's db.
+// Spent is nil unless the CoinDatabase keeps spent outputs, in which case
+// it parallels OutputIndexes and marks the outputs that have been spent.
+// Spent outputs are tombstones until GarbageCollect removes them.
+// SpentHeights parallels Spent and holds the height of the Block that
+// spent each output.
 type CoinRecord struct {
 	Version        uint32
 	OutputIndexes  []uint32
 	Amounts        []uint32
 	LockingScripts []string
+	Spent          []bool
+	SpentHeights   []uint32
 }
 
 // EncodeCoinRecord returns a pro.CoinRecord given a CoinRecord.
+// LockingScripts are stored as strings, so they must be valid UTF-8
+// for the pro.CoinRecord to marshal. Use EncodeCoinRecordBinary for
+// LockingScripts that may contain arbitrary bytes.
 func EncodeCoinRecord(cr *CoinRecord) *pro.CoinRecord {
 	var outputIndexes []uint32
 	var amounts []uint32
 	var lockingScripts []string
+	var spent []bool
+	var spentHeights []uint32
 	for i := 0; i < len(cr.OutputIndexes); i++ {
 		outputIndexes = append(outputIndexes, cr.OutputIndexes[i])
 		amounts = append(amounts, cr.Amounts[i])
 		lockingScripts = append(lockingScripts, cr.LockingScripts[i])
+		if cr.Spent != nil {
+			spent = append(spent, cr.isSpent(i))
+			spentHeights = append(spentHeights, cr.spentHeight(i))
+		}
 	}
 	return &pro.CoinRecord{
 		Version:        cr.Version,
 		OutputIndexes:  outputIndexes,
 		Amounts:        amounts,
 		LockingScripts: lockingScripts,
+		Spent:          spent,
+		SpentHeights:   spentHeights,
 	}
 }
 
-// DecodeCoinRecord returns a CoinRecord given a pro.CoinRecord.
-func DecodeCoinRecord(pcr *pro.CoinRecord) *CoinRecord {
+// EncodeCoinRecordBinary returns a pro.CoinRecord given a CoinRecord,
+// storing its LockingScripts as bytes so that they may contain
+// arbitrary bytes.
+func EncodeCoinRecordBinary(cr *CoinRecord) *pro.CoinRecord {
+	pcr := EncodeCoinRecord(cr)
+	lockingScriptBytes := make([][]byte, 0, len(pcr.LockingScripts))
+	for _, lockingScript := range pcr.LockingScripts {
+		lockingScriptBytes = append(lockingScriptBytes, []byte(lockingScript))
+	}
+	pcr.LockingScripts = nil
+	pcr.LockingScriptBytes = lockingScriptBytes
+	return pcr
+}
+
+// DecodeCoinRecord returns a CoinRecord given a pro.CoinRecord. It
+// reads LockingScripts from whichever of the string and bytes fields
+// the pro.CoinRecord was encoded with. It returns an error if the
+// pro.CoinRecord's version is unknown or its parallel fields do not have
+// one entry per Coin, as in a corrupt record.
+func DecodeCoinRecord(pcr *pro.CoinRecord) (*CoinRecord, error) {
+	if pcr.GetVersion() != CoinRecordVersion {
+		return nil, fmt.Errorf("[DecodeCoinRecord] unknown coin record version {%v}, expected {%v}", pcr.GetVersion(), CoinRecordVersion)
+	}
+	binary := len(pcr.GetLockingScriptBytes()) > 0
+	n := len(pcr.GetOutputIndexes())
+	numScripts := len(pcr.GetLockingScripts())
+	if binary {
+		numScripts = len(pcr.GetLockingScriptBytes())
+	}
+	if len(pcr.GetAmounts()) != n || numScripts != n || len(pcr.GetSpent()) > n {
+		return nil, fmt.Errorf("[DecodeCoinRecord] mismatched coin record: {%v} output indexes, {%v} amounts, {%v} locking scripts, {%v} spent flags",
+			n, len(pcr.GetAmounts()), numScripts, len(pcr.GetSpent()))
+	}
 	var outputIndexes []uint32
 	var amounts []uint32
 	var lockingScripts []string
+	var spent []bool
+	var spentHeights []uint32
 	for i := 0; i < len(pcr.GetOutputIndexes()); i++ {
 		outputIndexes = append(outputIndexes, pcr.GetOutputIndexes()[i])
 		amounts = append(amounts, pcr.GetAmounts()[i])
-		lockingScripts = append(lockingScripts, pcr.GetLockingScripts()[i])
+		if binary {
+			lockingScripts = append(lockingScripts, string(pcr.GetLockingScriptBytes()[i]))
+		} else {
+			lockingScripts = append(lockingScripts, pcr.GetLockingScripts()[i])
+		}
+		if i < len(pcr.GetSpent()) {
+			spent = append(spent, pcr.GetSpent()[i])
+			// records written before spent heights were kept read as height 0
+			var height uint32
+			if i < len(pcr.GetSpentHeights()) {
+				height = pcr.GetSpentHeights()[i]
+			}
+			spentHeights = append(spentHeights, height)
+		}
 	}
 	return &CoinRecord{
 		Version:        pcr.GetVersion(),
 		OutputIndexes:  outputIndexes,
 		Amounts:        amounts,
 		LockingScripts: lockingScripts,
+		Spent:          spent,
+		SpentHeights:   spentHeights,
+	}, nil
+}
+
+// Validate returns an error if the CoinRecord's Amounts and
+// LockingScripts do not have exactly one entry per output index, or if
+// Spent or SpentHeights have more.
+func (cr *CoinRecord) Validate() error {
+	n := len(cr.OutputIndexes)
+	if len(cr.Amounts) != n || len(cr.LockingScripts) != n || len(cr.Spent) > n || len(cr.SpentHeights) > n {
+		return fmt.Errorf("[Validate] mismatched coin record: {%v} output indexes, {%v} amounts, {%v} locking scripts, {%v} spent flags, {%v} spent heights",
+			n, len(cr.Amounts), len(cr.LockingScripts), len(cr.Spent), len(cr.SpentHeights))
+	}
+	return nil
+}
+
+// output returns the TransactionOutput of the Coin at a position in the
+// CoinRecord's parallel slices, or false if the position is out of
+// bounds of any of them.
+func (cr *CoinRecord) output(position int) (*block.TransactionOutput, bool) {
+	if position < 0 || position >= len(cr.OutputIndexes) || position >= len(cr.Amounts) || position >= len(cr.LockingScripts) {
+		return nil, false
+	}
+	return &block.TransactionOutput{
+		Amount:        cr.Amounts[position],
+		LockingScript: cr.LockingScripts[position],
+	}, true
+}
+
+// MergeCoinRecords returns a CoinRecord containing the union of the
+// Coins in two CoinRecords of the same Transaction. A Coin is spent in
+// the result only if it is spent in every CoinRecord that contains it,
+// at the height it was spent in the first.
+// It returns an error if either CoinRecord is invalid, or if both
+// contain a Coin with the same output index but a different amount or
+// locking script.
+func MergeCoinRecords(a, b *CoinRecord) (*CoinRecord, error) {
+	for _, cr := range []*CoinRecord{a, b} {
+		if err := cr.Validate(); err != nil {
+			return nil, fmt.Errorf("[MergeCoinRecords] %w", err)
+		}
+	}
+	merged := &CoinRecord{Version: a.Version}
+	for i := range a.OutputIndexes {
+		merged.addCoin(a.OutputIndexes[i], a.Amounts[i], a.LockingScripts[i], a.isSpent(i), a.spentHeight(i))
+	}
+	for i, outputIndex := range b.OutputIndexes {
+		j := indexOf(merged.OutputIndexes, outputIndex)
+		if j < 0 {
+			merged.addCoin(outputIndex, b.Amounts[i], b.LockingScripts[i], b.isSpent(i), b.spentHeight(i))
+			continue
+		}
+		if merged.Amounts[j] != b.Amounts[i] || merged.LockingScripts[j] != b.LockingScripts[i] {
+			return nil, fmt.Errorf("[MergeCoinRecords] conflicting coins for output index {%v}", outputIndex)
+		}
+		if merged.isSpent(j) && !b.isSpent(i) {
+			merged.Spent[j] = false
+			merged.SpentHeights[j] = 0
+		}
+	}
+	return merged, nil
+}
+
+// addCoin appends a Coin to the CoinRecord, keeping Spent and
+// SpentHeights parallel to the other slices if the Coin is spent or
+// Spent is already in use.
+func (cr *CoinRecord) addCoin(outputIndex uint32, amount uint32, lockingScript string, spent bool, spentHeight uint32) {
+	if spent && cr.Spent == nil {
+		cr.Spent = make([]bool, len(cr.OutputIndexes))
+		cr.SpentHeights = make([]uint32, len(cr.OutputIndexes))
+	}
+	cr.OutputIndexes = append(cr.OutputIndexes, outputIndex)
+	cr.Amounts = append(cr.Amounts, amount)
+	cr.LockingScripts = append(cr.LockingScripts, lockingScript)
+	if cr.Spent != nil {
+		cr.Spent = append(cr.Spent, spent)
+		if !spent {
+			spentHeight = 0
+		}
+		cr.SpentHeights = append(cr.SpentHeights, spentHeight)
+	}
+}
+
+// isSpent returns whether the Coin at a position in the CoinRecord's
+// parallel slices is marked spent.
+func (cr *CoinRecord) isSpent(position int) bool {
+	return position < len(cr.Spent) && cr.Spent[position]
+}
+
+// spentHeight returns the height at which the Coin at a position in the
+// CoinRecord's parallel slices was spent, or 0 if it is unspent.
+func (cr *CoinRecord) spentHeight(position int) uint32 {
+	if !cr.isSpent(position) || position >= len(cr.SpentHeights) {
+		return 0
+	}
+	return cr.SpentHeights[position]
+}
+
+// markSpent marks the Coin at a position in the CoinRecord's parallel
+// slices as spent at a height.
+func (cr *CoinRecord) markSpent(position int, height uint32) {
+	for len(cr.Spent) < len(cr.OutputIndexes) {
+		cr.Spent = append(cr.Spent, false)
+	}
+	for len(cr.SpentHeights) < len(cr.OutputIndexes) {
+		cr.SpentHeights = append(cr.SpentHeights, 0)
+	}
+	cr.Spent[position] = true
+	cr.SpentHeights[position] = height
+}
+
+// unspentIndex returns the position of the unspent Coin with an output
+// index in the CoinRecord's parallel slices, or -1 if there is no such
+// Coin or it is marked spent.
+func (cr *CoinRecord) unspentIndex(outputIndex uint32) int {
+	index := indexOf(cr.OutputIndexes, outputIndex)
+	if index < 0 || cr.isSpent(index) {
+		return -1
+	}
+	return index
+}
+
+// sortedPositions returns the positions of the CoinRecord's unspent
+// Coins in its parallel slices, ordered by output index.
+func (cr *CoinRecord) sortedPositions() []int {
+	positions := make([]int, 0, len(cr.OutputIndexes))
+	for i := range cr.OutputIndexes {
+		if !cr.isSpent(i) {
+			positions = append(positions, i)
+		}
 	}
+	sort.Slice(positions, func(i, j int) bool {
+		return cr.OutputIndexes[positions[i]] < cr.OutputIndexes[positions[j]]
+	})
+	return positions
 }
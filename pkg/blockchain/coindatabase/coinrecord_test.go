@@ -0,0 +1,205 @@
+package coindatabase
+
+import (
+	"Chain/pkg/block"
+	"Chain/pkg/blockchain/kvstore"
+	"Chain/pkg/pro"
+	"google.golang.org/protobuf/proto"
+	"reflect"
+	"testing"
+)
+
+func TestMergeCoinRecords(t *testing.T) {
+	a := &CoinRecord{Version: CoinRecordVersion}
+	a.addCoin(0, 5, "alice", false, 0)
+	b := &CoinRecord{Version: CoinRecordVersion}
+	b.addCoin(2, 9, "bob", false, 0)
+	merged, err := MergeCoinRecords(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(merged.OutputIndexes) != 2 {
+		t.Fatalf("merged record has %v coins, want 2", len(merged.OutputIndexes))
+	}
+	for _, want := range []struct {
+		outputIndex uint32
+		amount      uint32
+		script      string
+	}{{0, 5, "alice"}, {2, 9, "bob"}} {
+		txo, ok := merged.output(merged.unspentIndex(want.outputIndex))
+		if !ok || txo.Amount != want.amount || txo.LockingScript != want.script {
+			t.Errorf("output %v of merged record is %v, want amount %v locked by %v", want.outputIndex, txo, want.amount, want.script)
+		}
+	}
+}
+
+func TestMergeCoinRecordsConflict(t *testing.T) {
+	a := &CoinRecord{Version: CoinRecordVersion}
+	a.addCoin(0, 5, "alice", false, 0)
+	b := &CoinRecord{Version: CoinRecordVersion}
+	b.addCoin(0, 6, "alice", false, 0)
+	if _, err := MergeCoinRecords(a, b); err == nil {
+		t.Error("merged records with conflicting amounts for the same output")
+	}
+}
+
+// binaryScripts are locking scripts that are not valid UTF-8.
+var binaryScripts = []string{"\xff\xfe\x00\x01", "\x80script", "\x00"}
+
+func TestEncodeCoinRecordBinary(t *testing.T) {
+	cr := &CoinRecord{Version: CoinRecordVersion}
+	for i, script := range binaryScripts {
+		cr.addCoin(uint32(i), uint32(i+1), script, i == 1, uint32(i))
+	}
+	// strings must be valid UTF-8, so the scripts only survive as bytes
+	if _, err := proto.Marshal(EncodeCoinRecord(cr)); err == nil {
+		t.Error("marshalled non-UTF-8 locking scripts as strings")
+	}
+	data, err := proto.Marshal(EncodeCoinRecordBinary(cr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pcr := &pro.CoinRecord{}
+	if err := proto.Unmarshal(data, pcr); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeCoinRecord(pcr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, cr) {
+		t.Errorf("decoded %+v, want %+v", decoded, cr)
+	}
+}
+
+func TestBinaryLockingScripts(t *testing.T) {
+	config := DefaultConfig()
+	config.BinaryLockingScripts = true
+	coinDB := NewWithStore(kvstore.NewMemoryStore(), config)
+	var txs []*block.Transaction
+	for i, script := range binaryScripts {
+		txs = append(txs, coinbase(script, uint32(i), 5))
+	}
+	coinDB.StoreBlock(txs, 1)
+	if err := coinDB.FlushMainCache(); err != nil {
+		t.Fatal(err)
+	}
+	for i, tx := range txs {
+		coin := mustGetCoin(t, coinDB, CoinLocator{tx.Hash(), 0})
+		if coin == nil || coin.TransactionOutput.LockingScript != binaryScripts[i] {
+			t.Errorf("got coin %v after flushing, want one locked by %q", coin, binaryScripts[i])
+		}
+	}
+}
+
+// BenchmarkEncodeCoinRecord compares encoding and decoding a CoinRecord
+// with its LockingScripts as strings and as bytes.
+func BenchmarkEncodeCoinRecord(b *testing.B) {
+	cr := &CoinRecord{Version: CoinRecordVersion}
+	for i := 0; i < 16; i++ {
+		cr.addCoin(uint32(i), 5, "locking script of a typical coin", false, 0)
+	}
+	for _, bm := range []struct {
+		name   string
+		encode func(*CoinRecord) *pro.CoinRecord
+	}{{"string", EncodeCoinRecord}, {"binary", EncodeCoinRecordBinary}} {
+		b.Run(bm.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				data, err := proto.Marshal(bm.encode(cr))
+				if err != nil {
+					b.Fatal(err)
+				}
+				pcr := &pro.CoinRecord{}
+				if err := proto.Unmarshal(data, pcr); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := DecodeCoinRecord(pcr); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestEncodeCoinRecordSpent(t *testing.T) {
+	cr := &CoinRecord{Version: CoinRecordVersion}
+	cr.addCoin(0, 5, "alice", false, 0)
+	cr.addCoin(1, 7, "bob", true, 3)
+	cr.addCoin(4, 9, "carol", false, 0)
+	// the Spent bits and heights survive serialization
+	bytes, err := proto.Marshal(EncodeCoinRecord(cr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pcr := &pro.CoinRecord{}
+	if err := proto.Unmarshal(bytes, pcr); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeCoinRecord(pcr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, cr) {
+		t.Errorf("decoded record %+v, want %+v", decoded, cr)
+	}
+	for position, spent := range []bool{false, true, false} {
+		if decoded.isSpent(position) != spent {
+			t.Errorf("coin at position %v has spent %v, want %v", position, decoded.isSpent(position), spent)
+		}
+	}
+	if height := decoded.spentHeight(1); height != 3 {
+		t.Errorf("spent coin has spent height %v, want 3", height)
+	}
+}
+
+func TestDecodeCoinRecordRejectsMismatchedFields(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		pcr  *pro.CoinRecord
+	}{
+		{"missing amount", &pro.CoinRecord{OutputIndexes: []uint32{0, 1}, Amounts: []uint32{5}, LockingScripts: []string{"alice", "bob"}}},
+		{"extra amount", &pro.CoinRecord{OutputIndexes: []uint32{0}, Amounts: []uint32{5, 7}, LockingScripts: []string{"alice"}}},
+		{"missing script", &pro.CoinRecord{OutputIndexes: []uint32{0, 1}, Amounts: []uint32{5, 7}, LockingScripts: []string{"alice"}}},
+		{"missing binary script", &pro.CoinRecord{OutputIndexes: []uint32{0, 1}, Amounts: []uint32{5, 7}, LockingScriptBytes: [][]byte{{0xff}}}},
+		{"extra spent flag", &pro.CoinRecord{OutputIndexes: []uint32{0}, Amounts: []uint32{5}, LockingScripts: []string{"alice"}, Spent: []bool{false, true}}},
+	} {
+		tc.pcr.Version = CoinRecordVersion
+		if cr, err := DecodeCoinRecord(tc.pcr); err == nil {
+			t.Errorf("%v: decoded mismatched record to %+v", tc.name, cr)
+		}
+		// reading the record from the db returns the error instead of
+		// panicking
+		coinDB := newTestDB(10)
+		tx := coinbase("alice", 0, 5, 7)
+		bytes, err := proto.Marshal(tc.pcr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := coinDB.db.Put(coinDB.recordKey(tx.Hash()), bytes); err != nil {
+			t.Fatal(err)
+		}
+		for outputIndex := uint32(0); outputIndex < 2; outputIndex++ {
+			if coin, err := coinDB.GetCoin(CoinLocator{tx.Hash(), outputIndex}); err == nil {
+				t.Errorf("%v: got coin %v for output %v of a mismatched record, want an error", tc.name, coin, outputIndex)
+			}
+		}
+	}
+}
+
+func TestMergeCoinRecordsRejectsMismatchedFields(t *testing.T) {
+	valid := &CoinRecord{Version: CoinRecordVersion}
+	valid.addCoin(0, 5, "alice", false, 0)
+	mismatched := &CoinRecord{Version: CoinRecordVersion, OutputIndexes: []uint32{1, 2}, Amounts: []uint32{7}, LockingScripts: []string{"bob", "carol"}}
+	if _, err := MergeCoinRecords(valid, mismatched); err == nil {
+		t.Error("merged a record with more output indexes than amounts")
+	}
+	if _, err := MergeCoinRecords(mismatched, valid); err == nil {
+		t.Error("merged into a record with more output indexes than amounts")
+	}
+	// a conflicting locking script is rejected like a conflicting amount
+	other := &CoinRecord{Version: CoinRecordVersion}
+	other.addCoin(0, 5, "mallory", false, 0)
+	if _, err := MergeCoinRecords(valid, other); err == nil {
+		t.Error("merged records with conflicting locking scripts for the same output")
+	}
+}
@@ -1,9 +1,82 @@
 package coindatabase
 
+import (
+	"io"
+	"time"
+)
+
 // Config is the CoinDatabase's configuration options.
+// MainCacheCapacity is the number of Coins the mainCache holds before
+// part of it is flushed to the db. 0 disables the mainCache, so new
+// Coins are written straight to the db and every read goes to it.
+// FlushInterval, if non-zero, is how often a background goroutine
+// flushes the mainCache, bounding how much unflushed state a crash
+// can lose.
+// RawKeys stores CoinRecords under the raw bytes of their hex-encoded
+// Transaction hashes, halving the size of each key. An existing db must
+// be migrated with MigrateToRawKeys.
+// SortedFlush flushes the mainCache in sorted CoinLocator order, so that
+// identical caches produce identical db writes.
+// RequireNonEmptyScript rejects Transactions that spend Coins with an
+// empty LockingScript.
+// RejectZeroOutputs rejects Blocks with outputs of amount zero, which
+// would otherwise become unspendable CoinRecords. Chains that use
+// zero-value outputs to carry data should leave it unset.
+// KeepSpentOutputs marks spent Coins as spent in their CoinRecords
+// instead of removing them, so that GetSpentCoin can still find them.
+// These tombstones are kept until GarbageCollect removes them.
+// ValidationCacheSize, if non-zero, is the number of Transactions whose
+// inputs were found valid that are remembered, so that they are not
+// checked again until one of the Coins they spend changes.
+// BinaryLockingScripts stores LockingScripts in CoinRecords as bytes
+// instead of strings, so that scripts need not be valid UTF-8. Records
+// written either way can be read regardless of the setting.
+// CompactAfterDeletes, if non-zero, is the number of Coins deleted from
+// the db after which it is compacted in the background, so that reads
+// stay fast under heavy spending. It has no effect on KVStores that
+// cannot be compacted.
+// Subsidy, if set, returns the amount a Block at a given height may
+// mint. ValidateBlock then requires each Block's coinbase to claim
+// exactly the subsidy plus the Block's fees.
+// KeyPrefix, if set, is prepended to every key, so that the CoinDatabase
+// can share a KVStore with other databases.
+// MaxOutputAmount, if non-zero, is the largest amount a Transaction
+// output may have. Blocks with larger outputs are rejected.
+// LogSpentCoins keeps a log of the Coins spent by stored Blocks, with
+// their amounts and LockingScripts, for DrainSpentLog to return. The log
+// grows until it is drained.
+// RecoverFromLock makes New rebuild the manifest of a levelDB left
+// corrupt by a crash, instead of returning an error. Despite the name,
+// it cannot open a locked levelDB: only a running process holds the
+// lock, and New returns an error wrapping kvstore.ErrLocked.
+// DisableUndo, for append-only chains that never reorg, makes UndoCoins
+// return an error wrapping chainwriter.ErrUndoDisabled. RollbackCoins,
+// which recovers a Block left half-applied by a crash, still works.
+// OpLog, if set, receives a line of JSON for every change made to the
+// CoinDatabase: every Block stored, undone, or rolled back, every flush
+// of the mainCache, Reset, RemoveBlockCoins, GarbageCollect, migration,
+// and SetCacheCapacity, so that ReplayOpLog can reproduce the
+// CoinDatabase's state from it. Each change is logged once it is made.
 type Config struct {
 	DatabasePath      string
 	MainCacheCapacity uint32
+	FlushInterval     time.Duration
+	RawKeys           bool
+	SortedFlush       bool
+
+	RequireNonEmptyScript bool
+	RejectZeroOutputs     bool
+	KeepSpentOutputs      bool
+	ValidationCacheSize   int
+	BinaryLockingScripts  bool
+	CompactAfterDeletes   int
+	Subsidy               func(height uint32) uint32
+	KeyPrefix             []byte
+	RecoverFromLock       bool
+	MaxOutputAmount       uint32
+	LogSpentCoins         bool
+	DisableUndo           bool
+	OpLog                 io.Writer
 }
 
 // DefaultConfig returns the CoinDatabase's default Config.
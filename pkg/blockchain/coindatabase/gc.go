@@ -0,0 +1,69 @@
+package coindatabase
+
+import (
+	"Chain/pkg/blockchain/kvstore"
+	"Chain/pkg/pro"
+	"fmt"
+	"google.golang.org/protobuf/proto"
+)
+
+// GarbageCollect removes every tombstone, a Coin marked spent in its
+// CoinRecord because the CoinDatabase keeps spent outputs, that was spent
+// below beforeHeight, returning how many were removed. CoinRecords left
+// with no Coins are deleted. Coins spent in the mainCache are not
+// tombstones until it is flushed. All changes are written in a single
+// batch, so either every tombstone is removed or none are.
+func (coinDB *CoinDatabase) GarbageCollect(beforeHeight uint32) (int, error) {
+	coinDB.mu.Lock()
+	defer coinDB.mu.Unlock()
+	batch := new(kvstore.Batch)
+	removed := 0
+	iter := coinDB.db.NewIterator()
+	for iter.Next() {
+		txHash := coinDB.txHashFromKey(iter.Key())
+		pcr := &pro.CoinRecord{}
+		if err := pro.Unmarshal(string(txHash), iter.Value(), pcr); err != nil {
+			iter.Release()
+			return 0, fmt.Errorf("[GarbageCollect] %w", err)
+		}
+		cr, err := DecodeCoinRecord(pcr)
+		if err != nil {
+			iter.Release()
+			return 0, fmt.Errorf("[GarbageCollect] %w", err)
+		}
+		var collect []uint32
+		for i, outputIndex := range cr.OutputIndexes {
+			if cr.isSpent(i) && cr.spentHeight(i) < beforeHeight {
+				collect = append(collect, outputIndex)
+			}
+		}
+		if len(collect) == 0 {
+			continue
+		}
+		for _, outputIndex := range collect {
+			cr = coinDB.removeCoinFromRecord(cr, outputIndex)
+		}
+		removed += len(collect)
+		key := append([]byte{}, iter.Key()...)
+		if len(cr.OutputIndexes) == 0 {
+			batch.Delete(key)
+			continue
+		}
+		bytes, err := proto.Marshal(coinDB.encodeRecord(cr))
+		if err != nil {
+			iter.Release()
+			return 0, fmt.Errorf("[GarbageCollect] failed to marshal coin record {%v}: %w", txHash, err)
+		}
+		batch.Put(key, bytes)
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return 0, fmt.Errorf("[GarbageCollect] failed to iterate db: %w", err)
+	}
+	if err := coinDB.db.Write(batch); err != nil {
+		return 0, fmt.Errorf("[GarbageCollect] failed to write coin records: %w", err)
+	}
+	coinDB.noteDeletes(removed)
+	coinDB.logOp(&opEntry{Op: opCollect, Height: beforeHeight})
+	return removed, nil
+}
@@ -0,0 +1,74 @@
+package coindatabase
+
+import (
+	"Chain/pkg/block"
+	"Chain/pkg/blockchain/kvstore"
+	"testing"
+)
+
+func TestGarbageCollect(t *testing.T) {
+	config := DefaultConfig()
+	config.KeepSpentOutputs = true
+	coinDB := NewWithStore(kvstore.NewMemoryStore(), config)
+	alice := coinbase("alice", 0, 5, 7, 9)
+	coinDB.StoreBlock([]*block.Transaction{alice}, 1)
+	// each spend reaches the db once the mainCache is flushed, leaving a
+	// tombstone
+	for i, height := range []uint32{2, 4} {
+		if err := coinDB.FlushMainCache(); err != nil {
+			t.Fatal(err)
+		}
+		coinDB.StoreBlock([]*block.Transaction{coinbase("miner", height, 1), spend(alice, uint32(i), 5, "bob")}, height)
+	}
+	if err := coinDB.FlushMainCache(); err != nil {
+		t.Fatal(err)
+	}
+	tombstone := func(outputIndex uint32) bool {
+		t.Helper()
+		coin, err := coinDB.GetSpentCoin(CoinLocator{alice.Hash(), outputIndex})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return coin != nil
+	}
+	if !tombstone(0) || !tombstone(1) {
+		t.Fatal("spent coins did not leave tombstones")
+	}
+	for _, tc := range []struct {
+		beforeHeight uint32
+		removed      int
+		tombstones   []bool
+	}{
+		// the spend at height 2 is collected, and the one at 4 is not
+		{3, 1, []bool{false, true}},
+		{3, 0, []bool{false, true}},
+		{5, 1, []bool{false, false}},
+	} {
+		removed, err := coinDB.GarbageCollect(tc.beforeHeight)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if removed != tc.removed {
+			t.Errorf("collected %v tombstones before height %v, want %v", removed, tc.beforeHeight, tc.removed)
+		}
+		for i, want := range tc.tombstones {
+			if got := tombstone(uint32(i)); got != want {
+				t.Errorf("after collecting before height %v, coin %v has tombstone %v, want %v", tc.beforeHeight, i, got, want)
+			}
+		}
+		if coin := mustGetCoin(t, coinDB, CoinLocator{alice.Hash(), 2}); coin == nil {
+			t.Errorf("after collecting before height %v, the unspent coin is gone", tc.beforeHeight)
+		}
+	}
+	// collecting the last Coin deletes the CoinRecord
+	coinDB.StoreBlock([]*block.Transaction{coinbase("miner", 5, 1), spend(alice, 2, 9, "bob")}, 5)
+	if err := coinDB.FlushMainCache(); err != nil {
+		t.Fatal(err)
+	}
+	if removed, err := coinDB.GarbageCollect(6); err != nil || removed != 1 {
+		t.Fatalf("collected %v tombstones with error %v, want 1", removed, err)
+	}
+	if _, ok := dbContents(t, coinDB)[string(coinDB.recordKey(alice.Hash()))]; ok {
+		t.Error("coin record with every coin collected is still in the db")
+	}
+}
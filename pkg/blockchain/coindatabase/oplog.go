@@ -0,0 +1,138 @@
+package coindatabase
+
+import (
+	"Chain/pkg/block"
+	"Chain/pkg/blockchain/chainwriter"
+	"Chain/pkg/blockchain/kvstore"
+	"Chain/pkg/utils"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The kinds of entry in an operation log.
+const (
+	opStore    = "store"
+	opUndo     = "undo"
+	opRollback = "rollback"
+	opFlush    = "flush"
+	opReset    = "reset"
+	opRemove   = "remove"
+	opCollect  = "collect"
+	opMigrate  = "migrate"
+	opRawKeys  = "rawKeys"
+	opCapacity = "capacity"
+)
+
+// opEntry is an entry in an operation log, recording one change to the
+// CoinDatabase. Op is the kind of change, and the other fields are the
+// arguments it was made with: Transactions and Height for a stored
+// Block, Blocks and UndoBlocks for Blocks undone or rolled back,
+// Transactions for Coins removed, Height for tombstones collected, and
+// Capacity for a new mainCache capacity. Records holds the CoinRecords
+// written by MigrateRecords, whose upgrade function cannot be logged.
+type opEntry struct {
+	Op           string                   `json:"op"`
+	Height       uint32                   `json:"height,omitempty"`
+	Capacity     uint32                   `json:"capacity,omitempty"`
+	Transactions []*block.Transaction     `json:"transactions,omitempty"`
+	Blocks       []*block.Block           `json:"blocks,omitempty"`
+	UndoBlocks   []*chainwriter.UndoBlock `json:"undoBlocks,omitempty"`
+	Records      []loggedRecord           `json:"records,omitempty"`
+}
+
+// loggedRecord is a serialized CoinRecord and its db key, as written to
+// the db.
+type loggedRecord struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// logOp writes an entry to the operation log, if there is one. Failing
+// to write it does not fail the change it records. Entries are logged
+// only once their change has been made, and the caller must hold mu, so
+// that entries are written in the order the changes were made.
+func (coinDB *CoinDatabase) logOp(entry *opEntry) {
+	if coinDB.opLog == nil {
+		return
+	}
+	if err := json.NewEncoder(coinDB.opLog).Encode(entry); err != nil {
+		utils.Debug.Printf("[logOp] failed to write {%v} entry: %v", entry.Op, err)
+	}
+}
+
+// ReplayOpLog re-applies every change recorded in an operation log, in
+// order, so that a fresh CoinDatabase with the same Config ends up in
+// the same state as the one that wrote the log. It returns an error if
+// an entry cannot be read or re-applied; the entries before it are
+// still applied.
+func (coinDB *CoinDatabase) ReplayOpLog(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	for n := 0; ; n++ {
+		entry := &opEntry{}
+		err := dec.Decode(entry)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("[ReplayOpLog] failed to read entry {%v}: %w", n, err)
+		}
+		if err := coinDB.replayOp(entry); err != nil {
+			return fmt.Errorf("[ReplayOpLog] entry {%v}: %w", n, err)
+		}
+	}
+}
+
+// replayOp re-applies the change recorded by an operation log entry.
+func (coinDB *CoinDatabase) replayOp(entry *opEntry) error {
+	switch entry.Op {
+	case opStore:
+		coinDB.StoreBlock(entry.Transactions, entry.Height)
+		return nil
+	case opUndo:
+		return coinDB.UndoCoins(entry.Blocks, entry.UndoBlocks)
+	case opRollback:
+		if len(entry.Blocks) != 1 || len(entry.UndoBlocks) != 1 {
+			return fmt.Errorf("rollback of {%v} blocks and {%v} undo blocks", len(entry.Blocks), len(entry.UndoBlocks))
+		}
+		return coinDB.RollbackCoins(entry.Blocks[0], entry.UndoBlocks[0])
+	case opFlush:
+		return coinDB.FlushMainCache()
+	case opReset:
+		return coinDB.Reset()
+	case opRemove:
+		return coinDB.RemoveBlockCoins(entry.Transactions)
+	case opCollect:
+		_, err := coinDB.GarbageCollect(entry.Height)
+		return err
+	case opMigrate:
+		return coinDB.writeMigratedRecords(entry.Records)
+	case opRawKeys:
+		return coinDB.MigrateToRawKeys()
+	case opCapacity:
+		coinDB.SetCacheCapacity(entry.Capacity)
+		return nil
+	default:
+		return fmt.Errorf("unknown operation {%v}", entry.Op)
+	}
+}
+
+// writeMigratedRecords replays MigrateRecords, flushing the mainCache,
+// writing the CoinRecords it produced in a single batch, and flushing
+// the Coins of those records.
+func (coinDB *CoinDatabase) writeMigratedRecords(records []loggedRecord) error {
+	coinDB.mu.Lock()
+	defer coinDB.mu.Unlock()
+	coinDB.flushMainCache() // ignore error; Coins of old records are flushed after migrating
+	batch := new(kvstore.Batch)
+	for _, record := range records {
+		batch.Put(record.Key, record.Value)
+	}
+	if err := coinDB.db.Write(batch); err != nil {
+		return fmt.Errorf("failed to write migrated coin records: %w", err)
+	}
+	coinDB.balances = nil
+	coinDB.logOp(&opEntry{Op: opMigrate, Records: records})
+	return coinDB.flushMainCache()
+}
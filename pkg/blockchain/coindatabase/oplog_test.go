@@ -0,0 +1,73 @@
+package coindatabase
+
+import (
+	"Chain/pkg/block"
+	"Chain/pkg/blockchain/chainwriter"
+	"Chain/pkg/blockchain/kvstore"
+	"Chain/pkg/pro"
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestReplayOpLog(t *testing.T) {
+	var log bytes.Buffer
+	config := DefaultConfig()
+	config.MainCacheCapacity = 2
+	config.KeepSpentOutputs = true
+	config.OpLog = &log
+	coinDB := NewWithStore(kvstore.NewMemoryStore(), config)
+
+	alice := coinbase("alice", 0, 5, 7)
+	coinDB.StoreBlock([]*block.Transaction{alice}, 1)
+	toBob := spend(alice, 0, 5, "bob")
+	coinDB.StoreBlock([]*block.Transaction{coinbase("miner", 1, 1), toBob}, 2)
+	coinDB.FlushMainCache()
+	toCarol := spend(alice, 1, 7, "carol")
+	b3 := &block.Block{Header: &block.Header{}, Transactions: []*block.Transaction{coinbase("miner", 2, 1), toCarol}}
+	coinDB.StoreBlock(b3.Transactions, 3)
+	ub3 := &chainwriter.UndoBlock{
+		TransactionInputHashes: []block.TxHash{alice.Hash()},
+		OutputIndexes:          []uint32{1},
+		Amounts:                []uint32{7},
+		LockingScripts:         []string{"alice"},
+	}
+	if err := coinDB.UndoCoins([]*block.Block{b3}, []*chainwriter.UndoBlock{ub3}); err != nil {
+		t.Fatal(err)
+	}
+	coinDB.SetCacheCapacity(1)
+	if _, err := coinDB.GarbageCollect(3); err != nil {
+		t.Fatal(err)
+	}
+	if err := coinDB.RemoveBlockCoins([]*block.Transaction{toBob}); err != nil {
+		t.Fatal(err)
+	}
+	if err := coinDB.MigrateRecords(func(old *pro.CoinRecord) *pro.CoinRecord { return old }); err != nil {
+		t.Fatal(err)
+	}
+	want := dbContents(t, coinDB)
+
+	replayConfig := *config
+	replayConfig.OpLog = nil
+	replayed := NewWithStore(kvstore.NewMemoryStore(), &replayConfig)
+	if err := replayed.ReplayOpLog(&log); err != nil {
+		t.Fatal(err)
+	}
+	if replayed.MainCacheCapacity != 1 {
+		t.Errorf("replayed mainCache capacity is {%v}, want 1", replayed.MainCacheCapacity)
+	}
+	if got := dbContents(t, replayed); !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed db holds %v, want %v", got, want)
+	}
+	wantHash, err := coinDB.UTXOSetHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotHash, err := replayed.UTXOSetHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(gotHash, wantHash) {
+		t.Errorf("replayed UTXO set hash is %x, want %x", gotHash, wantHash)
+	}
+}
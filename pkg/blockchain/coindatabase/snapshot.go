@@ -0,0 +1,111 @@
+package coindatabase
+
+import (
+	"Chain/pkg/block"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// ExportSnapshot flushes the mainCache and writes every unspent Coin to
+// a CSV file at path, one row per Coin, sorted by CoinLocator. Each row
+// is: Transaction hash, output index, amount, locking script.
+func (coinDB *CoinDatabase) ExportSnapshot(path string) error {
+	coinDB.mu.Lock()
+	defer coinDB.mu.Unlock()
+	if err := coinDB.flushMainCache(); err != nil {
+		return fmt.Errorf("[ExportSnapshot] %w", err)
+	}
+	records, txHashes, err := coinDB.sortedRecords()
+	if err != nil {
+		return fmt.Errorf("[ExportSnapshot] %w", err)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("[ExportSnapshot] unable to create file {%v}: %w", path, err)
+	}
+	w := csv.NewWriter(file)
+	for _, txHash := range txHashes {
+		cr := records[txHash]
+		for _, i := range cr.sortedPositions() {
+			row := []string{
+				string(txHash),
+				strconv.FormatUint(uint64(cr.OutputIndexes[i]), 10),
+				strconv.FormatUint(uint64(cr.Amounts[i]), 10),
+				cr.LockingScripts[i],
+			}
+			if err := w.Write(row); err != nil {
+				file.Close() // ignore error; Write error takes precedence
+				return fmt.Errorf("[ExportSnapshot] failed to write to file {%v}: %w", path, err)
+			}
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		file.Close() // ignore error; Flush error takes precedence
+		return fmt.Errorf("[ExportSnapshot] failed to write to file {%v}: %w", path, err)
+	}
+	return file.Close()
+}
+
+// readSnapshot returns the Coins in a snapshot written by ExportSnapshot.
+func readSnapshot(path string) (map[CoinLocator]*block.TransactionOutput, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open snapshot {%v}: %w", path, err)
+	}
+	defer file.Close()
+	r := csv.NewReader(file)
+	r.FieldsPerRecord = 4
+	rows, err := r.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read snapshot {%v}: %w", path, err)
+	}
+	coins := make(map[CoinLocator]*block.TransactionOutput, len(rows))
+	for _, row := range rows {
+		outputIndex, err := strconv.ParseUint(row[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid output index {%v} in snapshot {%v}", row[1], path)
+		}
+		amount, err := strconv.ParseUint(row[2], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid amount {%v} in snapshot {%v}", row[2], path)
+		}
+		cl := CoinLocator{ReferenceTransactionHash: block.TxHash(row[0]), OutputIndex: uint32(outputIndex)}
+		coins[cl] = &block.TransactionOutput{Amount: uint32(amount), LockingScript: row[3]}
+	}
+	return coins, nil
+}
+
+// DiffUTXOSnapshots compares two snapshots written by ExportSnapshot. It
+// returns the Coins only in a, the Coins only in b, and the Coins in both
+// whose amounts differ, each sorted by CoinLocator.
+func DiffUTXOSnapshots(a, b string) (onlyInA []CoinLocator, onlyInB []CoinLocator, amountMismatch []CoinLocator, err error) {
+	coinsA, err := readSnapshot(a)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("[DiffUTXOSnapshots] %w", err)
+	}
+	coinsB, err := readSnapshot(b)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("[DiffUTXOSnapshots] %w", err)
+	}
+	for cl, txoA := range coinsA {
+		txoB, ok := coinsB[cl]
+		switch {
+		case !ok:
+			onlyInA = append(onlyInA, cl)
+		case txoA.Amount != txoB.Amount:
+			amountMismatch = append(amountMismatch, cl)
+		}
+	}
+	for cl := range coinsB {
+		if _, ok := coinsA[cl]; !ok {
+			onlyInB = append(onlyInB, cl)
+		}
+	}
+	sortLocators(onlyInA)
+	sortLocators(onlyInB)
+	sortLocators(amountMismatch)
+	return onlyInA, onlyInB, amountMismatch, nil
+}
@@ -0,0 +1,61 @@
+package coindatabase
+
+import (
+	"Chain/pkg/block"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiffUTXOSnapshots(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a.csv"), filepath.Join(dir, "b.csv")
+	coinDB := newTestDB(10)
+	alice, bob := coinbase("alice", 0, 5, 7), coinbase("bob", 1, 3)
+	coinDB.StoreBlock([]*block.Transaction{alice, bob}, 1)
+	if err := coinDB.ExportSnapshot(a); err != nil {
+		t.Fatal(err)
+	}
+	// b has one coin of alice spent...
+	payment := spend(alice, 0, 5, "carol")
+	if _, err := coinDB.StoreBlockWithSpends([]*block.Transaction{coinbase("carol", 2, 1), payment}, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := coinDB.ExportSnapshot(b); err != nil {
+		t.Fatal(err)
+	}
+	// ...and a different amount for the coin of bob
+	data, err := os.ReadFile(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edited := strings.Replace(string(data), string(bob.Hash())+",0,3,", string(bob.Hash())+",0,4,", 1)
+	if edited == string(data) {
+		t.Fatal("snapshot has no row for the coin of bob")
+	}
+	if err := os.WriteFile(b, []byte(edited), 0644); err != nil {
+		t.Fatal(err)
+	}
+	onlyInA, onlyInB, amountMismatch, err := DiffUTXOSnapshots(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []CoinLocator{{alice.Hash(), 0}}; !reflect.DeepEqual(onlyInA, want) {
+		t.Errorf("got %v only in a, want %v", onlyInA, want)
+	}
+	wantOnlyInB := []CoinLocator{{payment.Hash(), 0}, {coinbase("carol", 2, 1).Hash(), 0}}
+	sortLocators(wantOnlyInB)
+	if !reflect.DeepEqual(onlyInB, wantOnlyInB) {
+		t.Errorf("got %v only in b, want %v", onlyInB, wantOnlyInB)
+	}
+	if want := []CoinLocator{{bob.Hash(), 0}}; !reflect.DeepEqual(amountMismatch, want) {
+		t.Errorf("got amount mismatches %v, want %v", amountMismatch, want)
+	}
+	// a snapshot does not differ from itself
+	onlyInA, onlyInB, amountMismatch, err = DiffUTXOSnapshots(a, a)
+	if err != nil || onlyInA != nil || onlyInB != nil || amountMismatch != nil {
+		t.Errorf("diffing a snapshot with itself gave %v, %v, %v, %v", onlyInA, onlyInB, amountMismatch, err)
+	}
+}
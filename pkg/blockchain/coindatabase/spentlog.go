@@ -0,0 +1,37 @@
+package coindatabase
+
+// SpentCoin is an entry in the CoinDatabase's spent-coin log, recording
+// a Coin spent by a stored Block.
+// Locator is the CoinLocator of the spent Coin.
+// Amount and LockingScript are those of the Coin's TransactionOutput.
+// Height is the height of the Block that spent it.
+type SpentCoin struct {
+	Locator       CoinLocator
+	Amount        uint32
+	LockingScript string
+	Height        uint32
+}
+
+// logSpend appends a spent Coin to the spent-coin log, if it is kept.
+func (coinDB *CoinDatabase) logSpend(cl CoinLocator, coin *Coin, height uint32) {
+	if !coinDB.logSpends {
+		return
+	}
+	coinDB.spentLog = append(coinDB.spentLog, SpentCoin{
+		Locator:       cl,
+		Amount:        coin.TransactionOutput.Amount,
+		LockingScript: coin.TransactionOutput.LockingScript,
+		Height:        height,
+	})
+}
+
+// DrainSpentLog returns the Coins spent since the spent-coin log was
+// last drained, in the order they were spent, and empties the log. It
+// returns nil unless the Config set LogSpentCoins.
+func (coinDB *CoinDatabase) DrainSpentLog() []SpentCoin {
+	coinDB.mu.Lock()
+	defer coinDB.mu.Unlock()
+	spent := coinDB.spentLog
+	coinDB.spentLog = nil
+	return spent
+}
@@ -0,0 +1,50 @@
+package coindatabase
+
+import (
+	"Chain/pkg/block"
+	"Chain/pkg/blockchain/kvstore"
+	"reflect"
+	"testing"
+)
+
+func TestSpentLog(t *testing.T) {
+	config := DefaultConfig()
+	config.LogSpentCoins = true
+	coinDB := NewWithStore(kvstore.NewMemoryStore(), config)
+	alice := coinbase("alice", 0, 5, 7)
+	coinDB.StoreBlock([]*block.Transaction{alice}, 1)
+	// one Coin is spent from the db and one from the mainCache
+	if err := coinDB.FlushMainCache(); err != nil {
+		t.Fatal(err)
+	}
+	bob := coinbase("bob", 1, 3)
+	coinDB.StoreBlock([]*block.Transaction{bob}, 2)
+	spent, err := coinDB.StoreBlockWithSpends([]*block.Transaction{coinbase("miner", 2, 1), spend(alice, 1, 7, "carol"), spend(bob, 0, 3, "dave")}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []SpentCoin{
+		{CoinLocator{alice.Hash(), 1}, 7, "alice", 3},
+		{CoinLocator{bob.Hash(), 0}, 3, "bob", 3},
+	}
+	got := coinDB.DrainSpentLog()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("spent log holds %+v, want %+v", got, want)
+	}
+	// the log matches the Coins the Block reported spending
+	for i, coin := range spent {
+		if got[i].Amount != coin.TransactionOutput.Amount || got[i].LockingScript != coin.TransactionOutput.LockingScript {
+			t.Errorf("log entry %+v does not match spent coin %+v", got[i], coin)
+		}
+	}
+	if got := coinDB.DrainSpentLog(); len(got) != 0 {
+		t.Errorf("drained log still holds %+v", got)
+	}
+	// without LogSpentCoins nothing is kept
+	coinDB = newTestDB(10)
+	coinDB.StoreBlock([]*block.Transaction{alice}, 1)
+	coinDB.StoreBlock([]*block.Transaction{coinbase("miner", 1, 1), spend(alice, 0, 5, "bob")}, 2)
+	if got := coinDB.DrainSpentLog(); got != nil {
+		t.Errorf("spent log without LogSpentCoins holds %+v", got)
+	}
+}
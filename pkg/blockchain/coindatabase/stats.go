@@ -0,0 +1,113 @@
+package coindatabase
+
+import (
+	"Chain/pkg/block"
+	"Chain/pkg/utils"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+	"unsafe"
+)
+
+// CacheStats counts how Coins were looked up.
+// Hits and Misses count the lookups of Coins during validation and by
+// GetCoin that were and were not answered by the mainCache.
+// DbReads counts the CoinRecords read from the db, including those read
+// to flush the mainCache or undo Blocks.
+type CacheStats struct {
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+	DbReads uint64 `json:"dbreads"`
+}
+
+// statsLine is a CacheStats written by SnapshotStats, along with when it
+// was taken, in Unix nanoseconds.
+type statsLine struct {
+	Time int64 `json:"time"`
+	CacheStats
+}
+
+// mapEntryOverhead approximates the bytes a Go map spends per entry
+// beyond its key and value, for its buckets' hash bits and slack.
+const mapEntryOverhead = 16
+
+// coinOverhead approximates the fixed bytes the mainCache spends on each
+// Coin: its map key and value, and the Coin and TransactionOutput the
+// value points to, but not the strings they hold.
+const coinOverhead = uint64(unsafe.Sizeof(CoinLocator{})+unsafe.Sizeof((*Coin)(nil))+
+	unsafe.Sizeof(Coin{})+unsafe.Sizeof(block.TransactionOutput{})) + mapEntryOverhead
+
+// readRecord reads the serialized CoinRecord of a Transaction from the
+// db, counting the read.
+func (coinDB *CoinDatabase) readRecord(txHash block.TxHash) ([]byte, error) {
+	coinDB.stats.DbReads++
+	return coinDB.db.Get(coinDB.recordKey(txHash))
+}
+
+// CacheStats returns the CacheStats counted since the CoinDatabase was
+// created or ResetCacheStats was last called.
+func (coinDB *CoinDatabase) CacheStats() CacheStats {
+	coinDB.mu.Lock()
+	defer coinDB.mu.Unlock()
+	return coinDB.stats
+}
+
+// ResetCacheStats sets every CacheStats counter to zero.
+func (coinDB *CoinDatabase) ResetCacheStats() {
+	coinDB.mu.Lock()
+	defer coinDB.mu.Unlock()
+	coinDB.stats = CacheStats{}
+}
+
+// ApproxMemoryBytes estimates how many bytes the Coins in the mainCache
+// take up: a fixed overhead per Coin plus the length of its
+// ReferenceTransactionHash and LockingScript. It is not exact, but it
+// grows in proportion to the mainCache's real memory use.
+func (coinDB *CoinDatabase) ApproxMemoryBytes() uint64 {
+	coinDB.mu.Lock()
+	defer coinDB.mu.Unlock()
+	var total uint64
+	for cl, coin := range coinDB.MainCache {
+		total += coinOverhead + uint64(len(cl.ReferenceTransactionHash)) + uint64(len(coin.TransactionOutput.LockingScript))
+	}
+	return total
+}
+
+// SnapshotStats writes the current CacheStats to w as one line of JSON,
+// with the time it was taken, for offline analysis.
+func (coinDB *CoinDatabase) SnapshotStats(w io.Writer) error {
+	line := statsLine{Time: time.Now().UnixNano(), CacheStats: coinDB.CacheStats()}
+	if err := json.NewEncoder(w).Encode(line); err != nil {
+		return fmt.Errorf("[SnapshotStats] failed to write stats: %w", err)
+	}
+	return nil
+}
+
+// SnapshotStatsEvery calls SnapshotStats with w every interval from a
+// background goroutine, until the returned stop function is called.
+// Failed writes are logged and do not stop it. stop waits for the
+// goroutine to exit, and should be called before Close.
+func (coinDB *CoinDatabase) SnapshotStatsEvery(w io.Writer, interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		defer close(exited)
+		for {
+			select {
+			case <-ticker.C:
+				if err := coinDB.SnapshotStats(w); err != nil {
+					utils.Debug.Printf("[SnapshotStatsEvery] %v", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+	}
+}
@@ -0,0 +1,80 @@
+package coindatabase
+
+import (
+	"Chain/pkg/block"
+	"bytes"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockedBuffer is a bytes.Buffer safe to write from a background
+// goroutine while the test reads it.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestSnapshotStats(t *testing.T) {
+	coinDB := newTestDB(10)
+	alice, bob := coinbase("alice", 0, 5), coinbase("bob", 1, 7)
+	coinDB.StoreBlock([]*block.Transaction{alice}, 1)
+	if err := coinDB.FlushMainCache(); err != nil {
+		t.Fatal(err)
+	}
+	coinDB.StoreBlock([]*block.Transaction{bob}, 2)
+	coinDB.ResetCacheStats()
+	// bob's Coin is a hit, and alice's a miss read from the db
+	mustGetCoin(t, coinDB, CoinLocator{bob.Hash(), 0})
+	mustGetCoin(t, coinDB, CoinLocator{alice.Hash(), 0})
+	var buf bytes.Buffer
+	if err := coinDB.SnapshotStats(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(buf.String(), "\n"); lines != 1 {
+		t.Errorf("snapshot %q has %v lines, want 1", buf.String(), lines)
+	}
+	var snapshot map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &snapshot); err != nil {
+		t.Fatalf("snapshot %q is not JSON: %v", buf.String(), err)
+	}
+	for field, want := range map[string]float64{"hits": 1, "misses": 1, "dbreads": 1} {
+		if got, ok := snapshot[field]; !ok || got != want {
+			t.Errorf("snapshot has %v %v, want %v", field, got, want)
+		}
+	}
+	if _, ok := snapshot["time"]; !ok {
+		t.Errorf("snapshot %v has no time", snapshot)
+	}
+
+	var periodic lockedBuffer
+	stop := coinDB.SnapshotStatsEvery(&periodic, time.Millisecond)
+	deadline := time.Now().Add(5 * time.Second)
+	for strings.Count(periodic.String(), "\n") < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	stop()
+	written := periodic.String()
+	if lines := strings.Count(written, "\n"); lines < 2 {
+		t.Fatalf("periodic snapshots wrote %v lines, want at least 2", lines)
+	}
+	// nothing is written once stopped
+	time.Sleep(5 * time.Millisecond)
+	if periodic.String() != written {
+		t.Error("snapshots were written after stop")
+	}
+}
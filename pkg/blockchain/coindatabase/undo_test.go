@@ -0,0 +1,90 @@
+package coindatabase
+
+import (
+	"Chain/pkg/block"
+	"Chain/pkg/blockchain/chainwriter"
+	"reflect"
+	"testing"
+)
+
+func TestUndoCoinsIsAllOrNothing(t *testing.T) {
+	coinDB := newTestDB(10)
+	alice := coinbase("alice", 0, 5, 7, 9)
+	coinDB.StoreBlock([]*block.Transaction{alice}, 1)
+	toBob := spend(alice, 0, 5, "bob")
+	b2 := &block.Block{Header: &block.Header{}, Transactions: []*block.Transaction{toBob}}
+	coinDB.StoreBlock(b2.Transactions, 2)
+	toCarol := spend(alice, 1, 7, "carol")
+	b3 := &block.Block{Header: &block.Header{}, Transactions: []*block.Transaction{toCarol}}
+	coinDB.StoreBlock(b3.Transactions, 3)
+	before := dbContents(t, coinDB)
+
+	ub3 := &chainwriter.UndoBlock{
+		TransactionInputHashes: []block.TxHash{alice.Hash()},
+		OutputIndexes:          []uint32{1},
+		Amounts:                []uint32{7},
+		LockingScripts:         []string{"alice"},
+	}
+	// the second UndoBlock restores a Coin that was never spent
+	ub2 := &chainwriter.UndoBlock{
+		TransactionInputHashes: []block.TxHash{alice.Hash()},
+		OutputIndexes:          []uint32{2},
+		Amounts:                []uint32{9},
+		LockingScripts:         []string{"alice"},
+	}
+	if err := coinDB.UndoCoins([]*block.Block{b3, b2}, []*chainwriter.UndoBlock{ub3, ub2}); err == nil {
+		t.Fatal("undid blocks with an invalid undo block")
+	}
+	if after := dbContents(t, coinDB); !reflect.DeepEqual(after, before) {
+		t.Errorf("failed undo changed the db from %v to %v", before, after)
+	}
+	if coin := mustGetCoin(t, coinDB, CoinLocator{toCarol.Hash(), 0}); coin == nil {
+		t.Error("failed undo erased a coin created by the first block")
+	}
+	if coin := mustGetCoin(t, coinDB, CoinLocator{alice.Hash(), 1}); coin != nil {
+		t.Error("failed undo restored a coin spent by the first block")
+	}
+	// the first UndoBlock alone is valid
+	if err := coinDB.UndoCoins([]*block.Block{b3}, []*chainwriter.UndoBlock{ub3}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUndoCoinsRejectsUnspentCoins(t *testing.T) {
+	coinDB := newTestDB(10)
+	alice := coinbase("alice", 0, 5, 7)
+	coinDB.StoreBlock([]*block.Transaction{alice}, 1)
+	toBob := spend(alice, 0, 5, "bob")
+	b2 := &block.Block{Header: &block.Header{}, Transactions: []*block.Transaction{toBob}}
+	coinDB.StoreBlock(b2.Transactions, 2)
+	before := dbContents(t, coinDB)
+
+	undoBlock := func(indexes ...uint32) *chainwriter.UndoBlock {
+		ub := &chainwriter.UndoBlock{}
+		for _, i := range indexes {
+			ub.TransactionInputHashes = append(ub.TransactionInputHashes, alice.Hash())
+			ub.OutputIndexes = append(ub.OutputIndexes, i)
+			ub.Amounts = append(ub.Amounts, alice.Outputs[i].Amount)
+			ub.LockingScripts = append(ub.LockingScripts, "alice")
+		}
+		return ub
+	}
+	for name, ub := range map[string]*chainwriter.UndoBlock{
+		// output 1 was never spent, so restoring it would duplicate it
+		"an unspent coin": undoBlock(0, 1),
+		"a coin twice":    undoBlock(0, 0),
+	} {
+		if err := coinDB.UndoCoins([]*block.Block{b2}, []*chainwriter.UndoBlock{ub}); err == nil {
+			t.Errorf("undid a block with an undo block restoring %v", name)
+		}
+		if after := dbContents(t, coinDB); !reflect.DeepEqual(after, before) {
+			t.Errorf("undo block restoring %v changed the db from %v to %v", name, before, after)
+		}
+	}
+	if err := coinDB.UndoCoins([]*block.Block{b2}, []*chainwriter.UndoBlock{undoBlock(0)}); err != nil {
+		t.Fatal(err)
+	}
+	if coin := mustGetCoin(t, coinDB, CoinLocator{alice.Hash(), 0}); coin == nil || coin.TransactionOutput.Amount != 5 {
+		t.Errorf("got coin %v after undoing its spend, want amount 5", coin)
+	}
+}
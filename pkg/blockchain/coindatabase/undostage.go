@@ -0,0 +1,161 @@
+package coindatabase
+
+import (
+	"Chain/pkg/block"
+	"Chain/pkg/blockchain/chainwriter"
+	"Chain/pkg/blockchain/kvstore"
+	"Chain/pkg/pro"
+	"errors"
+	"fmt"
+	"google.golang.org/protobuf/proto"
+)
+
+// undoStage holds the changes made by UndoCoins until every Block has
+// been reverted.
+// records are the staged CoinRecords by Transaction hash; a nil
+// CoinRecord is deleted from the db.
+// cacheOps are the changes to the mainCache, in order.
+// restored is the set of Coins restored so far, and partial is whether
+// Coins that are not spent may be restored, for a partly stored Block.
+type undoStage struct {
+	coinDB   *CoinDatabase
+	records  map[block.TxHash]*CoinRecord
+	cacheOps []cacheOp
+	restored map[CoinLocator]bool
+	partial  bool
+}
+
+// cacheOp removes a Coin from the mainCache, or marks it unspent.
+type cacheOp struct {
+	cl     CoinLocator
+	remove bool
+}
+
+// record returns the staged CoinRecord for a Transaction hash, reading
+// it from the db if it has not been staged. It returns nil if there is
+// no such CoinRecord.
+func (stage *undoStage) record(txHash block.TxHash) (*CoinRecord, error) {
+	if cr, ok := stage.records[txHash]; ok {
+		return cr, nil
+	}
+	data, err := stage.coinDB.readRecord(txHash)
+	if errors.Is(err, kvstore.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve coin record {%v}: %w", txHash, err)
+	}
+	pcr := &pro.CoinRecord{}
+	if err := pro.Unmarshal(string(txHash), data, pcr); err != nil {
+		return nil, err
+	}
+	return DecodeCoinRecord(pcr)
+}
+
+// removeCreatedCoins stages the removal of the Coins created by a
+// Transaction.
+func (stage *undoStage) removeCreatedCoins(tx *block.Transaction) error {
+	txHash := tx.Hash()
+	for idx := range tx.Outputs {
+		cl := CoinLocator{txHash, uint32(idx)}
+		cr, err := stage.record(txHash)
+		if err != nil {
+			return err
+		}
+		if cr != nil {
+			cr = stage.coinDB.removeCoinFromRecord(cr, cl.OutputIndex)
+			if len(cr.OutputIndexes) == 0 {
+				cr = nil
+			}
+			stage.records[txHash] = cr
+		}
+		stage.cacheOps = append(stage.cacheOps, cacheOp{cl, true})
+	}
+	return nil
+}
+
+// markCoinsUnspent stages the restoration of the Coins spent by a Block,
+// given its UndoBlock. It returns an error if the UndoBlock is malformed
+// or conflicts with a stored CoinRecord, or, unless the stage is
+// partial, if it restores a Coin that was not spent, which would create
+// a Coin out of nothing.
+// https://edstem.org/us/courses/36337/discussion/2593635
+func (stage *undoStage) markCoinsUnspent(undoBlock *chainwriter.UndoBlock) error {
+	n := len(undoBlock.TransactionInputHashes)
+	if len(undoBlock.OutputIndexes) != n || len(undoBlock.Amounts) != n || len(undoBlock.LockingScripts) != n {
+		return fmt.Errorf("malformed undo block: {%v} hashes, {%v} output indexes, {%v} amounts, {%v} locking scripts",
+			n, len(undoBlock.OutputIndexes), len(undoBlock.Amounts), len(undoBlock.LockingScripts))
+	}
+	for i := 0; i < n; i++ {
+		txHash := undoBlock.TransactionInputHashes[i]
+		// the coin record is gone from the db if all of its coins were spent
+		cr, err := stage.record(txHash)
+		if err != nil {
+			return err
+		}
+		if cr == nil {
+			cr = &CoinRecord{Version: CoinRecordVersion}
+		}
+		cl := CoinLocator{txHash, undoBlock.OutputIndexes[i]}
+		if stage.restored[cl] {
+			return fmt.Errorf("undo block restores coin {%v} more than once", cl)
+		}
+		if !stage.partial && cr.unspentIndex(cl.OutputIndex) >= 0 && !stage.coinDB.spentInCache(cl) {
+			return fmt.Errorf("undo block restores coin {%v}, which is not spent", cl)
+		}
+		stage.restored[cl] = true
+		// a coin only spent in the mainCache is still in its coin record,
+		// so merge rather than append
+		restored := stage.coinDB.addCoinToRecord(&CoinRecord{Version: CoinRecordVersion}, undoBlock, i)
+		merged, err := MergeCoinRecords(cr, restored)
+		if err != nil {
+			return err
+		}
+		stage.records[txHash] = merged
+		stage.cacheOps = append(stage.cacheOps, cacheOp{cl, false})
+	}
+	return nil
+}
+
+// spentInCache returns whether a Coin is marked spent in the mainCache,
+// in which case its CoinRecord may still hold it unspent.
+func (coinDB *CoinDatabase) spentInCache(cl CoinLocator) bool {
+	coin, ok := coinDB.MainCache[cl]
+	return ok && coin.IsSpent
+}
+
+// commit writes the staged CoinRecords to the db in a single batch, then
+// applies the staged mainCache changes.
+func (stage *undoStage) commit() error {
+	batch := new(kvstore.Batch)
+	for txHash, cr := range stage.records {
+		if cr == nil {
+			batch.Delete(stage.coinDB.recordKey(txHash))
+			continue
+		}
+		bytes, err := proto.Marshal(stage.coinDB.encodeRecord(cr))
+		if err != nil {
+			return fmt.Errorf("failed to marshal coin record {%v}: %w", txHash, err)
+		}
+		batch.Put(stage.coinDB.recordKey(txHash), bytes)
+	}
+	if err := stage.coinDB.db.Write(batch); err != nil {
+		return fmt.Errorf("failed to write coin records: %w", err)
+	}
+	for _, op := range stage.cacheOps {
+		if op.remove {
+			stage.coinDB.invalidateSpends(op.cl)
+		}
+		coin, ok := stage.coinDB.MainCache[op.cl]
+		switch {
+		case !ok:
+		case op.remove:
+			delete(stage.coinDB.MainCache, op.cl)
+			stage.coinDB.MainCacheSize -= 1
+		default:
+			coin.IsSpent = false
+			coin.SpentHeight = 0
+		}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package coindatabase
+
+import (
+	"Chain/pkg/block"
+	"fmt"
+	"math"
+)
+
+// BlockValidator validates a Block's Transactions one at a time, as they
+// arrive, so that a Block need not be fully read before validation
+// starts. It applies the same rules as ValidateBlock.
+// spent is the set of Coins spent by the Transactions fed so far, and
+// created holds the Coins they created.
+// records, if non-nil, holds the CoinRecords read so far, so that each is
+// read from the db at most once. It is only set by callers that hold the
+// CoinDatabase's mu for the whole Block, such as ValidateBlock.
+// outputTotal, coinbaseTotal, and fees are running sums checked by
+// Finish.
+// err is the first error returned by Feed, returned again by every
+// later call.
+type BlockValidator struct {
+	coinDB *CoinDatabase
+	height uint32
+	count  int // number of Transactions fed so far
+
+	spent   map[CoinLocator]bool
+	created map[CoinLocator]*Coin
+	records map[block.TxHash]*CoinRecord
+
+	outputTotal   uint64
+	coinbaseTotal uint64
+	fees          uint64
+
+	err error
+}
+
+// NewBlockValidator returns a BlockValidator for the Block at a height.
+// The CoinDatabase is locked only while each Transaction is checked, so
+// Blocks stored while a BlockValidator is in use are seen by the
+// Transactions fed after them.
+func (coinDB *CoinDatabase) NewBlockValidator(height uint32) *BlockValidator {
+	return &BlockValidator{
+		coinDB:  coinDB,
+		height:  height,
+		spent:   make(map[CoinLocator]bool),
+		created: make(map[CoinLocator]*Coin),
+	}
+}
+
+// Feed validates the next Transaction of the Block. It returns an error
+// if the Transaction is invalid given the Transactions fed before it,
+// after which the BlockValidator rejects everything.
+func (v *BlockValidator) Feed(tx *block.Transaction) error {
+	v.coinDB.mu.Lock()
+	defer v.coinDB.mu.Unlock()
+	return v.feed(tx)
+}
+
+// feed is Feed for callers that already hold the CoinDatabase's mu.
+func (v *BlockValidator) feed(tx *block.Transaction) error {
+	if v.err != nil {
+		return v.err
+	}
+	i := v.count
+	v.count++
+	v.err = v.check(i, tx)
+	return v.err
+}
+
+// check validates the Transaction at index i of the Block and adds it to
+// the running state.
+func (v *BlockValidator) check(i int, tx *block.Transaction) error {
+	coinDB := v.coinDB
+	coinbase := isCoinbase(i, tx)
+	if !coinbase {
+		if len(tx.Inputs) == 0 {
+			return fmt.Errorf("[Feed] transaction {%v} has no inputs but is not a coinbase", i)
+		}
+		// checked before hashing, which would fail on a nil input
+		if err := checkInputs(tx); err != nil {
+			return fmt.Errorf("[Feed] transaction {%v}: %w", i, err)
+		}
+	}
+	txHash := tx.Hash()
+	// a coinbase Transaction has no inputs to validate
+	if !coinbase {
+		if err := coinDB.validateTransaction(tx, txHash, v.created, v.records); err != nil {
+			return err
+		}
+		for _, txi := range tx.Inputs {
+			cl := makeCoinLocator(txi)
+			if v.spent[cl] {
+				return fmt.Errorf("[Feed] transaction {%v} spends coin {%v} already spent in this block", i, cl)
+			}
+			v.spent[cl] = true
+		}
+		if coinDB.subsidy != nil {
+			fee, err := coinDB.transactionFee(tx, v.created, v.records)
+			if err != nil {
+				return err
+			}
+			v.fees += fee
+		}
+	}
+	for j, txo := range tx.Outputs {
+		if txo.Amount == 0 && coinDB.rejectZero {
+			return fmt.Errorf("[Feed] transaction {%v} output {%v} has amount zero", i, j)
+		}
+		if coinDB.maxOutput > 0 && txo.Amount > coinDB.maxOutput {
+			return fmt.Errorf("[Feed] transaction {%v} output {%v} has amount {%v} over the maximum {%v}", i, j, txo.Amount, coinDB.maxOutput)
+		}
+		if uint64(txo.Amount) > math.MaxUint64-v.outputTotal {
+			return fmt.Errorf("[Feed] transaction {%v} output {%v} overflows the block's output total", i, j)
+		}
+		v.outputTotal += uint64(txo.Amount)
+		if coinbase {
+			v.coinbaseTotal += uint64(txo.Amount)
+		}
+		v.created[CoinLocator{txHash, uint32(j)}] = &Coin{TransactionOutput: txo}
+	}
+	return nil
+}
+
+// Finish returns an error if any Transaction fed was invalid, or if the
+// CoinDatabase checks a subsidy and the coinbase does not claim exactly
+// the subsidy plus the Block's fees.
+func (v *BlockValidator) Finish() error {
+	if v.err != nil {
+		return v.err
+	}
+	if v.coinDB.subsidy != nil {
+		if expected := uint64(v.coinDB.subsidy(v.height)) + v.fees; v.coinbaseTotal != expected {
+			return fmt.Errorf("[Finish] coinbase claims {%v} but subsidy plus fees is {%v} at height {%v}", v.coinbaseTotal, expected, v.height)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package coindatabase
+
+import (
+	"Chain/pkg/block"
+	"strings"
+	"testing"
+)
+
+func TestBlockValidator(t *testing.T) {
+	coinDB := newTestDB(10)
+	alice := coinbase("alice", 0, 5, 7)
+	coinDB.StoreBlock([]*block.Transaction{alice}, 1)
+	toBob := spend(alice, 0, 5, "bob")
+	valid := []*block.Transaction{coinbase("miner", 1, 1), toBob, spend(toBob, 0, 5, "carol"), spend(alice, 1, 7, "dave")}
+	v := coinDB.NewBlockValidator(2)
+	for i, tx := range valid {
+		if err := v.Feed(tx); err != nil {
+			t.Fatalf("rejected valid transaction %v: %v", i, err)
+		}
+	}
+	if err := v.Finish(); err != nil {
+		t.Errorf("rejected a valid block: %v", err)
+	}
+
+	// the double-spend is caught as it is fed, and the BlockValidator
+	// rejects everything after it
+	v = coinDB.NewBlockValidator(2)
+	for i, tx := range valid[:2] {
+		if err := v.Feed(tx); err != nil {
+			t.Fatalf("rejected valid transaction %v: %v", i, err)
+		}
+	}
+	err := v.Feed(spend(alice, 0, 5, "eve"))
+	if err == nil || !strings.Contains(err.Error(), "already spent in this block") {
+		t.Fatalf("got error %v for a double-spend, want one for a coin already spent in this block", err)
+	}
+	if later := v.Feed(valid[3]); later != err {
+		t.Errorf("got error %v for a valid transaction after a double-spend, want %v", later, err)
+	}
+	if finish := v.Finish(); finish != err {
+		t.Errorf("Finish returned %v after a double-spend, want %v", finish, err)
+	}
+}
@@ -0,0 +1,105 @@
+package coindatabase
+
+import (
+	"Chain/pkg/block"
+	"container/list"
+)
+
+// validationCache is a least-recently-used set of the hashes of
+// Transactions whose inputs were found valid, so that validating the
+// same Transaction again, as happens during forks, skips the input
+// checks. A Transaction is dropped as soon as one of the Coins it spends
+// is spent or removed. The caller must hold the CoinDatabase's mu.
+type validationCache struct {
+	capacity int
+	order    *list.List                     // most recently used at the front
+	entries  map[block.TxHash]*list.Element // values are *validationEntry
+	byInput  map[CoinLocator]map[block.TxHash]bool
+}
+
+// validationEntry is a Transaction in a validationCache, along with the
+// Coins it spends.
+type validationEntry struct {
+	txHash block.TxHash
+	inputs []CoinLocator
+}
+
+// newValidationCache returns an empty validationCache holding up to
+// capacity Transactions.
+func newValidationCache(capacity int) *validationCache {
+	return &validationCache{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[block.TxHash]*list.Element),
+		byInput:  make(map[CoinLocator]map[block.TxHash]bool),
+	}
+}
+
+// contains returns whether a Transaction is in the validationCache.
+func (c *validationCache) contains(txHash block.TxHash) bool {
+	elem, ok := c.entries[txHash]
+	if ok {
+		c.order.MoveToFront(elem)
+	}
+	return ok
+}
+
+// add adds a Transaction with hash txHash to the validationCache,
+// evicting the least recently used Transaction if the cache is full.
+func (c *validationCache) add(txHash block.TxHash, tx *block.Transaction) {
+	if c.contains(txHash) {
+		return
+	}
+	if c.order.Len() >= c.capacity {
+		c.remove(c.order.Back().Value.(*validationEntry).txHash)
+	}
+	entry := &validationEntry{txHash: txHash}
+	for _, txi := range tx.Inputs {
+		cl := makeCoinLocator(txi)
+		entry.inputs = append(entry.inputs, cl)
+		if c.byInput[cl] == nil {
+			c.byInput[cl] = make(map[block.TxHash]bool)
+		}
+		c.byInput[cl][txHash] = true
+	}
+	c.entries[txHash] = c.order.PushFront(entry)
+}
+
+// remove removes a Transaction from the validationCache.
+func (c *validationCache) remove(txHash block.TxHash) {
+	elem, ok := c.entries[txHash]
+	if !ok {
+		return
+	}
+	entry := elem.Value.(*validationEntry)
+	for _, cl := range entry.inputs {
+		delete(c.byInput[cl], txHash)
+		if len(c.byInput[cl]) == 0 {
+			delete(c.byInput, cl)
+		}
+	}
+	c.order.Remove(elem)
+	delete(c.entries, txHash)
+}
+
+// invalidate removes every Transaction that spends a Coin.
+func (c *validationCache) invalidate(cl CoinLocator) {
+	for txHash := range c.byInput[cl] {
+		c.remove(txHash)
+	}
+}
+
+// clear empties the validationCache.
+func (c *validationCache) clear() {
+	c.order.Init()
+	c.entries = make(map[block.TxHash]*list.Element)
+	c.byInput = make(map[CoinLocator]map[block.TxHash]bool)
+}
+
+// invalidateSpends drops the Transactions that spend a Coin from the
+// validation cache, if it is enabled.
+func (coinDB *CoinDatabase) invalidateSpends(cl CoinLocator) {
+	if coinDB.validated != nil {
+		coinDB.validated.invalidate(cl)
+	}
+}
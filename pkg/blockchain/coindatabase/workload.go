@@ -0,0 +1,140 @@
+package coindatabase
+
+import (
+	"Chain/pkg/block"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// workloadReward is the amount minted by each coinbase Transaction in a
+// simulated workload.
+const workloadReward = 1 << 20
+
+// Stats summarizes a simulated workload.
+// CacheHits and CacheMisses count the spent Coins that were and were not
+// in the mainCache when their Block was validated.
+// RejectedBlocks counts the Blocks that failed validation and were not
+// stored, which should be zero for a healthy CoinDatabase.
+// ValidateTime and StoreTime are the total time spent in ValidateBlock
+// and StoreBlock.
+type Stats struct {
+	Blocks         int
+	Transactions   int
+	CacheHits      int
+	CacheMisses    int
+	RejectedBlocks int
+	ValidateTime   time.Duration
+	StoreTime      time.Duration
+}
+
+// HitRate returns the fraction of spent Coins that were found in the
+// mainCache, or zero if no Coins were spent.
+func (s Stats) HitRate() float64 {
+	if s.CacheHits+s.CacheMisses == 0 {
+		return 0
+	}
+	return float64(s.CacheHits) / float64(s.CacheHits+s.CacheMisses)
+}
+
+// workloadCoin is an unspent Coin that a simulated workload may spend.
+type workloadCoin struct {
+	cl     CoinLocator
+	amount uint32
+}
+
+// SimulateWorkload generates and applies a number of Blocks to a
+// CoinDatabase, returning cache-hit and timing Stats. Each Block has a
+// coinbase Transaction followed by up to txPerBlock Transactions, each
+// spending a Coin chosen at random from those created by earlier Blocks
+// and splitting it in two. The same seed always generates the same
+// Blocks, so runs against CoinDatabases with different Configs can be
+// compared. The CoinDatabase should start out empty.
+func SimulateWorkload(coinDB *CoinDatabase, blocks int, txPerBlock int, seed int64) Stats {
+	rng := rand.New(rand.NewSource(seed))
+	var stats Stats
+	var unspent []workloadCoin
+	for height := 1; height <= blocks; height++ {
+		coinbase := &block.Transaction{
+			Outputs:  []*block.TransactionOutput{{Amount: workloadReward, LockingScript: "workload"}},
+			LockTime: uint32(height),
+		}
+		transactions := []*block.Transaction{coinbase}
+		for i := 0; i < txPerBlock && len(unspent) > 0; i++ {
+			j := rng.Intn(len(unspent))
+			coin := unspent[j]
+			unspent[j] = unspent[len(unspent)-1]
+			unspent = unspent[:len(unspent)-1]
+			transactions = append(transactions, workloadTransaction(coin))
+		}
+		coinDB.mu.Lock()
+		for _, tx := range transactions[1:] {
+			if _, ok := coinDB.MainCache[makeCoinLocator(tx.Inputs[0])]; ok {
+				stats.CacheHits++
+			} else {
+				stats.CacheMisses++
+			}
+		}
+		coinDB.mu.Unlock()
+		start := time.Now()
+		valid := coinDB.ValidateBlock(transactions, uint32(height))
+		stats.ValidateTime += time.Since(start)
+		if !valid {
+			stats.RejectedBlocks++
+			continue
+		}
+		start = time.Now()
+		coinDB.StoreBlock(transactions, uint32(height))
+		stats.StoreTime += time.Since(start)
+		stats.Blocks++
+		stats.Transactions += len(transactions)
+		for _, tx := range transactions {
+			txHash := tx.Hash()
+			for k, txo := range tx.Outputs {
+				unspent = append(unspent, workloadCoin{CoinLocator{txHash, uint32(k)}, txo.Amount})
+			}
+		}
+	}
+	return stats
+}
+
+// ValidateBlocksTimed validates and stores a chain of Blocks in order,
+// stopping at the first invalid Block, and returns how many were valid
+// along with the total time spent validating them. Storing is not timed.
+// The Blocks are taken to be at heights 1, 2, and so on, as in
+// SimulateWorkload, so the CoinDatabase should start out empty.
+func (coinDB *CoinDatabase) ValidateBlocksTimed(blocks [][]*block.Transaction) (validated int, elapsed time.Duration, err error) {
+	for i, transactions := range blocks {
+		height := uint32(i + 1)
+		start := time.Now()
+		valid := coinDB.ValidateBlock(transactions, height)
+		elapsed += time.Since(start)
+		if !valid {
+			return validated, elapsed, fmt.Errorf("[ValidateBlocksTimed] block {%v} at height {%v} is invalid", i, height)
+		}
+		coinDB.StoreBlock(transactions, height)
+		validated++
+	}
+	return validated, elapsed, nil
+}
+
+// workloadTransaction returns a Transaction spending a Coin and splitting
+// its amount between two outputs, or paying it to one output if it
+// cannot be split.
+func workloadTransaction(coin workloadCoin) *block.Transaction {
+	txi := &block.TransactionInput{
+		ReferenceTransactionHash: coin.cl.ReferenceTransactionHash,
+		OutputIndex:              coin.cl.OutputIndex,
+	}
+	outputs := []*block.TransactionOutput{{Amount: coin.amount, LockingScript: "workload"}}
+	if coin.amount > 1 {
+		outputs = []*block.TransactionOutput{
+			{Amount: coin.amount / 2, LockingScript: "workload"},
+			{Amount: coin.amount - coin.amount/2, LockingScript: "workload"},
+		}
+	}
+	return &block.Transaction{
+		Inputs:  []*block.TransactionInput{txi},
+		Outputs: outputs,
+	}
+}
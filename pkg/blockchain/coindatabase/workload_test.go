@@ -0,0 +1,180 @@
+package coindatabase
+
+import (
+	"Chain/pkg/block"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSimulateWorkload(t *testing.T) {
+	stats := SimulateWorkload(newTestDB(30), 50, 10, 1)
+	if stats.RejectedBlocks != 0 || stats.Blocks != 50 {
+		t.Errorf("stored {%v} blocks and rejected {%v}, want 50 and 0", stats.Blocks, stats.RejectedBlocks)
+	}
+	// which Coins are flushed varies, but the Blocks do not
+	unbounded := SimulateWorkload(newTestDB(1000), 50, 10, 1)
+	if unbounded.Transactions != stats.Transactions {
+		t.Errorf("the same seed gave {%v} transactions, then {%v}", stats.Transactions, unbounded.Transactions)
+	}
+	if unbounded.HitRate() != 1 {
+		t.Errorf("got hit rate {%v} with every coin cached, want 1", unbounded.HitRate())
+	}
+}
+
+func BenchmarkSimulateWorkload(b *testing.B) {
+	for _, capacity := range []uint32{0, 30, 1000} {
+		b.Run(fmt.Sprintf("capacity=%v", capacity), func(b *testing.B) {
+			var hitRate float64
+			for i := 0; i < b.N; i++ {
+				hitRate = SimulateWorkload(newTestDB(capacity), 100, 20, 1).HitRate()
+			}
+			b.ReportMetric(hitRate, "hits/spend")
+		})
+	}
+}
+
+// BenchmarkValidateBlock compares validating a Block whose inputs are all
+// in the db against prefetching their CoinRecords first.
+func BenchmarkValidateBlock(b *testing.B) {
+	const spends = 100
+	coinDB := newTestDB(2 * spends)
+	amounts := make([]uint32, spends)
+	for i := range amounts {
+		amounts[i] = 10
+	}
+	parents := make([]*block.Transaction, 10)
+	for i := range parents {
+		parents[i] = coinbase("alice", uint32(i), amounts[:spends/len(parents)]...)
+		coinDB.StoreBlock([]*block.Transaction{parents[i]}, uint32(i+1))
+	}
+	var transactions []*block.Transaction
+	var txHashes []block.TxHash
+	for _, parent := range parents {
+		for j := range parent.Outputs {
+			transactions = append(transactions, spend(parent, uint32(j), 10, "bob"))
+		}
+		txHashes = append(txHashes, parent.Hash())
+	}
+	height := uint32(len(parents) + 1)
+	for _, prefetch := range []bool{false, true} {
+		b.Run(fmt.Sprintf("prefetch=%v", prefetch), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				coinDB.FlushMainCache()
+				b.StartTimer()
+				if prefetch {
+					coinDB.Prefetch(txHashes)
+				}
+				if !coinDB.ValidateBlock(transactions, height) {
+					b.Fatal("block is invalid")
+				}
+			}
+		})
+	}
+}
+
+// sharedRecordBlock stores parents coinbases of outputs Coins each in
+// coinDB, and returns a Block spending every one of their Coins, so that
+// each CoinRecord is referenced by outputs of the Block's Transactions.
+func sharedRecordBlock(coinDB *CoinDatabase, parents, outputs int) ([]*block.Transaction, uint32) {
+	amounts := make([]uint32, outputs)
+	for i := range amounts {
+		amounts[i] = 10
+	}
+	var transactions []*block.Transaction
+	for i := 0; i < parents; i++ {
+		parent := coinbase("alice", uint32(i), amounts...)
+		coinDB.StoreBlock([]*block.Transaction{parent}, uint32(i+1))
+		for j := range parent.Outputs {
+			transactions = append(transactions, spend(parent, uint32(j), 10, "bob"))
+		}
+	}
+	coinDB.FlushMainCache()
+	return transactions, uint32(parents + 1)
+}
+
+func TestValidateBlockReadsSharedRecordsOnce(t *testing.T) {
+	coinDB := newTestDB(0)
+	transactions, height := sharedRecordBlock(coinDB, 2, 5)
+	coinDB.ResetCacheStats()
+	if !coinDB.ValidateBlock(transactions, height) {
+		t.Fatal("block is invalid")
+	}
+	if reads := coinDB.CacheStats().DbReads; reads != 2 {
+		t.Errorf("read {%v} records to validate spends of 2, want 2", reads)
+	}
+}
+
+// BenchmarkValidateBlockSharedRecords validates a Block whose
+// Transactions all spend Coins of a few CoinRecords, which ValidateBlock
+// reads from the db once each.
+func BenchmarkValidateBlockSharedRecords(b *testing.B) {
+	for _, parents := range []int{1, 10, 100} {
+		b.Run(fmt.Sprintf("records=%v", parents), func(b *testing.B) {
+			coinDB := newTestDB(0)
+			transactions, height := sharedRecordBlock(coinDB, parents, 100/parents)
+			coinDB.ResetCacheStats()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if !coinDB.ValidateBlock(transactions, height) {
+					b.Fatal("block is invalid")
+				}
+			}
+			b.ReportMetric(float64(coinDB.CacheStats().DbReads)/float64(b.N), "reads/op")
+		})
+	}
+}
+
+// generateChain returns n Blocks, each with a coinbase of width Coins
+// and width Transactions spending the Coins of the previous coinbase.
+func generateChain(n, width int) [][]*block.Transaction {
+	amounts := make([]uint32, width)
+	for i := range amounts {
+		amounts[i] = 10
+	}
+	var blocks [][]*block.Transaction
+	var prev *block.Transaction
+	for i := 0; i < n; i++ {
+		cb := coinbase("alice", uint32(i), amounts...)
+		transactions := []*block.Transaction{cb}
+		if prev != nil {
+			for j := range prev.Outputs {
+				transactions = append(transactions, spend(prev, uint32(j), 10, "bob"))
+			}
+		}
+		blocks = append(blocks, transactions)
+		prev = cb
+	}
+	return blocks
+}
+
+func TestValidateBlocksTimed(t *testing.T) {
+	blocks := generateChain(5, 3)
+	validated, _, err := newTestDB(10).ValidateBlocksTimed(blocks)
+	if err != nil || validated != len(blocks) {
+		t.Errorf("validated {%v} of {%v} blocks, with error %v", validated, len(blocks), err)
+	}
+	// the fourth Block spends the Coins of the second instead of the third
+	blocks[3] = append(blocks[3][:1], blocks[2][1:]...)
+	validated, _, err = newTestDB(10).ValidateBlocksTimed(blocks)
+	if err == nil || validated != 3 {
+		t.Errorf("validated {%v} blocks up to an invalid fourth, with error %v", validated, err)
+	}
+}
+
+func BenchmarkValidateBlocksTimed(b *testing.B) {
+	blocks := generateChain(50, 20)
+	var elapsed time.Duration
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		coinDB := newTestDB(0)
+		b.StartTimer()
+		validated, blockTime, err := coinDB.ValidateBlocksTimed(blocks)
+		if err != nil || validated != len(blocks) {
+			b.Fatalf("validated {%v} of {%v} blocks: %v", validated, len(blocks), err)
+		}
+		elapsed += blockTime
+	}
+	b.ReportMetric(float64(elapsed.Nanoseconds())/float64(b.N*len(blocks)), "validate-ns/block")
+}
@@ -7,6 +7,26 @@ import (
 )
 
 // Config is the BlockChain's configuration options.
+// MaxUndoDepth, if non-zero, is the number of Blocks below the tip whose
+// UndoBlocks are kept on Disk. It must be at least the number of unsafe
+// hashes the BlockChain keeps, so that forks can be undone; New returns
+// an error otherwise.
+// BlockCacheSize, if non-zero, is the number of decoded Blocks kept in
+// memory for reads by hash.
+// MaxReorgDepth, if non-zero, is the most Blocks that switching to a
+// fork may undo. Forks deeper than that are refused.
+// DisableUndo, for append-only chains that never reorg, is passed to the
+// ChainWriter and CoinDatabase, so that UndoBlocks are never written to
+// Disk. Forks are then refused with ErrUndoDisabled.
+// TransactionIndex keeps an index from the hash of each Transaction on
+// the active chain to its Block, for FindTransaction.
+// Subsidy, if set, returns the amount a Block at a given height may
+// mint, and is passed to the CoinDatabase, which then requires each
+// Block's coinbase to claim exactly the subsidy plus the Block's fees.
+// The genesis Block's InitialSubsidy is not checked.
+// RecoverFromLock is passed to the write-ahead log, BlockInfoDatabase,
+// and CoinDatabase, so that New rebuilds the manifest of any levelDB
+// left corrupt by a crash. It cannot open a levelDB that is locked.
 type Config struct {
 	GenesisPublicKey  string
 	InitialSubsidy    uint32
@@ -14,6 +34,14 @@ type Config struct {
 	BlockInfoDBPath   string
 	ChainWriterDBPath string
 	CoinDBPath        string
+	WALPath           string
+	MaxUndoDepth      uint32
+	BlockCacheSize    int
+	MaxReorgDepth     uint32
+	DisableUndo       bool
+	TransactionIndex  bool
+	Subsidy           func(height uint32) uint32
+	RecoverFromLock   bool
 }
 
 // GENPK is the public key that was used
@@ -35,5 +63,6 @@ func DefaultConfig() *Config {
 		BlockInfoDBPath:   blockinfodatabase.DefaultConfig().DatabasePath,
 		ChainWriterDBPath: chainwriter.DefaultConfig().DataDirectory,
 		CoinDBPath:        coindatabase.DefaultConfig().DatabasePath,
+		WALPath:           "waldata",
 	}
 }
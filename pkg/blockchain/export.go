@@ -0,0 +1,97 @@
+package blockchain
+
+import (
+	"Chain/pkg/block"
+	"Chain/pkg/pro"
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// ExportBlocks writes every Block on the active chain, from the genesis
+// Block to the last Block, to a single file at path. Each Block is
+// written as a 4-byte big-endian length followed by the serialized
+// Block.
+func (bc *BlockChain) ExportBlocks(path string) error {
+	records, err := bc.RecentRecords(int(bc.Length))
+	if err != nil {
+		return fmt.Errorf("[ExportBlocks] %w", err)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("[ExportBlocks] unable to create file {%v}: %w", path, err)
+	}
+	w := bufio.NewWriter(file)
+	prefix := make([]byte, 4)
+	// records run from the last Block back to the genesis Block
+	for i := len(records) - 1; i >= 0; i-- {
+		hash := (&block.Block{Header: records[i].Header}).Hash()
+		b, err := bc.readBlock(hash, records[i])
+		if err != nil {
+			file.Close() // ignore error; read error takes precedence
+			return fmt.Errorf("[ExportBlocks] %w", err)
+		}
+		data, err := proto.Marshal(block.EncodeBlock(b))
+		if err != nil {
+			file.Close() // ignore error; Marshal error takes precedence
+			return fmt.Errorf("[ExportBlocks] failed to marshal block at height {%v}: %w", records[i].Height, err)
+		}
+		binary.BigEndian.PutUint32(prefix, uint32(len(data)))
+		if _, err := w.Write(prefix); err != nil {
+			file.Close() // ignore error; Write error takes precedence
+			return fmt.Errorf("[ExportBlocks] failed to write to file {%v}: %w", path, err)
+		}
+		if _, err := w.Write(data); err != nil {
+			file.Close() // ignore error; Write error takes precedence
+			return fmt.Errorf("[ExportBlocks] failed to write to file {%v}: %w", path, err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		file.Close() // ignore error; Flush error takes precedence
+		return fmt.Errorf("[ExportBlocks] failed to write to file {%v}: %w", path, err)
+	}
+	return file.Close()
+}
+
+// ImportBlocks reads Blocks written by ExportBlocks from the file at
+// path and handles each one with HandleBlock, in order. Blocks the
+// BlockChain already has, such as the genesis Block, are skipped. It
+// returns an error if a Block does not become the last Block of the
+// active chain.
+func (bc *BlockChain) ImportBlocks(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("[ImportBlocks] unable to open file {%v}: %w", path, err)
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+	prefix := make([]byte, 4)
+	for i := 0; ; i++ {
+		if _, err := io.ReadFull(r, prefix); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("[ImportBlocks] failed to read block {%v} from file {%v}: %w", i, path, err)
+		}
+		data := make([]byte, binary.BigEndian.Uint32(prefix))
+		if _, err := io.ReadFull(r, data); err != nil {
+			return fmt.Errorf("[ImportBlocks] failed to read block {%v} from file {%v}: %w", i, path, err)
+		}
+		pb := &pro.Block{}
+		if err := pro.Unmarshal(fmt.Sprintf("%v[%v]", path, i), data, pb); err != nil {
+			return fmt.Errorf("[ImportBlocks] %w", err)
+		}
+		b := block.DecodeBlock(pb)
+		hash := b.Hash()
+		if _, err := bc.BlockInfoDB.GetBlockRecord(hash); err == nil {
+			continue
+		}
+		bc.HandleBlock(b)
+		if bc.LastHash != hash {
+			return fmt.Errorf("[ImportBlocks] block {%v} with hash {%v} was rejected", i, hash)
+		}
+	}
+}
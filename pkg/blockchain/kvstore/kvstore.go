@@ -0,0 +1,74 @@
+// Package kvstore defines the key-value store that the CoinDatabase and
+// BlockInfoDatabase are built on, so that they do not depend on a
+// particular storage engine. LevelDB is the default implementation.
+package kvstore
+
+import "errors"
+
+// ErrNotFound is returned by Get when a key is not in the KVStore.
+var ErrNotFound = errors.New("kvstore: not found")
+
+// KVStore is a key-value store. Keys are iterated in ascending byte
+// order.
+type KVStore interface {
+	// Get returns the value for a key, or ErrNotFound if there is none.
+	Get(key []byte) ([]byte, error)
+	// Put sets the value for a key.
+	Put(key, value []byte) error
+	// Delete removes a key. Deleting a missing key is not an error.
+	Delete(key []byte) error
+	// Has returns whether a key is in the KVStore.
+	Has(key []byte) (bool, error)
+	// NewIterator returns an Iterator over every key in the KVStore.
+	NewIterator() Iterator
+	// Write applies every operation in a Batch atomically.
+	Write(batch *Batch) error
+	// Close closes the KVStore.
+	Close() error
+}
+
+// Compacter is implemented by KVStores that can reclaim the space left
+// by deleted keys on demand.
+type Compacter interface {
+	// Compact compacts every key in the KVStore.
+	Compact() error
+}
+
+// Iterator iterates over the keys of a KVStore in ascending order. The
+// slices returned by Key and Value are only valid until the next call
+// to Next.
+type Iterator interface {
+	Next() bool
+	Key() []byte
+	Value() []byte
+	Release()
+	Error() error
+}
+
+// Batch is a list of Puts and Deletes to be applied to a KVStore
+// atomically by Write.
+type Batch struct {
+	ops []batchOp
+}
+
+// batchOp is a single Put or Delete in a Batch.
+type batchOp struct {
+	key    []byte
+	value  []byte
+	delete bool
+}
+
+// Put adds a Put of a key and value to the Batch.
+func (b *Batch) Put(key, value []byte) {
+	b.ops = append(b.ops, batchOp{key: key, value: value})
+}
+
+// Delete adds a Delete of a key to the Batch.
+func (b *Batch) Delete(key []byte) {
+	b.ops = append(b.ops, batchOp{key: key, delete: true})
+}
+
+// Len returns the number of operations in the Batch.
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
@@ -0,0 +1,196 @@
+package kvstore
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// stores opens each KVStore implementation, empty, for the conformance
+// tests.
+var stores = []struct {
+	name string
+	open func(t *testing.T) KVStore
+}{
+	{"memory", func(t *testing.T) KVStore { return NewMemoryStore() }},
+	{"leveldb", func(t *testing.T) KVStore {
+		db, err := OpenLevelDB(t.TempDir(), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}},
+	{"prefixed", func(t *testing.T) KVStore {
+		// keys on either side of the prefix must stay invisible
+		store := NewMemoryStore()
+		for _, key := range []string{"a", "b", "b.", "c:key"} {
+			if err := store.Put([]byte(key), []byte("other")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return NewPrefixed(store, []byte("b:"), true)
+	}},
+}
+
+// contents returns every key and value in a KVStore, in iteration
+// order.
+func contents(t *testing.T, store KVStore) [][2]string {
+	t.Helper()
+	iter := store.NewIterator()
+	defer iter.Release()
+	var kvs [][2]string
+	for iter.Next() {
+		kvs = append(kvs, [2]string{string(iter.Key()), string(iter.Value())})
+	}
+	if err := iter.Error(); err != nil {
+		t.Fatal(err)
+	}
+	return kvs
+}
+
+func TestKVStoreConformance(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, store KVStore)
+	}{
+		{"GetMissingKey", func(t *testing.T, store KVStore) {
+			if value, err := store.Get([]byte("key")); !errors.Is(err, ErrNotFound) {
+				t.Errorf("got value %q and error %v for a missing key, want ErrNotFound", value, err)
+			}
+			if has, err := store.Has([]byte("key")); err != nil || has {
+				t.Errorf("Has returned %v, %v for a missing key, want false", has, err)
+			}
+		}},
+		{"PutThenGet", func(t *testing.T, store KVStore) {
+			for _, value := range []string{"first", "second"} {
+				if err := store.Put([]byte("key"), []byte(value)); err != nil {
+					t.Fatal(err)
+				}
+				if got, err := store.Get([]byte("key")); err != nil || string(got) != value {
+					t.Errorf("got value %q and error %v, want %q", got, err, value)
+				}
+			}
+			if has, err := store.Has([]byte("key")); err != nil || !has {
+				t.Errorf("Has returned %v, %v for a stored key, want true", has, err)
+			}
+		}},
+		{"PutCopiesValue", func(t *testing.T, store KVStore) {
+			value := []byte("value")
+			if err := store.Put([]byte("key"), value); err != nil {
+				t.Fatal(err)
+			}
+			value[0] = 'X'
+			if got, err := store.Get([]byte("key")); err != nil || string(got) != "value" {
+				t.Errorf("got value %q and error %v after changing the slice passed to Put, want \"value\"", got, err)
+			}
+		}},
+		{"Delete", func(t *testing.T, store KVStore) {
+			if err := store.Put([]byte("key"), []byte("value")); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.Delete([]byte("key")); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.Get([]byte("key")); !errors.Is(err, ErrNotFound) {
+				t.Errorf("got error %v for a deleted key, want ErrNotFound", err)
+			}
+			if err := store.Delete([]byte("key")); err != nil {
+				t.Errorf("deleting a missing key returned %v", err)
+			}
+		}},
+		{"IterateInOrder", func(t *testing.T, store KVStore) {
+			if got := contents(t, store); got != nil {
+				t.Errorf("empty store iterated %v", got)
+			}
+			for _, key := range []string{"b", "a\xff", "c", "a"} {
+				if err := store.Put([]byte(key), []byte("v"+key)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want := [][2]string{{"a", "va"}, {"a\xff", "va\xff"}, {"b", "vb"}, {"c", "vc"}}
+			if got := contents(t, store); !reflect.DeepEqual(got, want) {
+				t.Errorf("iterated %q, want %q", got, want)
+			}
+		}},
+		{"WriteBatch", func(t *testing.T, store KVStore) {
+			if err := store.Put([]byte("old"), []byte("value")); err != nil {
+				t.Fatal(err)
+			}
+			batch := &Batch{}
+			batch.Put([]byte("new"), []byte("value"))
+			batch.Delete([]byte("old"))
+			if err := store.Write(batch); err != nil {
+				t.Fatal(err)
+			}
+			want := [][2]string{{"new", "value"}}
+			if got := contents(t, store); !reflect.DeepEqual(got, want) {
+				t.Errorf("store holds %q after the batch, want %q", got, want)
+			}
+		}},
+	}
+	for _, s := range stores {
+		for _, tt := range tests {
+			t.Run(s.name+"/"+tt.name, func(t *testing.T) {
+				store := s.open(t)
+				defer store.Close()
+				tt.run(t, store)
+			})
+		}
+	}
+}
+
+func TestPrefixedStoresShareLevelDB(t *testing.T) {
+	db, err := OpenLevelDB(t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	coins, infos := NewPrefixed(db, []byte("coin:"), false), NewPrefixed(db, []byte("info:"), false)
+	for _, kv := range []struct {
+		store      *Prefixed
+		key, value string
+	}{{coins, "a", "1"}, {coins, "b", "2"}, {infos, "a", "3"}} {
+		if err := kv.store.Put([]byte(kv.key), []byte(kv.value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the same key holds a different value in each store
+	for _, tc := range []struct {
+		store *Prefixed
+		key   string
+		value string
+	}{{coins, "a", "1"}, {infos, "a", "3"}} {
+		if value, err := tc.store.Get([]byte(tc.key)); err != nil || string(value) != tc.value {
+			t.Errorf("got value %q and error %v under {%v}, want %q", value, err, tc.key, tc.value)
+		}
+	}
+	if has, err := infos.Has([]byte("b")); err != nil || has {
+		t.Errorf("got has %v and error %v for a key in the other store", has, err)
+	}
+	// deletes and batches stay within a store
+	if err := infos.Delete([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	batch := new(Batch)
+	batch.Delete([]byte("b"))
+	batch.Put([]byte("c"), []byte("4"))
+	if err := coins.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := contents(t, coins), [][2]string{{"a", "1"}, {"c", "4"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("coin store holds %v, want %v", got, want)
+	}
+	if got := contents(t, infos); len(got) != 0 {
+		t.Errorf("info store holds %v, want nothing", got)
+	}
+	if got, want := contents(t, db), [][2]string{{"coin:a", "1"}, {"coin:c", "4"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("shared db holds %v, want %v", got, want)
+	}
+	// closing a store that does not own the db leaves it open for the other
+	if err := infos.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := coins.Get([]byte("a")); err != nil || string(value) != "1" {
+		t.Errorf("got value %q and error %v after closing the other store, want %q", value, err, "1")
+	}
+}
@@ -0,0 +1,112 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"github.com/syndtr/goleveldb/leveldb"
+	lerrors "github.com/syndtr/goleveldb/leveldb/errors"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"syscall"
+)
+
+// ErrLocked is returned by OpenLevelDB when the LevelDB's lock file is
+// held, by another process or by a LevelDB left open in this one.
+var ErrLocked = errors.New("kvstore: db is locked")
+
+// LevelDB is a KVStore backed by a LevelDB.
+type LevelDB struct {
+	db *leveldb.DB
+}
+
+// OpenLevelDB opens, or creates, the LevelDB at a path. If the LevelDB
+// is corrupt, as when a crash leaves its manifest missing or partly
+// written, and recover is set, it is opened again with its manifest
+// rebuilt from the tables and journal on Disk.
+//
+// The lock of a process that crashed is released by the operating
+// system, so a locked LevelDB is open in a running process, or earlier
+// in this one, and no recovery can help. OpenLevelDB then returns an
+// error wrapping ErrLocked.
+func OpenLevelDB(path string, recover bool) (*LevelDB, error) {
+	db, err := leveldb.OpenFile(path, nil)
+	if lerrors.IsCorrupted(err) && recover {
+		db, err = leveldb.RecoverFile(path, nil)
+	}
+	if isLockError(err) {
+		return nil, fmt.Errorf("[OpenLevelDB] db at {%v} is locked; stop the process using it: %w", path, ErrLocked)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("[OpenLevelDB] could not open db at {%v}: %w", path, err)
+	}
+	return &LevelDB{db: db}, nil
+}
+
+// isLockError returns whether an error from opening a LevelDB was caused
+// by its lock file being held.
+func isLockError(err error) bool {
+	return errors.Is(err, syscall.EAGAIN) || errors.Is(err, storage.ErrLocked)
+}
+
+// Get returns the value for a key, or ErrNotFound if there is none.
+func (l *LevelDB) Get(key []byte) ([]byte, error) {
+	value, err := l.db.Get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, ErrNotFound
+	}
+	return value, err
+}
+
+// Put sets the value for a key.
+func (l *LevelDB) Put(key, value []byte) error {
+	return l.db.Put(key, value, nil)
+}
+
+// Delete removes a key.
+func (l *LevelDB) Delete(key []byte) error {
+	return l.db.Delete(key, nil)
+}
+
+// PutSync sets the value for a key, returning once it is on Disk.
+func (l *LevelDB) PutSync(key, value []byte) error {
+	return l.db.Put(key, value, &opt.WriteOptions{Sync: true})
+}
+
+// DeleteSync removes a key, returning once the removal is on Disk.
+func (l *LevelDB) DeleteSync(key []byte) error {
+	return l.db.Delete(key, &opt.WriteOptions{Sync: true})
+}
+
+// Has returns whether a key is in the LevelDB.
+func (l *LevelDB) Has(key []byte) (bool, error) {
+	return l.db.Has(key, nil)
+}
+
+// NewIterator returns an Iterator over every key in the LevelDB.
+func (l *LevelDB) NewIterator() Iterator {
+	return l.db.NewIterator(nil, nil)
+}
+
+// Write applies every operation in a Batch atomically.
+func (l *LevelDB) Write(batch *Batch) error {
+	lb := new(leveldb.Batch)
+	for _, op := range batch.ops {
+		if op.delete {
+			lb.Delete(op.key)
+		} else {
+			lb.Put(op.key, op.value)
+		}
+	}
+	return l.db.Write(lb, nil)
+}
+
+// Compact compacts every key in the LevelDB.
+func (l *LevelDB) Compact() error {
+	return l.db.CompactRange(util.Range{})
+}
+
+// Close closes the LevelDB.
+func (l *LevelDB) Close() error {
+	return l.db.Close()
+}
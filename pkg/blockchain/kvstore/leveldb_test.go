@@ -0,0 +1,58 @@
+package kvstore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenLevelDBRecoversMissingManifest(t *testing.T) {
+	path := t.TempDir()
+	db, err := OpenLevelDB(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// a crash while the manifest is rewritten can leave none behind
+	manifests, err := filepath.Glob(filepath.Join(path, "MANIFEST-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, manifest := range manifests {
+		if err := os.Remove(manifest); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := OpenLevelDB(path, false); err == nil {
+		t.Fatal("opened a db without a manifest without recovering it")
+	}
+	db, err = OpenLevelDB(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	value, err := db.Get([]byte("key"))
+	if err != nil || string(value) != "value" {
+		t.Errorf("got value %q and error %v after recovery, want \"value\"", value, err)
+	}
+}
+
+func TestOpenLevelDBLocked(t *testing.T) {
+	path := t.TempDir()
+	db, err := OpenLevelDB(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, recover := range []bool{false, true} {
+		if _, err := OpenLevelDB(path, recover); !errors.Is(err, ErrLocked) {
+			t.Errorf("opening a locked db with recover {%v} returned %v, want ErrLocked", recover, err)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package kvstore
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// errClosed is returned by a MemoryStore's methods after Close.
+var errClosed = errors.New("kvstore: store is closed")
+
+// MemoryStore is a KVStore kept entirely in memory, for tests that
+// should not touch Disk.
+type MemoryStore struct {
+	mu     sync.RWMutex
+	data   map[string][]byte
+	closed bool
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{data: make(map[string][]byte)}
+}
+
+// Get returns a copy of the value for a key, or ErrNotFound if there is
+// none.
+func (m *MemoryStore) Get(key []byte) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return nil, errClosed
+	}
+	value, ok := m.data[string(key)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]byte{}, value...), nil
+}
+
+// Put sets the value for a key to a copy of value.
+func (m *MemoryStore) Put(key, value []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return errClosed
+	}
+	m.data[string(key)] = append([]byte{}, value...)
+	return nil
+}
+
+// Delete removes a key.
+func (m *MemoryStore) Delete(key []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return errClosed
+	}
+	delete(m.data, string(key))
+	return nil
+}
+
+// Has returns whether a key is in the MemoryStore.
+func (m *MemoryStore) Has(key []byte) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return false, errClosed
+	}
+	_, ok := m.data[string(key)]
+	return ok, nil
+}
+
+// NewIterator returns an Iterator over a snapshot of the MemoryStore,
+// so writes made while iterating are not seen.
+func (m *MemoryStore) NewIterator() Iterator {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return &memoryIterator{index: -1, err: errClosed}
+	}
+	keys := make([]string, 0, len(m.data))
+	for key := range m.data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		values[i] = m.data[key]
+	}
+	return &memoryIterator{keys: keys, values: values, index: -1}
+}
+
+// Write applies every operation in a Batch atomically.
+func (m *MemoryStore) Write(batch *Batch) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return errClosed
+	}
+	for _, op := range batch.ops {
+		if op.delete {
+			delete(m.data, string(op.key))
+		} else {
+			m.data[string(op.key)] = append([]byte{}, op.value...)
+		}
+	}
+	return nil
+}
+
+// Close closes the MemoryStore and drops its contents.
+func (m *MemoryStore) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	m.data = nil
+	return nil
+}
+
+// memoryIterator iterates over a sorted snapshot of a MemoryStore.
+type memoryIterator struct {
+	keys   []string
+	values [][]byte
+	index  int
+	err    error
+}
+
+// Next moves to the next key, returning false when there are none left.
+func (it *memoryIterator) Next() bool {
+	if it.index >= len(it.keys) {
+		return false
+	}
+	it.index++
+	return it.index < len(it.keys)
+}
+
+// Key returns the current key, or nil if the Iterator is exhausted.
+func (it *memoryIterator) Key() []byte {
+	if it.index < 0 || it.index >= len(it.keys) {
+		return nil
+	}
+	return []byte(it.keys[it.index])
+}
+
+// Value returns the current value, or nil if the Iterator is exhausted.
+func (it *memoryIterator) Value() []byte {
+	if it.index < 0 || it.index >= len(it.keys) {
+		return nil
+	}
+	return it.values[it.index]
+}
+
+// Release releases the Iterator's snapshot.
+func (it *memoryIterator) Release() {
+	it.keys = nil
+	it.values = nil
+}
+
+// Error returns the error, if any, that stopped the Iterator.
+func (it *memoryIterator) Error() error {
+	return it.err
+}
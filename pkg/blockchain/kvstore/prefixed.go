@@ -0,0 +1,137 @@
+package kvstore
+
+import "bytes"
+
+// Prefixed is a KVStore that stores its keys in another KVStore with a
+// prefix prepended, so that several databases can share one KVStore
+// without seeing each other's keys.
+type Prefixed struct {
+	store      KVStore
+	prefix     []byte
+	closeStore bool
+}
+
+// NewPrefixed returns a Prefixed view of a KVStore that prepends prefix
+// to every key. If closeStore is set, closing the Prefixed also closes
+// the underlying KVStore; otherwise it is left open for the other views
+// sharing it, and must be closed by its owner.
+func NewPrefixed(store KVStore, prefix []byte, closeStore bool) *Prefixed {
+	return &Prefixed{
+		store:      store,
+		prefix:     append([]byte{}, prefix...),
+		closeStore: closeStore,
+	}
+}
+
+// key returns a key with the Prefixed's prefix prepended.
+func (p *Prefixed) key(key []byte) []byte {
+	return append(append(make([]byte, 0, len(p.prefix)+len(key)), p.prefix...), key...)
+}
+
+// Get returns the value for a key, or ErrNotFound if there is none.
+func (p *Prefixed) Get(key []byte) ([]byte, error) {
+	return p.store.Get(p.key(key))
+}
+
+// Put sets the value for a key.
+func (p *Prefixed) Put(key, value []byte) error {
+	return p.store.Put(p.key(key), value)
+}
+
+// Delete removes a key.
+func (p *Prefixed) Delete(key []byte) error {
+	return p.store.Delete(p.key(key))
+}
+
+// Has returns whether a key is in the Prefixed.
+func (p *Prefixed) Has(key []byte) (bool, error) {
+	return p.store.Has(p.key(key))
+}
+
+// NewIterator returns an Iterator over every key with the Prefixed's
+// prefix, with the prefix stripped.
+func (p *Prefixed) NewIterator() Iterator {
+	return &prefixedIterator{iter: p.store.NewIterator(), prefix: p.prefix}
+}
+
+// Write applies every operation in a Batch atomically, prepending the
+// prefix to each key.
+func (p *Prefixed) Write(batch *Batch) error {
+	prefixed := &Batch{ops: make([]batchOp, len(batch.ops))}
+	for i, op := range batch.ops {
+		prefixed.ops[i] = batchOp{key: p.key(op.key), value: op.value, delete: op.delete}
+	}
+	return p.store.Write(prefixed)
+}
+
+// Compact compacts the underlying KVStore, if it can be compacted.
+func (p *Prefixed) Compact() error {
+	if c, ok := p.store.(Compacter); ok {
+		return c.Compact()
+	}
+	return nil
+}
+
+// Close closes the underlying KVStore if the Prefixed owns it.
+func (p *Prefixed) Close() error {
+	if !p.closeStore {
+		return nil
+	}
+	return p.store.Close()
+}
+
+// prefixedIterator iterates over the keys of a KVStore that have a
+// prefix. Since keys are iterated in order, those with the prefix are
+// contiguous, and iteration stops at the first key past them.
+type prefixedIterator struct {
+	iter   Iterator
+	prefix []byte
+	done   bool
+}
+
+// Next moves to the next key with the prefix, returning false when there
+// are none left.
+func (it *prefixedIterator) Next() bool {
+	for !it.done && it.iter.Next() {
+		key := it.iter.Key()
+		if bytes.HasPrefix(key, it.prefix) {
+			return true
+		}
+		if bytes.Compare(key, it.prefix) > 0 {
+			it.done = true
+		}
+	}
+	it.done = true
+	return false
+}
+
+// Key returns the current key without its prefix, or nil if the Iterator
+// is exhausted.
+func (it *prefixedIterator) Key() []byte {
+	if it.done {
+		return nil
+	}
+	key := it.iter.Key()
+	if key == nil {
+		return nil
+	}
+	return key[len(it.prefix):]
+}
+
+// Value returns the current value, or nil if the Iterator is exhausted.
+func (it *prefixedIterator) Value() []byte {
+	if it.done {
+		return nil
+	}
+	return it.iter.Value()
+}
+
+// Release releases the underlying Iterator.
+func (it *prefixedIterator) Release() {
+	it.iter.Release()
+}
+
+// Error returns the error, if any, that stopped the Iterator.
+func (it *prefixedIterator) Error() error {
+	return it.iter.Error()
+}
@@ -0,0 +1,64 @@
+package blockchain
+
+import (
+	"Chain/pkg/block"
+	"Chain/pkg/utils"
+	"errors"
+	"fmt"
+)
+
+// ErrTxIndexDisabled is returned by FindTransaction when the BlockChain
+// does not keep a transaction index.
+var ErrTxIndexDisabled = errors.New("transaction index disabled")
+
+// ErrTransactionNotFound is returned by FindTransaction when no Block on
+// the active chain contains a Transaction.
+var ErrTransactionNotFound = errors.New("transaction not found")
+
+// FindTransaction returns a Transaction on the active chain given its
+// hash, along with the hash of the Block containing it. It returns
+// ErrTxIndexDisabled unless the Config set TransactionIndex, and an
+// error wrapping ErrTransactionNotFound if the Transaction is not on the
+// active chain.
+func (bc *BlockChain) FindTransaction(txHash block.TxHash) (*block.Transaction, block.BlockHash, error) {
+	if !bc.txIndex {
+		return nil, "", ErrTxIndexDisabled
+	}
+	blockHash, err := bc.BlockInfoDB.GetTransactionBlock(txHash)
+	if err != nil {
+		return nil, "", fmt.Errorf("[FindTransaction] %w: %v", ErrTransactionNotFound, err)
+	}
+	b, err := bc.getBlock(blockHash)
+	if err != nil {
+		return nil, "", fmt.Errorf("[FindTransaction] cannot read block {%v}: %w", blockHash, err)
+	}
+	for _, tx := range b.Transactions {
+		if tx.Hash() == txHash {
+			return tx, blockHash, nil
+		}
+	}
+	return nil, "", fmt.Errorf("[FindTransaction] index points transaction {%v} at block {%v}, which does not contain it: %w", txHash, blockHash, ErrTransactionNotFound)
+}
+
+// indexTransactions adds a Block connected to the active chain to the
+// transaction index, if it is enabled. The index is not needed for
+// consensus, so a failure is logged rather than returned.
+func (bc *BlockChain) indexTransactions(b *block.Block, blockHash block.BlockHash) {
+	if !bc.txIndex {
+		return
+	}
+	if err := bc.BlockInfoDB.IndexTransactions(blockHash, b.Transactions); err != nil {
+		utils.Debug.Printf("Failed to index transactions of block {%v}: %v", blockHash, err)
+	}
+}
+
+// unindexTransactions removes a Block disconnected from the active chain
+// from the transaction index, if it is enabled.
+func (bc *BlockChain) unindexTransactions(b *block.Block, blockHash block.BlockHash) {
+	if !bc.txIndex {
+		return
+	}
+	if err := bc.BlockInfoDB.UnindexTransactions(blockHash, b.Transactions); err != nil {
+		utils.Debug.Printf("Failed to unindex transactions of block {%v}: %v", blockHash, err)
+	}
+}
@@ -0,0 +1,131 @@
+package blockchain
+
+import (
+	"Chain/pkg/block"
+	"Chain/pkg/blockchain/chainwriter"
+	"Chain/pkg/blockchain/kvstore"
+	"Chain/pkg/pro"
+	"errors"
+	"fmt"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// pendingKey is the WAL key of the Block currently being applied.
+var pendingKey = []byte("pending")
+
+// writeAheadLog records a Block before it is applied to the
+// CoinDatabase, ChainWriter, and BlockInfoDatabase, and clears the
+// record once all three have been updated. A record found on startup
+// means the BlockChain crashed partway through applying that Block.
+// db is a levelDB for persistent storage.
+type writeAheadLog struct {
+	db *kvstore.LevelDB
+}
+
+// pendingApply is a Block that was being applied when the BlockChain
+// stopped, along with the UndoBlock needed to roll it back and whether
+// its BlockRecord was stored before it was applied.
+type pendingApply struct {
+	Hash          block.BlockHash
+	Height        uint32
+	Block         *block.Block
+	UndoBlock     *chainwriter.UndoBlock
+	RecordExisted bool
+}
+
+// openWriteAheadLog returns a writeAheadLog stored at path, recovering
+// a corrupt levelDB as kvstore.OpenLevelDB does if recover is set.
+func openWriteAheadLog(path string, recover bool) (*writeAheadLog, error) {
+	db, err := kvstore.OpenLevelDB(path, recover)
+	if err != nil {
+		return nil, fmt.Errorf("[openWriteAheadLog] unable to open write-ahead log with path {%v}: %w", path, err)
+	}
+	return &writeAheadLog{db: db}, nil
+}
+
+// begin durably records that a Block is about to be applied.
+// recordExisted is whether the Block's BlockRecord is already stored, as
+// for a forked Block, in which case recovery keeps it.
+func (wal *writeAheadLog) begin(hash block.BlockHash, height uint32, b *block.Block, ub *chainwriter.UndoBlock, recordExisted bool) error {
+	entry := &pro.WALEntry{
+		Hash:          string(hash),
+		Height:        height,
+		Block:         block.EncodeBlock(b),
+		UndoBlock:     chainwriter.EncodeUndoBlock(ub),
+		RecordExisted: recordExisted,
+	}
+	data, err := proto.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("[wal.begin] unable to marshal entry for block {%v}: %w", hash, err)
+	}
+	if err := wal.db.PutSync(pendingKey, data); err != nil {
+		return fmt.Errorf("[wal.begin] unable to store entry for block {%v}: %w", hash, err)
+	}
+	return nil
+}
+
+// commit durably records that the pending Block has been applied.
+func (wal *writeAheadLog) commit() error {
+	if err := wal.db.DeleteSync(pendingKey); err != nil {
+		return fmt.Errorf("[wal.commit] unable to clear pending entry: %w", err)
+	}
+	return nil
+}
+
+// pending returns the Block that was being applied when the BlockChain
+// stopped, or nil if every applied Block was committed.
+func (wal *writeAheadLog) pending() (*pendingApply, error) {
+	data, err := wal.db.Get(pendingKey)
+	if errors.Is(err, kvstore.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("[wal.pending] unable to read pending entry: %w", err)
+	}
+	entry := &pro.WALEntry{}
+	if err := pro.Unmarshal(string(pendingKey), data, entry); err != nil {
+		return nil, fmt.Errorf("[wal.pending] %w", err)
+	}
+	ub, err := chainwriter.DecodeUndoBlock(entry.GetUndoBlock())
+	if err != nil {
+		return nil, fmt.Errorf("[wal.pending] %w", err)
+	}
+	return &pendingApply{
+		Hash:          block.BlockHash(entry.GetHash()),
+		Height:        entry.GetHeight(),
+		Block:         block.DecodeBlock(entry.GetBlock()),
+		UndoBlock:     ub,
+		RecordExisted: entry.GetRecordExisted(),
+	}, nil
+}
+
+// close closes the writeAheadLog's db.
+func (wal *writeAheadLog) close() error {
+	return wal.db.Close()
+}
+
+// recover rolls back a Block that was partway through being applied
+// when the BlockChain stopped. The Block's Coins are undone and any
+// transaction index entries are removed, as is its BlockRecord unless it
+// was stored before the Block was applied; all are no-ops for stores
+// the Block never reached.
+func (bc *BlockChain) recover() error {
+	p, err := bc.wal.pending()
+	if err != nil || p == nil {
+		return err
+	}
+	if err := bc.CoinDB.RollbackCoins(p.Block, p.UndoBlock); err != nil {
+		return fmt.Errorf("[recover] %w", err)
+	}
+	if !p.RecordExisted {
+		if err := bc.BlockInfoDB.RemoveBlockRecord(p.Hash); err != nil {
+			return fmt.Errorf("[recover] %w", err)
+		}
+	}
+	// a no-op if the Block was never indexed
+	if err := bc.BlockInfoDB.UnindexTransactions(p.Hash, p.Block.Transactions); err != nil {
+		return fmt.Errorf("[recover] %w", err)
+	}
+	return bc.wal.commit()
+}
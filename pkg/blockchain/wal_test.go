@@ -0,0 +1,100 @@
+package blockchain
+
+import (
+	"Chain/pkg/block"
+	"Chain/pkg/blockchain/chainwriter"
+	"Chain/pkg/blockchain/coindatabase"
+	"Chain/pkg/blockchain/kvstore"
+	"Chain/test"
+	"errors"
+	"testing"
+)
+
+// crash begins applying a Block at height, applying its Coins only if
+// applyCoins is set, and then closes bc as though it had stopped before
+// storing the Block's BlockRecord. It returns the BlockChain reopened
+// from the same stores.
+func crash(t *testing.T, bc *BlockChain, config *Config, b *block.Block, height uint32, ub *chainwriter.UndoBlock, recordExisted bool, applyCoins bool) *BlockChain {
+	t.Helper()
+	if err := bc.wal.begin(b.Hash(), height, b, ub, recordExisted); err != nil {
+		t.Fatal(err)
+	}
+	if applyCoins {
+		bc.CoinDB.StoreBlock(b.Transactions, height)
+	}
+	if err := bc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	bc, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, err := bc.wal.pending(); err != nil || p != nil {
+		t.Fatalf("got pending block %v and error %v after recovering, want neither", p, err)
+	}
+	return bc
+}
+
+// hasOutputs fails the test unless the first output of each of a Block's
+// Transactions is unspent if want is set, and spent or missing if not.
+func hasOutputs(t *testing.T, bc *BlockChain, b *block.Block, want bool) {
+	t.Helper()
+	for _, tx := range b.Transactions {
+		coin, err := bc.CoinDB.GetCoin(coindatabase.CoinLocator{ReferenceTransactionHash: tx.Hash(), OutputIndex: 0})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (coin != nil) != want {
+			t.Errorf("coin of transaction {%v} exists: %v, want %v", tx.Hash(), coin != nil, want)
+		}
+	}
+}
+
+func TestRecoverAfterCrash(t *testing.T) {
+	inTempDir(t)
+	config := DefaultConfig()
+	config.InitialSubsidy = 1000
+	bc, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis := bc.LastBlock
+	b1 := extend(t, bc, genesis, 1)[0]
+	// a side Block, with Transactions of its own, is stored but not applied
+	side := test.MakeBlockFromPrev(genesis)
+	side.Header.Nonce = 1
+	for _, tx := range side.Transactions {
+		tx.LockTime = 1
+	}
+	if err := bc.ProcessBlockFrom(side, "peer"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a crash while connecting the side Block keeps its BlockRecord
+	bc = crash(t, bc, config, side, 2, &chainwriter.UndoBlock{}, true, false)
+	if _, err := bc.BlockInfoDB.GetBlockRecord(side.Hash()); err != nil {
+		t.Errorf("recovery removed the block record stored before the crash: %v", err)
+	}
+	hasOutputs(t, bc, b1, true)
+
+	// a crash after the coin update but before the BlockRecord is stored
+	// leaves the coins as they were before the Block
+	b2 := test.MakeBlockFromPrev(b1)
+	ub, err := bc.makeUndoBlock(b2.Transactions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hasOutputs(t, bc, b2, false)
+	bc = crash(t, bc, config, b2, 3, ub, false, true)
+	defer bc.Close()
+	hasOutputs(t, bc, b1, true)
+	hasOutputs(t, bc, b2, false)
+	if _, err := bc.BlockInfoDB.GetBlockRecord(b2.Hash()); !errors.Is(err, kvstore.ErrNotFound) {
+		t.Errorf("got error %v reading the block record of the rolled back block, want kvstore.ErrNotFound", err)
+	}
+	for _, b := range []*block.Block{b1, side} {
+		if _, err := bc.BlockInfoDB.GetBlockRecord(b.Hash()); err != nil {
+			t.Errorf("recovery removed the block record of {%v}: %v", b.Hash(), err)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package pro
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// maxPreviewBytes is the maximum number of bytes shown in an
+// UnmarshalError's Preview.
+const maxPreviewBytes = 32
+
+// UnmarshalError is returned when stored bytes cannot be unmarshalled
+// into a protobuf message.
+// Source is the db key or file location the bytes were read from.
+// Preview is the hex encoding of the first bytes that failed to unmarshal.
+// Err is the underlying unmarshal error.
+type UnmarshalError struct {
+	Source  string
+	Preview string
+	Err     error
+}
+
+// Error returns a description of the UnmarshalError.
+func (e *UnmarshalError) Error() string {
+	return fmt.Sprintf("failed to unmarshal {%v} (bytes: %v): %v", e.Source, e.Preview, e.Err)
+}
+
+// Unwrap returns the underlying unmarshal error.
+func (e *UnmarshalError) Unwrap() error {
+	return e.Err
+}
+
+// Unmarshal unmarshals data into m, returning an *UnmarshalError that
+// records source and a preview of data if it fails.
+func Unmarshal(source string, data []byte, m proto.Message) error {
+	if err := proto.Unmarshal(data, m); err != nil {
+		preview := data
+		if len(preview) > maxPreviewBytes {
+			preview = preview[:maxPreviewBytes]
+		}
+		return &UnmarshalError{
+			Source:  source,
+			Preview: hex.EncodeToString(preview),
+			Err:     err,
+		}
+	}
+	return nil
+}
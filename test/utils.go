@@ -4,7 +4,7 @@ import (
 	"Chain/pkg/block"
 	"Chain/pkg/blockchain/blockinfodatabase"
 	"Chain/pkg/blockchain/chainwriter"
-	"fmt"
+	"Chain/pkg/utils"
 	"os"
 )
 
@@ -13,13 +13,14 @@ func cleanUp() {
 	removeBlockInfoDB()
 	removeCoinDB()
 	removeDataDB()
+	removeWAL()
 }
 
 // removeCoinDB removes the coin database's level db.
 func removeCoinDB() {
 	if _, err := os.Stat("coindata"); !os.IsNotExist(err) {
 		if err2 := os.RemoveAll("coindata"); err2 != nil {
-			fmt.Errorf("could not remove leveldb coindata")
+			utils.Debug.Printf("could not remove leveldb coindata")
 		}
 	}
 }
@@ -28,7 +29,16 @@ func removeCoinDB() {
 func removeBlockInfoDB() {
 	if _, err := os.Stat("blockinfodata"); !os.IsNotExist(err) {
 		if err2 := os.RemoveAll("blockinfodata"); err2 != nil {
-			fmt.Errorf("could not remove leveldb blockinfodata")
+			utils.Debug.Printf("could not remove leveldb blockinfodata")
+		}
+	}
+}
+
+// removeWAL removes the blockchain's write-ahead log.
+func removeWAL() {
+	if _, err := os.Stat("waldata"); !os.IsNotExist(err) {
+		if err2 := os.RemoveAll("waldata"); err2 != nil {
+			utils.Debug.Printf("could not remove leveldb waldata")
 		}
 	}
 }
@@ -37,7 +47,7 @@ func removeBlockInfoDB() {
 func removeDataDB() {
 	if _, err := os.Stat("data"); !os.IsNotExist(err) {
 		if err2 := os.RemoveAll("data"); err2 != nil {
-			fmt.Errorf("could not remove directory data")
+			utils.Debug.Printf("could not remove directory data")
 		}
 	}
 }
@@ -107,7 +117,7 @@ func MockedBlock() *block.Block {
 // MockedUndoBlock returns a mocked UndoBlock.
 func MockedUndoBlock() *chainwriter.UndoBlock {
 	return &chainwriter.UndoBlock{
-		TransactionInputHashes: []string{""},
+		TransactionInputHashes: []block.TxHash{""},
 		OutputIndexes:          []uint32{1},
 		Amounts:                []uint32{1},
 		LockingScripts:         []string{""},
@@ -186,7 +196,7 @@ func MakeBlockFromPrev(b *block.Block) *block.Block {
 // other Blocks. It also does not actually take care of amounts
 // or public keys.
 func UndoBlockFromBlock(b *block.Block) *chainwriter.UndoBlock {
-	var transactionHashes []string
+	var transactionHashes []block.TxHash
 	var outputIndexes []uint32
 	var amounts []uint32
 	var lockingScripts []string